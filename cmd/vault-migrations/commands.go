@@ -0,0 +1,905 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pampatzoglou/hashicorp-vault-migrations/pkg/migrations"
+	"github.com/rs/zerolog/log"
+)
+
+// command is a CLI subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+// commands returns every subcommand in the order shown in the usage text
+func commands() []command {
+	return []command{
+		{"apply", "Apply pending migrations", runApply},
+		{"status", "Show the tracked version and pending migrations", runStatus},
+		{"plan", "Simulate pending migrations against the current Vault state", runPlan},
+		{"generate", "Generate a migration from a schema", runGenerate},
+		{"validate", "Validate the configuration, schema and migration files", runValidate},
+		{"schema", "Export the JSON Schemas of schema files for editors", runSchema},
+		{"rollback", "Roll back applied migrations using their down tasks", runRollback},
+		{"restore", "Restore the values a migration overwrote from its snapshot", runRestore},
+		{"history", "Show the ledger of applied migrations", runHistory},
+		{"lock", "Show or release the migration lock", runLock},
+		{"version", "Show version information", runVersion},
+		{"completion", "Print a shell completion script (bash, zsh)", runCompletion},
+		{"help", "Show this help message", runHelp},
+	}
+}
+
+// commonFlags are accepted by every command that talks to Vault or reads config
+type commonFlags struct {
+	config   string
+	logLevel string
+}
+
+// flagSetCreated, when set, is called with every FlagSet a command creates.
+// Shell completion uses it to read the flags of each command.
+var flagSetCreated func(fs *flag.FlagSet)
+
+// newCommandFlagSet creates the FlagSet of a command. Every command parses
+// its arguments with one, so each supports --help.
+func newCommandFlagSet(name, usageLine string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  vault-migrations %s\n", strings.TrimSpace(name+" "+usageLine))
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(fs.Output(), "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	if flagSetCreated != nil {
+		flagSetCreated(fs)
+	}
+	return fs
+}
+
+// newFlagSet creates a command FlagSet with the common flags registered
+func newFlagSet(name, usageLine string) (*flag.FlagSet, *commonFlags) {
+	fs := newCommandFlagSet(name, usageLine)
+	common := &commonFlags{}
+	fs.StringVar(&common.config, "config", "config.yaml", "Path to configuration file")
+	fs.StringVar(&common.logLevel, "log-level", "", "Log level (debug, info, warn, error)")
+	return fs, common
+}
+
+// parseFlags parses command arguments and sets up logging. It returns an exit
+// code and false when the command should stop.
+func parseFlags(fs *flag.FlagSet, common *commonFlags, args []string) (int, bool) {
+	if code, ok := parseArgs(fs, args); !ok {
+		return code, false
+	}
+	if err := setupLogging(common.logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// parseArgs parses the arguments of a command without common flags. It
+// returns an exit code and false when the command should stop.
+func parseArgs(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// fail logs an error and returns the failure exit code
+func fail(err error, msg string) int {
+	log.Error().Err(err).Msg(msg)
+	return exitError
+}
+
+// loadConfig loads and validates the configuration. Offline commands fall back
+// to a minimal configuration when the file is missing and only require the
+// migrations directory.
+func loadConfig(path string, offline bool) (*migrations.Config, error) {
+	config, err := migrations.LoadConfig(path)
+	if err != nil && !offline {
+		return nil, err
+	}
+	if err != nil {
+		log.Debug().Err(err).Msg("using default configuration")
+		config = &migrations.Config{
+			Migrations: migrations.MigrationsConfig{
+				Directory: "./migrations",
+			},
+		}
+	}
+
+	if err := config.Validate(offline); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return config, nil
+}
+
+// newRunner creates a migration runner connected to the configured Vault
+func newRunner(config *migrations.Config) (*migrations.MigrationRunner, error) {
+	vaultClient, err := migrations.NewVaultClient(config.Vault)
+	if err != nil {
+		return nil, err
+	}
+	return migrations.NewMigrationRunner(vaultClient.GetClient(), config)
+}
+
+// newOfflineRunner creates a migration runner that only reads migration files
+func newOfflineRunner(config *migrations.Config) (*migrations.MigrationRunner, error) {
+	offline := *config
+	offline.DryRun = true
+	return migrations.NewMigrationRunner(nil, &offline)
+}
+
+func runApply(args []string) int {
+	fs, common := newFlagSet("apply", "[flags]")
+	dryRun := fs.Bool("dry-run", false, "Perform a dry run without making changes")
+	targets := fs.String("targets", "", "Comma-separated list of targets to apply to (default all)")
+	to := fs.Int("to", 0, "Stop after applying this version")
+	steps := fs.Int("steps", 0, "Apply at most this many migrations")
+	pause := fs.Bool("pause", false, "Ask for confirmation before each migration after the first")
+	skipPreflight := fs.Bool("skip-preflight", false, "Do not check token capabilities before applying")
+	emitPolicy := fs.Bool("emit-policy", false, "Print the ACL policy that grants missing capabilities when the pre-flight check fails")
+	if code, ok := parseFlags(fs, common, args); !ok {
+		return code
+	}
+	if *to < 0 || *steps < 0 {
+		fmt.Fprintln(os.Stderr, "--to and --steps must not be negative")
+		return exitUsage
+	}
+
+	opts := migrations.ApplyOptions{TargetVersion: *to, Steps: *steps}
+	if *pause {
+		if !isInteractive() {
+			fmt.Fprintln(os.Stderr, "--pause requires an interactive terminal")
+			return exitUsage
+		}
+		opts.Confirm = confirmMigration
+	}
+
+	config, err := loadConfig(common.config, false)
+	if err != nil {
+		return fail(err, "failed to load configuration")
+	}
+	if *dryRun {
+		config.DryRun = true
+	}
+	if *skipPreflight {
+		config.Migrations.SkipPreflight = true
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	// Fan out to every target when the config lists several clusters
+	if len(config.Targets) > 0 {
+		if *pause {
+			fmt.Fprintln(os.Stderr, "--pause cannot be used with multiple targets")
+			return exitUsage
+		}
+		if *targets != "" {
+			if config.Targets, err = filterTargets(config.Targets, *targets); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitUsage
+			}
+		}
+		results := migrations.RunMigrationsOnTargets(ctx, config, opts)
+		fmt.Print(migrations.FormatTargetSummary(results))
+		if migrations.TargetsFailed(results) {
+			return exitError
+		}
+		return exitOK
+	}
+	if *targets != "" {
+		fmt.Fprintln(os.Stderr, "--targets requires targets in the configuration file")
+		return exitUsage
+	}
+
+	runner, err := newRunner(config)
+	if err != nil {
+		return fail(err, "failed to create migration runner")
+	}
+	if config.DryRun {
+		return printDryRun(ctx, runner, opts, "text")
+	}
+	if err := runner.RunMigrationsWithOptions(ctx, opts); err != nil {
+		var preflightErr *migrations.PreflightError
+		if *emitPolicy && errors.As(err, &preflightErr) {
+			fmt.Print(preflightErr.Policy())
+		}
+		return fail(err, "migration failed")
+	}
+	return exitOK
+}
+
+// isInteractive reports whether stdin is a terminal
+func isInteractive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmMigration asks the operator whether to continue with a migration
+func confirmMigration(migration migrations.Migration) (bool, error) {
+	fmt.Fprintf(os.Stderr, "Apply migration %d (%s)? [y/N] ", migration.Version, migration.File)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// filterTargets keeps the targets named in a comma-separated list
+func filterTargets(targets []migrations.TargetConfig, names string) ([]migrations.TargetConfig, error) {
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		wanted[strings.TrimSpace(name)] = true
+	}
+
+	var filtered []migrations.TargetConfig
+	for _, target := range targets {
+		if wanted[target.Name] {
+			filtered = append(filtered, target)
+			delete(wanted, target.Name)
+		}
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("unknown target: %s", name)
+	}
+	return filtered, nil
+}
+
+func runStatus(args []string) int {
+	fs, common := newFlagSet("status", "[flags]")
+	output := fs.String("output", "text", "Output format (text, json)")
+	exitCode := fs.Bool("exit-code", false, "Exit with 3 when migrations are pending and 4 when files drifted from the ledger")
+	if code, ok := parseFlags(fs, common, args); !ok {
+		return code
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unsupported output format: %s\n", *output)
+		return exitUsage
+	}
+
+	config, err := loadConfig(common.config, false)
+	if err != nil {
+		return fail(err, "failed to load configuration")
+	}
+	runner, err := newRunner(config)
+	if err != nil {
+		return fail(err, "failed to create migration runner")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	report, err := runner.Status(ctx)
+	if err != nil {
+		return fail(err, "failed to read status")
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return fail(err, "failed to encode status")
+		}
+	} else {
+		printStatus(os.Stdout, report)
+	}
+
+	if *exitCode {
+		switch {
+		case report.HasDrift():
+			return exitDrift
+		case report.HasPending():
+			return exitPending
+		}
+	}
+	return exitOK
+}
+
+// printStatus writes a human-readable status report
+func printStatus(out io.Writer, report *migrations.StatusReport) {
+	namespaces := make([]string, 0, len(report.Versions))
+	for namespace := range report.Versions {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		fmt.Fprintf(out, "Namespace %s: version %d\n", namespaceLabel(namespace), report.Versions[namespace])
+	}
+	printLock(out, report.Lock)
+	fmt.Fprintln(out)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAMESPACE\tFILE\tSTATE\tAPPLIED AT")
+	for _, migration := range report.Migrations {
+		appliedAt := "-"
+		if migration.AppliedAt != nil {
+			appliedAt = migration.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+			migration.Version, namespaceLabel(migration.Namespace), migration.File, migration.State, appliedAt)
+	}
+	w.Flush()
+}
+
+func runPlan(args []string) int {
+	fs, common := newFlagSet("plan", "[flags]")
+	output := fs.String("output", "text", "Output format (text, json)")
+	to := fs.Int("to", 0, "Plan up to and including this version")
+	steps := fs.Int("steps", 0, "Plan at most this many migrations")
+	if code, ok := parseFlags(fs, common, args); !ok {
+		return code
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unsupported output format: %s\n", *output)
+		return exitUsage
+	}
+
+	config, err := loadConfig(common.config, false)
+	if err != nil {
+		return fail(err, "failed to load configuration")
+	}
+	config.DryRun = true
+	runner, err := newRunner(config)
+	if err != nil {
+		return fail(err, "failed to create migration runner")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	return printDryRun(ctx, runner, migrations.ApplyOptions{TargetVersion: *to, Steps: *steps}, *output)
+}
+
+// printDryRun simulates pending migrations and prints the per-task report.
+// It fails when the token lacks a capability a task needs.
+func printDryRun(ctx context.Context, runner *migrations.MigrationRunner, opts migrations.ApplyOptions, output string) int {
+	report, err := runner.DryRun(ctx, opts)
+	if err != nil {
+		return fail(err, "dry run failed")
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return fail(err, "failed to encode dry run report")
+		}
+	} else if len(report.Tasks) == 0 {
+		fmt.Println("No pending migrations")
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAMESPACE\tMETHOD\tPATH\tACTION\tCHANGED")
+		for _, task := range report.Tasks {
+			detail := strings.Join(task.Changed, ",")
+			if task.Error != "" {
+				detail = task.Error
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n",
+				task.Version, namespaceLabel(task.Namespace), task.Method, task.Path, task.Action, detail)
+		}
+		w.Flush()
+
+		fmt.Printf("\n%d to create, %d to update, %d to delete, %d unchanged, %d checks, %d skipped, %d denied, %d failing\n",
+			report.Count(migrations.ActionCreate), report.Count(migrations.ActionUpdate),
+			report.Count(migrations.ActionDelete), report.Count(migrations.ActionNoop),
+			report.Count(migrations.ActionCheck), report.Count(migrations.ActionSkip),
+			report.Count(migrations.ActionPermissionDenied), report.Count(migrations.ActionFail))
+	}
+
+	if report.Count(migrations.ActionPermissionDenied) > 0 {
+		log.Error().Msg("the token is not permitted to run every task")
+		return exitError
+	}
+	if report.Count(migrations.ActionFail) > 0 {
+		log.Error().Msg("a precondition is not met")
+		return exitError
+	}
+	return exitOK
+}
+
+func runGenerate(args []string) int {
+	fs, common := newFlagSet("generate", "[flags]")
+	schemaFile := fs.String("schema", "schema.yaml", "Path to schema file, directory or glob")
+	offline := fs.Bool("offline", false, "Do not read the current state from Vault")
+	strict := fs.Bool("strict", false, "Fail on policy lint warnings as well as errors")
+	if code, ok := parseFlags(fs, common, args); !ok {
+		return code
+	}
+
+	config, err := loadConfig(common.config, true)
+	if err != nil {
+		return fail(err, "failed to load configuration")
+	}
+
+	schema, err := migrations.LoadSchema(*schemaFile)
+	if err != nil {
+		return fail(err, "failed to load schema")
+	}
+
+	// Try to connect to Vault and get current state, including the KV
+	// secrets the schema names
+	var currentConfig map[string]interface{}
+	if !*offline && config.Vault.Address != "" {
+		client, err := migrations.NewVaultClient(config.Vault)
+		if err == nil {
+			currentConfig, err = currentState(client, schema.DesiredState)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to get current state from Vault, will generate migration from schema only")
+			}
+		} else {
+			log.Warn().Err(err).Msg("failed to connect to Vault, will generate migration from schema only")
+		}
+	}
+
+	// Generate migration based on schema and available state
+	runner, err := newOfflineRunner(config)
+	if err != nil {
+		return fail(err, "failed to create migration runner")
+	}
+	existing, err := runner.ValidateMigrations(context.Background())
+	if err != nil {
+		return fail(err, "invalid migrations")
+	}
+	result, err := migrations.GenerateIntelligentMigration(currentConfig, schema.DesiredState, config.Migrations.Directory)
+	if err != nil {
+		return fail(err, "failed to generate migration")
+	}
+	log.Info().Msg(result)
+
+	// Lint the policies of the migration that was written, if any
+	loaded, err := runner.ValidateMigrations(context.Background())
+	if err != nil {
+		return fail(err, "invalid generated migration")
+	}
+	errorCount, warningCount := logLintFindings(runner.LintMigrations(generatedMigrations(existing, loaded)))
+	if errorCount > 0 || (*strict && warningCount > 0) {
+		log.Error().Int("errors", errorCount).Int("warnings", warningCount).Msg("policy lint failed")
+		return exitError
+	}
+	return exitOK
+}
+
+// currentState reads the current state of Vault and of the KV secrets in the
+// desired state
+func currentState(client *migrations.VaultClient, desired map[string]interface{}) (map[string]interface{}, error) {
+	state, err := client.GetCurrentState()
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := client.GetKVState(desired)
+	if err != nil {
+		return nil, err
+	}
+	for path, secret := range secrets {
+		state[path] = secret
+	}
+	return state, nil
+}
+
+// generatedMigrations returns the migrations newer than all existing ones
+func generatedMigrations(existing, loaded []migrations.Migration) []migrations.Migration {
+	latest := 0
+	for _, migration := range existing {
+		latest = max(latest, migration.Version)
+	}
+	var generated []migrations.Migration
+	for _, migration := range loaded {
+		if migration.Version > latest {
+			generated = append(generated, migration)
+		}
+	}
+	return generated
+}
+
+func runValidate(args []string) int {
+	fs, common := newFlagSet("validate", "[flags]")
+	schemaFile := fs.String("schema", "", "Path to schema file, directory or glob to validate")
+	strict := fs.Bool("strict", false, "Fail on policy lint warnings as well as errors")
+	openAPI := fs.Bool("openapi", false, "Check paths and fields against Vault's OpenAPI document")
+	openAPICache := fs.String("openapi-cache", "", "File to cache the OpenAPI document in, read when Vault cannot be reached")
+	if code, ok := parseFlags(fs, common, args); !ok {
+		return code
+	}
+
+	config, err := loadConfig(common.config, true)
+	if err != nil {
+		return fail(err, "failed to load configuration")
+	}
+
+	var spec *migrations.OpenAPISpec
+	if *openAPI {
+		spec, err = loadOpenAPISpec(config, *openAPICache)
+		if err != nil {
+			return fail(err, "failed to load the OpenAPI document")
+		}
+	}
+
+	var findings []migrations.LintFinding
+	var apiFindings []migrations.OpenAPIFinding
+	if *schemaFile != "" {
+		schema, err := migrations.LoadSchema(*schemaFile)
+		if err != nil {
+			return fail(err, "invalid schema")
+		}
+		findings = append(findings, migrations.LintDesiredState(schema.DesiredState)...)
+		if spec != nil {
+			apiFindings = append(apiFindings, spec.CheckSchema(schema)...)
+		}
+	}
+
+	runner, err := newOfflineRunner(config)
+	if err != nil {
+		return fail(err, "failed to create migration runner")
+	}
+	loaded, err := runner.ValidateMigrations(context.Background())
+	if err != nil {
+		return fail(err, "invalid migrations")
+	}
+	findings = append(findings, runner.LintMigrations(loaded)...)
+	if spec != nil {
+		apiFindings = append(apiFindings, spec.CheckMigrations(loaded)...)
+	}
+
+	failed := false
+	errorCount, warningCount := logLintFindings(findings)
+	if errorCount > 0 || (*strict && warningCount > 0) {
+		log.Error().Int("errors", errorCount).Int("warnings", warningCount).Msg("policy lint failed")
+		failed = true
+	}
+	errorCount, warningCount = logOpenAPIFindings(apiFindings)
+	if errorCount > 0 || (*strict && warningCount > 0) {
+		log.Error().Int("errors", errorCount).Int("warnings", warningCount).Msg("OpenAPI check failed")
+		failed = true
+	}
+	if failed {
+		return exitError
+	}
+
+	fmt.Printf("Configuration and %d migration files are valid\n", len(loaded))
+	return exitOK
+}
+
+// loadOpenAPISpec downloads Vault's OpenAPI document, saving it to the cache
+// file if one is given. When Vault cannot be reached, the cached copy is used.
+func loadOpenAPISpec(config *migrations.Config, cacheFile string) (*migrations.OpenAPISpec, error) {
+	data, err := fetchOpenAPISpec(config)
+	switch {
+	case err == nil && cacheFile != "":
+		if err := os.WriteFile(cacheFile, data, 0o644); err != nil {
+			log.Warn().Err(err).Str("file", cacheFile).Msg("failed to cache the OpenAPI document")
+		}
+	case err != nil && cacheFile != "":
+		log.Warn().Err(err).Str("file", cacheFile).Msg("failed to download the OpenAPI document, using the cached copy")
+		data, err = os.ReadFile(cacheFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the cached OpenAPI document: %w", err)
+		}
+	case err != nil:
+		return nil, err
+	}
+	return migrations.ParseOpenAPISpec(data)
+}
+
+// fetchOpenAPISpec downloads Vault's OpenAPI document
+func fetchOpenAPISpec(config *migrations.Config) ([]byte, error) {
+	if config.Vault.Address == "" {
+		return nil, fmt.Errorf("no Vault address is configured")
+	}
+	client, err := migrations.NewVaultClient(config.Vault)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	return client.FetchOpenAPISpec(ctx)
+}
+
+// logOpenAPIFindings logs OpenAPI findings and counts them by severity
+func logOpenAPIFindings(findings []migrations.OpenAPIFinding) (errorCount, warningCount int) {
+	for _, finding := range findings {
+		event := log.Warn()
+		if finding.Severity == migrations.LintError {
+			event = log.Error()
+			errorCount++
+		} else {
+			warningCount++
+		}
+		event.Str("source", finding.Source).
+			Str("path", finding.Path).
+			Str("field", finding.Field).
+			Msg(finding.Message)
+	}
+	return errorCount, warningCount
+}
+
+// logLintFindings logs policy lint findings and counts them by severity
+func logLintFindings(findings []migrations.LintFinding) (errorCount, warningCount int) {
+	for _, finding := range findings {
+		event := log.Warn()
+		if finding.Severity == migrations.LintError {
+			event = log.Error()
+			errorCount++
+		} else {
+			warningCount++
+		}
+		event.Str("policy", finding.Policy).
+			Str("namespace", finding.Namespace).
+			Str("path", finding.Path).
+			Msg(finding.Message)
+	}
+	return errorCount, warningCount
+}
+
+func runSchema(args []string) int {
+	fs := newCommandFlagSet("schema", "[flags]")
+	output := fs.String("output", "", "Directory to write the JSON Schemas to (default: print the schema file schema)")
+	if code, ok := parseArgs(fs, args); !ok {
+		return code
+	}
+
+	if *output == "" {
+		if err := writeJSONSchema(os.Stdout, migrations.SchemaFileSchema()); err != nil {
+			return fail(err, "failed to encode JSON Schema")
+		}
+		return exitOK
+	}
+
+	// One schema for whole schema files, and one per resource for editors
+	// that map schemas to paths themselves
+	schemas := map[string]*migrations.JSONSchema{"vault-migrations.schema.json": migrations.SchemaFileSchema()}
+	for name, schema := range migrations.ResourceSchemas() {
+		schemas[name+".schema.json"] = schema
+	}
+	if err := os.MkdirAll(*output, 0o755); err != nil {
+		return fail(err, "failed to create output directory")
+	}
+	for name, schema := range schemas {
+		file, err := os.Create(filepath.Join(*output, name))
+		if err != nil {
+			return fail(err, "failed to write JSON Schema")
+		}
+		err = writeJSONSchema(file, schema)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fail(err, "failed to write JSON Schema")
+		}
+	}
+	fmt.Printf("Wrote %d JSON Schemas to %s\n", len(schemas), *output)
+	return exitOK
+}
+
+// writeJSONSchema writes an indented JSON Schema, keeping the <path>
+// placeholders of its descriptions readable
+func writeJSONSchema(w io.Writer, schema *migrations.JSONSchema) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(schema)
+}
+
+func runRollback(args []string) int {
+	fs, common := newFlagSet("rollback", "--to=<version> [flags]")
+	to := fs.Int("to", -1, "Version to roll back to (required)")
+	dryRun := fs.Bool("dry-run", false, "Show what would be rolled back without making changes")
+	if code, ok := parseFlags(fs, common, args); !ok {
+		return code
+	}
+	if *to < 0 {
+		fmt.Fprintln(os.Stderr, "--to is required")
+		fs.Usage()
+		return exitUsage
+	}
+
+	config, err := loadConfig(common.config, false)
+	if err != nil {
+		return fail(err, "failed to load configuration")
+	}
+	if *dryRun {
+		config.DryRun = true
+	}
+	runner, err := newRunner(config)
+	if err != nil {
+		return fail(err, "failed to create migration runner")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if err := runner.Rollback(ctx, *to); err != nil {
+		return fail(err, "rollback failed")
+	}
+	return exitOK
+}
+
+func runRestore(args []string) int {
+	fs, common := newFlagSet("restore", "--migration=<version> [flags]")
+	version := fs.Int("migration", 0, "Version of the migration whose snapshot to restore (required)")
+	namespace := fs.String("namespace", "", "Namespace of the migration, when several namespaces use its version (empty for the configured one)")
+	if code, ok := parseFlags(fs, common, args); !ok {
+		return code
+	}
+	namespaceSet := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "namespace" {
+			namespaceSet = true
+		}
+	})
+	if *version <= 0 {
+		fmt.Fprintln(os.Stderr, "--migration is required")
+		fs.Usage()
+		return exitUsage
+	}
+
+	config, err := loadConfig(common.config, false)
+	if err != nil {
+		return fail(err, "failed to load configuration")
+	}
+	runner, err := newRunner(config)
+	if err != nil {
+		return fail(err, "failed to create migration runner")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if namespaceSet {
+		err = runner.RestoreSnapshotInNamespace(ctx, *namespace, *version)
+	} else {
+		err = runner.RestoreSnapshot(ctx, *version)
+	}
+	if err != nil {
+		return fail(err, "restore failed")
+	}
+	return exitOK
+}
+
+func runHistory(args []string) int {
+	fs, common := newFlagSet("history", "[flags]")
+	if code, ok := parseFlags(fs, common, args); !ok {
+		return code
+	}
+
+	config, err := loadConfig(common.config, false)
+	if err != nil {
+		return fail(err, "failed to load configuration")
+	}
+	runner, err := newRunner(config)
+	if err != nil {
+		return fail(err, "failed to create migration runner")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	entries, err := runner.History(ctx)
+	if err != nil {
+		return fail(err, "failed to read history")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAMESPACE\tFILE\tAPPLIED AT\tAPPLIED BY\tDURATION")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Version, namespaceLabel(entry.Namespace), entry.File,
+			entry.AppliedAt.Format(time.RFC3339), entry.AppliedBy, entry.Duration)
+	}
+	w.Flush()
+	return exitOK
+}
+
+func runLock(args []string) int {
+	fs, common := newFlagSet("lock", "[status|release] [flags]")
+	if code, ok := parseFlags(fs, common, args); !ok {
+		return code
+	}
+
+	action := "status"
+	if fs.NArg() > 0 {
+		action = fs.Arg(0)
+	}
+	if action != "status" && action != "release" {
+		fmt.Fprintf(os.Stderr, "unknown lock action: %s\n", action)
+		fs.Usage()
+		return exitUsage
+	}
+
+	config, err := loadConfig(common.config, false)
+	if err != nil {
+		return fail(err, "failed to load configuration")
+	}
+	runner, err := newRunner(config)
+	if err != nil {
+		return fail(err, "failed to create migration runner")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if action == "release" {
+		if err := runner.ForceUnlock(ctx); err != nil {
+			return fail(err, "failed to release lock")
+		}
+		fmt.Println("Lock released")
+		return exitOK
+	}
+
+	lock, err := runner.LockInfo(ctx)
+	if err != nil {
+		return fail(err, "failed to read migration lock")
+	}
+	printLock(os.Stdout, lock)
+	return exitOK
+}
+
+func runVersion(args []string) int {
+	fs := newCommandFlagSet("version", "")
+	if code, ok := parseArgs(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "version takes no arguments")
+		return exitUsage
+	}
+	fmt.Printf("vault-migrations version %s\n", version)
+	fmt.Printf("commit: %s\n", commit)
+	fmt.Printf("build date: %s\n", date)
+	return exitOK
+}
+
+func runHelp(args []string) int {
+	fs := newCommandFlagSet("help", "")
+	if code, ok := parseArgs(fs, args); !ok {
+		return code
+	}
+	printUsage()
+	return exitOK
+}
+
+// printLock writes a one-line description of the lock state
+func printLock(w io.Writer, lock *migrations.LockInfo) {
+	switch {
+	case lock == nil:
+		fmt.Fprintln(w, "Lock: free")
+	case lock.Expired():
+		fmt.Fprintf(w, "Lock: stale, held by %s since %s\n", lock.Holder, lock.AcquiredAt.Format(time.RFC3339))
+	default:
+		fmt.Fprintf(w, "Lock: held by %s since %s\n", lock.Holder, lock.AcquiredAt.Format(time.RFC3339))
+	}
+}
+
+// namespaceLabel renders an empty namespace as the configured default
+func namespaceLabel(namespace string) string {
+	if namespace == "" {
+		return "(default)"
+	}
+	return strconv.Quote(namespace)
+}
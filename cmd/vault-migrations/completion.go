@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const bashCompletion = `# bash completion for vault-migrations
+_vault_migrations() {
+    local cur prev commands
+    COMPREPLY=()
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    commands="%s"
+
+    if [[ ${COMP_CWORD} -eq 1 ]]; then
+        COMPREPLY=( $(compgen -W "${commands}" -- "${cur}") )
+        return 0
+    fi
+
+    case "${prev}" in
+        --config|--schema|--output|--openapi-cache)
+            COMPREPLY=( $(compgen -f -- "${cur}") )
+            return 0
+            ;;
+        --log-level)
+            COMPREPLY=( $(compgen -W "debug info warn error" -- "${cur}") )
+            return 0
+            ;;
+    esac
+
+    case "${COMP_WORDS[1]}" in
+%s    esac
+}
+complete -F _vault_migrations vault-migrations
+`
+
+const zshCompletion = `#compdef vault-migrations
+# zsh completion for vault-migrations
+autoload -U +X bashcompinit && bashcompinit
+%s`
+
+// commandArgs lists the positional arguments of commands that take one of
+// a fixed set
+var commandArgs = map[string][]string{
+	"lock":       {"status", "release"},
+	"completion": {"bash", "zsh"},
+}
+
+// commandFlags returns the flags of a command. The command is run with
+// --help, which stops right after its flags are defined, and the flags are
+// read from the FlagSet it created.
+func commandFlags(cmd command) []string {
+	var fs *flag.FlagSet
+	flagSetCreated = func(created *flag.FlagSet) {
+		created.SetOutput(io.Discard)
+		fs = created
+	}
+	defer func() { flagSetCreated = nil }()
+	cmd.run([]string{"--help"})
+
+	var flags []string
+	if fs != nil {
+		fs.VisitAll(func(f *flag.Flag) {
+			flags = append(flags, "--"+f.Name)
+		})
+	}
+	return flags
+}
+
+// bashCompletionScript renders the bash completion script from the command
+// table and the flags of each command
+func bashCompletionScript() string {
+	var names []string
+	var cases strings.Builder
+	for _, cmd := range commands() {
+		names = append(names, cmd.name)
+		words := append(commandFlags(cmd), commandArgs[cmd.name]...)
+		if len(words) > 0 {
+			fmt.Fprintf(&cases, "        %s)\n            COMPREPLY=( $(compgen -W \"%s\" -- \"${cur}\") )\n            ;;\n", cmd.name, strings.Join(words, " "))
+		}
+	}
+	return fmt.Sprintf(bashCompletion, strings.Join(names, " "), cases.String())
+}
+
+func runCompletion(args []string) int {
+	fs := newCommandFlagSet("completion", "<bash|zsh>")
+	if code, ok := parseArgs(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	switch fs.Arg(0) {
+	case "bash":
+		fmt.Print(bashCompletionScript())
+	case "zsh":
+		fmt.Printf(zshCompletion, bashCompletionScript())
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported shell: %s\n", fs.Arg(0))
+		return exitUsage
+	}
+	return exitOK
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -10,25 +9,18 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/hashicorp/vault/api"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/pampatzoglou/hashicorp-vault-migrations/pkg/migrations"
 )
 
 const usage = `vault-migrations - A tool for managing HashiCorp Vault configuration migrations
 
 Usage:
-  vault-migrations [flags]
+  vault-migrations <command> [flags]
 
-Flags:
-  --config string     Path to configuration file (default "config.yaml")
-  --schema string     Path to schema file (default "schema.yaml")
-  --dry-run          Perform a dry run without making changes
-  --log-level        Set logging level (debug, info, warn, error)
-  --generate         Generate migration from schema
-  --help             Show this help message
-  --version          Show version information
+Commands:
+%s
+Run "vault-migrations <command> --help" for the flags of a command.
 
 Configuration File (YAML):
   vault:
@@ -44,6 +36,24 @@ Configuration File (YAML):
     directory: "./migrations"          # Directory containing migration files
     concurrent_tasks: true            # Run tasks concurrently within migrations
     stop_on_error: true              # Stop on first error
+    skip_preflight: false            # Skip the token capability check before applying
+    lock_path: "secret/vault-migrations/lock"  # Optional, a KV v2 path makes the lock atomic
+    lock_holder: "ci-job-1234"       # Optional, names the run in the lock and history (default host:pid)
+    snapshots: false                 # Save the prior value of every path a migration modifies, secrets included
+    auto_restore: false              # Restore the snapshot when a migration fails (implies snapshots)
+
+  targets:                            # Optional, apply to several clusters
+    - name: eu-west                   # Unset vault fields inherit from vault above
+      canary: true                    # Canaries run first; a failure skips the rest
+      vault:
+        address: "https://vault.eu-west:8200"
+    - name: us-east
+      vault:
+        address: "https://vault.us-east:8200"
+
+  fan_out:
+    mode: "parallel"                  # parallel or serial
+    parallelism: 4                    # Maximum targets applied at once
 
   log_level: "info"                   # Logging level
   dry_run: false                     # Perform dry run without making changes
@@ -53,195 +63,151 @@ Environment Variables:
   VAULT_TOKEN     Alternative to config file vault.token
   VAULT_NAMESPACE Alternative to config file vault.namespace
 
+Exit Codes:
+  0  Success
+  1  The command failed
+  2  Invalid command line usage
+  3  status --exit-code: migrations are pending
+  4  status --exit-code: applied migrations are missing or changed on disk
+
 Examples:
-  # Run migrations with default config file
-  vault-migrations
+  # Apply pending migrations with the default config file
+  vault-migrations apply
+
+  # Apply with custom config and debug logging
+  vault-migrations apply --config=/path/to/config.yaml --log-level=debug
+
+  # Generate a migration from a schema
+  vault-migrations generate --schema=/path/to/schema.yaml
+
+  # Generate a migration from a schema split into one file per team
+  vault-migrations generate --schema=schema.d/
+
+  # Export the JSON Schemas of schema files for editor completion
+  vault-migrations schema --output=.schemas
+
+  # Apply up to version 5, one migration at a time with confirmation
+  vault-migrations apply --to=5 --pause
+
+  # Show what would be applied
+  vault-migrations plan
 
-  # Run migrations with custom config and schema files
-  vault-migrations --config=/path/to/config.yaml --schema=/path/to/schema.yaml
+  # Fail a CI job when migrations are pending
+  vault-migrations status --output=json --exit-code
 
-  # Generate migration from schema
-  vault-migrations --generate --schema=/path/to/schema.yaml
+  # Roll back to version 3
+  vault-migrations rollback --to=3
 
-  # Perform a dry run with debug logging
-  vault-migrations --dry-run --log-level=debug
+  # Enable bash completion
+  source <(vault-migrations completion bash)
 
 Version: %s
 `
 
+// Exit codes shared by every command
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitUsage   = 2
+	exitPending = 3
+	exitDrift   = 4
+)
+
 var (
 	version = "dev"
 	commit  = "none"
 	date    = "unknown"
 )
 
-func printVersion() {
-	fmt.Printf("vault-migrations version %s\n", version)
-	fmt.Printf("commit: %s\n", commit)
-	fmt.Printf("build date: %s\n", date)
-}
-
-// normalizeFlag converts a flag to use -- prefix if needed
-func normalizeFlag(name string) string {
-	if !strings.HasPrefix(name, "--") {
-		return "--" + name
+func printUsage() {
+	var b strings.Builder
+	for _, cmd := range commands() {
+		fmt.Fprintf(&b, "  %-11s %s\n", cmd.name, cmd.summary)
 	}
-	return name
+	fmt.Fprintf(os.Stderr, usage, b.String(), version)
 }
 
-func main() {
-	// Create custom FlagSet to handle -- prefix
-	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, usage, version)
-	}
-
-	// Parse command line flags
-	configFile := fs.String("config", "config.yaml", "Path to configuration file")
-	schemaFile := fs.String("schema", "schema.yaml", "Path to schema file")
-	dryRun := fs.Bool("dry-run", false, "Perform a dry run without making changes")
-	logLevel := fs.String("log-level", "", "Log level (debug, info, warn, error)")
-	showVersion := fs.Bool("version", false, "Show version information")
-	generate := fs.Bool("generate", false, "Generate migration from schema")
-
-	// Handle -- prefix for flags
-	args := make([]string, 0, len(os.Args[1:]))
-	for _, arg := range os.Args[1:] {
-		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") {
-			arg = "-" + arg
-		}
-		args = append(args, arg)
-	}
-
-	if err := fs.Parse(args); err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing flags: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Show version if requested
-	if *showVersion {
-		printVersion()
-		os.Exit(0)
-	}
-
-	// Setup logging
+// setupLogging configures the global logger
+func setupLogging(level string) error {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339})
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
 
-	if *logLevel != "" {
-		level, err := zerolog.ParseLevel(*logLevel)
-		if err != nil {
-			log.Fatal().Err(err).Msg("invalid log level")
-		}
-		zerolog.SetGlobalLevel(level)
+	if level == "" {
+		return nil
+	}
+	parsed, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
 	}
+	zerolog.SetGlobalLevel(parsed)
+	return nil
+}
 
-	// Load configuration
-	var config *migrations.Config
-	var err error
-	if *configFile != "" {
-		config, err = migrations.LoadConfig(*configFile)
-		if err != nil && !*generate {
-			log.Fatal().Err(err).Msg("failed to load configuration")
-		} else if err != nil {
-			// For generate command, we'll create a minimal config
-			config = &migrations.Config{
-				Migrations: migrations.MigrationsConfig{
-					Directory: "./migrations", // default directory
-				},
-			}
-		}
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
 
-		// Validate configuration based on mode
-		if err := config.Validate(*generate); err != nil {
-			log.Fatal().Err(err).Msg("invalid configuration")
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigCh:
+			log.Info().Msgf("received signal %s, initiating shutdown", sig)
+			cancel()
+		case <-ctx.Done():
 		}
-	}
+	}()
 
-	// Override dry-run from command line if specified or in generate mode
-	if *dryRun || *generate {
-		if config != nil {
-			config.DryRun = true
-		}
+	return ctx, func() {
+		signal.Stop(sigCh)
+		cancel()
 	}
+}
 
-	// Create migration runner
-	var runner *migrations.MigrationRunner
-	if config != nil {
-		// For non-generate commands, create a Vault client
-		var client *api.Client
-		var err error
-		
-		if !*generate {
-			vaultClient, err := migrations.NewVaultClient(config.Vault)
-			if err != nil {
-				log.Fatal().Err(err).Msg("failed to create Vault client")
-			}
-			client = vaultClient.GetClient()
-		}
-
-		runner, err = migrations.NewMigrationRunner(client, config)
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to create migration runner")
+// legacyArgs translates the flag-only invocation of earlier releases
+// (no command, --generate, --version) into a command and its arguments.
+func legacyArgs(args []string) (string, []string) {
+	rest := make([]string, 0, len(args))
+	name := "apply"
+	for _, arg := range args {
+		switch strings.TrimLeft(arg, "-") {
+		case "generate":
+			name = "generate"
+		case "version":
+			return "version", nil
+		case "help", "h":
+			return "help", nil
+		default:
+			rest = append(rest, arg)
 		}
 	}
+	return name, rest
+}
 
-	// Handle generate command
-	if *generate {
-		migrationsDir := "./migrations" // default directory
-		if config != nil && config.Migrations.Directory != "" {
-			migrationsDir = config.Migrations.Directory
-		}
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
 
-		var currentConfig map[string]interface{}
-		var err error
-
-		// Try to connect to Vault and get current state
-		if config != nil && config.Vault.Address != "" {
-			client, err := migrations.NewVaultClient(config.Vault)
-			if err == nil {
-				currentConfig, err = client.GetCurrentState()
-				if err != nil {
-					log.Warn().Err(err).Msg("failed to get current state from Vault, will generate migration from schema only")
-				}
-			} else {
-				log.Warn().Err(err).Msg("failed to connect to Vault, will generate migration from schema only")
+// run dispatches to a command and returns the process exit code
+func run(args []string) int {
+	name := "help"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+		if strings.HasPrefix(name, "-") {
+			name, args = legacyArgs(append([]string{name}, args...))
+			if name == "apply" || name == "generate" {
+				fmt.Fprintf(os.Stderr, "warning: running without a command is deprecated, use \"vault-migrations %s\"\n", name)
 			}
 		}
-
-		// Generate migration based on schema and available state
-		schema, err := migrations.LoadSchema(*schemaFile)
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to load schema")
-		}
-		result, err := migrations.GenerateIntelligentMigration(currentConfig, schema.DesiredState, migrationsDir)
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to generate migration")
-		}
-		log.Info().Msg(result)
-		return
 	}
 
-	// For non-generate commands, we need a valid config
-	if config == nil {
-		log.Fatal().Msg("configuration is required for non-generate commands")
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
 	}
 
-	// Set up context with cancellation
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// Handle signals
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigCh
-		log.Info().Msgf("received signal %s, initiating shutdown", sig)
-		cancel()
-	}()
-
-	// Run migrations
-	if err := runner.RunMigrations(ctx); err != nil {
-		log.Fatal().Err(err).Msg("migration failed")
-	}
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+	printUsage()
+	return exitUsage
 }
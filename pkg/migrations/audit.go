@@ -0,0 +1,174 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// auditFields are the fields an audit task accepts in its data
+var auditFields = map[string]bool{
+	"type":        true,
+	"description": true,
+	"options":     true,
+	"local":       true,
+}
+
+// auditType handles tasks that enable and disable audit devices. The task
+// path is sys/audit/<path>; data holds the device type, description, options
+// and local, as written to Vault.
+//
+// Audit devices are guarded: Vault cannot change an enabled device, so a
+// device whose settings differ is only disabled and enabled again when the
+// task sets replace: true, and the last enabled device is never disabled.
+type auditType struct{}
+
+func (auditType) validate(task Task) error {
+	if auditDevicePath(task.Path) == "" {
+		return fmt.Errorf("audit path must name a device, such as sys/audit/file")
+	}
+	switch task.Method {
+	case "POST", "PUT":
+	case "DELETE":
+		if len(task.Data) > 0 {
+			return fmt.Errorf("data is not supported by audit DELETE")
+		}
+		if task.Replace {
+			return fmt.Errorf("replace is not supported by audit DELETE")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported audit method: %s", task.Method)
+	}
+
+	for field := range task.Data {
+		if !auditFields[field] {
+			return fmt.Errorf("unknown audit field %q", field)
+		}
+	}
+	if stringField(task.Data, "type") == "" {
+		return fmt.Errorf("audit %s needs data.type", task.Method)
+	}
+	if task.Data["options"] != nil && stringKeyMap(task.Data["options"]) == nil {
+		return fmt.Errorf("audit options must be a map")
+	}
+	return nil
+}
+
+func (auditType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	devicePath := auditDevicePath(task.Path)
+	devices, err := m.auditDevices(ctx, task.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	current := devices[devicePath]
+
+	raw := func(method string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Path, t.Data, t.Replace = method, path.Join("sys/audit", devicePath), data, false
+		return t
+	}
+
+	if task.Method == "DELETE" {
+		if current == nil {
+			return nil, nil
+		}
+		if len(devices) == 1 {
+			return nil, fmt.Errorf("refusing to disable sys/audit/%s, the last enabled audit device; enable another device first", devicePath)
+		}
+		return []Task{raw("DELETE", nil)}, nil
+	}
+
+	switch {
+	case current == nil:
+		return []Task{raw("PUT", task.Data)}, nil
+	case auditStateEqual(current, task.Data):
+		return nil, nil
+	case !task.Replace:
+		return nil, fmt.Errorf("audit device sys/audit/%s is enabled with different settings; set replace: true to disable and re-enable it", devicePath)
+	default:
+		if len(devices) == 1 {
+			m.logger.Warn().Str("path", devicePath).Msg("Re-enabling the only audit device; requests in between are not audited")
+		}
+		return []Task{raw("DELETE", nil), raw("PUT", task.Data)}, nil
+	}
+}
+
+// auditDevicePath returns the device path of an audit task path, or an empty
+// string if it does not name a device
+func auditDevicePath(p string) string {
+	p = strings.Trim(p, "/")
+	if !strings.HasPrefix(p, "sys/audit/") {
+		return ""
+	}
+	return strings.TrimPrefix(p, "sys/audit/")
+}
+
+// auditDevices returns the enabled audit devices by path
+func (m *MigrationRunner) auditDevices(ctx context.Context, namespace string) (map[string]map[string]interface{}, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, fmt.Errorf("cannot list audit devices without Vault client")
+	}
+
+	secret, err := client.Logical().ReadWithContext(ctx, "sys/audit")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit devices: %w", err)
+	}
+	devices := make(map[string]map[string]interface{})
+	if secret == nil {
+		return devices, nil
+	}
+	for devicePath, device := range secret.Data {
+		if fields := stringKeyMap(device); fields != nil {
+			devices[strings.TrimSuffix(devicePath, "/")] = fields
+		}
+	}
+	return devices, nil
+}
+
+// auditTaskFromDiff converts a difference in an audit device into an audit
+// task. Tasks that change an enabled device are generated without replace,
+// so they fail until someone confirms the change.
+func auditTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	devicePath := auditDevicePath(diff.Path)
+	if devicePath == "" || strings.Contains(devicePath, "/") {
+		return Task{}, false
+	}
+	task := Task{Type: "audit", Path: "sys/audit/" + devicePath, Method: method}
+	if method != "DELETE" {
+		task.Data = stringKeyMap(diff.NewValue)
+	}
+	return task, true
+}
+
+// auditStateEqual compares the current settings of an audit device with the
+// desired ones. Vault returns options as strings, so they are compared as
+// written; an option that is set on only one side is a difference.
+func auditStateEqual(current, desired interface{}) bool {
+	have, want := stringKeyMap(current), stringKeyMap(desired)
+	if have == nil || want == nil {
+		return configValuesEqual(current, desired)
+	}
+	if stringField(have, "type") != stringField(want, "type") ||
+		stringField(have, "description") != stringField(want, "description") ||
+		(have["local"] == true) != (want["local"] == true) {
+		return false
+	}
+
+	haveOptions, wantOptions := stringKeyMap(have["options"]), stringKeyMap(want["options"])
+	if len(haveOptions) != len(wantOptions) {
+		return false
+	}
+	for option, value := range wantOptions {
+		current, ok := haveOptions[option]
+		if !ok || fmt.Sprint(current) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditType_Validate(t *testing.T) {
+	valid := []Task{
+		{Type: "audit", Method: "PUT", Path: "sys/audit/file", Data: map[string]interface{}{
+			"type": "file", "options": map[interface{}]interface{}{"file_path": "/vault/audit/audit.log"},
+		}},
+		{Type: "audit", Method: "PUT", Path: "sys/audit/file", Replace: true, Data: map[string]interface{}{"type": "file"}},
+		{Type: "audit", Method: "DELETE", Path: "sys/audit/syslog"},
+		{Method: "READ", Path: "sys/audit/file"},
+	}
+	for _, task := range valid {
+		assert.NoError(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+
+	invalid := []Task{
+		{Type: "audit", Method: "PUT", Path: "sys/audit", Data: map[string]interface{}{"type": "file"}},
+		{Type: "audit", Method: "PUT", Path: "sys/audit/file", Data: map[string]interface{}{"file_path": "/vault/audit/audit.log"}},
+		{Type: "audit", Method: "PUT", Path: "sys/audit/file", Data: map[string]interface{}{"type": "file", "options": "file_path=stdout"}},
+		{Type: "audit", Method: "DELETE", Path: "sys/audit/file", Data: map[string]interface{}{"type": "file"}},
+		{Method: "DELETE", Path: "sys/audit/file"},
+		{Method: "PUT", Path: "sys/audit/file", Data: map[string]interface{}{"type": "file"}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestAuditType_Expand(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "sys/audit/file", map[string]interface{}{
+		"type": "file", "options": map[string]interface{}{"file_path": "/vault/audit/audit.log", "log_raw": "false"},
+	})
+
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: t.TempDir()},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	file := func(options map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"type": "file", "options": options}
+	}
+	current := map[string]interface{}{"file_path": "/vault/audit/audit.log", "log_raw": false}
+	changed := map[string]interface{}{"file_path": "/vault/audit/vault.log"}
+
+	got, err := runner.expandType(ctx, Task{Type: "audit", Method: "PUT", Path: "sys/audit/file", Data: file(current)})
+	require.NoError(t, err)
+	assert.Empty(t, got, "an unchanged device is left alone")
+
+	_, err = runner.expandType(ctx, Task{Type: "audit", Method: "PUT", Path: "sys/audit/file", Data: file(changed)})
+	assert.ErrorContains(t, err, "set replace: true")
+
+	got, err = runner.expandType(ctx, Task{Type: "audit", Method: "PUT", Path: "sys/audit/file", Replace: true, Data: file(changed)})
+	require.NoError(t, err)
+	assert.Equal(t, []Task{
+		{Method: "DELETE", Path: "sys/audit/file"},
+		{Method: "PUT", Path: "sys/audit/file", Data: file(changed)},
+	}, got)
+
+	_, err = runner.expandType(ctx, Task{Type: "audit", Method: "DELETE", Path: "sys/audit/file"})
+	assert.ErrorContains(t, err, "last enabled audit device")
+
+	got, err = runner.expandType(ctx, Task{Type: "audit", Method: "DELETE", Path: "sys/audit/missing"})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	server.put("", "sys/audit/syslog", map[string]interface{}{"type": "syslog"})
+	got, err = runner.expandType(ctx, Task{Type: "audit", Method: "DELETE", Path: "sys/audit/file"})
+	require.NoError(t, err)
+	assert.Equal(t, []Task{{Method: "DELETE", Path: "sys/audit/file"}}, got)
+}
+
+func TestMigrationRunner_AuditSwap(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "sys/audit/file", map[string]interface{}{"type": "file"})
+
+	migrations := []Migration{{
+		Version: 1,
+		Tasks: []Task{
+			{Type: "audit", Method: "PUT", Path: "sys/audit/syslog", Data: map[string]interface{}{"type": "syslog"}},
+			{Type: "audit", Method: "DELETE", Path: "sys/audit/file"},
+		},
+	}}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+		require.NoError(t, runner.RunMigrations(context.Background()))
+	})
+
+	_, ok := server.get("", "sys/audit/file")
+	assert.False(t, ok)
+	_, ok = server.get("", "sys/audit/syslog")
+	assert.True(t, ok, "the new device is enabled before the old one is disabled")
+}
+
+func TestGenerateTasksFromDiffs_Audit(t *testing.T) {
+	current := map[string]interface{}{
+		"sys/audit/file": map[string]interface{}{
+			"type": "file", "description": "", "local": false,
+			"options": map[string]interface{}{"file_path": "/vault/audit/audit.log", "hmac_accessor": "true"},
+		},
+		"sys/audit/old": map[string]interface{}{"type": "socket", "options": map[string]interface{}{}},
+	}
+	desired := map[string]interface{}{
+		"sys/audit/file": map[interface{}]interface{}{
+			"type":    "file",
+			"options": map[interface{}]interface{}{"file_path": "/vault/audit/audit.log", "hmac_accessor": true},
+		},
+		"sys/audit/syslog": map[interface{}]interface{}{"type": "syslog"},
+	}
+
+	tasks := generateTasksFromDiffs(compareConfigs(current, desired))
+	orderTasks(tasks)
+
+	assert.Equal(t, []Task{
+		{Type: "audit", Method: "POST", Path: "sys/audit/syslog", Data: map[string]interface{}{"type": "syslog"}},
+		{Type: "audit", Method: "DELETE", Path: "sys/audit/old"},
+	}, tasks)
+}
@@ -0,0 +1,297 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authConfigEndpoints maps auth method types to their configuration endpoint
+// below auth/<path>/. Methods without an entry, such as approle and
+// userpass, have nothing to configure besides their roles and users.
+var authConfigEndpoints = map[string]string{
+	"kubernetes": "config",
+	"jwt":        "config",
+	"oidc":       "config",
+	"ldap":       "config",
+	"cert":       "config",
+}
+
+// authWriteOnlyFields are method config fields Vault accepts but never
+// returns. They are left out of the current state and not compared.
+var authWriteOnlyFields = map[string]bool{
+	"token_reviewer_jwt": true,
+	"oidc_client_secret": true,
+	"bindpass":           true,
+	"client_tls_key":     true,
+}
+
+// authFields are the fields an auth task accepts in its data
+var authFields = map[string]bool{
+	"type":          true,
+	"description":   true,
+	"config":        true,
+	"options":       true,
+	"local":         true,
+	"seal_wrap":     true,
+	"method_config": true,
+	"moved_from":    true,
+}
+
+// authType handles tasks that enable, tune, configure and disable auth
+// methods. The task path is the mount, written as auth/<path>; data holds the
+// method type, description, config (the tune parameters, such as
+// default_lease_ttl) and method_config, which is written to the method's own
+// configuration endpoint, such as auth/kubernetes/config.
+type authType struct{}
+
+func (authType) validate(task Task) error {
+	if authMountPath(task.Path) == "" {
+		return fmt.Errorf("auth path must name a mount, such as auth/approle")
+	}
+	switch task.Method {
+	case "POST", "PUT":
+	case "DELETE":
+		if len(task.Data) > 0 {
+			return fmt.Errorf("data is not supported by auth DELETE")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported auth method: %s", task.Method)
+	}
+
+	for field := range task.Data {
+		if !authFields[field] {
+			return fmt.Errorf("unknown auth field %q", field)
+		}
+	}
+	methodType := stringField(task.Data, "type")
+	if methodType == "" {
+		return fmt.Errorf("auth %s needs data.type", task.Method)
+	}
+	if _, ok := task.Data["moved_from"]; ok {
+		from := authMovedFromPath(task.Data)
+		if from == "" {
+			return fmt.Errorf("auth moved_from must be the previous path of the method, such as auth/approle")
+		}
+		if from == authMountPath(task.Path) {
+			return fmt.Errorf("auth moved_from must differ from the mount path")
+		}
+	}
+	if task.Data["config"] != nil && stringKeyMap(task.Data["config"]) == nil {
+		return fmt.Errorf("auth config must be a map")
+	}
+	if task.Data["method_config"] != nil {
+		if stringKeyMap(task.Data["method_config"]) == nil {
+			return fmt.Errorf("auth method_config must be a map")
+		}
+		if _, ok := authConfigEndpoints[methodType]; !ok {
+			return fmt.Errorf("auth type %s has no configuration endpoint", methodType)
+		}
+	}
+	return nil
+}
+
+func (authType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	mountPath := authMountPath(task.Path)
+	current, err := m.authMount(ctx, task.Namespace, mountPath)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := func(method, p string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Path, t.Data, t.Replace = method, p, data, false
+		return t
+	}
+	sysPath := path.Join("sys/auth", mountPath)
+
+	if task.Method == "DELETE" {
+		if current == nil {
+			return nil, nil
+		}
+		return []Task{raw("DELETE", sysPath, nil)}, nil
+	}
+
+	var tasks []Task
+	if from := authMovedFromPath(task.Data); current == nil && from != "" {
+		current, err = m.authMount(ctx, task.Namespace, from)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil {
+			tasks = append(tasks, remountTask(task, "auth/"+from, "auth/"+mountPath))
+		}
+	}
+
+	methodType := stringField(task.Data, "type")
+	switch {
+	case current == nil:
+		tasks = append(tasks, raw("POST", sysPath, authEnableData(task.Data)))
+	case stringField(current, "type") != methodType:
+		if !task.Replace {
+			return nil, fmt.Errorf("auth/%s is a %s method, the task wants %s; set replace: true to disable and re-enable it, which deletes its roles and configuration",
+				mountPath, stringField(current, "type"), methodType)
+		}
+		tasks = append(tasks,
+			raw("DELETE", sysPath, nil),
+			raw("POST", sysPath, authEnableData(task.Data)))
+	default:
+		if tune := authTuneData(task.Data); len(tune) > 0 {
+			tasks = append(tasks, raw("POST", path.Join(sysPath, "tune"), tune))
+		}
+	}
+
+	if methodConfig := stringKeyMap(task.Data["method_config"]); methodConfig != nil {
+		tasks = append(tasks, raw("POST", path.Join("auth", mountPath, authConfigEndpoints[methodType]), methodConfig))
+	}
+	return tasks, nil
+}
+
+// authMountPath returns the mount path of an auth task path, accepting
+// auth/<path> and sys/auth/<path>
+func authMountPath(p string) string {
+	p = strings.Trim(p, "/")
+	p = strings.TrimPrefix(p, "sys/")
+	if !strings.HasPrefix(p, "auth/") {
+		return ""
+	}
+	return strings.TrimPrefix(p, "auth/")
+}
+
+// authMount returns the current settings of an enabled auth method, or nil if
+// nothing is mounted at the path
+func (m *MigrationRunner) authMount(ctx context.Context, namespace, mountPath string) (map[string]interface{}, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, fmt.Errorf("cannot list auth methods without Vault client")
+	}
+
+	secret, err := client.Logical().ReadWithContext(ctx, "sys/auth")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list auth methods: %w", err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	return stringKeyMap(secret.Data[mountPath+"/"]), nil
+}
+
+// authMovedFromPath returns the previous mount path in data.moved_from,
+// written as auth/<path>
+func authMovedFromPath(data map[string]interface{}) string {
+	return authMountPath(stringField(data, "moved_from"))
+}
+
+// authEnableData returns the body of a sys/auth/<path> request
+func authEnableData(data map[string]interface{}) map[string]interface{} {
+	enable := make(map[string]interface{})
+	for _, field := range []string{"type", "description", "config", "options", "local", "seal_wrap"} {
+		if value, ok := data[field]; ok {
+			enable[field] = stringKeys(value)
+		}
+	}
+	return enable
+}
+
+// authTuneData returns the body of a sys/auth/<path>/tune request. Type,
+// local and seal_wrap cannot be changed after the method is enabled.
+func authTuneData(data map[string]interface{}) map[string]interface{} {
+	tune := make(map[string]interface{})
+	for field, value := range stringKeyMap(data["config"]) {
+		tune[field] = value
+	}
+	if description, ok := data["description"]; ok {
+		tune["description"] = description
+	}
+	if options, ok := data["options"]; ok {
+		tune["options"] = stringKeys(options)
+	}
+	return tune
+}
+
+// authTaskFromDiff converts a difference in an auth method, written in the
+// desired state as auth/<path> with a type, into an auth task
+func authTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	mountPath := authMountPath(diff.Path)
+	if mountPath == "" || strings.Contains(mountPath, "/") {
+		return Task{}, false
+	}
+	value := diff.NewValue
+	if value == nil {
+		value = diff.OldValue
+	}
+	if stringField(stringKeyMap(value), "type") == "" {
+		return Task{}, false
+	}
+
+	task := Task{Type: "auth", Path: "auth/" + mountPath, Method: method}
+	if method != "DELETE" {
+		task.Data = stringKeyMap(diff.NewValue)
+	}
+	return task, true
+}
+
+// authStateEqual compares the current state of an auth method with the
+// desired one. Only the config and method_config fields the desired state
+// sets are compared, apart from write-only ones, and durations match whether
+// they are written as seconds or as "1h".
+func authStateEqual(current, desired interface{}) bool {
+	have, want := stringKeyMap(current), stringKeyMap(desired)
+	if have == nil || want == nil {
+		return configValuesEqual(current, desired)
+	}
+	if stringField(have, "type") != stringField(want, "type") ||
+		stringField(have, "description") != stringField(want, "description") {
+		return false
+	}
+
+	haveConfig := stringKeyMap(have["config"])
+	for field, value := range stringKeyMap(want["config"]) {
+		if !configFieldEqual(haveConfig[field], value) {
+			return false
+		}
+	}
+	haveMethodConfig := stringKeyMap(have["method_config"])
+	for field, value := range stringKeyMap(want["method_config"]) {
+		if !authWriteOnlyFields[field] && !configFieldEqual(haveMethodConfig[field], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// configFieldEqual compares a mount config value, treating durations written
+// as seconds and as duration strings alike
+func configFieldEqual(current, desired interface{}) bool {
+	if a, ok := durationSeconds(current); ok {
+		if b, ok := durationSeconds(desired); ok {
+			return a == b
+		}
+	}
+	return configValuesEqual(current, desired)
+}
+
+// durationSeconds parses a TTL written as seconds or as a duration string,
+// which like in Vault may count days with a d suffix
+func durationSeconds(v interface{}) (int64, bool) {
+	s := fmt.Sprint(v)
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return seconds, true
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.ParseInt(days, 10, 64); err == nil {
+			return n * 24 * 60 * 60, true
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return int64(d / time.Second), true
+	}
+	return 0, false
+}
@@ -0,0 +1,208 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthType_Expand(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "sys/auth/approle", map[string]interface{}{"type": "approle"})
+	server.put("", "sys/auth/k8s", map[string]interface{}{"type": "jwt"})
+
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: t.TempDir()},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		task Task
+		want []Task
+	}{
+		{
+			name: "enable",
+			task: Task{Type: "auth", Method: "PUT", Path: "auth/userpass", Data: map[string]interface{}{
+				"type": "userpass", "description": "people", "local": true,
+			}},
+			want: []Task{
+				{Method: "POST", Path: "sys/auth/userpass", Data: map[string]interface{}{"type": "userpass", "description": "people", "local": true}},
+			},
+		},
+		{
+			name: "tune an enabled method",
+			task: Task{Type: "auth", Method: "PUT", Path: "auth/approle", Data: map[string]interface{}{
+				"type": "approle", "description": "apps", "local": true,
+				"config": map[string]interface{}{"default_lease_ttl": "1h"},
+			}},
+			want: []Task{
+				{Method: "POST", Path: "sys/auth/approle/tune", Data: map[string]interface{}{"default_lease_ttl": "1h", "description": "apps"}},
+			},
+		},
+		{
+			name: "enable and configure",
+			task: Task{Type: "auth", Method: "PUT", Path: "auth/kubernetes", Data: map[string]interface{}{
+				"type":          "kubernetes",
+				"method_config": map[string]interface{}{"kubernetes_host": "https://kubernetes.default.svc"},
+			}},
+			want: []Task{
+				{Method: "POST", Path: "sys/auth/kubernetes", Data: map[string]interface{}{"type": "kubernetes"}},
+				{Method: "POST", Path: "auth/kubernetes/config", Data: map[string]interface{}{"kubernetes_host": "https://kubernetes.default.svc"}},
+			},
+		},
+		{
+			name: "re-mount when the type changes",
+			task: Task{Type: "auth", Method: "PUT", Path: "auth/k8s", Replace: true, Data: map[string]interface{}{"type": "kubernetes"}},
+			want: []Task{
+				{Method: "DELETE", Path: "sys/auth/k8s"},
+				{Method: "POST", Path: "sys/auth/k8s", Data: map[string]interface{}{"type": "kubernetes"}},
+			},
+		},
+		{
+			name: "disable",
+			task: Task{Type: "auth", Method: "DELETE", Path: "auth/approle"},
+			want: []Task{{Method: "DELETE", Path: "sys/auth/approle"}},
+		},
+		{
+			name: "disable a method that is not enabled",
+			task: Task{Type: "auth", Method: "DELETE", Path: "auth/missing"},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, authType{}.validate(tt.task))
+			got, err := runner.expandType(ctx, tt.task)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = runner.expandType(ctx, Task{Type: "auth", Method: "PUT", Path: "auth/k8s", Data: map[string]interface{}{"type": "kubernetes"}})
+	assert.ErrorContains(t, err, "set replace: true", "changing the type should need replace")
+}
+
+func TestAuthType_Validate(t *testing.T) {
+	invalid := []Task{
+		{Type: "auth", Method: "PUT", Path: "secret/app", Data: map[string]interface{}{"type": "approle"}},
+		{Type: "auth", Method: "PUT", Path: "auth/approle", Data: map[string]interface{}{"description": "no type"}},
+		{Type: "auth", Method: "PUT", Path: "auth/approle", Data: map[string]interface{}{"type": "approle", "tune": map[string]interface{}{}}},
+		{Type: "auth", Method: "PUT", Path: "auth/approle", Data: map[string]interface{}{"type": "approle", "method_config": map[string]interface{}{"a": 1}}},
+		{Type: "auth", Method: "DELETE", Path: "auth/approle", Data: map[string]interface{}{"type": "approle"}},
+		{Type: "auth", Method: "PATCH", Path: "auth/approle", Data: map[string]interface{}{"type": "approle"}},
+		{Method: "PUT", Path: "auth/approle", Replace: true},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestMigrationRunner_AuthTasks(t *testing.T) {
+	server := newTestVaultServer(t)
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{Type: "auth", Method: "PUT", Path: "auth/approle", Data: map[string]interface{}{
+					"type":   "approle",
+					"config": map[string]interface{}{"default_lease_ttl": "1h"},
+				}},
+				{Path: "auth/approle/role/app", Method: "POST", Data: map[string]interface{}{"token_ttl": "1h"}},
+			},
+		},
+		{
+			Version: 2,
+			Tasks: []Task{
+				{Type: "auth", Method: "PUT", Path: "auth/approle", Data: map[string]interface{}{
+					"type":   "approle",
+					"config": map[string]interface{}{"default_lease_ttl": "2h"},
+				}},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir, Snapshots: true},
+		})
+		require.NoError(t, err)
+		require.NoError(t, runner.RunMigrations(context.Background()))
+	})
+
+	mount, ok := server.get("", "sys/auth/approle")
+	require.True(t, ok)
+	assert.Equal(t, "approle", mount["type"])
+	tune, ok := server.get("", "sys/auth/approle/tune")
+	require.True(t, ok, "the second migration should tune instead of re-enabling")
+	assert.Equal(t, "2h", tune["default_lease_ttl"])
+}
+
+func TestGenerateTasksFromDiffs_Auth(t *testing.T) {
+	current := map[string]interface{}{
+		"auth/approle": map[string]interface{}{
+			"type": "approle", "description": "",
+			"config": map[string]interface{}{"default_lease_ttl": 3600, "max_lease_ttl": 0},
+		},
+		"auth/old": map[string]interface{}{"type": "userpass", "description": ""},
+	}
+	desired := map[string]interface{}{
+		"auth/approle": map[interface{}]interface{}{
+			"type":   "approle",
+			"config": map[interface{}]interface{}{"default_lease_ttl": "1h"},
+		},
+		"auth/approle/role/app": map[interface{}]interface{}{"token_ttl": "1h"},
+		"auth/kubernetes": map[interface{}]interface{}{
+			"type": "kubernetes",
+		},
+	}
+
+	tasks := generateTasksFromDiffs(compareConfigs(current, desired))
+	orderTasks(tasks)
+
+	assert.Equal(t, []Task{
+		{Type: "auth", Method: "POST", Path: "auth/kubernetes", Data: map[string]interface{}{"type": "kubernetes"}},
+		{Method: "POST", Path: "auth/approle/role/app", Data: map[string]interface{}{"token_ttl": "1h"}},
+		{Type: "auth", Method: "DELETE", Path: "auth/old"},
+	}, tasks, "auth/approle is unchanged because 3600 seconds is 1h")
+}
+
+func TestGenerateTasksFromDiffs_AuthMethodConfig(t *testing.T) {
+	current := map[string]interface{}{
+		"auth/kubernetes": map[string]interface{}{
+			"type": "kubernetes", "description": "",
+			"method_config": map[string]interface{}{
+				"kubernetes_host":        "https://old.example.com",
+				"disable_iss_validation": true,
+			},
+		},
+	}
+	desired := func(host string) map[string]interface{} {
+		return map[string]interface{}{
+			"auth/kubernetes": map[interface{}]interface{}{
+				"type": "kubernetes",
+				"method_config": map[interface{}]interface{}{
+					"kubernetes_host":    host,
+					"token_reviewer_jwt": "write-only",
+				},
+			},
+		}
+	}
+
+	assert.Empty(t, generateTasksFromDiffs(compareConfigs(current, desired("https://old.example.com"))),
+		"write-only fields are not returned by Vault and not compared")
+
+	tasks := generateTasksFromDiffs(compareConfigs(current, desired("https://new.example.com")))
+	assert.Equal(t, []Task{{Type: "auth", Method: "PUT", Path: "auth/kubernetes", Data: map[string]interface{}{
+		"type": "kubernetes",
+		"method_config": map[string]interface{}{
+			"kubernetes_host":    "https://new.example.com",
+			"token_reviewer_jwt": "write-only",
+		},
+	}}}, tasks)
+}
@@ -0,0 +1,320 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// capabilitiesSelf asks Vault which capabilities the client's token has on
+// each path, in a single request
+func capabilitiesSelf(ctx context.Context, client *api.Client, paths []string) (map[string][]string, error) {
+	result := make(map[string][]string, len(paths))
+	if len(paths) == 0 {
+		return result, nil
+	}
+
+	secret, err := client.Logical().WriteWithContext(ctx, "sys/capabilities-self", map[string]interface{}{
+		"paths": paths,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query token capabilities: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("failed to query token capabilities: empty response")
+	}
+
+	for _, path := range paths {
+		raw, ok := secret.Data[path].([]interface{})
+		if !ok {
+			continue
+		}
+		capabilities := make([]string, 0, len(raw))
+		for _, c := range raw {
+			capabilities = append(capabilities, fmt.Sprint(c))
+		}
+		result[path] = capabilities
+	}
+	return result, nil
+}
+
+// hasCapability reports whether a capability list grants the given capability
+func hasCapability(capabilities []string, needed string) bool {
+	for _, c := range capabilities {
+		switch c {
+		case "deny":
+			return false
+		case "root", needed:
+			return true
+		}
+	}
+	return false
+}
+
+// MissingCapability is a capability a pending task needs but the token lacks.
+type MissingCapability struct {
+	Version      int      `json:"version,omitempty"`
+	Namespace    string   `json:"namespace,omitempty"`
+	Method       string   `json:"method,omitempty"`
+	Path         string   `json:"path"`
+	Needed       []string `json:"needed"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// PreflightError reports every missing capability found before applying.
+type PreflightError struct {
+	Missing []MissingCapability
+}
+
+func (e *PreflightError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "token lacks capabilities for %d paths:", len(e.Missing))
+	for _, missing := range e.Missing {
+		b.WriteString("\n  ")
+		if missing.Version > 0 {
+			fmt.Fprintf(&b, "migration %d: ", missing.Version)
+		}
+		if missing.Method != "" {
+			fmt.Fprintf(&b, "%s ", missing.Method)
+		}
+		b.WriteString(missing.Path)
+		if missing.Namespace != "" {
+			fmt.Fprintf(&b, " (namespace %s)", missing.Namespace)
+		}
+		fmt.Fprintf(&b, " needs %s, has [%s]", strings.Join(missing.Needed, " or "), strings.Join(missing.Capabilities, ", "))
+	}
+	return b.String()
+}
+
+// Policy renders the minimal ACL policy that grants the missing
+// capabilities. Policies are namespace scoped, so paths are grouped by
+// namespace with a comment heading each group.
+func (e *PreflightError) Policy() string {
+	grants := make(map[string]map[string][]string)
+	for _, missing := range e.Missing {
+		if grants[missing.Namespace] == nil {
+			grants[missing.Namespace] = make(map[string][]string)
+		}
+		grants[missing.Namespace][missing.Path] = uniqueStrings(append(grants[missing.Namespace][missing.Path], missing.Needed...))
+	}
+
+	namespaces := make([]string, 0, len(grants))
+	for namespace := range grants {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	var b strings.Builder
+	for _, namespace := range namespaces {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		if namespace != "" {
+			fmt.Fprintf(&b, "# Namespace: %s\n", namespace)
+		}
+
+		paths := make([]string, 0, len(grants[namespace]))
+		for path := range grants[namespace] {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			capabilities := grants[namespace][path]
+			sort.Strings(capabilities)
+			fmt.Fprintf(&b, "path %q {\n  capabilities = [%s]\n}\n", path, quoteJoin(capabilities))
+		}
+	}
+	return b.String()
+}
+
+// preflightCheck is one path and the capabilities that satisfy it
+type preflightCheck struct {
+	version   int
+	namespace string
+	method    string
+	path      string
+	anyOf     []string
+}
+
+// taskCapabilities returns the capabilities that allow a task to run. Vault
+// only requires "create" for new keys on paths with an existence check, and
+// the HTTP API treats POST and PUT alike, so both are satisfied by either
+// create or update. Read-only tasks need read, except LIST.
+func taskCapabilities(method string) []string {
+	switch method {
+	case "POST", "PUT":
+		return []string{"create", "update"}
+	case "PATCH":
+		return []string{"patch"}
+	case "DELETE":
+		return []string{"delete"}
+	case "LIST":
+		return []string{"list"}
+	case "READ", "ASSERT", "WAIT_FOR", "EXISTS", "ABSENT":
+		return []string{"read"}
+	default:
+		return []string{"update"}
+	}
+}
+
+// Preflight checks, with one sys/capabilities-self request per namespace, that
+// the token can run every task of the given migrations and update the version
+// tracking, history, snapshot and lock paths. It returns a *PreflightError listing every
+// missing capability.
+func (m *MigrationRunner) Preflight(ctx context.Context, migrations []Migration) error {
+	if m.client == nil {
+		return fmt.Errorf("cannot check capabilities without Vault client")
+	}
+	if len(migrations) == 0 {
+		return nil
+	}
+
+	lock := m.lockLocation(ctx)
+	checks := []preflightCheck{
+		{path: lock.path, anyOf: []string{"create", "update"}},
+		{path: lock.deletePath, anyOf: []string{"delete"}},
+	}
+	trackedNamespaces := make(map[string]bool)
+	ledgerNamespaces := false
+	for _, migration := range migrations {
+		if !trackedNamespaces[migration.Namespace] {
+			trackedNamespaces[migration.Namespace] = true
+			checks = append(checks, preflightCheck{namespace: migration.Namespace, path: m.trackingPath, anyOf: []string{"create", "update"}})
+			if migration.Namespace != "" && !ledgerNamespaces {
+				// The ledger namespaces are listed in the default namespace
+				ledgerNamespaces = true
+				checks = append(checks, preflightCheck{path: m.ledgerNamespacesPath(), anyOf: []string{"create", "update"}})
+			}
+		}
+		checks = append(checks, preflightCheck{
+			namespace: migration.Namespace,
+			path:      path.Join(m.historyPath(), strconv.Itoa(migration.Version)),
+			anyOf:     []string{"create", "update"},
+		})
+		if m.snapshots {
+			checks = append(checks, preflightCheck{
+				namespace: migration.Namespace,
+				path:      m.snapshotPath(migration.Version),
+				anyOf:     []string{"create", "update"},
+			})
+		}
+		for _, task := range m.preflightTasks(ctx, migration) {
+			namespace := task.Namespace
+			if task.ForEach != "" {
+				checks = append(checks, preflightCheck{
+					version:   migration.Version,
+					namespace: namespace,
+					method:    "LIST",
+					path:      task.ForEach,
+					anyOf:     []string{"list"},
+				})
+				continue
+			}
+			checks = append(checks, preflightCheck{
+				version:   migration.Version,
+				namespace: namespace,
+				method:    task.Method,
+				path:      task.Path,
+				anyOf:     taskCapabilities(task.Method),
+			})
+			// Snapshots read every path before it is modified
+			if m.snapshots && !isReadOnly(task.Method) {
+				checks = append(checks, preflightCheck{
+					version:   migration.Version,
+					namespace: namespace,
+					method:    "READ",
+					path:      task.Path,
+					anyOf:     []string{"read"},
+				})
+			}
+		}
+	}
+
+	paths := make(map[string][]string)
+	for _, check := range checks {
+		paths[check.namespace] = append(paths[check.namespace], check.path)
+	}
+	capabilities := make(map[string]map[string][]string, len(paths))
+	for namespace, nsPaths := range paths {
+		client, err := m.clientForNamespace(namespace)
+		if err != nil {
+			return err
+		}
+		nsCapabilities, err := capabilitiesSelf(ctx, client, uniqueStrings(nsPaths))
+		if err != nil {
+			return fmt.Errorf("namespace %q: %w", namespace, err)
+		}
+		capabilities[namespace] = nsCapabilities
+	}
+
+	preflightErr := &PreflightError{}
+	for _, check := range checks {
+		have := capabilities[check.namespace][check.path]
+		allowed := false
+		for _, capability := range check.anyOf {
+			if hasCapability(have, capability) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			preflightErr.Missing = append(preflightErr.Missing, MissingCapability{
+				Version:      check.version,
+				Namespace:    check.namespace,
+				Method:       check.method,
+				Path:         check.path,
+				Needed:       check.anyOf,
+				Capabilities: have,
+			})
+		}
+	}
+
+	if len(preflightErr.Missing) > 0 {
+		return preflightErr
+	}
+	return nil
+}
+
+// preflightTasks returns the raw tasks of a migration to check, with for_each
+// tasks expanded for the keys that exist now. Every for_each task is also
+// returned unexpanded, so the permission to list it is checked even when the
+// listing fails. Typed tasks that cannot be resolved yet, such as kv tasks on
+// a mount the migration creates, are left out.
+func (m *MigrationRunner) preflightTasks(ctx context.Context, migration Migration) []Task {
+	var tasks []Task
+	for _, task := range migration.Tasks {
+		task.Method = canonicalMethod(task.Method)
+		if task.Namespace == "" {
+			task.Namespace = migration.Namespace
+		}
+
+		candidates := []Task{task}
+		if task.ForEach != "" {
+			tasks = append(tasks, task)
+			candidates, _ = m.expandTask(ctx, task)
+		}
+		for _, candidate := range candidates {
+			expanded, err := m.expandType(ctx, candidate)
+			if err != nil {
+				m.logger.Warn().Err(err).Msg("Cannot resolve task, its capabilities are not checked")
+				continue
+			}
+			tasks = append(tasks, expanded...)
+		}
+	}
+	return tasks
+}
+
+// quoteJoin renders values as a comma-separated list of quoted strings
+func quoteJoin(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return strings.Join(quoted, ", ")
+}
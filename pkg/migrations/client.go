@@ -2,6 +2,7 @@ package migrations
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/hashicorp/vault/api"
 )
@@ -46,11 +47,94 @@ func (c *VaultClient) GetCurrentState() (map[string]interface{}, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to list auth methods: %w", err)
 	}
+	authPaths := make(map[string]string, len(auths))
 	for path, auth := range auths {
-		state[fmt.Sprintf("sys/auth/%s", path)] = map[string]interface{}{
+		authPaths[auth.Accessor] = strings.TrimSuffix(path, "/")
+		// The token method is always enabled and cannot be managed
+		if auth.Type == "token" {
+			continue
+		}
+		entry := map[string]interface{}{
 			"type":        auth.Type,
 			"description": auth.Description,
+			"config": map[string]interface{}{
+				"default_lease_ttl":  auth.Config.DefaultLeaseTTL,
+				"max_lease_ttl":      auth.Config.MaxLeaseTTL,
+				"listing_visibility": auth.Config.ListingVisibility,
+				"token_type":         auth.Config.TokenType,
+			},
+		}
+		// The method's own configuration, without the fields Vault never returns
+		if endpoint, ok := authConfigEndpoints[auth.Type]; ok {
+			configPath := fmt.Sprintf("auth/%s/%s", strings.TrimSuffix(path, "/"), endpoint)
+			secret, err := c.client.Logical().Read(configPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", configPath, err)
+			}
+			if secret != nil {
+				methodConfig := make(map[string]interface{}, len(secret.Data))
+				for field, value := range secret.Data {
+					if !authWriteOnlyFields[field] {
+						methodConfig[field] = value
+					}
+				}
+				entry["method_config"] = methodConfig
+			}
+		}
+		state["auth/"+strings.TrimSuffix(path, "/")] = entry
+	}
+
+	// Get audit devices
+	audits, err := c.client.Sys().ListAudit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit devices: %w", err)
+	}
+	for path, audit := range audits {
+		state["sys/audit/"+strings.TrimSuffix(path, "/")] = map[string]interface{}{
+			"type":        audit.Type,
+			"description": audit.Description,
+			"options":     audit.Options,
+			"local":       audit.Local,
+		}
+	}
+
+	// Get registered plugins; builtin plugins are part of Vault
+	plugins, err := c.client.Sys().ListPlugins(&api.ListPluginsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list plugins: %w", err)
+	}
+	for _, plugin := range plugins.Details {
+		if plugin.Builtin {
+			continue
+		}
+		path := fmt.Sprintf("sys/plugins/catalog/%s/%s", plugin.Type, plugin.Name)
+		pluginType, err := api.ParsePluginType(plugin.Type)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get plugin %s: %w", path, err)
+		}
+		registered, err := c.client.Sys().GetPlugin(&api.GetPluginInput{
+			Name:    plugin.Name,
+			Type:    pluginType,
+			Version: plugin.Version,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get plugin %s: %w", path, err)
+		}
+		// Of several registered versions, the newest is kept
+		if existing := stringKeyMap(state[path]); existing != nil && pluginVersionLess(plugin.Version, stringField(existing, "version")) {
+			continue
+		}
+		entry := map[string]interface{}{
+			"sha256":  registered.SHA256,
+			"command": registered.Command,
 		}
+		if len(registered.Args) > 0 {
+			entry["args"] = registered.Args
+		}
+		if plugin.Version != "" {
+			entry["version"] = plugin.Version
+		}
+		state[path] = entry
 	}
 
 	// Get policies
@@ -59,28 +143,259 @@ func (c *VaultClient) GetCurrentState() (map[string]interface{}, error) {
 		return nil, fmt.Errorf("failed to list policies: %w", err)
 	}
 	for _, name := range policies {
+		// The root policy cannot be read or changed
+		if name == "root" {
+			continue
+		}
 		policy, err := c.client.Sys().GetPolicy(name)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get policy %s: %w", name, err)
 		}
-		state[fmt.Sprintf("sys/policy/%s", name)] = map[string]interface{}{
+		state[fmt.Sprintf("sys/policies/acl/%s", name)] = map[string]interface{}{
 			"policy": policy,
 		}
 	}
 
+	// Sentinel policies only exist on Vault Enterprise; elsewhere listing
+	// them fails and they are left out
+	for _, kind := range []string{"rgp", "egp"} {
+		list, err := c.client.Logical().List("sys/policies/" + kind)
+		if err != nil || list == nil {
+			continue
+		}
+		keys, _ := list.Data["keys"].([]interface{})
+		for _, key := range keys {
+			endpoint := fmt.Sprintf("sys/policies/%s/%v", kind, key)
+			secret, err := c.client.Logical().Read(endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get policy %s: %w", endpoint, err)
+			}
+			if secret == nil {
+				continue
+			}
+			entry := map[string]interface{}{
+				"policy":            secret.Data["policy"],
+				"enforcement_level": secret.Data["enforcement_level"],
+			}
+			if kind == "egp" {
+				entry["paths"] = secret.Data["paths"]
+			}
+			state[endpoint] = entry
+		}
+	}
+
+	// Get quotas; lease count quotas only exist on Vault Enterprise and are
+	// left out where listing them fails
+	for _, kind := range []string{"rate-limit", "lease-count"} {
+		list, err := c.client.Logical().List("sys/quotas/" + kind)
+		if err != nil {
+			if kind == "rate-limit" {
+				return nil, fmt.Errorf("failed to list rate limit quotas: %w", err)
+			}
+			continue
+		}
+		if list == nil {
+			continue
+		}
+		keys, _ := list.Data["keys"].([]interface{})
+		for _, key := range keys {
+			path := fmt.Sprintf("sys/quotas/%s/%v", kind, key)
+			secret, err := c.client.Logical().Read(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			if secret == nil {
+				continue
+			}
+			entry := make(map[string]interface{})
+			for field := range quotaFields[kind] {
+				if value, ok := secret.Data[field]; ok && field != "mount" && value != "" {
+					entry[field] = value
+				}
+			}
+			state[path] = entry
+		}
+	}
+
 	// Get mounts
 	mounts, err := c.client.Sys().ListMounts()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list mounts: %w", err)
 	}
 	for path, mount := range mounts {
+		if systemMountTypes[mount.Type] {
+			continue
+		}
 		state[fmt.Sprintf("sys/mounts/%s", path)] = map[string]interface{}{
 			"type":        mount.Type,
 			"description": mount.Description,
-			"config":      mount.Config,
-			"options":     mount.Options,
+			"config": map[string]interface{}{
+				"default_lease_ttl":  mount.Config.DefaultLeaseTTL,
+				"max_lease_ttl":      mount.Config.MaxLeaseTTL,
+				"force_no_cache":     mount.Config.ForceNoCache,
+				"listing_visibility": mount.Config.ListingVisibility,
+			},
+			"options": mount.Options,
 		}
+		if mount.Type == "database" {
+			if err := c.databaseState(path, state); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := c.identityState(authPaths, state); err != nil {
+		return nil, err
 	}
 
 	return state, nil
 }
+
+// identityState adds the entities, groups and their aliases to state, by name
+// rather than by ID. Members are listed by name, and aliases name their auth
+// mount by path; authPaths maps mount accessors to paths.
+func (c *VaultClient) identityState(authPaths map[string]string, state map[string]interface{}) error {
+	names := make(map[string]map[string]string)
+	for _, kind := range []string{"entity", "group"} {
+		list, err := c.client.Logical().List("identity/" + kind + "/id")
+		if err != nil {
+			return fmt.Errorf("failed to list identity %s: %w", kind, err)
+		}
+		names[kind] = map[string]string{}
+		if list != nil {
+			keyInfo, _ := list.Data["key_info"].(map[string]interface{})
+			names[kind] = identityNames(keyInfo)
+		}
+	}
+
+	alias := func(kind, owner string, data interface{}) {
+		fields := stringKeyMap(data)
+		name := stringField(fields, "name")
+		mount, ok := authPaths[stringField(fields, "mount_accessor")]
+		if name == "" || !ok {
+			return
+		}
+		entry := map[string]interface{}{"mount": mount, strings.TrimSuffix(kind, "-alias"): owner}
+		if metadata := stringKeyMap(fields["custom_metadata"]); len(metadata) > 0 {
+			entry["custom_metadata"] = metadata
+		}
+		state[fmt.Sprintf("identity/%s/name/%s", kind, name)] = entry
+	}
+
+	for _, kind := range []string{"entity", "group"} {
+		for _, name := range names[kind] {
+			path := fmt.Sprintf("identity/%s/name/%s", kind, name)
+			secret, err := c.client.Logical().Read(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			if secret == nil {
+				continue
+			}
+			entry := map[string]interface{}{
+				"policies": emptyList(secret.Data["policies"]),
+			}
+			if metadata := stringKeyMap(secret.Data["metadata"]); len(metadata) > 0 {
+				entry["metadata"] = metadata
+			}
+			if kind == "entity" {
+				entry["disabled"] = secret.Data["disabled"]
+				aliases, _ := secret.Data["aliases"].([]interface{})
+				for _, a := range aliases {
+					alias("entity-alias", name, a)
+				}
+			} else {
+				entry["type"] = secret.Data["type"]
+				if secret.Data["type"] != "external" {
+					entry["member_entities"] = namesForIDs(secret.Data["member_entity_ids"], names["entity"])
+					entry["member_groups"] = namesForIDs(secret.Data["member_group_ids"], names["group"])
+				}
+				alias("group-alias", name, secret.Data["alias"])
+			}
+			state[path] = entry
+		}
+	}
+	return nil
+}
+
+// databaseState adds the connections and roles of a database mount to state.
+// Connection details are flattened into the connection, the shape they are
+// written in; passwords are never returned by Vault.
+func (c *VaultClient) databaseState(mount string, state map[string]interface{}) error {
+	for _, kind := range []string{"config", "roles", "static-roles"} {
+		list, err := c.client.Logical().List(mount + kind)
+		if err != nil {
+			return fmt.Errorf("failed to list %s%s: %w", mount, kind, err)
+		}
+		if list == nil {
+			continue
+		}
+		keys, _ := list.Data["keys"].([]interface{})
+		for _, key := range keys {
+			path := fmt.Sprintf("%s%s/%v", mount, kind, key)
+			secret, err := c.client.Logical().Read(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			if secret == nil {
+				continue
+			}
+			entry := make(map[string]interface{}, len(secret.Data))
+			for field, value := range secret.Data {
+				if field == "connection_details" {
+					details, _ := value.(map[string]interface{})
+					for detail, detailValue := range details {
+						entry[detail] = detailValue
+					}
+					continue
+				}
+				entry[field] = value
+			}
+			state[path] = entry
+		}
+	}
+	return nil
+}
+
+// GetKVState reads the KV version 2 secrets the desired state names as
+// <mount>/data/<path>. Their data is returned as its fingerprint, so the
+// state never holds the values, and their metadata with the fields that can
+// be written. Secrets that do not exist are left out.
+func (c *VaultClient) GetKVState(desired map[string]interface{}) (map[string]interface{}, error) {
+	state := make(map[string]interface{})
+	for path, value := range desired {
+		if !isKVEntry(path, value) {
+			continue
+		}
+		entry := make(map[string]interface{})
+
+		secret, err := c.client.Logical().Read(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if secret != nil && secret.Data["data"] != nil {
+			entry["data"] = kvDataFingerprint(secret.Data["data"])
+		}
+
+		parts := strings.SplitN(path, "/", 3)
+		metadataPath := parts[0] + "/metadata/" + parts[2]
+		metadata, err := c.client.Logical().Read(metadataPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", metadataPath, err)
+		}
+		if metadata != nil {
+			fields := make(map[string]interface{}, len(kvMetadataFields))
+			for _, field := range kvMetadataFields {
+				if v := metadata.Data[field]; v != nil {
+					fields[field] = v
+				}
+			}
+			entry["metadata"] = fields
+		}
+
+		if len(entry) > 0 {
+			state[path] = entry
+		}
+	}
+	return state, nil
+}
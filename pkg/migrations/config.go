@@ -10,28 +10,64 @@ import (
 
 // VaultConfig holds Vault-specific configuration
 type VaultConfig struct {
-	Address     string `yaml:"address"`
-	Token       string `yaml:"token"`
-	AuthMethod  string `yaml:"auth_method,omitempty"`
-	Role        string `yaml:"role,omitempty"`
-	Namespace   string `yaml:"namespace,omitempty"`
-	MaxRetries  int    `yaml:"max_retries,omitempty"`
-	RetryDelay  string `yaml:"retry_delay,omitempty"`
+	Address    string `yaml:"address"`
+	Token      string `yaml:"token"`
+	AuthMethod string `yaml:"auth_method,omitempty"`
+	Role       string `yaml:"role,omitempty"`
+	Namespace  string `yaml:"namespace,omitempty"`
+	MaxRetries int    `yaml:"max_retries,omitempty"`
+	RetryDelay string `yaml:"retry_delay,omitempty"`
 }
 
 // MigrationsConfig holds migration-specific configuration
 type MigrationsConfig struct {
-	Directory        string `yaml:"directory"`
+	Directory       string `yaml:"directory"`
 	ConcurrentTasks bool   `yaml:"concurrent_tasks,omitempty"`
 	StopOnError     bool   `yaml:"stop_on_error,omitempty"`
+	SkipPreflight   bool   `yaml:"skip_preflight,omitempty"`
+	// LockPath is where the migration lock is kept; on a KV version 2 mount
+	// it is taken with check-and-set
+	LockPath string `yaml:"lock_path,omitempty"`
+	// LockHolder names this run in the lock and the history ledger, such
+	// as a CI job; empty uses the host name and process ID
+	LockHolder string `yaml:"lock_holder,omitempty"`
+	// Snapshots and AutoRestore are opt-in, as snapshots store the prior
+	// value of every path in Vault, KV secret values included
+	Snapshots   bool `yaml:"snapshots,omitempty"`
+	AutoRestore bool `yaml:"auto_restore,omitempty"`
+	// VerifyConnections sets verify_connection on database connection
+	// writes that do not set it themselves; unset leaves Vault's default
+	VerifyConnections *bool `yaml:"verify_connections,omitempty"`
 }
 
+// TargetConfig describes one Vault cluster in a multi-cluster apply. Unset
+// Vault fields are inherited from the top-level vault section.
+type TargetConfig struct {
+	Name   string      `yaml:"name"`
+	Canary bool        `yaml:"canary,omitempty"`
+	Vault  VaultConfig `yaml:"vault"`
+}
+
+// FanOutConfig controls how migrations are applied across targets
+type FanOutConfig struct {
+	Mode        string `yaml:"mode,omitempty"`
+	Parallelism int    `yaml:"parallelism,omitempty"`
+}
+
+// Fan-out modes
+const (
+	FanOutParallel = "parallel"
+	FanOutSerial   = "serial"
+)
+
 // Config holds the complete configuration
 type Config struct {
 	Vault      VaultConfig      `yaml:"vault"`
 	Migrations MigrationsConfig `yaml:"migrations"`
-	LogLevel   string          `yaml:"log_level,omitempty"`
-	DryRun     bool           `yaml:"dry_run,omitempty"`
+	Targets    []TargetConfig   `yaml:"targets,omitempty"`
+	FanOut     FanOutConfig     `yaml:"fan_out,omitempty"`
+	LogLevel   string           `yaml:"log_level,omitempty"`
+	DryRun     bool             `yaml:"dry_run,omitempty"`
 }
 
 // LoadConfig loads configuration from a YAML file
@@ -46,6 +82,10 @@ func LoadConfig(configPath string) (*Config, error) {
 			ConcurrentTasks: true,
 			StopOnError:     true,
 		},
+		FanOut: FanOutConfig{
+			Mode:        FanOutParallel,
+			Parallelism: 4,
+		},
 		LogLevel: "info",
 	}
 
@@ -65,6 +105,13 @@ func LoadConfig(configPath string) (*Config, error) {
 	config.Vault.Token = interpolateEnv(config.Vault.Token)
 	config.Vault.Role = interpolateEnv(config.Vault.Role)
 	config.Vault.Namespace = interpolateEnv(config.Vault.Namespace)
+	for i := range config.Targets {
+		target := &config.Targets[i].Vault
+		target.Address = interpolateEnv(target.Address)
+		target.Token = interpolateEnv(target.Token)
+		target.Role = interpolateEnv(target.Role)
+		target.Namespace = interpolateEnv(target.Namespace)
+	}
 
 	// Validate configuration
 	if err := config.Validate(false); err != nil {
@@ -89,12 +136,18 @@ func (c *Config) Validate(isGenerateOnly bool) error {
 	}
 
 	// For other modes, validate Vault configuration
-	if c.Vault.Address == "" {
-		return fmt.Errorf("vault address is required")
-	}
+	if len(c.Targets) > 0 {
+		if err := c.validateTargets(); err != nil {
+			return err
+		}
+	} else {
+		if c.Vault.Address == "" {
+			return fmt.Errorf("vault address is required")
+		}
 
-	if c.Vault.AuthMethod == "" && c.Vault.Token == "" {
-		return fmt.Errorf("either vault token or auth method is required")
+		if c.Vault.AuthMethod == "" && c.Vault.Token == "" {
+			return fmt.Errorf("either vault token or auth method is required")
+		}
 	}
 
 	if c.Migrations.Directory == "" {
@@ -109,6 +162,67 @@ func (c *Config) Validate(isGenerateOnly bool) error {
 	return nil
 }
 
+// validateTargets checks the multi-cluster target list and fan-out settings
+func (c *Config) validateTargets() error {
+	switch c.FanOut.Mode {
+	case "", FanOutParallel, FanOutSerial:
+	default:
+		return fmt.Errorf("invalid fan-out mode: %s", c.FanOut.Mode)
+	}
+	if c.FanOut.Parallelism < 0 {
+		return fmt.Errorf("fan-out parallelism must not be negative")
+	}
+
+	seen := make(map[string]bool)
+	for i, target := range c.Targets {
+		if target.Name == "" {
+			return fmt.Errorf("target %d: name is required", i)
+		}
+		if seen[target.Name] {
+			return fmt.Errorf("duplicate target name: %s", target.Name)
+		}
+		seen[target.Name] = true
+
+		vault := c.TargetVaultConfig(target)
+		if vault.Address == "" {
+			return fmt.Errorf("target %s: vault address is required", target.Name)
+		}
+		if vault.AuthMethod == "" && vault.Token == "" {
+			return fmt.Errorf("target %s: either vault token or auth method is required", target.Name)
+		}
+	}
+
+	return nil
+}
+
+// TargetVaultConfig returns the Vault configuration for a target, filling
+// unset fields from the top-level vault section
+func (c *Config) TargetVaultConfig(target TargetConfig) VaultConfig {
+	vault := target.Vault
+	if vault.Address == "" {
+		vault.Address = c.Vault.Address
+	}
+	if vault.Token == "" {
+		vault.Token = c.Vault.Token
+	}
+	if vault.AuthMethod == "" {
+		vault.AuthMethod = c.Vault.AuthMethod
+	}
+	if vault.Role == "" {
+		vault.Role = c.Vault.Role
+	}
+	if vault.Namespace == "" {
+		vault.Namespace = c.Vault.Namespace
+	}
+	if vault.MaxRetries == 0 {
+		vault.MaxRetries = c.Vault.MaxRetries
+	}
+	if vault.RetryDelay == "" {
+		vault.RetryDelay = c.Vault.RetryDelay
+	}
+	return vault
+}
+
 // interpolateEnv replaces environment variables in the format ${VAR} or $VAR
 func interpolateEnv(value string) string {
 	if value == "" {
@@ -10,6 +10,7 @@ import (
 )
 
 func TestLoadConfig(t *testing.T) {
+	migrationsDir := t.TempDir()
 	// Create temporary directory for test config
 	tmpDir, err := os.MkdirTemp("", "vault-migrations-config-test")
 	require.NoError(t, err)
@@ -26,7 +27,7 @@ vault:
   retry_delay: "1s"
 
 migrations:
-  directory: "./migrations"
+  directory: "` + migrationsDir + `"
   concurrent_tasks: true
   stop_on_error: true
 
@@ -52,14 +53,17 @@ dry_run: false
 	assert.Equal(t, "test-namespace", config.Vault.Namespace)
 	assert.Equal(t, 3, config.Vault.MaxRetries)
 	assert.Equal(t, "1s", config.Vault.RetryDelay)
-	assert.Equal(t, "./migrations", config.Migrations.Directory)
+	assert.Equal(t, migrationsDir, config.Migrations.Directory)
 	assert.True(t, config.Migrations.ConcurrentTasks)
 	assert.True(t, config.Migrations.StopOnError)
+	assert.False(t, config.Migrations.Snapshots)
+	assert.False(t, config.Migrations.AutoRestore)
 	assert.Equal(t, "info", config.LogLevel)
 	assert.False(t, config.DryRun)
 }
 
 func TestLoadConfig_Validation(t *testing.T) {
+	migrationsDir := t.TempDir()
 	tests := []struct {
 		name        string
 		config      string
@@ -72,7 +76,7 @@ vault:
   address: "http://vault:8200"
   token: "test-token"
 migrations:
-  directory: "./migrations"
+  directory: "` + migrationsDir + `"
 `,
 			expectError: false,
 		},
@@ -82,7 +86,7 @@ migrations:
 vault:
   token: "test-token"
 migrations:
-  directory: "./migrations"
+  directory: "` + migrationsDir + `"
 `,
 			expectError: true,
 		},
@@ -92,7 +96,7 @@ migrations:
 vault:
   address: "http://vault:8200"
 migrations:
-  directory: "./migrations"
+  directory: "` + migrationsDir + `"
 `,
 			expectError: true,
 		},
@@ -130,6 +134,7 @@ vault:
 }
 
 func TestConfig_EnvironmentInterpolation(t *testing.T) {
+	migrationsDir := t.TempDir()
 	// Set test environment variables
 	os.Setenv("TEST_VAULT_ADDR", "http://test-vault:8200")
 	os.Setenv("TEST_VAULT_TOKEN", "test-token-123")
@@ -147,7 +152,7 @@ vault:
   token: "${TEST_VAULT_TOKEN}"
   namespace: "${TEST_VAULT_NAMESPACE}"
 migrations:
-  directory: "./migrations"
+  directory: "` + migrationsDir + `"
 `
 	tmpDir, err := os.MkdirTemp("", "vault-migrations-config-test")
 	require.NoError(t, err)
@@ -168,13 +173,14 @@ migrations:
 }
 
 func TestConfig_DefaultValues(t *testing.T) {
+	migrationsDir := t.TempDir()
 	// Create minimal config
 	configContent := `
 vault:
   address: "http://vault:8200"
   token: "test-token"
 migrations:
-  directory: "./migrations"
+  directory: "` + migrationsDir + `"
 `
 	tmpDir, err := os.MkdirTemp("", "vault-migrations-config-test")
 	require.NoError(t, err)
@@ -193,6 +199,34 @@ migrations:
 	assert.Equal(t, "1s", config.Vault.RetryDelay)
 	assert.True(t, config.Migrations.ConcurrentTasks)
 	assert.True(t, config.Migrations.StopOnError)
+	assert.False(t, config.Migrations.Snapshots)
+	assert.False(t, config.Migrations.AutoRestore)
 	assert.Equal(t, "info", config.LogLevel)
 	assert.False(t, config.DryRun)
 }
+
+func TestConfig_Targets(t *testing.T) {
+	config := &Config{
+		Vault: VaultConfig{Token: "shared-token", Namespace: "admin"},
+		Targets: []TargetConfig{
+			{Name: "eu", Vault: VaultConfig{Address: "https://vault.eu:8200"}},
+			{Name: "us", Vault: VaultConfig{Address: "https://vault.us:8200", Token: "us-token"}},
+		},
+	}
+	require.NoError(t, config.validateTargets())
+
+	eu := config.TargetVaultConfig(config.Targets[0])
+	assert.Equal(t, "https://vault.eu:8200", eu.Address)
+	assert.Equal(t, "shared-token", eu.Token)
+	assert.Equal(t, "admin", eu.Namespace)
+
+	us := config.TargetVaultConfig(config.Targets[1])
+	assert.Equal(t, "us-token", us.Token)
+
+	config.Targets = append(config.Targets, TargetConfig{Name: "eu", Vault: VaultConfig{Address: "https://other:8200"}})
+	assert.Error(t, config.validateTargets())
+
+	config.Targets = config.Targets[:2]
+	config.FanOut.Mode = "random"
+	assert.Error(t, config.validateTargets())
+}
@@ -0,0 +1,261 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// databaseWriteOnlyFields are connection fields Vault accepts but never
+// returns, so they cannot be compared with the current state
+var databaseWriteOnlyFields = map[string]bool{
+	"password":            true,
+	"private_key":         true,
+	"tls_certificate_key": true,
+}
+
+// databaseIgnoredFields are connection fields that only affect the write
+// itself and are left out of comparisons
+var databaseIgnoredFields = map[string]bool{
+	"verify_connection": true,
+	"rotate_root":       true,
+}
+
+// fingerprintPrefix marks a write-only value replaced by its fingerprint
+const fingerprintPrefix = "sha256:"
+
+// databaseType handles tasks on database secrets engines. The task path is a
+// connection, <mount>/config/<name>, or a role, <mount>/roles/<name> or
+// <mount>/static-roles/<name>. Connections accept rotate_root: true, which
+// rotates the root credentials right after the connection is created; an
+// existing connection with rotate_root is updated without its write-only
+// fields, so the rotated password is kept.
+type databaseType struct{}
+
+// databaseResource is what a database task path names
+type databaseResource struct {
+	mount string
+	// kind is config, roles or static-roles
+	kind string
+	name string
+}
+
+func (databaseType) validate(task Task) error {
+	resource, ok := parseDatabasePath(task.Path)
+	if !ok {
+		return fmt.Errorf("database path must be <mount>/config/<name>, <mount>/roles/<name> or <mount>/static-roles/<name>")
+	}
+	switch task.Method {
+	case "POST", "PUT":
+	case "DELETE":
+		if len(task.Data) > 0 {
+			return fmt.Errorf("data is not supported by database DELETE")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported database method: %s", task.Method)
+	}
+
+	switch resource.kind {
+	case "config":
+		if stringField(task.Data, "plugin_name") == "" {
+			return fmt.Errorf("database connection needs data.plugin_name")
+		}
+		for _, field := range []string{"verify_connection", "rotate_root"} {
+			if _, ok := task.Data[field].(bool); task.Data[field] != nil && !ok {
+				return fmt.Errorf("database %s must be true or false", field)
+			}
+		}
+	default:
+		if stringField(task.Data, "db_name") == "" {
+			return fmt.Errorf("database role needs data.db_name")
+		}
+		if task.Data["rotate_root"] != nil {
+			return fmt.Errorf("rotate_root is only supported by database connections")
+		}
+	}
+	return nil
+}
+
+func (databaseType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	resource, _ := parseDatabasePath(task.Path)
+	raw := func(method, p string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Path, t.Data = method, p, data
+		return t
+	}
+	if task.Method == "DELETE" {
+		return []Task{raw("DELETE", task.Path, nil)}, nil
+	}
+	if resource.kind != "config" {
+		return []Task{raw("POST", task.Path, task.Data)}, nil
+	}
+
+	exists, err := m.pathExists(ctx, task.Namespace, task.Path)
+	if err != nil {
+		return nil, err
+	}
+	rotate, _ := task.Data["rotate_root"].(bool)
+
+	request := make(map[string]interface{})
+	for field, value := range task.Data {
+		if field == "rotate_root" || (exists && rotate && databaseWriteOnlyFields[field]) {
+			continue
+		}
+		request[field] = value
+	}
+	if _, ok := request["verify_connection"]; !ok && m.verifyConnections != nil {
+		request["verify_connection"] = *m.verifyConnections
+	}
+
+	tasks := []Task{raw("POST", task.Path, request)}
+	if rotate && !exists {
+		tasks = append(tasks, raw("POST", path.Join(resource.mount, "rotate-root", resource.name), nil))
+	}
+	return tasks, nil
+}
+
+// parseDatabasePath splits a database task path into its mount and resource
+func parseDatabasePath(p string) (databaseResource, bool) {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	n := len(segments)
+	if n < 3 || segments[n-1] == "" {
+		return databaseResource{}, false
+	}
+	switch segments[n-2] {
+	case "config", "roles", "static-roles":
+		return databaseResource{mount: strings.Join(segments[:n-2], "/"), kind: segments[n-2], name: segments[n-1]}, true
+	default:
+		return databaseResource{}, false
+	}
+}
+
+// isDatabaseEntry reports whether a desired state entry is a database
+// connection or role: a connection has a plugin_name, a role a db_name
+func isDatabaseEntry(p string, value interface{}) bool {
+	resource, ok := parseDatabasePath(p)
+	if !ok {
+		return false
+	}
+	fields := stringKeyMap(value)
+	if resource.kind == "config" {
+		return stringField(fields, "plugin_name") != ""
+	}
+	return stringField(fields, "db_name") != ""
+}
+
+// databaseTaskFromDiff converts a difference in a database connection or
+// role into a database task
+func databaseTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	value := diff.NewValue
+	if value == nil {
+		value = diff.OldValue
+	}
+	if !isDatabaseEntry(diff.Path, value) {
+		return Task{}, false
+	}
+	task := Task{Type: "database", Path: diff.Path, Method: method}
+	if method != "DELETE" {
+		task.Data = stringKeyMap(diff.NewValue)
+	}
+	return task, true
+}
+
+// databaseStateEqual compares the current state of a database connection or
+// role with the desired one. Only the fields the desired state sets are
+// compared. Write-only fields are compared by fingerprint when the current
+// state has one, and ignored otherwise, since Vault never returns them.
+func databaseStateEqual(current, desired interface{}) bool {
+	have, want := stringKeyMap(current), stringKeyMap(desired)
+	if have == nil || want == nil {
+		return configValuesEqual(current, desired)
+	}
+	for field, value := range want {
+		switch {
+		case databaseIgnoredFields[field]:
+		case databaseWriteOnlyFields[field]:
+			if recorded, ok := have[field].(string); ok && strings.HasPrefix(recorded, fingerprintPrefix) && recorded != fingerprint(value) {
+				return false
+			}
+		case !databaseFieldEqual(have[field], value):
+			return false
+		}
+	}
+	return true
+}
+
+// databaseFieldEqual compares a database field. Vault returns statements as
+// lists, which match a single statement written as a string, and TTLs as
+// seconds.
+func databaseFieldEqual(current, desired interface{}) bool {
+	if list, ok := current.([]interface{}); ok && len(list) == 1 {
+		if _, ok := desired.(string); ok {
+			current = list[0]
+		}
+	}
+	return configFieldEqual(current, desired)
+}
+
+// fingerprint returns a one-way fingerprint of a write-only value
+func fingerprint(v interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(v)))
+	return fingerprintPrefix + hex.EncodeToString(sum[:])
+}
+
+// fingerprintWriteOnly returns a copy of a state with the write-only fields
+// of database connections and the data of KV secrets replaced by their
+// fingerprints, so the state file never holds the values
+func fingerprintWriteOnly(state map[string]interface{}) map[string]interface{} {
+	converted := make(map[string]interface{}, len(state))
+	for p, value := range state {
+		converted[p] = value
+		if isKVEntry(p, value) {
+			fields := stringKeyMap(value)
+			if fields["data"] != nil {
+				fields["data"] = kvDataFingerprint(fields["data"])
+			}
+			converted[p] = fields
+			continue
+		}
+		if !isDatabaseEntry(p, value) {
+			continue
+		}
+		fields := stringKeyMap(value)
+		for field, secret := range fields {
+			if databaseWriteOnlyFields[field] {
+				if s, ok := secret.(string); !ok || !strings.HasPrefix(s, fingerprintPrefix) {
+					fields[field] = fingerprint(secret)
+				}
+			}
+		}
+		converted[p] = fields
+	}
+	return converted
+}
+
+// mergeFingerprints copies the fingerprints of write-only fields recorded in
+// the last known state into the current state read from Vault, which never
+// contains the values
+func mergeFingerprints(current, lastKnown map[string]interface{}) {
+	for p, value := range lastKnown {
+		recorded := stringKeyMap(value)
+		entry := stringKeyMap(current[p])
+		if recorded == nil || entry == nil {
+			continue
+		}
+		merged := false
+		for field, secret := range recorded {
+			s, ok := secret.(string)
+			if databaseWriteOnlyFields[field] && entry[field] == nil && ok && strings.HasPrefix(s, fingerprintPrefix) {
+				entry[field] = secret
+				merged = true
+			}
+		}
+		if merged {
+			current[p] = entry
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package migrations
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabaseType_Validate(t *testing.T) {
+	valid := []Task{
+		{Type: "database", Method: "PUT", Path: "database/config/postgresql", Data: map[string]interface{}{
+			"plugin_name": "postgresql-database-plugin", "verify_connection": false, "rotate_root": true,
+		}},
+		{Type: "database", Method: "PUT", Path: "database/roles/readonly", Data: map[string]interface{}{"db_name": "postgresql"}},
+		{Type: "database", Method: "PUT", Path: "db/eu/static-roles/app", Data: map[string]interface{}{"db_name": "postgresql", "username": "app"}},
+		{Type: "database", Method: "DELETE", Path: "database/config/postgresql"},
+	}
+	for _, task := range valid {
+		assert.NoError(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+
+	invalid := []Task{
+		{Type: "database", Method: "PUT", Path: "database/creds/readonly", Data: map[string]interface{}{"db_name": "postgresql"}},
+		{Type: "database", Method: "PUT", Path: "database/config/postgresql", Data: map[string]interface{}{"connection_url": "postgresql://"}},
+		{Type: "database", Method: "PUT", Path: "database/config/postgresql", Data: map[string]interface{}{
+			"plugin_name": "postgresql-database-plugin", "rotate_root": "yes",
+		}},
+		{Type: "database", Method: "PUT", Path: "database/roles/readonly", Data: map[string]interface{}{"default_ttl": "1h"}},
+		{Type: "database", Method: "PUT", Path: "database/roles/readonly", Data: map[string]interface{}{"db_name": "postgresql", "rotate_root": true}},
+		{Type: "database", Method: "DELETE", Path: "database/roles/readonly", Data: map[string]interface{}{"db_name": "postgresql"}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestDatabaseType_Expand(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "database/config/existing", map[string]interface{}{"plugin_name": "postgresql-database-plugin"})
+
+	verify := false
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: t.TempDir(), VerifyConnections: &verify},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	connection := func(name string, extra map[string]interface{}) Task {
+		data := map[string]interface{}{
+			"plugin_name": "postgresql-database-plugin",
+			"username":    "vault",
+			"password":    "secret",
+			"rotate_root": true,
+		}
+		for k, v := range extra {
+			data[k] = v
+		}
+		return Task{Type: "database", Method: "PUT", Path: "database/config/" + name, Data: data}
+	}
+
+	tests := []struct {
+		name string
+		task Task
+		want []Task
+	}{
+		{
+			name: "create and rotate the root credentials",
+			task: connection("new", nil),
+			want: []Task{
+				{Method: "POST", Path: "database/config/new", Data: map[string]interface{}{
+					"plugin_name": "postgresql-database-plugin", "username": "vault", "password": "secret", "verify_connection": false,
+				}},
+				{Method: "POST", Path: "database/rotate-root/new"},
+			},
+		},
+		{
+			name: "update a rotated connection",
+			task: connection("existing", map[string]interface{}{"verify_connection": true}),
+			want: []Task{
+				{Method: "POST", Path: "database/config/existing", Data: map[string]interface{}{
+					"plugin_name": "postgresql-database-plugin", "username": "vault", "verify_connection": true,
+				}},
+			},
+		},
+		{
+			name: "role",
+			task: Task{Type: "database", Method: "PUT", Path: "database/roles/readonly", Data: map[string]interface{}{"db_name": "existing"}},
+			want: []Task{{Method: "POST", Path: "database/roles/readonly", Data: map[string]interface{}{"db_name": "existing"}}},
+		},
+		{
+			name: "delete",
+			task: Task{Type: "database", Method: "DELETE", Path: "database/config/existing"},
+			want: []Task{{Method: "DELETE", Path: "database/config/existing"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runner.expandType(ctx, tt.task)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDatabaseStateEqual(t *testing.T) {
+	desired := map[interface{}]interface{}{
+		"plugin_name":         "postgresql-database-plugin",
+		"password":            "secret",
+		"verify_connection":   false,
+		"creation_statements": "CREATE ROLE",
+		"default_ttl":         "1h",
+	}
+
+	assert.True(t, databaseStateEqual(map[string]interface{}{
+		"plugin_name":         "postgresql-database-plugin",
+		"creation_statements": []interface{}{"CREATE ROLE"},
+		"default_ttl":         3600,
+		"password_policy":     "",
+	}, desired), "the password is unknown and extra fields are ignored")
+	assert.True(t, databaseStateEqual(map[string]interface{}{
+		"plugin_name": "postgresql-database-plugin", "password": fingerprint("secret"),
+		"creation_statements": "CREATE ROLE", "default_ttl": "1h",
+	}, desired))
+	assert.False(t, databaseStateEqual(map[string]interface{}{
+		"plugin_name": "postgresql-database-plugin", "password": fingerprint("old"),
+		"creation_statements": "CREATE ROLE", "default_ttl": "1h",
+	}, desired), "the password changed")
+	assert.False(t, databaseStateEqual(map[string]interface{}{
+		"plugin_name": "mysql-database-plugin", "creation_statements": "CREATE ROLE", "default_ttl": "1h",
+	}, desired))
+}
+
+func TestGenerateIntelligentMigration_DatabasePassword(t *testing.T) {
+	dir := t.TempDir()
+	desired := func(password string) map[string]interface{} {
+		return map[string]interface{}{
+			"database/config/postgresql": map[interface{}]interface{}{
+				"plugin_name": "postgresql-database-plugin",
+				"username":    "vault",
+				"password":    password,
+			},
+			"database/roles/readonly": map[interface{}]interface{}{"db_name": "postgresql"},
+		}
+	}
+	// The state read from Vault never holds the password
+	live := func() map[string]interface{} {
+		return map[string]interface{}{
+			"database/config/postgresql": map[string]interface{}{
+				"plugin_name": "postgresql-database-plugin",
+				"username":    "vault",
+			},
+			"database/roles/readonly": map[string]interface{}{"db_name": "postgresql"},
+		}
+	}
+
+	_, err := GenerateIntelligentMigration(nil, desired("secret"), dir)
+	require.NoError(t, err)
+	state, err := os.ReadFile(filepath.Join(dir, ".state.yaml"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(state), "secret")
+	assert.Contains(t, string(state), fingerprintPrefix)
+
+	result, err := GenerateIntelligentMigration(live(), desired("secret"), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "No migrations required - configurations are identical", result)
+
+	result, err = GenerateIntelligentMigration(live(), desired("rotated"), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "Generated migration version 2 with 1 tasks", result)
+}
+
+func TestOrderTasks_Database(t *testing.T) {
+	tasks := []Task{
+		{Type: "database", Method: "DELETE", Path: "database/config/old"},
+		{Type: "database", Method: "DELETE", Path: "database/roles/old"},
+		{Type: "database", Method: "POST", Path: "database/roles/readonly"},
+		{Type: "database", Method: "POST", Path: "database/config/postgresql"},
+	}
+	orderTasks(tasks)
+
+	var paths []string
+	for _, task := range tasks {
+		paths = append(paths, task.Path)
+	}
+	assert.Equal(t, []string{"database/config/postgresql", "database/roles/old", "database/roles/readonly", "database/config/old"}, paths)
+}
@@ -0,0 +1,435 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// TaskAction is what a task would do to Vault.
+type TaskAction string
+
+// Task actions reported by a dry run
+const (
+	ActionCreate           TaskAction = "create"
+	ActionUpdate           TaskAction = "update"
+	ActionNoop             TaskAction = "no-op"
+	ActionDelete           TaskAction = "delete"
+	ActionPermissionDenied TaskAction = "permission-denied"
+	ActionUnknown          TaskAction = "unknown"
+	// ActionCheck is a read-only task. Preconditions are evaluated against the
+	// simulated state; ASSERT and WAIT_FOR depend on how Vault handles the
+	// writes and are only checked for permission.
+	ActionCheck TaskAction = "check"
+	// ActionFail is a task that would fail, such as an unmet precondition or
+	// a PATCH of a path that does not exist
+	ActionFail TaskAction = "fail"
+	// ActionSkip marks every task of a migration an unmet precondition would skip
+	ActionSkip TaskAction = "skip"
+)
+
+// TaskPlan is the simulated outcome of a single task. Changed lists the
+// fields a write would modify; values are left out so secrets never end up in
+// reports or logs.
+type TaskPlan struct {
+	Version      int        `json:"version"`
+	Namespace    string     `json:"namespace,omitempty"`
+	Method       string     `json:"method"`
+	Path         string     `json:"path"`
+	Action       TaskAction `json:"action"`
+	Changed      []string   `json:"changed,omitempty"`
+	Capabilities []string   `json:"capabilities,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// DryRunReport is the per-task outcome of simulating pending migrations.
+type DryRunReport struct {
+	Tasks []TaskPlan `json:"tasks"`
+}
+
+// Count returns the number of tasks with the given action.
+func (r *DryRunReport) Count(action TaskAction) int {
+	n := 0
+	for _, task := range r.Tasks {
+		if task.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// simulatedValue is the value of a path as earlier simulated tasks left it
+type simulatedValue struct {
+	exists bool
+	data   map[string]interface{}
+}
+
+// dryRun simulates a set of migrations against a Vault
+type dryRun struct {
+	runner       *MigrationRunner
+	state        map[string]simulatedValue
+	capabilities map[string]map[string][]string
+}
+
+// DryRun simulates the pending migrations selected by opts without writing
+// anything. Each task's path is read to decide whether it would be created,
+// updated, left unchanged or deleted, and the token's capabilities on the path
+// are checked. Later tasks see the values simulated by earlier ones. Without a
+// Vault client every task is reported as unknown.
+func (m *MigrationRunner) DryRun(ctx context.Context, opts ApplyOptions) (*DryRunReport, error) {
+	pending, err := m.selectPending(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sim := &dryRun{
+		runner:       m,
+		state:        make(map[string]simulatedValue),
+		capabilities: make(map[string]map[string][]string),
+	}
+	if err := sim.loadCapabilities(ctx, pending); err != nil {
+		return nil, err
+	}
+
+	report := &DryRunReport{}
+	for _, migration := range pending {
+		// Preconditions are planned first, as apply checks them before writing
+		var preconditions, tasks []Task
+		for _, task := range sim.expand(ctx, migration, report) {
+			if isPrecondition(task.Method) {
+				preconditions = append(preconditions, task)
+			} else {
+				tasks = append(tasks, task)
+			}
+		}
+
+		skipped := false
+		for _, task := range append(preconditions, tasks...) {
+			var plan TaskPlan
+			if skipped {
+				plan = TaskPlan{Namespace: task.Namespace, Method: task.Method, Path: task.Path, Action: ActionSkip}
+			} else {
+				plan = sim.planTask(ctx, task)
+				skipped = plan.Action == ActionSkip
+			}
+			plan.Version = migration.Version
+			report.Tasks = append(report.Tasks, plan)
+		}
+	}
+	return report, nil
+}
+
+// expand resolves a migration's tasks into raw tasks like apply does. A
+// for_each task whose path cannot be listed, or a typed task that cannot be
+// resolved, is reported on its own instead of expanded.
+func (d *dryRun) expand(ctx context.Context, migration Migration, report *DryRunReport) []Task {
+	var tasks []Task
+	for _, task := range migration.Tasks {
+		task.Method = canonicalMethod(task.Method)
+		if task.Namespace == "" {
+			task.Namespace = migration.Namespace
+		}
+		if d.runner.client == nil {
+			tasks = append(tasks, task)
+			continue
+		}
+
+		candidates := []Task{task}
+		var err error
+		if task.ForEach != "" {
+			candidates, err = d.runner.expandTask(ctx, task)
+		}
+		if err != nil {
+			plan := TaskPlan{
+				Version:      migration.Version,
+				Namespace:    task.Namespace,
+				Method:       "LIST",
+				Path:         task.ForEach,
+				Action:       ActionUnknown,
+				Capabilities: d.capabilities[task.Namespace][task.ForEach],
+				Error:        err.Error(),
+			}
+			if !hasCapability(plan.Capabilities, "list") {
+				plan.Action = ActionPermissionDenied
+			}
+			report.Tasks = append(report.Tasks, plan)
+			continue
+		}
+
+		for _, candidate := range candidates {
+			expanded, err := d.runner.expandType(ctx, candidate)
+			if err != nil {
+				report.Tasks = append(report.Tasks, TaskPlan{
+					Version:   migration.Version,
+					Namespace: candidate.Namespace,
+					Method:    candidate.Method,
+					Path:      candidate.Path,
+					Action:    ActionUnknown,
+					Error:     err.Error(),
+				})
+				continue
+			}
+			tasks = append(tasks, expanded...)
+		}
+	}
+	return tasks
+}
+
+// selectPending returns the pending migrations within the limits of opts
+func (m *MigrationRunner) selectPending(ctx context.Context, opts ApplyOptions) ([]Migration, error) {
+	migrations, err := m.loadMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	lastApplied := make(map[string]int)
+	var pending []Migration
+	for _, migration := range migrations {
+		applied, ok := lastApplied[migration.Namespace]
+		if !ok {
+			applied, err = m.getLastAppliedVersion(ctx, migration.Namespace)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get last applied version for namespace %q: %w", migration.Namespace, err)
+			}
+			lastApplied[migration.Namespace] = applied
+		}
+
+		if migration.Version <= applied {
+			continue
+		}
+		if opts.TargetVersion > 0 && migration.Version > opts.TargetVersion {
+			break
+		}
+		if opts.Steps > 0 && len(pending) >= opts.Steps {
+			break
+		}
+		if err := validateMigration(migration); err != nil {
+			return nil, fmt.Errorf("invalid migration %d: %w", migration.Version, err)
+		}
+		pending = append(pending, migration)
+	}
+	return pending, nil
+}
+
+// loadCapabilities queries the token's capabilities on every task path, one
+// request per namespace
+func (d *dryRun) loadCapabilities(ctx context.Context, migrations []Migration) error {
+	if d.runner.client == nil {
+		return nil
+	}
+
+	paths := make(map[string][]string)
+	for _, migration := range migrations {
+		for _, task := range d.runner.preflightTasks(ctx, migration) {
+			if task.ForEach != "" {
+				paths[task.Namespace] = append(paths[task.Namespace], task.ForEach)
+				continue
+			}
+			paths[task.Namespace] = append(paths[task.Namespace], task.Path)
+		}
+	}
+
+	for namespace, nsPaths := range paths {
+		client, err := d.runner.clientForNamespace(namespace)
+		if err != nil {
+			return err
+		}
+		capabilities, err := capabilitiesSelf(ctx, client, uniqueStrings(nsPaths))
+		if err != nil {
+			return fmt.Errorf("namespace %q: %w", namespace, err)
+		}
+		d.capabilities[namespace] = capabilities
+	}
+	return nil
+}
+
+// planTask simulates one task and records its effect for later tasks
+func (d *dryRun) planTask(ctx context.Context, task Task) TaskPlan {
+	plan := TaskPlan{
+		Namespace: task.Namespace,
+		Method:    task.Method,
+		Path:      task.Path,
+	}
+	if d.runner.client == nil {
+		plan.Action = ActionUnknown
+		plan.Error = "no Vault client"
+		return plan
+	}
+	plan.Capabilities = d.capabilities[task.Namespace][task.Path]
+	if isReadOnly(task.Method) {
+		return d.planCheck(ctx, task, plan)
+	}
+
+	current, err := d.read(ctx, task.Namespace, task.Path)
+	if err != nil {
+		plan.Action = ActionUnknown
+		plan.Error = err.Error()
+		if !hasCapability(plan.Capabilities, "create") && !hasCapability(plan.Capabilities, "update") {
+			plan.Action = ActionPermissionDenied
+		}
+		return plan
+	}
+
+	var needed string
+	next := current
+	switch task.Method {
+	case "DELETE":
+		if !current.exists {
+			plan.Action = ActionNoop
+			break
+		}
+		plan.Action, needed = ActionDelete, "delete"
+		next = simulatedValue{}
+	case "PATCH":
+		if !current.exists {
+			plan.Action, plan.Error = ActionFail, "path does not exist"
+			return plan
+		}
+		patched := mergePatch(current.data, task.Data)
+		plan.Changed = changedFields(current.data, patched)
+		for field := range current.data {
+			if _, ok := patched[field]; !ok {
+				plan.Changed = append(plan.Changed, field)
+			}
+		}
+		sort.Strings(plan.Changed)
+		plan.Action = ActionNoop
+		if len(plan.Changed) > 0 {
+			plan.Action, needed = ActionUpdate, "patch"
+		}
+		next = simulatedValue{exists: true, data: patched}
+	default:
+		plan.Changed = changedFields(current.data, task.Data)
+		switch {
+		case !current.exists:
+			plan.Action, needed = ActionCreate, "create"
+		case len(plan.Changed) > 0:
+			plan.Action, needed = ActionUpdate, "update"
+		default:
+			plan.Action = ActionNoop
+		}
+		next = simulatedValue{exists: true, data: mergeData(current.data, task.Data)}
+	}
+
+	if needed != "" && !hasCapability(plan.Capabilities, needed) {
+		plan.Action = ActionPermissionDenied
+		plan.Error = fmt.Sprintf("token lacks %q capability", needed)
+		return plan
+	}
+
+	d.state[statePathKey(task.Namespace, task.Path)] = next
+	return plan
+}
+
+// planCheck simulates a read-only task
+func (d *dryRun) planCheck(ctx context.Context, task Task, plan TaskPlan) TaskPlan {
+	needed := taskCapabilities(task.Method)[0]
+	if !hasCapability(plan.Capabilities, needed) {
+		plan.Action = ActionPermissionDenied
+		plan.Error = fmt.Sprintf("token lacks %q capability", needed)
+		return plan
+	}
+	plan.Action = ActionCheck
+	if !isPrecondition(task.Method) {
+		return plan
+	}
+
+	current, err := d.read(ctx, task.Namespace, task.Path)
+	if err != nil {
+		plan.Action = ActionUnknown
+		plan.Error = err.Error()
+		return plan
+	}
+	if reason := evaluateCondition(task, current.exists, current.data); reason != "" {
+		plan.Action, plan.Error = ActionFail, reason
+		if task.OnFail == "skip" {
+			plan.Action = ActionSkip
+		}
+	}
+	return plan
+}
+
+// read returns the simulated value of a path, falling back to Vault
+func (d *dryRun) read(ctx context.Context, namespace, path string) (simulatedValue, error) {
+	if value, ok := d.state[statePathKey(namespace, path)]; ok {
+		return value, nil
+	}
+
+	client, err := d.runner.clientForNamespace(namespace)
+	if err != nil {
+		return simulatedValue{}, err
+	}
+	secret, err := client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return simulatedValue{}, fmt.Errorf("failed to read current value: %w", err)
+	}
+	if secret == nil {
+		return simulatedValue{}, nil
+	}
+	return simulatedValue{exists: true, data: secret.Data}, nil
+}
+
+// statePathKey identifies a path within a namespace
+func statePathKey(namespace, path string) string {
+	return namespace + "|" + path
+}
+
+// changedFields returns the fields of desired that differ from current
+func changedFields(current, desired map[string]interface{}) []string {
+	var changed []string
+	for field, value := range desired {
+		if old, ok := current[field]; !ok || !configValuesEqual(old, value) {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// mergeData overlays written fields on the current value
+func mergeData(current, written map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(current)+len(written))
+	for k, v := range current {
+		merged[k] = v
+	}
+	for k, v := range written {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergePatch applies a JSON merge patch (RFC 7396) to a value: null removes
+// a field and nested objects are merged recursively
+func mergePatch(current, patch map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(current)+len(patch))
+	for k, v := range current {
+		merged[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(merged, k)
+			continue
+		}
+		nested, isMap := v.(map[string]interface{})
+		existing, wasMap := merged[k].(map[string]interface{})
+		if isMap && wasMap {
+			merged[k] = mergePatch(existing, nested)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// uniqueStrings returns values without duplicates, in first-seen order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,145 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationRunner_DryRunReport(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "secret/existing", map[string]interface{}{"key": "1", "other": "x"})
+	server.setCapabilities("secret/forbidden", "read")
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{Path: "secret/existing", Method: "PUT", Data: map[string]interface{}{"key": "1"}},
+				{Path: "secret/new", Method: "POST", Data: map[string]interface{}{"key": "1"}},
+				{Path: "secret/missing", Method: "DELETE"},
+				{Path: "secret/forbidden", Method: "POST", Data: map[string]interface{}{"key": "1"}},
+			},
+		},
+		{
+			Version: 2,
+			Tasks: []Task{
+				// Sees the value simulated by migration 1
+				{Path: "secret/new", Method: "PUT", Data: map[string]interface{}{"key": "2"}},
+				{Path: "secret/existing", Method: "DELETE"},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+			DryRun:     true,
+		})
+		require.NoError(t, err)
+
+		report, err := runner.DryRun(context.Background(), ApplyOptions{})
+		require.NoError(t, err)
+		require.Len(t, report.Tasks, 6)
+
+		actions := make([]TaskAction, len(report.Tasks))
+		for i, task := range report.Tasks {
+			actions[i] = task.Action
+		}
+		assert.Equal(t, []TaskAction{
+			ActionNoop, ActionCreate, ActionNoop, ActionPermissionDenied,
+			ActionUpdate, ActionDelete,
+		}, actions)
+		assert.Equal(t, []string{"key"}, report.Tasks[4].Changed)
+		assert.Equal(t, 2, report.Tasks[4].Version)
+
+		// RunMigrations in dry-run mode fails on permission problems and writes nothing
+		err = runner.RunMigrations(context.Background())
+		require.Error(t, err)
+	})
+
+	_, ok := server.get("", "secret/new")
+	assert.False(t, ok, "dry run must not write")
+	_, ok = server.get("", "migrations/version")
+	assert.False(t, ok, "dry run must not track versions")
+}
+
+func TestMigrationRunner_DryRunWithoutClient(t *testing.T) {
+	migrations := []Migration{
+		{Version: 1, Tasks: []Task{{Path: "secret/one", Method: "POST"}}},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(nil, &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+			DryRun:     true,
+		})
+		require.NoError(t, err)
+
+		report, err := runner.DryRun(context.Background(), ApplyOptions{})
+		require.NoError(t, err)
+		require.Len(t, report.Tasks, 1)
+		assert.Equal(t, ActionUnknown, report.Tasks[0].Action)
+
+		require.NoError(t, runner.RunMigrations(context.Background()))
+	})
+}
+
+func TestMigrationRunner_Preflight(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.setCapabilities("secret/app", "read")
+	server.setCapabilities("sys/auth/approle", "read")
+	server.setCapabilities("secret/created", "create")
+	server.setCapabilities("secret/old", "read", "update")
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{Path: "secret/app", Method: "POST"},
+				{Path: "sys/auth/approle", Method: "PUT"},
+				{Path: "secret/old", Method: "DELETE"},
+				{Path: "secret/fine", Method: "POST"},
+				{Path: "secret/created", Method: "PUT"},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+
+		err = runner.RunMigrations(context.Background())
+		require.Error(t, err)
+
+		var preflightErr *PreflightError
+		require.ErrorAs(t, err, &preflightErr)
+		require.Len(t, preflightErr.Missing, 3)
+		assert.Equal(t, "secret/app", preflightErr.Missing[0].Path)
+		assert.Equal(t, []string{"create", "update"}, preflightErr.Missing[0].Needed)
+		assert.Equal(t, []string{"create", "update"}, preflightErr.Missing[1].Needed, "PUT, like POST, creates with either")
+		assert.Equal(t, []string{"delete"}, preflightErr.Missing[2].Needed)
+		assert.Contains(t, err.Error(), "migration 1: POST secret/app needs create or update, has [read]")
+
+		assert.Equal(t, `path "secret/app" {
+  capabilities = ["create", "update"]
+}
+path "secret/old" {
+  capabilities = ["delete"]
+}
+path "sys/auth/approle" {
+  capabilities = ["create", "update"]
+}
+`, preflightErr.Policy())
+	})
+
+	// Nothing is written when the pre-flight check fails
+	_, ok := server.get("", "secret/fine")
+	assert.False(t, ok)
+	_, ok = server.get("", "migrations/lock")
+	assert.False(t, ok)
+}
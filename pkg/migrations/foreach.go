@@ -0,0 +1,99 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// keyPlaceholder matches {{key}} in the path and data of a for_each task.
+// Only this placeholder is replaced, so templated ACL policies such as
+// {{identity.entity.id}} pass through untouched.
+var keyPlaceholder = regexp.MustCompile(`\{\{\s*key\s*\}\}`)
+
+// expandTask returns the tasks a for_each task stands for: the path in
+// ForEach is listed and the task is repeated for every child key, with
+// {{key}} replaced in its path and string data. Child keys ending in a slash
+// are folders and are skipped. Other tasks are returned unchanged.
+func (m *MigrationRunner) expandTask(ctx context.Context, task Task) ([]Task, error) {
+	if task.ForEach == "" {
+		return []Task{task}, nil
+	}
+
+	client, err := m.clientForNamespace(task.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := client.Logical().ListWithContext(ctx, task.ForEach)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", task.ForEach, err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	keys, _ := secret.Data["keys"].([]interface{})
+
+	var tasks []Task
+	for _, raw := range keys {
+		key := fmt.Sprint(raw)
+		if strings.HasSuffix(key, "/") {
+			continue
+		}
+		child := task
+		child.ForEach = ""
+		child.Path = replaceKey(task.Path, key).(string)
+		if task.Data != nil {
+			child.Data = replaceKey(task.Data, key).(map[string]interface{})
+		}
+		tasks = append(tasks, child)
+	}
+	return tasks, nil
+}
+
+// replaceKey returns a copy of value with {{key}} replaced in every string
+func replaceKey(value interface{}, key string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return keyPlaceholder.ReplaceAllLiteralString(v, key)
+	case map[string]interface{}:
+		replaced := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			replaced[k] = replaceKey(item, key)
+		}
+		return replaced
+	case map[interface{}]interface{}:
+		replaced := make(map[interface{}]interface{}, len(v))
+		for k, item := range v {
+			replaced[k] = replaceKey(item, key)
+		}
+		return replaced
+	case []interface{}:
+		replaced := make([]interface{}, len(v))
+		for i, item := range v {
+			replaced[i] = replaceKey(item, key)
+		}
+		return replaced
+	default:
+		return value
+	}
+}
+
+// resolveTasks prepares a migration's tasks for execution: methods are
+// mapped to their canonical names, tasks inherit the migration namespace
+// unless they set their own, and for_each tasks are expanded.
+func (m *MigrationRunner) resolveTasks(ctx context.Context, namespace string, tasks []Task) ([]Task, error) {
+	var resolved []Task
+	for _, task := range tasks {
+		task.Method = canonicalMethod(task.Method)
+		if task.Namespace == "" {
+			task.Namespace = namespace
+		}
+		expanded, err := m.expandTask(ctx, task)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand for_each task: %w", err)
+		}
+		resolved = append(resolved, expanded...)
+	}
+	return resolved, nil
+}
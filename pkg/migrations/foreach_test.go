@@ -0,0 +1,118 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalMethod(t *testing.T) {
+	tests := map[string]string{
+		"write":  "POST",
+		"read":   "READ",
+		"delete": "DELETE",
+		"list":   "LIST",
+		"patch":  "PATCH",
+		"PUT":    "PUT",
+	}
+	for method, want := range tests {
+		assert.Equal(t, want, canonicalMethod(method), method)
+	}
+}
+
+func TestMigrationRunner_Patch(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "auth/approle/role/app", map[string]interface{}{"token_ttl": "1h", "policies": "app"})
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{Path: "auth/approle/role/app", Method: "patch", Data: map[string]interface{}{"token_ttl": "2h"}},
+			},
+		},
+		{
+			Version: 2,
+			Tasks: []Task{
+				{Path: "auth/approle/role/missing", Method: "PATCH", Data: map[string]interface{}{"token_ttl": "2h"}},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		report, err := runner.DryRun(ctx, ApplyOptions{})
+		require.NoError(t, err)
+		require.Len(t, report.Tasks, 2)
+		assert.Equal(t, ActionUpdate, report.Tasks[0].Action)
+		assert.Equal(t, []string{"token_ttl"}, report.Tasks[0].Changed)
+		assert.Equal(t, ActionFail, report.Tasks[1].Action)
+
+		err = runner.RunMigrations(ctx)
+		require.Error(t, err, "patching a missing path should fail")
+		assert.Equal(t, []int{1}, runner.AppliedVersions())
+	})
+
+	role, ok := server.get("", "auth/approle/role/app")
+	require.True(t, ok)
+	assert.Equal(t, "2h", role["token_ttl"])
+	assert.Equal(t, "app", role["policies"], "fields not in the patch should be kept")
+}
+
+func TestMigrationRunner_ForEach(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "auth/approle/role/app", map[string]interface{}{"token_ttl": "1h"})
+	server.put("", "auth/approle/role/worker", map[string]interface{}{"token_ttl": "1h"})
+	server.put("", "auth/approle/role/nested/child", map[string]interface{}{"token_ttl": "1h"})
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{
+					ForEach: "auth/approle/role",
+					Path:    "auth/approle/role/{{ key }}",
+					Method:  "PATCH",
+					Data: map[string]interface{}{
+						"token_ttl":   "2h",
+						"description": "role {{key}}",
+						"policy":      "path \"secret/{{identity.entity.id}}\" {}",
+					},
+				},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		report, err := runner.DryRun(ctx, ApplyOptions{})
+		require.NoError(t, err)
+		require.Len(t, report.Tasks, 2)
+		assert.Equal(t, "auth/approle/role/app", report.Tasks[0].Path)
+		assert.Equal(t, "auth/approle/role/worker", report.Tasks[1].Path)
+
+		require.NoError(t, runner.RunMigrations(ctx))
+	})
+
+	for _, name := range []string{"app", "worker"} {
+		role, ok := server.get("", "auth/approle/role/"+name)
+		require.True(t, ok)
+		assert.Equal(t, "2h", role["token_ttl"])
+		assert.Equal(t, "role "+name, role["description"])
+		assert.Equal(t, "path \"secret/{{identity.entity.id}}\" {}", role["policy"])
+	}
+	nested, _ := server.get("", "auth/approle/role/nested/child")
+	assert.Equal(t, "1h", nested["token_ttl"], "folders should not be expanded")
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -25,7 +26,7 @@ type StateFile struct {
 // getLastKnownState retrieves the last known state from the state file
 func getLastKnownState(migrationsDir string) (map[string]interface{}, error) {
 	statePath := filepath.Join(migrationsDir, ".state.yaml")
-	
+
 	// If state file doesn't exist, return empty state
 	if _, err := os.Stat(statePath); os.IsNotExist(err) {
 		return nil, nil
@@ -47,7 +48,7 @@ func getLastKnownState(migrationsDir string) (map[string]interface{}, error) {
 // saveLastKnownState saves the current state to the state file
 func saveLastKnownState(migrationsDir string, state map[string]interface{}) error {
 	stateFile := StateFile{
-		LastKnownState: state,
+		LastKnownState: fingerprintWriteOnly(state),
 	}
 
 	data, err := yaml.Marshal(stateFile)
@@ -63,15 +64,19 @@ func saveLastKnownState(migrationsDir string, state map[string]interface{}) erro
 	return nil
 }
 
-// GenerateMigration creates a new migration file.
-func GenerateMigration(version int, tasks []Task, outputDir string) error {
+// GenerateMigration creates a new migration file, named
+// V<version>__<description>.yaml.
+func GenerateMigration(version int, description string, tasks []Task, outputDir string) error {
+	orderTasks(tasks)
+	concurrent := false
 	migration := Migration{
-		Version: version,
-		Tasks:   tasks,
+		Version:     version,
+		Description: description,
+		Tasks:       tasks,
+		Concurrent:  &concurrent,
 	}
 
-	filename := fmt.Sprintf("%s.yaml", sanitizeFilename(fmt.Sprintf("migration_%d", version)))
-	outputPath := filepath.Join(outputDir, filename)
+	outputPath := filepath.Join(outputDir, migrationFilename(version, description))
 
 	data, err := yaml.Marshal(migration)
 	if err != nil {
@@ -93,13 +98,17 @@ func GenerateIntelligentMigration(currentConfig, desiredConfig map[string]interf
 		return "", fmt.Errorf("failed to get latest version: %w", err)
 	}
 
-	// Get last known state if no current config is provided
+	// Get last known state if no current config is provided. The state read
+	// from Vault lacks write-only fields, so their fingerprints are taken
+	// from the last known state.
+	lastKnownState, err := getLastKnownState(migrationsDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to get last known state: %w", err)
+	}
 	if currentConfig == nil {
-		lastKnownState, err := getLastKnownState(migrationsDir)
-		if err != nil {
-			return "", fmt.Errorf("failed to get last known state: %w", err)
-		}
 		currentConfig = lastKnownState
+	} else {
+		mergeFingerprints(currentConfig, lastKnownState)
 	}
 
 	// If no current config and no last known state, generate a full migration
@@ -111,16 +120,11 @@ func GenerateIntelligentMigration(currentConfig, desiredConfig map[string]interf
 		// Create tasks for all desired configurations
 		var tasks []Task
 		for path, value := range desiredConfig {
-			task := Task{
-				Path:   path,
-				Method: "POST",
-				Data:   toMapStringInterface(value),
-			}
-			tasks = append(tasks, task)
+			tasks = append(tasks, taskFromDiff(HCLDiff{Path: path, NewValue: value}))
 		}
 
 		// Generate the migration file
-		if err := GenerateMigration(version+1, tasks, migrationsDir); err != nil {
+		if err := GenerateMigration(version+1, "initial configuration", tasks, migrationsDir); err != nil {
 			return "", fmt.Errorf("failed to generate migration: %w", err)
 		}
 
@@ -145,7 +149,7 @@ func GenerateIntelligentMigration(currentConfig, desiredConfig map[string]interf
 	}
 
 	// Generate the migration file
-	if err := GenerateMigration(version+1, tasks, migrationsDir); err != nil {
+	if err := GenerateMigration(version+1, "schema changes", tasks, migrationsDir); err != nil {
 		return "", fmt.Errorf("failed to generate migration: %w", err)
 	}
 
@@ -159,34 +163,14 @@ func GenerateIntelligentMigration(currentConfig, desiredConfig map[string]interf
 
 // getLatestVersion gets the latest migration version from the migrations directory
 func getLatestVersion(migrationsDir string) (int, error) {
-	files, err := filepath.Glob(filepath.Join(migrationsDir, "*.yaml"))
+	migrations, err := readMigrations(migrationsDir)
 	if err != nil {
 		return 0, err
 	}
-
-	if len(files) == 0 {
+	if len(migrations) == 0 {
 		return 0, nil
 	}
-
-	versions := make([]int, 0, len(files))
-	for _, file := range files {
-		var migration Migration
-		data, err := ioutil.ReadFile(file)
-		if err != nil {
-			continue
-		}
-		if err := yaml.Unmarshal(data, &migration); err != nil {
-			continue
-		}
-		versions = append(versions, migration.Version)
-	}
-
-	if len(versions) == 0 {
-		return 0, nil
-	}
-
-	sort.Ints(versions)
-	return versions[len(versions)-1], nil
+	return migrations[len(migrations)-1].Version, nil
 }
 
 // compareConfigs compares two configurations and returns the differences
@@ -205,7 +189,7 @@ func compareConfigs(current, desired map[string]interface{}) []HCLDiff {
 			continue
 		}
 
-		if !configValuesEqual(currentValue, desiredValue) {
+		if !resourceValuesEqual(path, currentValue, desiredValue) {
 			// Changed configuration
 			diffs = append(diffs, HCLDiff{
 				Path:     path,
@@ -245,42 +229,263 @@ func configValuesEqual(a, b interface{}) bool {
 	return aStr == bStr
 }
 
+// resourceValuesEqual compares the current and desired value of a path,
+// using the comparison of the resource the path holds
+func resourceValuesEqual(path string, current, desired interface{}) bool {
+	if mountPath := authMountPath(path); mountPath != "" && !strings.Contains(mountPath, "/") {
+		return authStateEqual(current, desired)
+	}
+	if mountPath := secretMountPath(path); mountPath != "" && !strings.Contains(mountPath, "/") {
+		return mountStateEqual(current, desired)
+	}
+	if _, ok := parsePluginPath(path); ok {
+		return pluginStateEqual(current, desired)
+	}
+	if devicePath := auditDevicePath(path); devicePath != "" && !strings.Contains(devicePath, "/") {
+		return auditStateEqual(current, desired)
+	}
+	if kind, _ := policyEndpoint(path); kind != "" {
+		return policyStateEqual(kind, current, desired)
+	}
+	if isDatabaseEntry(path, desired) {
+		return databaseStateEqual(current, desired)
+	}
+	if isKVEntry(path, desired) {
+		return kvStateEqual(current, desired)
+	}
+	if _, ok := parseIdentityPath(path); ok {
+		return identityStateEqual(current, desired)
+	}
+	if _, ok := parseQuotaPath(path); ok {
+		return quotaStateEqual(current, desired)
+	}
+	return configValuesEqual(current, desired)
+}
+
+// orderTasks sorts generated tasks so that everything exists before it is
+// used and is removed after its users. Tasks run in this order:
+//
+//   - plugins are registered
+//   - auth methods, secrets engines and audit devices are enabled
+//   - root CAs, then the intermediates they sign, are generated
+//   - database connections are written
+//   - identity entities and groups, then what refers to them, are written
+//   - other paths are written
+//   - quotas are written, after the mounts they apply to
+//   - database connections are deleted, after their roles
+//   - auth methods, secrets engines and audit devices are disabled
+//   - plugins are deregistered
+//
+// Tasks of the same rank are sorted by path, so generated migrations are
+// stable.
+func orderTasks(tasks []Task) {
+	rank := func(task Task) int {
+		pki, _ := parsePKIPath(task.Path)
+		database, _ := parseDatabasePath(task.Path)
+		connection := task.Type == "database" && database.kind == "config"
+		switch {
+		case task.Type == "plugin" && task.Method == "DELETE":
+			return 10
+		case (task.Type == "auth" || task.Type == "mount" || task.Type == "audit") && task.Method == "DELETE":
+			return 9
+		case connection && task.Method == "DELETE":
+			return 8
+		case task.Type == "quota" && task.Method != "DELETE":
+			return 7
+		case task.Type == "plugin":
+			return 0
+		case task.Type == "auth" || task.Type == "mount" || task.Type == "audit":
+			return 1
+		case task.Type == "pki" && pki.kind == "root":
+			return 2
+		case task.Type == "pki" && pki.kind == "intermediate":
+			return 3
+		case connection:
+			return 4
+		case task.Type == "identity":
+			return 5
+		default:
+			return 6
+		}
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if ri, rj := rank(tasks[i]), rank(tasks[j]); ri != rj {
+			return ri < rj
+		}
+		if ri, rj := identityRank(tasks[i]), identityRank(tasks[j]); ri != rj {
+			return ri < rj
+		}
+		return tasks[i].Path < tasks[j].Path
+	})
+}
+
 // generateTasksFromDiffs converts HCL differences into Vault tasks
 func generateTasksFromDiffs(diffs []HCLDiff) []Task {
 	var tasks []Task
+	moved := movedMounts(diffs)
 
 	for _, diff := range diffs {
 		// Skip if both old and new values are nil
 		if diff.OldValue == nil && diff.NewValue == nil {
 			continue
 		}
-
-		method := "POST"
-		if diff.OldValue != nil && diff.NewValue == nil {
-			method = "DELETE"
-		} else if diff.OldValue != nil {
-			method = "PUT"
+		// Removing a CA or key generation from the desired state must not
+		// remove the CA or key; that is done explicitly on its issuer or key
+		if diff.NewValue == nil && isPKIGeneration(diff.Path) {
+			continue
 		}
-
-		task := Task{
-			Path:   diff.Path,
-			Method: method,
+		// Entities and their aliases are also created by logins, so they are
+		// only deleted by explicit tasks
+		if diff.NewValue == nil && isIdentityLoginResource(diff.Path) {
+			continue
 		}
-
-		if diff.NewValue != nil {
-			task.Data = toMapStringInterface(diff.NewValue)
+		// The default policy exists in every Vault and cannot be deleted, so
+		// it is only managed when the schema defines it
+		if diff.NewValue == nil && isDefaultPolicy(diff.Path) {
+			continue
+		}
+		// A moved mount keeps its data, so nothing below its previous path is
+		// deleted
+		if diff.NewValue == nil && isBelowMovedMount(diff.Path, moved) {
+			continue
 		}
 
-		tasks = append(tasks, task)
+		tasks = append(tasks, taskFromDiff(diff))
 	}
 
 	return tasks
 }
 
+// taskFromDiff converts a single difference into a task
+func taskFromDiff(diff HCLDiff) Task {
+	method := "POST"
+	if diff.OldValue != nil && diff.NewValue == nil {
+		method = "DELETE"
+	} else if diff.OldValue != nil {
+		method = "PUT"
+	}
+
+	if task, ok := kvTaskFromDiff(diff, method); ok {
+		return task
+	}
+	if task, ok := pluginTaskFromDiff(diff, method); ok {
+		return task
+	}
+	if task, ok := authTaskFromDiff(diff, method); ok {
+		return task
+	}
+	if task, ok := mountTaskFromDiff(diff, method); ok {
+		return task
+	}
+	if task, ok := auditTaskFromDiff(diff, method); ok {
+		return task
+	}
+	if task, ok := policyTaskFromDiff(diff, method); ok {
+		return task
+	}
+	if task, ok := pkiTaskFromDiff(diff, method); ok {
+		return task
+	}
+	if task, ok := databaseTaskFromDiff(diff, method); ok {
+		return task
+	}
+	if task, ok := identityTaskFromDiff(diff, method); ok {
+		return task
+	}
+	if task, ok := quotaTaskFromDiff(diff, method); ok {
+		return task
+	}
+
+	task := Task{
+		Path:   diff.Path,
+		Method: method,
+	}
+
+	if diff.NewValue != nil {
+		task.Data = toMapStringInterface(diff.NewValue)
+	}
+
+	return task
+}
+
+// kvTaskFromDiff converts a difference in a KV version 2 secret into a kv
+// task. Secrets are written in the desired state as <mount>/data/<path> with
+// data and optional metadata fields, the shape Vault returns them in. Only
+// the parts that changed are written, and a removed secret is soft deleted
+// so its versions can still be recovered.
+func kvTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	value := diff.NewValue
+	if value == nil {
+		value = diff.OldValue
+	}
+	if !isKVEntry(diff.Path, value) {
+		return Task{}, false
+	}
+	parts := strings.SplitN(diff.Path, "/", 3)
+	fields := stringKeyMap(value)
+
+	task := Task{
+		Type:   "kv",
+		Path:   parts[0] + "/" + parts[2],
+		Method: method,
+	}
+	if method == "DELETE" {
+		return task, true
+	}
+
+	old := stringKeyMap(diff.OldValue)
+	if fields["data"] != nil && (old == nil || !kvDataEqual(old["data"], fields["data"])) {
+		task.Data = stringKeyMap(fields["data"])
+	}
+	if fields["metadata"] != nil && (old == nil || !kvMetadataEqual(old["metadata"], fields["metadata"])) {
+		task.Metadata = stringKeyMap(fields["metadata"])
+	}
+	if task.Data == nil && task.Metadata == nil {
+		task.Data, task.Metadata = stringKeyMap(fields["data"]), stringKeyMap(fields["metadata"])
+	}
+	return task, true
+}
+
 // toMapStringInterface converts an interface{} to map[string]interface{}
 func toMapStringInterface(v interface{}) map[string]interface{} {
-	if m, ok := v.(map[string]interface{}); ok {
+	if m := stringKeyMap(v); m != nil {
 		return m
 	}
 	return map[string]interface{}{"value": v}
 }
+
+// stringKeyMap converts a map decoded from YAML, which has interface{} keys,
+// into a map with string keys, recursively. Other values return nil.
+func stringKeyMap(v interface{}) map[string]interface{} {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, item := range m {
+			converted[k] = stringKeys(item)
+		}
+		return converted
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, item := range m {
+			converted[fmt.Sprint(k)] = stringKeys(item)
+		}
+		return converted
+	default:
+		return nil
+	}
+}
+
+// stringKeys converts the maps inside a YAML value to maps with string keys
+func stringKeys(v interface{}) interface{} {
+	if m := stringKeyMap(v); m != nil {
+		return m
+	}
+	if list, ok := v.([]interface{}); ok {
+		converted := make([]interface{}, len(list))
+		for i, item := range list {
+			converted[i] = stringKeys(item)
+		}
+		return converted
+	}
+	return v
+}
@@ -0,0 +1,261 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// HistoryEntry records a migration applied to Vault.
+type HistoryEntry struct {
+	Version   int       `json:"version"`
+	Namespace string    `json:"namespace,omitempty"`
+	File      string    `json:"file"`
+	Checksum  string    `json:"checksum"`
+	AppliedAt time.Time `json:"applied_at"`
+	AppliedBy string    `json:"applied_by"`
+	Duration  string    `json:"duration"`
+}
+
+// checksum returns the SHA256 of a migration file's contents
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// historyPath returns the path of the history ledger, next to the version tracking path
+func (m *MigrationRunner) historyPath() string {
+	return path.Join(path.Dir(m.trackingPath), "history")
+}
+
+// recordHistory writes a ledger entry for an applied migration
+func (m *MigrationRunner) recordHistory(ctx context.Context, migration Migration, start time.Time) error {
+	client, err := m.clientForNamespace(migration.Namespace)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"version":    strconv.Itoa(migration.Version),
+		"file":       migration.File,
+		"checksum":   migration.Checksum,
+		"applied_at": start.UTC().Format(time.RFC3339),
+		"applied_by": m.holder(),
+		"duration":   time.Since(start).Round(time.Millisecond).String(),
+	}
+	if _, err := client.Logical().WriteWithContext(ctx, path.Join(m.historyPath(), strconv.Itoa(migration.Version)), data); err != nil {
+		return err
+	}
+	return m.recordLedgerNamespace(ctx, migration.Namespace)
+}
+
+// ledgerNamespacesPath returns the path that lists the namespaces with a
+// history ledger. It is kept in the default namespace, so ledgers remain
+// visible after the last migration file of their namespace is removed.
+func (m *MigrationRunner) ledgerNamespacesPath() string {
+	return path.Join(path.Dir(m.trackingPath), "namespaces")
+}
+
+// ledgerNamespaces returns the namespaces recorded as having a history ledger
+func (m *MigrationRunner) ledgerNamespaces(ctx context.Context) ([]string, error) {
+	secret, err := m.client.Logical().ReadWithContext(ctx, m.ledgerNamespacesPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger namespaces: %w", err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	list, _ := secret.Data["namespaces"].([]interface{})
+	namespaces := make([]string, 0, len(list))
+	for _, namespace := range list {
+		namespaces = append(namespaces, fmt.Sprint(namespace))
+	}
+	return namespaces, nil
+}
+
+// recordLedgerNamespace adds a namespace to the ledger namespaces. Runs hold
+// the migration lock, so the list is not updated concurrently.
+func (m *MigrationRunner) recordLedgerNamespace(ctx context.Context, namespace string) error {
+	if namespace == "" {
+		return nil
+	}
+	namespaces, err := m.ledgerNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+	for _, recorded := range namespaces {
+		if recorded == namespace {
+			return nil
+		}
+	}
+
+	namespaces = append(namespaces, namespace)
+	sort.Strings(namespaces)
+	if _, err := m.client.Logical().WriteWithContext(ctx, m.ledgerNamespacesPath(), map[string]interface{}{"namespaces": namespaces}); err != nil {
+		return fmt.Errorf("failed to record ledger namespace: %w", err)
+	}
+	return nil
+}
+
+// deleteHistory removes the ledger entry for a migration
+func (m *MigrationRunner) deleteHistory(ctx context.Context, namespace string, version int) error {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	_, err = client.Logical().DeleteWithContext(ctx, path.Join(m.historyPath(), strconv.Itoa(version)))
+	return err
+}
+
+// readHistory returns the ledger entries of a namespace, oldest first
+func (m *MigrationRunner) readHistory(ctx context.Context, namespace string) ([]HistoryEntry, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := client.Logical().ListWithContext(ctx, m.historyPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list history: %w", err)
+	}
+	if list == nil || list.Data["keys"] == nil {
+		return nil, nil
+	}
+	keys, ok := list.Data["keys"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected history listing format")
+	}
+
+	var entries []HistoryEntry
+	for _, key := range keys {
+		secret, err := client.Logical().ReadWithContext(ctx, path.Join(m.historyPath(), fmt.Sprint(key)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history entry %v: %w", key, err)
+		}
+		if secret == nil {
+			continue
+		}
+
+		entry := HistoryEntry{Namespace: namespace}
+		entry.Version, _ = strconv.Atoi(stringField(secret.Data, "version"))
+		entry.File = stringField(secret.Data, "file")
+		entry.Checksum = stringField(secret.Data, "checksum")
+		entry.AppliedBy = stringField(secret.Data, "applied_by")
+		entry.Duration = stringField(secret.Data, "duration")
+		entry.AppliedAt, _ = time.Parse(time.RFC3339, stringField(secret.Data, "applied_at"))
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Version < entries[j].Version
+	})
+	return entries, nil
+}
+
+// History returns the ledger of applied migrations for the default namespace,
+// every namespace referenced by a migration file and every namespace recorded
+// as having a ledger.
+func (m *MigrationRunner) History(ctx context.Context) ([]HistoryEntry, error) {
+	if m.client == nil {
+		return nil, fmt.Errorf("cannot read history without Vault client")
+	}
+
+	namespaces, err := m.namespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []HistoryEntry
+	for _, namespace := range namespaces {
+		nsEntries, err := m.readHistory(ctx, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %q: %w", namespace, err)
+		}
+		entries = append(entries, nsEntries...)
+	}
+	return entries, nil
+}
+
+// CurrentVersions returns the tracked version of the default namespace, of
+// every namespace referenced by a migration file and of every namespace
+// recorded as having a ledger.
+func (m *MigrationRunner) CurrentVersions(ctx context.Context) (map[string]int, error) {
+	namespaces, err := m.namespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]int, len(namespaces))
+	for _, namespace := range namespaces {
+		version, err := m.getLastAppliedVersion(ctx, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %q: %w", namespace, err)
+		}
+		versions[namespace] = version
+	}
+	return versions, nil
+}
+
+// PendingMigrations returns the migrations newer than their namespace's tracked version.
+func (m *MigrationRunner) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	migrations, err := m.loadMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	versions, err := m.CurrentVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, migration := range migrations {
+		if migration.Version > versions[migration.Namespace] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// namespaces returns the default namespace plus every namespace used by a
+// migration or recorded as having a history ledger
+func (m *MigrationRunner) namespaces(ctx context.Context) ([]string, error) {
+	migrations, err := m.loadMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	seen := map[string]bool{"": true}
+	namespaces := []string{""}
+	add := func(namespace string) {
+		if !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	for _, migration := range migrations {
+		add(migration.Namespace)
+	}
+	if m.client != nil {
+		ledger, err := m.ledgerNamespaces(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, namespace := range ledger {
+			add(namespace)
+		}
+	}
+	return namespaces, nil
+}
+
+// stringField returns a field of secret data as a string
+func stringField(data map[string]interface{}, key string) string {
+	if data == nil || data[key] == nil {
+		return ""
+	}
+	return fmt.Sprint(data[key])
+}
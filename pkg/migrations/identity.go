@@ -0,0 +1,382 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// identityFields are the fields each kind of identity task accepts
+var identityFields = map[string]map[string]bool{
+	"entity": {"policies": true, "metadata": true, "disabled": true},
+	"group": {
+		"type": true, "policies": true, "metadata": true,
+		"member_entities": true, "member_groups": true,
+		"member_entity_ids": true, "member_group_ids": true,
+	},
+	"entity-alias": {"mount": true, "entity": true, "custom_metadata": true},
+	"group-alias":  {"mount": true, "group": true},
+}
+
+// oidcKinds are the identity/oidc resources, in the order they depend on
+// each other: roles and clients use keys and assignments, providers use
+// scopes and clients
+var oidcKinds = []string{"key", "assignment", "scope", "client", "role", "provider"}
+
+// identitySetFields are list fields whose order does not matter
+var identitySetFields = map[string]bool{
+	"policies":           true,
+	"member_entities":    true,
+	"member_groups":      true,
+	"member_entity_ids":  true,
+	"member_group_ids":   true,
+	"allowed_client_ids": true,
+	"assignments":        true,
+	"scopes_supported":   true,
+	"entity_ids":         true,
+	"group_ids":          true,
+	"redirect_uris":      true,
+}
+
+// identityType handles tasks on the identity secrets engine by name instead
+// of by generated ID:
+//
+//   - identity/entity/name/<name> and identity/group/name/<name> write an
+//     entity or group. Group members can be given by name in member_entities
+//     and member_groups.
+//   - identity/entity-alias/name/<name> and identity/group-alias/name/<name>
+//     write an alias of the entity or group named in data, on the auth mount
+//     named in data.mount; the mount accessor is looked up in sys/auth.
+//   - identity/oidc/<key|assignment|scope|client|role|provider>/<name> are
+//     written as given.
+type identityType struct{}
+
+// identityResource is what an identity task path names
+type identityResource struct {
+	// kind is entity, group, entity-alias, group-alias or oidc/<kind>
+	kind string
+	name string
+}
+
+func (identityType) validate(task Task) error {
+	resource, ok := parseIdentityPath(task.Path)
+	if !ok {
+		return fmt.Errorf("identity path must be identity/<entity|group|entity-alias|group-alias>/name/<name> or identity/oidc/<kind>/<name>")
+	}
+	alias := resource.kind == "entity-alias" || resource.kind == "group-alias"
+
+	switch task.Method {
+	case "POST", "PUT":
+	case "DELETE":
+		if alias {
+			if len(task.Data) != 1 || stringField(task.Data, "mount") == "" {
+				return fmt.Errorf("identity %s DELETE needs only data.mount, the alias's auth mount", resource.kind)
+			}
+		} else if len(task.Data) > 0 {
+			return fmt.Errorf("data is not supported by identity DELETE")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported identity method: %s", task.Method)
+	}
+
+	fields, ok := identityFields[resource.kind]
+	if !ok {
+		return nil
+	}
+	for field := range task.Data {
+		if !fields[field] {
+			return fmt.Errorf("unknown identity %s field %q", resource.kind, field)
+		}
+	}
+	switch resource.kind {
+	case "group":
+		external := stringField(task.Data, "type") == "external"
+		for _, field := range []string{"member_entities", "member_groups", "member_entity_ids", "member_group_ids"} {
+			if task.Data[field] == nil {
+				continue
+			}
+			if _, ok := task.Data[field].([]interface{}); !ok {
+				return fmt.Errorf("identity group %s must be a list", field)
+			}
+			if external {
+				return fmt.Errorf("external groups get their members from the group alias, not %s", field)
+			}
+		}
+	case "entity-alias":
+		if stringField(task.Data, "mount") == "" || stringField(task.Data, "entity") == "" {
+			return fmt.Errorf("identity entity-alias needs data.mount and data.entity")
+		}
+	case "group-alias":
+		if stringField(task.Data, "mount") == "" || stringField(task.Data, "group") == "" {
+			return fmt.Errorf("identity group-alias needs data.mount and data.group")
+		}
+	}
+	return nil
+}
+
+func (identityType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	resource, _ := parseIdentityPath(task.Path)
+	raw := func(method, p string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Path, t.Data = method, p, data
+		return t
+	}
+	if task.Method == "PUT" {
+		task.Method = "POST"
+	}
+
+	switch resource.kind {
+	case "group":
+		if task.Method == "DELETE" {
+			return []Task{raw("DELETE", task.Path, nil)}, nil
+		}
+		request := make(map[string]interface{})
+		for field, value := range task.Data {
+			request[field] = value
+		}
+		for field, kind := range map[string]string{"member_entities": "entity", "member_groups": "group"} {
+			names, ok := request[field].([]interface{})
+			if !ok {
+				continue
+			}
+			delete(request, field)
+			idField := "member_" + kind + "_ids"
+			ids, _ := request[idField].([]interface{})
+			for _, name := range names {
+				id, err := m.identityID(ctx, task.Namespace, kind, fmt.Sprint(name))
+				if err != nil {
+					return nil, err
+				}
+				ids = append(ids, id)
+			}
+			request[idField] = ids
+		}
+		return []Task{raw("POST", task.Path, request)}, nil
+	case "entity-alias", "group-alias":
+		mountPath := strings.Trim(stringField(task.Data, "mount"), "/")
+		if p := authMountPath(mountPath); p != "" {
+			mountPath = p
+		}
+		mount, err := m.authMount(ctx, task.Namespace, mountPath)
+		if err != nil {
+			return nil, err
+		}
+		accessor := stringField(mount, "accessor")
+		if accessor == "" {
+			return nil, fmt.Errorf("auth method %s is not enabled", mountPath)
+		}
+		aliasID, err := m.identityAliasID(ctx, task.Namespace, resource.kind, resource.name, accessor)
+		if err != nil {
+			return nil, err
+		}
+
+		if task.Method == "DELETE" {
+			if aliasID == "" {
+				return nil, nil
+			}
+			return []Task{raw("DELETE", path.Join("identity", resource.kind, "id", aliasID), nil)}, nil
+		}
+
+		owner := strings.TrimSuffix(resource.kind, "-alias")
+		canonicalID, err := m.identityID(ctx, task.Namespace, owner, stringField(task.Data, owner))
+		if err != nil {
+			return nil, err
+		}
+		request := map[string]interface{}{
+			"name":           resource.name,
+			"mount_accessor": accessor,
+			"canonical_id":   canonicalID,
+		}
+		if metadata, ok := task.Data["custom_metadata"]; ok {
+			request["custom_metadata"] = metadata
+		}
+		aliasPath := path.Join("identity", resource.kind)
+		if aliasID != "" {
+			aliasPath = path.Join(aliasPath, "id", aliasID)
+		}
+		return []Task{raw("POST", aliasPath, request)}, nil
+	default:
+		return []Task{raw(task.Method, task.Path, task.Data)}, nil
+	}
+}
+
+// parseIdentityPath returns the resource an identity task path names
+func parseIdentityPath(p string) (identityResource, bool) {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segments) < 4 || segments[0] != "identity" {
+		return identityResource{}, false
+	}
+	name := strings.Join(segments[3:], "/")
+	switch {
+	case segments[2] == "name" && identityFields[segments[1]] != nil:
+		return identityResource{kind: segments[1], name: name}, true
+	case segments[1] == "oidc" && identityOIDCRank(segments[2]) >= 0 && len(segments) == 4:
+		return identityResource{kind: "oidc/" + segments[2], name: name}, true
+	default:
+		return identityResource{}, false
+	}
+}
+
+// identityOIDCRank returns the position of an OIDC resource kind in
+// oidcKinds, or -1
+func identityOIDCRank(kind string) int {
+	for i, k := range oidcKinds {
+		if k == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+// identityID returns the ID of the entity or group with the given name
+func (m *MigrationRunner) identityID(ctx context.Context, namespace, kind, name string) (string, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return "", err
+	}
+	if client == nil {
+		return "", fmt.Errorf("cannot look up identity %s without Vault client", kind)
+	}
+	secret, err := client.Logical().ReadWithContext(ctx, path.Join("identity", kind, "name", name))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up identity %s %q: %w", kind, name, err)
+	}
+	if secret == nil || stringField(secret.Data, "id") == "" {
+		return "", fmt.Errorf("identity %s %q does not exist", kind, name)
+	}
+	return stringField(secret.Data, "id"), nil
+}
+
+// identityAliasID returns the ID of the entity or group alias with the given
+// name on a mount, or an empty string if there is none
+func (m *MigrationRunner) identityAliasID(ctx context.Context, namespace, kind, name, accessor string) (string, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return "", err
+	}
+	secret, err := client.Logical().ListWithContext(ctx, path.Join("identity", kind, "id"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list identity %ses: %w", kind, err)
+	}
+	if secret == nil {
+		return "", nil
+	}
+	info, _ := secret.Data["key_info"].(map[string]interface{})
+	for id, value := range info {
+		alias := stringKeyMap(value)
+		if stringField(alias, "name") == name && stringField(alias, "mount_accessor") == accessor {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+// identityTaskFromDiff converts a difference in an identity resource into an
+// identity task
+func identityTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	if _, ok := parseIdentityPath(diff.Path); !ok {
+		return Task{}, false
+	}
+	task := Task{Type: "identity", Path: diff.Path, Method: method}
+	if method != "DELETE" {
+		task.Data = stringKeyMap(diff.NewValue)
+	} else if mount := stringField(stringKeyMap(diff.OldValue), "mount"); mount != "" {
+		// Alias deletes look the alias up by its mount
+		task.Data = map[string]interface{}{"mount": mount}
+	}
+	return task, true
+}
+
+// isIdentityLoginResource reports whether a path is an entity or entity
+// alias. Vault creates these when users log in, so the generator does not
+// delete them when they are missing from the desired state.
+func isIdentityLoginResource(p string) bool {
+	resource, ok := parseIdentityPath(p)
+	return ok && (resource.kind == "entity" || resource.kind == "entity-alias")
+}
+
+// identityStateEqual compares the current state of an identity resource with
+// the desired one. Only the fields the desired state sets are compared, and
+// the order of members, policies and other lists does not matter.
+func identityStateEqual(current, desired interface{}) bool {
+	have, want := stringKeyMap(current), stringKeyMap(desired)
+	if have == nil || want == nil {
+		return configValuesEqual(current, desired)
+	}
+	for field, value := range want {
+		if identitySetFields[field] {
+			if !configValuesEqual(sortedStrings(emptyList(have[field])), sortedStrings(emptyList(value))) {
+				return false
+			}
+			continue
+		}
+		if !configFieldEqual(have[field], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// emptyList returns an empty list for a missing list field, which Vault
+// returns as null
+func emptyList(v interface{}) interface{} {
+	if v == nil {
+		return []interface{}{}
+	}
+	return v
+}
+
+// identityNames maps the IDs listed in key_info to the names of the entities
+// or groups
+func identityNames(keyInfo map[string]interface{}) map[string]string {
+	names := make(map[string]string, len(keyInfo))
+	for id, info := range keyInfo {
+		names[id] = stringField(stringKeyMap(info), "name")
+	}
+	return names
+}
+
+// namesForIDs replaces a list of IDs by the names they map to, sorted
+func namesForIDs(ids interface{}, names map[string]string) []interface{} {
+	list, _ := ids.([]interface{})
+	resolved := make([]string, 0, len(list))
+	for _, id := range list {
+		if name, ok := names[fmt.Sprint(id)]; ok {
+			resolved = append(resolved, name)
+		} else {
+			resolved = append(resolved, fmt.Sprint(id))
+		}
+	}
+	sort.Strings(resolved)
+	converted := make([]interface{}, len(resolved))
+	for i, name := range resolved {
+		converted[i] = name
+	}
+	return converted
+}
+
+// identityRank orders identity tasks among themselves: entities, groups,
+// groups with member groups, aliases, then OIDC resources in the order of
+// oidcKinds. Other tasks all have the same rank.
+func identityRank(task Task) int {
+	if task.Type != "identity" {
+		return 0
+	}
+	resource, _ := parseIdentityPath(task.Path)
+	switch resource.kind {
+	case "entity":
+		return 0
+	case "group":
+		if task.Data["member_groups"] != nil || task.Data["member_group_ids"] != nil {
+			return 2
+		}
+		return 1
+	case "entity-alias", "group-alias":
+		return 3
+	default:
+		return 4 + identityOIDCRank(strings.TrimPrefix(resource.kind, "oidc/"))
+	}
+}
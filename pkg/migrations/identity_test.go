@@ -0,0 +1,216 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityType_Validate(t *testing.T) {
+	valid := []Task{
+		{Type: "identity", Method: "PUT", Path: "identity/entity/name/alice", Data: map[string]interface{}{"policies": []interface{}{"dev"}}},
+		{Type: "identity", Method: "PUT", Path: "identity/group/name/devs", Data: map[string]interface{}{
+			"policies": []interface{}{"dev"}, "member_entities": []interface{}{"alice"},
+		}},
+		{Type: "identity", Method: "PUT", Path: "identity/group/name/admins", Data: map[string]interface{}{"type": "external"}},
+		{Type: "identity", Method: "PUT", Path: "identity/group-alias/name/vault-admins", Data: map[string]interface{}{"mount": "oidc", "group": "admins"}},
+		{Type: "identity", Method: "PUT", Path: "identity/entity-alias/name/alice", Data: map[string]interface{}{"mount": "auth/userpass", "entity": "alice"}},
+		{Type: "identity", Method: "DELETE", Path: "identity/group-alias/name/vault-admins", Data: map[string]interface{}{"mount": "oidc"}},
+		{Type: "identity", Method: "DELETE", Path: "identity/group/name/devs"},
+		{Type: "identity", Method: "PUT", Path: "identity/oidc/provider/default", Data: map[string]interface{}{"scopes_supported": []interface{}{"groups"}}},
+	}
+	for _, task := range valid {
+		assert.NoError(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+
+	invalid := []Task{
+		{Type: "identity", Method: "PUT", Path: "identity/group/id/1234", Data: map[string]interface{}{"policies": []interface{}{"dev"}}},
+		{Type: "identity", Method: "PUT", Path: "identity/oidc/unknown/x", Data: map[string]interface{}{"a": 1}},
+		{Type: "identity", Method: "PUT", Path: "identity/entity/name/alice", Data: map[string]interface{}{"member_entities": []interface{}{"bob"}}},
+		{Type: "identity", Method: "PUT", Path: "identity/group/name/devs", Data: map[string]interface{}{"member_entities": "alice"}},
+		{Type: "identity", Method: "PUT", Path: "identity/group/name/admins", Data: map[string]interface{}{
+			"type": "external", "member_entities": []interface{}{"alice"},
+		}},
+		{Type: "identity", Method: "PUT", Path: "identity/group-alias/name/vault-admins", Data: map[string]interface{}{"group": "admins"}},
+		{Type: "identity", Method: "PUT", Path: "identity/entity-alias/name/alice", Data: map[string]interface{}{"mount": "userpass"}},
+		{Type: "identity", Method: "DELETE", Path: "identity/group-alias/name/vault-admins"},
+		{Type: "identity", Method: "DELETE", Path: "identity/group/name/devs", Data: map[string]interface{}{"type": "internal"}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestIdentityType_Expand(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "sys/auth/userpass", map[string]interface{}{"type": "userpass", "accessor": "auth_userpass_1234"})
+	server.put("", "sys/auth/oidc", map[string]interface{}{"type": "oidc", "accessor": "auth_oidc_5678"})
+	server.put("", "identity/entity/name/alice", map[string]interface{}{"id": "entity-alice"})
+	server.put("", "identity/entity/name/bob", map[string]interface{}{"id": "entity-bob"})
+	server.put("", "identity/group/name/devs", map[string]interface{}{"id": "group-devs"})
+	server.put("", "identity/group/name/admins", map[string]interface{}{"id": "group-admins"})
+	server.handle("identity/entity-alias/id", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"keys": []interface{}{"alias-1", "alias-2"},
+			"key_info": map[string]interface{}{
+				"alias-1": map[string]interface{}{"name": "alice", "mount_accessor": "auth_oidc_5678"},
+				"alias-2": map[string]interface{}{"name": "alice", "mount_accessor": "auth_userpass_1234"},
+			},
+		}}))
+	})
+
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: t.TempDir()},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		task Task
+		want []Task
+	}{
+		{
+			name: "group members by name",
+			task: Task{Type: "identity", Method: "PUT", Path: "identity/group/name/engineering", Data: map[string]interface{}{
+				"policies":         []interface{}{"dev"},
+				"member_entities":  []interface{}{"alice", "bob"},
+				"member_groups":    []interface{}{"devs"},
+				"member_group_ids": []interface{}{"group-external"},
+			}},
+			want: []Task{{Method: "POST", Path: "identity/group/name/engineering", Data: map[string]interface{}{
+				"policies":          []interface{}{"dev"},
+				"member_entity_ids": []interface{}{"entity-alice", "entity-bob"},
+				"member_group_ids":  []interface{}{"group-external", "group-devs"},
+			}}},
+		},
+		{
+			name: "create a group alias",
+			task: Task{Type: "identity", Method: "PUT", Path: "identity/group-alias/name/vault-admins", Data: map[string]interface{}{
+				"mount": "auth/oidc", "group": "admins",
+			}},
+			want: []Task{{Method: "POST", Path: "identity/group-alias", Data: map[string]interface{}{
+				"name": "vault-admins", "mount_accessor": "auth_oidc_5678", "canonical_id": "group-admins",
+			}}},
+		},
+		{
+			name: "update an entity alias on the same mount",
+			task: Task{Type: "identity", Method: "PUT", Path: "identity/entity-alias/name/alice", Data: map[string]interface{}{
+				"mount": "userpass", "entity": "bob",
+			}},
+			want: []Task{{Method: "POST", Path: "identity/entity-alias/id/alias-2", Data: map[string]interface{}{
+				"name": "alice", "mount_accessor": "auth_userpass_1234", "canonical_id": "entity-bob",
+			}}},
+		},
+		{
+			name: "delete an entity alias",
+			task: Task{Type: "identity", Method: "DELETE", Path: "identity/entity-alias/name/alice", Data: map[string]interface{}{"mount": "oidc"}},
+			want: []Task{{Method: "DELETE", Path: "identity/entity-alias/id/alias-1"}},
+		},
+		{
+			name: "delete a missing group alias",
+			task: Task{Type: "identity", Method: "DELETE", Path: "identity/group-alias/name/gone", Data: map[string]interface{}{"mount": "oidc"}},
+			want: []Task{},
+		},
+		{
+			name: "oidc provider",
+			task: Task{Type: "identity", Method: "PUT", Path: "identity/oidc/provider/default", Data: map[string]interface{}{"issuer": "https://vault"}},
+			want: []Task{{Method: "POST", Path: "identity/oidc/provider/default", Data: map[string]interface{}{"issuer": "https://vault"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runner.expandType(ctx, tt.task)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, requests(got))
+		})
+	}
+
+	_, err = runner.expandType(ctx, Task{Type: "identity", Method: "PUT", Path: "identity/group/name/x", Data: map[string]interface{}{
+		"member_entities": []interface{}{"carol"},
+	}})
+	assert.ErrorContains(t, err, `identity entity "carol" does not exist`)
+
+	_, err = runner.expandType(ctx, Task{Type: "identity", Method: "PUT", Path: "identity/group-alias/name/x", Data: map[string]interface{}{
+		"mount": "ldap", "group": "admins",
+	}})
+	assert.ErrorContains(t, err, "auth method ldap is not enabled")
+}
+
+func TestIdentityStateEqual(t *testing.T) {
+	current := map[string]interface{}{
+		"type":            "internal",
+		"policies":        []interface{}{"ops", "dev"},
+		"member_entities": []interface{}{"bob", "alice"},
+		"member_groups":   []interface{}{},
+	}
+
+	assert.True(t, identityStateEqual(current, map[interface{}]interface{}{
+		"policies":        []interface{}{"dev", "ops"},
+		"member_entities": []interface{}{"alice", "bob"},
+	}), "the order of members and policies does not matter")
+	assert.True(t, identityStateEqual(map[string]interface{}{"policies": nil}, map[interface{}]interface{}{
+		"policies": []interface{}{},
+	}))
+	assert.False(t, identityStateEqual(current, map[interface{}]interface{}{
+		"member_entities": []interface{}{"alice"},
+	}))
+	assert.False(t, identityStateEqual(current, map[interface{}]interface{}{
+		"member_groups": []interface{}{"devs"},
+	}))
+}
+
+func TestGenerateTasksFromDiffs_Identity(t *testing.T) {
+	current := map[string]interface{}{
+		"identity/entity/name/login-created": map[string]interface{}{"policies": []interface{}{}},
+		"identity/entity-alias/name/login-created": map[string]interface{}{
+			"mount": "oidc", "entity": "login-created",
+		},
+		"identity/group-alias/name/old": map[string]interface{}{"mount": "oidc", "group": "old"},
+		"identity/group/name/devs": map[string]interface{}{
+			"type": "internal", "policies": []interface{}{"b", "a"}, "member_entities": []interface{}{"bob", "alice"},
+		},
+	}
+	desired := map[string]interface{}{
+		"identity/group/name/devs": map[interface{}]interface{}{
+			"policies": []interface{}{"a", "b"}, "member_entities": []interface{}{"alice", "bob"},
+		},
+		"identity/group/name/engineering": map[interface{}]interface{}{"member_groups": []interface{}{"devs", "ops"}},
+		"identity/group/name/ops":         map[interface{}]interface{}{"policies": []interface{}{"ops"}},
+		"identity/entity/name/carol":      map[interface{}]interface{}{"policies": []interface{}{"dev"}},
+		"identity/entity-alias/name/carol": map[interface{}]interface{}{
+			"mount": "userpass", "entity": "carol",
+		},
+		"identity/oidc/provider/default": map[interface{}]interface{}{"scopes_supported": []interface{}{"groups"}},
+		"identity/oidc/scope/groups":     map[interface{}]interface{}{"template": "{}"},
+	}
+
+	tasks := generateTasksFromDiffs(compareConfigs(current, desired))
+	orderTasks(tasks)
+
+	var paths []string
+	for _, task := range tasks {
+		assert.Equal(t, "identity", task.Type, task.Path)
+		paths = append(paths, task.Method+" "+task.Path)
+	}
+	assert.Equal(t, []string{
+		"POST identity/entity/name/carol",
+		"POST identity/group/name/ops",
+		"POST identity/group/name/engineering",
+		"POST identity/entity-alias/name/carol",
+		"DELETE identity/group-alias/name/old",
+		"POST identity/oidc/scope/groups",
+		"POST identity/oidc/provider/default",
+	}, paths, "unchanged groups, and entities created by logins, are left alone")
+	for _, task := range tasks {
+		if task.Method == "DELETE" {
+			assert.Equal(t, map[string]interface{}{"mount": "oidc"}, task.Data)
+		}
+	}
+}
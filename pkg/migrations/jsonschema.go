@@ -0,0 +1,280 @@
+package migrations
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// JSONSchema is the subset of JSON Schema (draft 2020-12) that describes the
+// resources of a schema file. The same definitions validate schema files and
+// are exported for editors.
+type JSONSchema struct {
+	Schema      string `json:"$schema,omitempty"`
+	ID          string `json:"$id,omitempty"`
+	Ref         string `json:"$ref,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Type    []string      `json:"type,omitempty"`
+	Enum    []interface{} `json:"enum,omitempty"`
+	Pattern string        `json:"pattern,omitempty"`
+
+	Properties        map[string]*JSONSchema `json:"properties,omitempty"`
+	PatternProperties map[string]*JSONSchema `json:"patternProperties,omitempty"`
+	// AdditionalProperties is false, or the schema of properties that are
+	// not listed
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+	Required             []string    `json:"required,omitempty"`
+	Items                *JSONSchema `json:"items,omitempty"`
+
+	If   *JSONSchema `json:"if,omitempty"`
+	Then *JSONSchema `json:"then,omitempty"`
+
+	Defs map[string]*JSONSchema `json:"$defs,omitempty"`
+}
+
+// SchemaError is a schema file value that does not match its JSON Schema
+type SchemaError struct {
+	File   string
+	Line   int
+	Column int
+	// Path is the keys leading to the value, such as sys/mounts/kv/ and config
+	Path    []string
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	location := fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Column)
+	if len(e.Path) == 0 {
+		return location + ": " + e.Message
+	}
+	return location + ": " + strings.Join(e.Path, ": ") + ": " + e.Message
+}
+
+// schemaValidator validates the YAML nodes of a file against a JSON Schema
+type schemaValidator struct {
+	root   *JSONSchema
+	file   string
+	errors []SchemaError
+}
+
+// validateYAML validates the document of a YAML file against a JSON Schema
+// and returns every mismatch, in the order they appear in the file
+func validateYAML(schema *JSONSchema, file string, data []byte) ([]SchemaError, error) {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse schema file %s: %w", file, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	v := &schemaValidator{root: schema, file: file}
+	v.validate(schema, doc.Content[0], nil)
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		if v.errors[i].Line != v.errors[j].Line {
+			return v.errors[i].Line < v.errors[j].Line
+		}
+		return v.errors[i].Column < v.errors[j].Column
+	})
+	return v.errors, nil
+}
+
+func (v *schemaValidator) fail(node *yaml3.Node, path []string, format string, args ...interface{}) {
+	v.errors = append(v.errors, SchemaError{
+		File:    v.file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    append([]string(nil), path...),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// matches reports whether a node is valid against a schema, without
+// recording errors
+func (v *schemaValidator) matches(schema *JSONSchema, node *yaml3.Node) bool {
+	probe := &schemaValidator{root: v.root, file: v.file}
+	probe.validate(schema, node, nil)
+	return len(probe.errors) == 0
+}
+
+func (v *schemaValidator) validate(schema *JSONSchema, node *yaml3.Node, path []string) {
+	for node.Kind == yaml3.AliasNode {
+		node = node.Alias
+	}
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/$defs/")
+		if def := v.root.Defs[name]; def != nil {
+			v.validate(def, node, path)
+		}
+	}
+	if schema.If != nil && schema.Then != nil && v.matches(schema.If, node) {
+		v.validate(schema.Then, node, path)
+	}
+
+	if len(schema.Type) > 0 && !nodeHasType(node, schema.Type) {
+		v.fail(node, path, "must be %s, not %s", strings.Join(schema.Type, " or "), nodeTypeName(node))
+		return
+	}
+	if len(schema.Enum) > 0 && !nodeInEnum(node, schema.Enum) {
+		v.fail(node, path, "must be one of %s", enumText(schema.Enum))
+	}
+	if schema.Pattern != "" && node.Kind == yaml3.ScalarNode && node.Tag == "!!str" &&
+		!regexp.MustCompile(schema.Pattern).MatchString(node.Value) {
+		v.fail(node, path, "%q does not match %s", node.Value, schema.Pattern)
+	}
+
+	switch node.Kind {
+	case yaml3.MappingNode:
+		v.validateMapping(schema, node, path)
+	case yaml3.SequenceNode:
+		if schema.Items != nil {
+			for i, item := range node.Content {
+				v.validate(schema.Items, item, append(path, fmt.Sprintf("[%d]", i)))
+			}
+		}
+	}
+}
+
+func (v *schemaValidator) validateMapping(schema *JSONSchema, node *yaml3.Node, path []string) {
+	present := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Tag == "!!merge" {
+			continue
+		}
+		present[key.Value] = true
+		keyPath := append(path, key.Value)
+
+		known := false
+		if property := schema.Properties[key.Value]; property != nil {
+			v.validate(property, value, keyPath)
+			known = true
+		}
+		patterns := make([]string, 0, len(schema.PatternProperties))
+		for pattern := range schema.PatternProperties {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			if regexp.MustCompile(pattern).MatchString(key.Value) {
+				v.validate(schema.PatternProperties[pattern], value, keyPath)
+				known = true
+			}
+		}
+		if known {
+			continue
+		}
+
+		switch additional := schema.AdditionalProperties.(type) {
+		case bool:
+			if !additional {
+				message := fmt.Sprintf("unknown field %q", key.Value)
+				if suggestion := closestField(key.Value, schema.Properties); suggestion != "" {
+					message += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+				v.fail(key, path, "%s", message)
+			}
+		case *JSONSchema:
+			v.validate(additional, value, keyPath)
+		}
+	}
+
+	for _, field := range schema.Required {
+		if !present[field] {
+			v.fail(node, path, "missing required field %q", field)
+		}
+	}
+}
+
+// nodeTypeName returns the JSON type of a YAML node
+func nodeTypeName(node *yaml3.Node) string {
+	switch node.Kind {
+	case yaml3.MappingNode:
+		return "object"
+	case yaml3.SequenceNode:
+		return "array"
+	}
+	switch node.Tag {
+	case "!!int":
+		return "integer"
+	case "!!float":
+		return "number"
+	case "!!bool":
+		return "boolean"
+	case "!!null":
+		return "null"
+	default:
+		return "string"
+	}
+}
+
+// nodeHasType reports whether a YAML node is of one of the JSON types
+func nodeHasType(node *yaml3.Node, types []string) bool {
+	actual := nodeTypeName(node)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeInEnum reports whether a scalar node equals one of the enum values
+func nodeInEnum(node *yaml3.Node, enum []interface{}) bool {
+	if node.Kind != yaml3.ScalarNode {
+		return false
+	}
+	for _, value := range enum {
+		if fmt.Sprint(value) == node.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// enumText lists enum values for an error message
+func enumText(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, value := range enum {
+		values[i] = fmt.Sprintf("%q", fmt.Sprint(value))
+	}
+	return strings.Join(values, ", ")
+}
+
+// closestField returns the known field a misspelled field most likely
+// meant, or an empty string if none is close
+func closestField(field string, properties map[string]*JSONSchema) string {
+	best, bestDistance := "", 3
+	for name := range properties {
+		if d := editDistance(field, name); d < bestDistance || (d == bestDistance && best != "" && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,93 @@
+package migrations
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateYAML_SchemaFile(t *testing.T) {
+	data := []byte(`include: [schema.d/]
+desired_state:
+  sys/mounts/kv/:
+    type: kv
+    config:
+      max_leaes_ttl: 24h
+      default_lease_ttl: forever
+  auth/kubernetes:
+    type: kubernetes
+    local: "yes"
+  auth/kubernetes/role/app:
+    bound_service_account_names: [app]
+  secret/:
+    description: not a mount without a type
+  sys/audit/file:
+    options:
+      file_path: /vault/audit.log
+  sys/quotas/rate-limit/global:
+    rate: 100
+    interval: 1s
+  identity/group/name/admins:
+    type: admins
+  kv/data/app:
+    anything: goes
+`)
+
+	mismatches, err := validateYAML(SchemaFileSchema(), "schema.yaml", data)
+	require.NoError(t, err)
+
+	var messages []string
+	for _, mismatch := range mismatches {
+		messages = append(messages, mismatch.Error())
+	}
+	assert.Equal(t, []string{
+		`schema.yaml:6:7: desired_state: sys/mounts/kv/: config: unknown field "max_leaes_ttl", did you mean "max_lease_ttl"?`,
+		`schema.yaml:7:26: desired_state: sys/mounts/kv/: config: default_lease_ttl: "forever" does not match ` + ttl().Pattern,
+		`schema.yaml:10:12: desired_state: auth/kubernetes: local: must be boolean, not string`,
+		`schema.yaml:16:5: desired_state: sys/audit/file: missing required field "type"`,
+		`schema.yaml:22:11: desired_state: identity/group/name/admins: type: must be one of "internal", "external"`,
+	}, messages)
+}
+
+func TestLoadSchema_Invalid(t *testing.T) {
+	dir := writeSchemaFiles(t, map[string]string{
+		"schema.yaml": `include: [team.yaml]
+desired_state:
+  sys/mounts/kv/:
+    type: kv
+    config:
+      max_leaes_ttl: 24h
+`,
+		"team.yaml": `desired_state:
+  sys/plugins/catalog/secret/my-secrets:
+    sha256: abc
+`,
+	})
+
+	_, err := LoadSchema(filepath.Join(dir, "schema.yaml"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), filepath.Join(dir, "schema.yaml")+`:6:7: desired_state: sys/mounts/kv/: config: unknown field "max_leaes_ttl"`)
+	assert.Contains(t, err.Error(), filepath.Join(dir, "team.yaml")+`:3:5: desired_state: sys/plugins/catalog/secret/my-secrets: missing required field "command"`)
+	assert.Contains(t, err.Error(), filepath.Join(dir, "team.yaml")+`:3:13: desired_state: sys/plugins/catalog/secret/my-secrets: sha256: "abc" does not match`)
+}
+
+func TestSchemaFileSchema_Export(t *testing.T) {
+	data, err := json.Marshal(SchemaFileSchema())
+	require.NoError(t, err)
+
+	var exported map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &exported))
+	assert.Equal(t, jsonSchemaDialect, exported["$schema"])
+	defs, _ := exported["$defs"].(map[string]interface{})
+	for name := range ResourceSchemas() {
+		assert.Contains(t, defs, name)
+	}
+
+	mount := ResourceSchemas()["mount"]
+	assert.Equal(t, jsonSchemaDialect, mount.Schema)
+	assert.Equal(t, false, mount.AdditionalProperties)
+	assert.Equal(t, []string{"type"}, mount.Required)
+}
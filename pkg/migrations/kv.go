@@ -0,0 +1,223 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// kvType handles tasks on KV secrets. The task path is the logical path used
+// by "vault kv", such as secret/app/config; the mount and its version are
+// looked up in sys/internal/ui/mounts and the request is sent to the data,
+// metadata, delete, undelete or destroy endpoint as the version requires.
+type kvType struct{}
+
+// kvMount is the KV mount a path belongs to
+type kvMount struct {
+	path    string
+	version int
+}
+
+func (kvType) validate(task Task) error {
+	switch task.Method {
+	case "POST", "PUT":
+		if len(task.Data) == 0 && len(task.Metadata) == 0 {
+			return fmt.Errorf("kv %s needs data or metadata", task.Method)
+		}
+	case "PATCH":
+		if len(task.Data) == 0 {
+			return fmt.Errorf("kv PATCH needs data")
+		}
+	case "UNDELETE":
+		if len(task.Versions) == 0 {
+			return fmt.Errorf("kv UNDELETE needs versions")
+		}
+	case "DELETE", "DESTROY", "READ", "LIST", "ASSERT", "WAIT_FOR", "EXISTS", "ABSENT":
+	default:
+		return fmt.Errorf("unsupported kv method: %s", task.Method)
+	}
+
+	switch task.Method {
+	case "POST", "PUT", "PATCH":
+		if len(task.Versions) > 0 {
+			return fmt.Errorf("versions is not supported by kv %s", task.Method)
+		}
+	case "DELETE", "UNDELETE", "DESTROY":
+		if len(task.Data) > 0 || len(task.Metadata) > 0 || task.CAS != nil {
+			return fmt.Errorf("data, metadata and cas are not supported by kv %s", task.Method)
+		}
+	default:
+		if len(task.Data) > 0 || len(task.Metadata) > 0 || task.CAS != nil || len(task.Versions) > 0 {
+			return fmt.Errorf("data, metadata, cas and versions are not supported by kv %s", task.Method)
+		}
+	}
+	if len(task.Metadata) > 0 && task.Method == "PATCH" {
+		return fmt.Errorf("metadata is not supported by kv PATCH")
+	}
+	return nil
+}
+
+func (kvType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	mount, err := m.kvMount(ctx, task.Namespace, task.Path)
+	if err != nil {
+		return nil, err
+	}
+	logical := strings.Trim(task.Path, "/") + "/"
+	if !strings.HasPrefix(logical, mount.path) {
+		return nil, fmt.Errorf("path is not below the mount %s", mount.path)
+	}
+	key := strings.TrimSuffix(strings.TrimPrefix(logical, mount.path), "/")
+	if key == "" && task.Method != "LIST" {
+		return nil, fmt.Errorf("path must name a secret below the mount %s", mount.path)
+	}
+
+	raw := func(method, p string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Path, t.Data = method, p, data
+		t.CAS, t.Versions, t.Metadata = nil, nil, nil
+		return t
+	}
+
+	if mount.version < 2 {
+		switch {
+		case task.CAS != nil || len(task.Metadata) > 0 || len(task.Versions) > 0:
+			return nil, fmt.Errorf("cas, metadata and versions need KV version 2, %s is version 1", mount.path)
+		case task.Method == "PATCH" || task.Method == "UNDELETE" || task.Method == "DESTROY":
+			return nil, fmt.Errorf("%s needs KV version 2, %s is version 1", task.Method, mount.path)
+		case task.Method == "PUT":
+			return []Task{raw("POST", task.Path, task.Data)}, nil
+		default:
+			return []Task{raw(task.Method, task.Path, task.Data)}, nil
+		}
+	}
+
+	dataPath := path.Join(mount.path, "data", key)
+	metadataPath := path.Join(mount.path, "metadata", key)
+	versions := map[string]interface{}{"versions": task.Versions}
+
+	switch task.Method {
+	case "POST", "PUT", "PATCH":
+		var tasks []Task
+		if len(task.Data) > 0 {
+			payload := map[string]interface{}{"data": task.Data}
+			if task.CAS != nil {
+				payload["options"] = map[string]interface{}{"cas": *task.CAS}
+			}
+			method := "POST"
+			if task.Method == "PATCH" {
+				method = "PATCH"
+			}
+			tasks = append(tasks, raw(method, dataPath, payload))
+		}
+		// Metadata writes only change the fields they set
+		if len(task.Metadata) > 0 {
+			tasks = append(tasks, raw("POST", metadataPath, task.Metadata))
+		}
+		return tasks, nil
+	case "DELETE":
+		if len(task.Versions) > 0 {
+			return []Task{raw("POST", path.Join(mount.path, "delete", key), versions)}, nil
+		}
+		return []Task{raw("DELETE", dataPath, nil)}, nil
+	case "UNDELETE":
+		return []Task{raw("POST", path.Join(mount.path, "undelete", key), versions)}, nil
+	case "DESTROY":
+		if len(task.Versions) > 0 {
+			return []Task{raw("PUT", path.Join(mount.path, "destroy", key), versions)}, nil
+		}
+		// Without versions every version and the metadata are removed
+		return []Task{raw("DELETE", metadataPath, nil)}, nil
+	case "LIST":
+		return []Task{raw("LIST", metadataPath, nil)}, nil
+	default:
+		return []Task{raw(task.Method, dataPath, nil)}, nil
+	}
+}
+
+// kvMount looks up the KV mount a logical path belongs to and its version
+func (m *MigrationRunner) kvMount(ctx context.Context, namespace, logicalPath string) (kvMount, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return kvMount{}, err
+	}
+	if client == nil {
+		return kvMount{}, fmt.Errorf("cannot look up mount without Vault client")
+	}
+
+	secret, err := client.Logical().ReadWithContext(ctx, path.Join("sys/internal/ui/mounts", logicalPath))
+	if err != nil {
+		return kvMount{}, fmt.Errorf("failed to look up mount: %w", err)
+	}
+	if secret == nil {
+		return kvMount{}, fmt.Errorf("no mount found for %s", logicalPath)
+	}
+
+	mountType := stringField(secret.Data, "type")
+	if mountType != "kv" && mountType != "generic" {
+		return kvMount{}, fmt.Errorf("%s is not on a KV mount (type %q)", logicalPath, mountType)
+	}
+
+	mount := kvMount{path: strings.TrimSuffix(stringField(secret.Data, "path"), "/") + "/", version: 1}
+	if options, ok := secret.Data["options"].(map[string]interface{}); ok && stringField(options, "version") == "2" {
+		mount.version = 2
+	}
+	return mount, nil
+}
+
+// kvMetadataFields are the metadata fields of a KV version 2 secret that can
+// be written, and so are read into the current state
+var kvMetadataFields = []string{"max_versions", "cas_required", "delete_version_after", "custom_metadata"}
+
+// isKVEntry reports whether a desired state entry is a KV version 2 secret,
+// written as <mount>/data/<path> with data or metadata
+func isKVEntry(p string, value interface{}) bool {
+	parts := strings.SplitN(p, "/", 3)
+	if len(parts) < 3 || parts[1] != "data" || parts[2] == "" {
+		return false
+	}
+	fields := stringKeyMap(value)
+	return fields["data"] != nil || fields["metadata"] != nil
+}
+
+// kvDataFingerprint returns the fingerprint of the data of a secret, which
+// the current state and the state file hold instead of the values
+func kvDataFingerprint(data interface{}) string {
+	if s, ok := data.(string); ok && strings.HasPrefix(s, fingerprintPrefix) {
+		return s
+	}
+	return fingerprint(stringKeyMap(data))
+}
+
+// kvDataEqual compares the data of a secret, by fingerprint when the
+// current state holds one
+func kvDataEqual(current, desired interface{}) bool {
+	if s, ok := current.(string); ok && strings.HasPrefix(s, fingerprintPrefix) {
+		return desired != nil && s == kvDataFingerprint(desired)
+	}
+	return configValuesEqual(current, desired)
+}
+
+// kvMetadataEqual compares the metadata fields the desired state sets
+func kvMetadataEqual(current, desired interface{}) bool {
+	have := stringKeyMap(current)
+	for field, value := range stringKeyMap(desired) {
+		if !configFieldEqual(have[field], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// kvStateEqual compares the current state of a KV version 2 secret with the
+// desired one
+func kvStateEqual(current, desired interface{}) bool {
+	have, want := stringKeyMap(current), stringKeyMap(desired)
+	if have == nil || want == nil {
+		return configValuesEqual(current, desired)
+	}
+	if want["data"] != nil && !kvDataEqual(have["data"], want["data"]) {
+		return false
+	}
+	return kvMetadataEqual(have["metadata"], want["metadata"])
+}
@@ -0,0 +1,226 @@
+package migrations
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKVServer(t *testing.T) *testVaultServer {
+	server := newTestVaultServer(t)
+	server.put("", "sys/mounts/secret", map[string]interface{}{"type": "kv", "options": map[string]interface{}{"version": "2"}})
+	server.put("", "sys/mounts/legacy", map[string]interface{}{"type": "kv", "options": map[string]interface{}{"version": "1"}})
+	server.put("", "sys/mounts/pki", map[string]interface{}{"type": "pki"})
+	return server
+}
+
+func TestKVType_Expand(t *testing.T) {
+	server := newTestKVServer(t)
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: t.TempDir()},
+	})
+	require.NoError(t, err)
+	cas := 3
+
+	tests := []struct {
+		name string
+		task Task
+		want []Task
+	}{
+		{
+			name: "v2 write with cas and metadata",
+			task: Task{
+				Type: "kv", Method: "PUT", Path: "secret/app/config", CAS: &cas,
+				Data:     map[string]interface{}{"key": "value"},
+				Metadata: map[string]interface{}{"max_versions": 5},
+			},
+			want: []Task{
+				{Method: "POST", Path: "secret/data/app/config", Data: map[string]interface{}{
+					"data":    map[string]interface{}{"key": "value"},
+					"options": map[string]interface{}{"cas": 3},
+				}},
+				{Method: "POST", Path: "secret/metadata/app/config", Data: map[string]interface{}{"max_versions": 5}},
+			},
+		},
+		{
+			name: "v2 soft delete of versions",
+			task: Task{Type: "kv", Method: "DELETE", Path: "secret/app/config", Versions: []int{1, 2}},
+			want: []Task{{Method: "POST", Path: "secret/delete/app/config", Data: map[string]interface{}{"versions": []int{1, 2}}}},
+		},
+		{
+			name: "v2 undelete",
+			task: Task{Type: "kv", Method: "UNDELETE", Path: "secret/app/config", Versions: []int{2}},
+			want: []Task{{Method: "POST", Path: "secret/undelete/app/config", Data: map[string]interface{}{"versions": []int{2}}}},
+		},
+		{
+			name: "v2 destroy versions",
+			task: Task{Type: "kv", Method: "DESTROY", Path: "secret/app/config", Versions: []int{1}},
+			want: []Task{{Method: "PUT", Path: "secret/destroy/app/config", Data: map[string]interface{}{"versions": []int{1}}}},
+		},
+		{
+			name: "v2 destroy everything",
+			task: Task{Type: "kv", Method: "DESTROY", Path: "secret/app/config"},
+			want: []Task{{Method: "DELETE", Path: "secret/metadata/app/config"}},
+		},
+		{
+			name: "v2 assert reads the data path",
+			task: Task{Type: "kv", Method: "EXISTS", Path: "secret/app/config", OnFail: "skip"},
+			want: []Task{{Method: "EXISTS", Path: "secret/data/app/config", OnFail: "skip"}},
+		},
+		{
+			name: "v1 write",
+			task: Task{Type: "kv", Method: "PUT", Path: "legacy/app", Data: map[string]interface{}{"key": "value"}},
+			want: []Task{{Method: "POST", Path: "legacy/app", Data: map[string]interface{}{"key": "value"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, kvType{}.validate(tt.task))
+			got, err := runner.expandType(context.Background(), tt.task)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	errors := []Task{
+		{Type: "kv", Method: "PUT", Path: "legacy/app", CAS: &cas, Data: map[string]interface{}{"key": "value"}},
+		{Type: "kv", Method: "UNDELETE", Path: "legacy/app", Versions: []int{1}},
+		{Type: "kv", Method: "PUT", Path: "pki/app", Data: map[string]interface{}{"key": "value"}},
+		{Type: "kv", Method: "PUT", Path: "missing/app", Data: map[string]interface{}{"key": "value"}},
+		{Type: "kv", Method: "PUT", Path: "secret", Data: map[string]interface{}{"key": "value"}},
+	}
+	for _, task := range errors {
+		_, err := runner.expandType(context.Background(), task)
+		assert.Error(t, err, "%+v", task)
+	}
+}
+
+func TestKVType_Validate(t *testing.T) {
+	invalid := []Task{
+		{Type: "kv", Method: "PUT", Path: "secret/a"},
+		{Type: "kv", Method: "UNDELETE", Path: "secret/a"},
+		{Type: "kv", Method: "DELETE", Path: "secret/a", Data: map[string]interface{}{"key": "value"}},
+		{Type: "kv", Method: "PUT", Path: "secret/a", Data: map[string]interface{}{"key": "value"}, Versions: []int{1}},
+		{Type: "kv", Method: "PATCH", Path: "secret/a", Metadata: map[string]interface{}{"max_versions": 1}},
+		{Type: "kv", Method: "TOUCH", Path: "secret/a"},
+		{Type: "unknown", Method: "PUT", Path: "secret/a"},
+		{Method: "PUT", Path: "secret/a", Versions: []int{1}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestMigrationRunner_KVTasks(t *testing.T) {
+	server := newTestKVServer(t)
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{
+					Type: "kv", Method: "write", Path: "secret/app/config",
+					Data:     map[string]interface{}{"api_key": "example"},
+					Metadata: map[string]interface{}{"custom_metadata": map[string]interface{}{"owner": "team-a"}},
+				},
+				{Type: "kv", Method: "ASSERT", Path: "secret/app/config", Expect: []Expectation{{Field: "$.data.api_key"}}},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir, ConcurrentTasks: true, Snapshots: true},
+		})
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		report, err := runner.DryRun(ctx, ApplyOptions{})
+		require.NoError(t, err)
+		require.Len(t, report.Tasks, 3)
+		assert.Equal(t, "secret/data/app/config", report.Tasks[0].Path)
+		assert.Equal(t, ActionCreate, report.Tasks[0].Action)
+		assert.Equal(t, "secret/metadata/app/config", report.Tasks[1].Path)
+
+		require.NoError(t, runner.RunMigrations(ctx))
+	})
+
+	data, ok := server.get("", "secret/data/app/config")
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"api_key": "example"}, data["data"])
+	metadata, ok := server.get("", "secret/metadata/app/config")
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"owner": "team-a"}, metadata["custom_metadata"])
+}
+
+func TestGenerateTasksFromDiffs_KV(t *testing.T) {
+	tasks := generateTasksFromDiffs([]HCLDiff{
+		{
+			Path:     "secret/data/app/config",
+			OldValue: map[interface{}]interface{}{"data": map[interface{}]interface{}{"key": "old"}, "metadata": map[interface{}]interface{}{"max_versions": 5}},
+			NewValue: map[interface{}]interface{}{"data": map[interface{}]interface{}{"key": "new"}, "metadata": map[interface{}]interface{}{"max_versions": 5}},
+		},
+		{
+			Path:     "secret/data/app/removed",
+			OldValue: map[interface{}]interface{}{"data": map[interface{}]interface{}{"key": "old"}},
+		},
+		{
+			Path:     "auth/approle/role/app",
+			NewValue: map[interface{}]interface{}{"token_ttl": "1h"},
+		},
+	})
+
+	assert.Equal(t, []Task{
+		{Type: "kv", Method: "PUT", Path: "secret/app/config", Data: map[string]interface{}{"key": "new"}},
+		{Type: "kv", Method: "DELETE", Path: "secret/app/removed"},
+		{Method: "POST", Path: "auth/approle/role/app", Data: map[string]interface{}{"token_ttl": "1h"}},
+	}, tasks)
+}
+
+func TestGenerateIntelligentMigration_KV(t *testing.T) {
+	server := newTestKVServer(t)
+	client := &VaultClient{client: server.client(t)}
+	dir := t.TempDir()
+	desired := func(apiKey string) map[string]interface{} {
+		return map[string]interface{}{
+			"secret/data/app/config": map[interface{}]interface{}{
+				"data":     map[interface{}]interface{}{"api_key": apiKey, "port": 8080},
+				"metadata": map[interface{}]interface{}{"max_versions": 5, "custom_metadata": map[interface{}]interface{}{"owner": "team-a"}},
+			},
+		}
+	}
+	apply := func() {
+		runner, err := NewMigrationRunner(server.client(t), &Config{Migrations: MigrationsConfig{Directory: dir}})
+		require.NoError(t, err)
+		require.NoError(t, runner.RunMigrations(context.Background()))
+	}
+
+	_, err := GenerateIntelligentMigration(nil, desired("example"), dir)
+	require.NoError(t, err)
+	apply()
+	state, err := os.ReadFile(filepath.Join(dir, ".state.yaml"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(state), "example", "the state file holds a fingerprint of the data")
+
+	live, err := client.GetKVState(desired("example"))
+	require.NoError(t, err)
+	result, err := GenerateIntelligentMigration(live, desired("example"), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "No migrations required - configurations are identical", result)
+
+	live, err = client.GetKVState(desired("rotated"))
+	require.NoError(t, err)
+	result, err = GenerateIntelligentMigration(live, desired("rotated"), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "Generated migration version 2 with 1 tasks", result)
+	migrations, err := readMigrations(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []Task{
+		{Type: "kv", Method: "PUT", Path: "secret/app/config", Data: map[string]interface{}{"api_key": "rotated", "port": 8080}},
+	}, migrations[1].Tasks, "only the data changed")
+}
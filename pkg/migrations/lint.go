@@ -0,0 +1,276 @@
+package migrations
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// LintSeverity is how serious a lint finding is.
+type LintSeverity string
+
+// Lint severities. Errors are policies Vault would reject; warnings are grants
+// a reviewer should look at.
+const (
+	LintError   LintSeverity = "error"
+	LintWarning LintSeverity = "warning"
+)
+
+// LintFinding is a problem found in an ACL policy.
+type LintFinding struct {
+	Severity  LintSeverity `json:"severity"`
+	Namespace string       `json:"namespace,omitempty"`
+	Policy    string       `json:"policy"`
+	Path      string       `json:"path,omitempty"`
+	Message   string       `json:"message"`
+}
+
+// String formats the finding for logs
+func (f LintFinding) String() string {
+	location := f.Policy
+	if f.Namespace != "" {
+		location = f.Namespace + "/" + location
+	}
+	if f.Path != "" {
+		location += fmt.Sprintf(" path %q", f.Path)
+	}
+	return fmt.Sprintf("%s: %s: %s", f.Severity, location, f.Message)
+}
+
+// aclCapabilities are the capabilities Vault accepts in ACL path rules
+var aclCapabilities = map[string]bool{
+	"create": true, "read": true, "update": true, "patch": true, "delete": true,
+	"list": true, "sudo": true, "deny": true, "subscribe": true, "recover": true,
+}
+
+// policyReferenceFields are the fields roles, groups and tokens attach
+// policies with
+var policyReferenceFields = map[string]bool{
+	"policies":         true,
+	"token_policies":   true,
+	"allowed_policies": true,
+}
+
+// lintedPolicy is an ACL policy found in a set of tasks
+type lintedPolicy struct {
+	namespace string
+	endpoint  string
+	text      string
+}
+
+// LintMigrations lints the ACL policies the migrations write. Policies that
+// no role, group or token role in the migrations attaches are reported as
+// unused.
+func (m *MigrationRunner) LintMigrations(migrations []Migration) []LintFinding {
+	var tasks []Task
+	for _, migration := range migrations {
+		for _, task := range migration.Tasks {
+			if task.Namespace == "" {
+				task.Namespace = migration.Namespace
+			}
+			tasks = append(tasks, task)
+		}
+	}
+	return lintTasks(tasks, m.migrationsDir)
+}
+
+// LintDesiredState lints the ACL policies of a schema's desired state.
+// Policies that no role, group or token role in the desired state attaches
+// are reported as unused.
+func LintDesiredState(state map[string]interface{}) []LintFinding {
+	paths := make([]string, 0, len(state))
+	for p := range state {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	tasks := make([]Task, 0, len(paths))
+	for _, p := range paths {
+		tasks = append(tasks, taskFromDiff(HCLDiff{Path: p, NewValue: state[p]}))
+	}
+	return lintTasks(tasks, "")
+}
+
+// lintTasks lints the ACL policies written by a list of tasks, in order, so a
+// policy deleted by a later task is not linted
+func lintTasks(tasks []Task, baseDir string) []LintFinding {
+	var findings []LintFinding
+	policies := make(map[string]lintedPolicy)
+	referenced := make(map[string]bool)
+
+	for _, task := range tasks {
+		kind, name := policyEndpoint(task.Path)
+		if kind == "" {
+			collectPolicyReferences(task.Data, referenced)
+			continue
+		}
+		if kind != "acl" {
+			continue
+		}
+		endpoint := path.Join("sys/policies/acl", name)
+		key := task.Namespace + "|" + endpoint
+		switch canonicalMethod(task.Method) {
+		case "DELETE":
+			delete(policies, key)
+			continue
+		case "POST", "PUT":
+		default:
+			continue
+		}
+
+		var text string
+		if task.Type == "policy" {
+			var err error
+			if text, err = policyText(task.Data, baseDir); err != nil {
+				findings = append(findings, LintFinding{Severity: LintError, Namespace: task.Namespace, Policy: endpoint, Message: err.Error()})
+				continue
+			}
+		} else if text = stringField(task.Data, "policy"); text == "" {
+			continue
+		}
+		policies[key] = lintedPolicy{namespace: task.Namespace, endpoint: endpoint, text: text}
+	}
+
+	for _, policy := range policies {
+		findings = append(findings, lintPolicy(policy)...)
+		name := path.Base(policy.endpoint)
+		if name != "default" && !referenced[name] {
+			findings = append(findings, LintFinding{
+				Severity:  LintWarning,
+				Namespace: policy.namespace,
+				Policy:    policy.endpoint,
+				Message:   "policy is not attached by any role, group or token role",
+			})
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Policy != b.Policy {
+			return a.Policy < b.Policy
+		}
+		return a.Path < b.Path
+	})
+	return findings
+}
+
+// lintPolicy checks the path rules of a single ACL policy
+func lintPolicy(policy lintedPolicy) []LintFinding {
+	finding := func(severity LintSeverity, rulePath, format string, args ...interface{}) LintFinding {
+		return LintFinding{
+			Severity:  severity,
+			Namespace: policy.namespace,
+			Policy:    policy.endpoint,
+			Path:      rulePath,
+			Message:   fmt.Sprintf(format, args...),
+		}
+	}
+
+	rules, err := parsePolicy(policy.text)
+	if err != nil {
+		return []LintFinding{finding(LintError, "", "%v", err)}
+	}
+
+	var findings []LintFinding
+	for _, rule := range rules {
+		capabilities := ruleCapabilities(rule)
+		for _, capability := range capabilities {
+			if !aclCapabilities[capability] {
+				findings = append(findings, finding(LintError, rule.path, "unknown capability %q", capability))
+			}
+		}
+		if slices.Contains(capabilities, "deny") {
+			continue
+		}
+		if slices.Contains(capabilities, "sudo") {
+			findings = append(findings, finding(LintWarning, rule.path, "grants sudo"))
+		}
+		switch strings.TrimSuffix(rule.path, "*") {
+		case "", "+/":
+			findings = append(findings, finding(LintWarning, rule.path, "grants %s on every path", strings.Join(capabilities, ", ")))
+		case "sys", "sys/":
+			findings = append(findings, finding(LintWarning, rule.path, "grants %s on all of sys/", strings.Join(capabilities, ", ")))
+		}
+	}
+
+	// Vault applies only the most specific rule matching a path, so a glob
+	// covering another rule silently stops applying below it
+	for _, rule := range rules {
+		for _, other := range rules {
+			if other.path == rule.path || !strings.HasSuffix(other.path, "*") {
+				continue
+			}
+			if aclPathMatches(other.path, strings.TrimSuffix(rule.path, "*")) {
+				findings = append(findings, finding(LintWarning, rule.path,
+					"overlaps %q; below this path only the capabilities of this rule apply", other.path))
+			}
+		}
+	}
+	return findings
+}
+
+// ruleCapabilities returns the capabilities of a path rule as strings
+func ruleCapabilities(rule policyRule) []string {
+	list, _ := sortedStrings(rule.fields["capabilities"]).([]interface{})
+	capabilities := make([]string, len(list))
+	for i, capability := range list {
+		capabilities[i] = fmt.Sprint(capability)
+	}
+	return capabilities
+}
+
+// aclPathMatches reports whether an ACL rule path matches a request path. A
+// trailing * matches any suffix and a + segment matches any single segment.
+func aclPathMatches(pattern, p string) bool {
+	glob := strings.HasSuffix(pattern, "*")
+	pattern = strings.TrimSuffix(pattern, "*")
+	patternSegments, pathSegments := strings.Split(pattern, "/"), strings.Split(p, "/")
+	if len(pathSegments) < len(patternSegments) || (!glob && len(pathSegments) != len(patternSegments)) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		switch {
+		case segment == "+":
+		case glob && i == len(patternSegments)-1:
+			if !strings.HasPrefix(pathSegments[i], segment) {
+				return false
+			}
+		case segment != pathSegments[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// collectPolicyReferences adds the policy names attached in task data to
+// referenced. Names are given as lists or as comma separated strings.
+func collectPolicyReferences(data map[string]interface{}, referenced map[string]bool) {
+	for field, value := range data {
+		if nested := stringKeyMap(value); nested != nil {
+			collectPolicyReferences(nested, referenced)
+			continue
+		}
+		if !policyReferenceFields[field] {
+			continue
+		}
+		switch names := value.(type) {
+		case string:
+			for _, name := range strings.Split(names, ",") {
+				referenced[strings.TrimSpace(name)] = true
+			}
+		case []interface{}:
+			for _, name := range names {
+				referenced[fmt.Sprint(name)] = true
+			}
+		case []string:
+			for _, name := range names {
+				referenced[name] = true
+			}
+		}
+	}
+}
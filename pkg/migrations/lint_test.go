@@ -0,0 +1,122 @@
+package migrations
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintPolicy(t *testing.T) {
+	policy := lintedPolicy{endpoint: "sys/policies/acl/ops", text: `
+path "*" {
+  capabilities = ["read"]
+}
+path "sys/*" {
+  capabilities = ["read", "update"]
+}
+path "sys/leases/revoke-force/*" {
+  capabilities = ["sudo", "update"]
+}
+path "secret/data/app/*" {
+  capabilities = ["read", "write"]
+}
+path "secret/data/app/private" {
+  capabilities = ["deny"]
+}
+`}
+
+	var got []string
+	for _, finding := range lintPolicy(policy) {
+		got = append(got, string(finding.Severity)+" "+finding.Path+": "+finding.Message)
+	}
+	assert.ElementsMatch(t, []string{
+		`warning *: grants read on every path`,
+		`warning sys/*: grants read, update on all of sys/`,
+		`warning sys/*: overlaps "*"; below this path only the capabilities of this rule apply`,
+		`warning sys/leases/revoke-force/*: grants sudo`,
+		`warning sys/leases/revoke-force/*: overlaps "*"; below this path only the capabilities of this rule apply`,
+		`warning sys/leases/revoke-force/*: overlaps "sys/*"; below this path only the capabilities of this rule apply`,
+		`error secret/data/app/*: unknown capability "write"`,
+		`warning secret/data/app/*: overlaps "*"; below this path only the capabilities of this rule apply`,
+		`warning secret/data/app/private: overlaps "*"; below this path only the capabilities of this rule apply`,
+		`warning secret/data/app/private: overlaps "secret/data/app/*"; below this path only the capabilities of this rule apply`,
+	}, got)
+
+	invalid := lintPolicy(lintedPolicy{endpoint: "sys/policies/acl/broken", text: `path "a" {`})
+	require.Len(t, invalid, 1)
+	assert.Equal(t, LintError, invalid[0].Severity)
+}
+
+func TestACLPathMatches(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"secret/*", "secret/data/app", true},
+		{"secret/*", "secret", false},
+		{"secret/data/ap*", "secret/data/app/config", true},
+		{"secret/+/app", "secret/data/app", true},
+		{"secret/+/app", "secret/data/app/config", false},
+		{"secret/+/app/*", "secret/data/app/config", true},
+		{"secret/data/app", "secret/data/app", true},
+		{"secret/data/app", "secret/data/other", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, aclPathMatches(tt.pattern, tt.path), "%s matches %s", tt.pattern, tt.path)
+	}
+}
+
+func TestLintDesiredState(t *testing.T) {
+	state := map[string]interface{}{
+		"sys/policies/acl/app": map[interface{}]interface{}{
+			"rules": []interface{}{map[interface{}]interface{}{"path": "secret/data/app/*", "capabilities": []interface{}{"read"}}},
+		},
+		"sys/policies/acl/ops": map[interface{}]interface{}{
+			"policy": `path "sys/health" { capabilities = ["read"] }`,
+		},
+		"sys/policies/acl/default": map[interface{}]interface{}{
+			"policy": `path "auth/token/lookup-self" { capabilities = ["read"] }`,
+		},
+		"auth/approle/role/app": map[interface{}]interface{}{
+			"token_policies": []interface{}{"app"},
+		},
+	}
+
+	findings := LintDesiredState(state)
+	require.Len(t, findings, 1)
+	assert.Equal(t, LintFinding{
+		Severity: LintWarning,
+		Policy:   "sys/policies/acl/ops",
+		Message:  "policy is not attached by any role, group or token role",
+	}, findings[0])
+}
+
+func TestMigrationRunner_LintMigrations(t *testing.T) {
+	runner, err := NewMigrationRunner(nil, &Config{DryRun: true, Migrations: MigrationsConfig{Directory: t.TempDir()}})
+	require.NoError(t, err)
+
+	findings := runner.LintMigrations([]Migration{
+		{
+			Version:   1,
+			Namespace: "team-a",
+			Tasks: []Task{
+				{Method: "PUT", Path: "sys/policy/old", Data: map[string]interface{}{"policy": `path "*" { capabilities = ["sudo"] }`}},
+				{Type: "policy", Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{
+					"policy": `path "sys/*" { capabilities = ["read"] }`,
+				}},
+				{Method: "POST", Path: "auth/token/roles/app", Data: map[string]interface{}{"allowed_policies": "app, other"}},
+			},
+		},
+		{
+			Version:   2,
+			Namespace: "team-a",
+			Tasks:     []Task{{Type: "policy", Method: "DELETE", Path: "sys/policies/acl/old"}},
+		},
+	})
+
+	require.Len(t, findings, 1, "the deleted policy is not linted")
+	assert.Equal(t, "team-a", findings[0].Namespace)
+	assert.Equal(t, "sys/*", findings[0].Path)
+	assert.Equal(t, `warning: team-a/sys/policies/acl/app path "sys/*": grants read on all of sys/`, findings[0].String())
+}
@@ -0,0 +1,290 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// lockTTL is how long a lock is honoured before it is considered stale. A
+// held lock is renewed every third of it, so only a crashed run leaves a lock
+// that expires.
+const lockTTL = 30 * time.Minute
+
+// errLockLost is returned when renewing a lock that was removed or taken
+// over by another run
+var errLockLost = errors.New("migration lock lost")
+
+// LockInfo describes the holder of the migration lock.
+type LockInfo struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the lock is stale and may be taken over.
+func (l *LockInfo) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+// lockHolder identifies this process as a lock holder
+func lockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// lockPath returns the path of the lock: lock_path if it is configured,
+// otherwise next to the version tracking path
+func (m *MigrationRunner) lockPath() string {
+	if m.lockEntryPath != "" {
+		return strings.Trim(m.lockEntryPath, "/")
+	}
+	return path.Join(path.Dir(m.trackingPath), "lock")
+}
+
+// lockEntry is where the lock is read, written and deleted
+type lockEntry struct {
+	path       string
+	deletePath string
+	// versioned is set on KV version 2 mounts, where the lock is written
+	// with check-and-set
+	versioned bool
+}
+
+// lockLocation looks up the mount of the lock path. On a KV version 2 mount
+// the lock goes through the data endpoint and is deleted with its metadata,
+// so the next run can create it again with cas 0. Other mounts, and mounts
+// that cannot be looked up, use the path as it is.
+func (m *MigrationRunner) lockLocation(ctx context.Context) lockEntry {
+	p := m.lockPath()
+	mount, err := m.kvMount(ctx, "", p)
+	if err != nil || mount.version < 2 {
+		return lockEntry{path: p, deletePath: p}
+	}
+	key := strings.TrimPrefix(p+"/", mount.path)
+	key = strings.TrimSuffix(key, "/")
+	return lockEntry{
+		path:       path.Join(mount.path, "data", key),
+		deletePath: path.Join(mount.path, "metadata", key),
+		versioned:  true,
+	}
+}
+
+// LockInfo returns the current lock holder, or nil if the lock is free.
+func (m *MigrationRunner) LockInfo(ctx context.Context) (*LockInfo, error) {
+	if m.client == nil {
+		return nil, fmt.Errorf("cannot read lock without Vault client")
+	}
+	info, _, err := m.readLock(ctx, m.lockLocation(ctx))
+	return info, err
+}
+
+// readLock reads the lock and, on KV version 2 mounts, the version of the
+// entry that a takeover has to check-and-set against
+func (m *MigrationRunner) readLock(ctx context.Context, entry lockEntry) (*LockInfo, int, error) {
+	secret, err := m.client.Logical().ReadWithContext(ctx, entry.path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read lock: %w", err)
+	}
+	if secret == nil {
+		return nil, 0, nil
+	}
+
+	data, version := secret.Data, 0
+	if entry.versioned {
+		data, _ = secret.Data["data"].(map[string]interface{})
+		if metadata, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+			version, _ = strconv.Atoi(fmt.Sprint(metadata["version"]))
+		}
+	}
+	if data == nil || data["holder"] == nil {
+		return nil, version, nil
+	}
+
+	info := &LockInfo{Holder: stringField(data, "holder")}
+	info.AcquiredAt, _ = time.Parse(time.RFC3339, stringField(data, "acquired_at"))
+	info.ExpiresAt, _ = time.Parse(time.RFC3339, stringField(data, "expires_at"))
+	return info, version, nil
+}
+
+// lockedError reports the holder of a lock this process could not take
+func lockedError(info *LockInfo) error {
+	return fmt.Errorf("migrations are locked by %s since %s", info.Holder, info.AcquiredAt.Format(time.RFC3339))
+}
+
+// acquireLock takes the migration lock so concurrent runs do not interleave.
+// Stale locks left by a crashed run expire after lockTTL. On a KV version 2
+// mount the lock is written with check-and-set against the version that was
+// read, so of two runs taking it at once only one succeeds; on other mounts
+// the lock is advisory.
+//
+// The lock is renewed until releaseLock is called. The returned context is
+// cancelled if the lock is lost, so the run stops instead of going on
+// without it.
+func (m *MigrationRunner) acquireLock(ctx context.Context) (context.Context, error) {
+	if m.client == nil {
+		return nil, fmt.Errorf("cannot acquire lock without Vault client")
+	}
+
+	entry := m.lockLocation(ctx)
+	info, version, err := m.readLock(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	if info != nil && info.Holder != m.holder() && !info.Expired() {
+		return nil, lockedError(info)
+	}
+
+	expiresAt, err := m.writeLock(ctx, entry, time.Now().UTC(), version)
+	if err != nil {
+		return nil, err
+	}
+
+	held, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.keepLock(held, entry, expiresAt, cancel)
+	}()
+	m.stopRenewal = func() {
+		cancel()
+		<-done
+	}
+	return held, nil
+}
+
+// writeLock writes the lock held by this runner, expiring lockTTL from now,
+// and returns when it expires
+func (m *MigrationRunner) writeLock(ctx context.Context, entry lockEntry, acquiredAt time.Time, version int) (time.Time, error) {
+	expiresAt := time.Now().UTC().Add(lockTTL)
+	data := map[string]interface{}{
+		"holder":      m.holder(),
+		"acquired_at": acquiredAt.Format(time.RFC3339),
+		"expires_at":  expiresAt.Format(time.RFC3339),
+	}
+	if entry.versioned {
+		data = map[string]interface{}{
+			"data":    data,
+			"options": map[string]interface{}{"cas": version},
+		}
+	}
+	if _, err := m.client.Logical().WriteWithContext(ctx, entry.path, data); err != nil {
+		if entry.versioned && isCASMismatch(err) {
+			// Another run took the lock after it was read
+			if info, _, readErr := m.readLock(ctx, entry); readErr == nil && info != nil {
+				return time.Time{}, lockedError(info)
+			}
+			return time.Time{}, fmt.Errorf("migrations are locked by another run")
+		}
+		return time.Time{}, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	return expiresAt, nil
+}
+
+// renewLock moves the expiry of the lock held by this runner lockTTL ahead
+func (m *MigrationRunner) renewLock(ctx context.Context, entry lockEntry) (time.Time, error) {
+	info, version, err := m.readLock(ctx, entry)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if info == nil {
+		return time.Time{}, fmt.Errorf("%w: it was removed", errLockLost)
+	}
+	if info.Holder != m.holder() {
+		return time.Time{}, fmt.Errorf("%w: %v", errLockLost, lockedError(info))
+	}
+	return m.writeLock(ctx, entry, info.AcquiredAt, version)
+}
+
+// keepLock renews the lock every third of lockTTL until ctx is done. A
+// failed renewal is retried at the next tick; when the lock is taken by
+// another run, or expires before it could be renewed, lost is called.
+func (m *MigrationRunner) keepLock(ctx context.Context, entry lockEntry, expiresAt time.Time, lost context.CancelFunc) {
+	ticker := time.NewTicker(lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		renewed, err := m.renewLock(ctx, entry)
+		if err == nil {
+			expiresAt = renewed
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !errors.Is(err, errLockLost) && time.Now().Before(expiresAt) {
+			m.logger.Warn().Err(err).Msg("Failed to renew migration lock, retrying")
+			continue
+		}
+		m.logger.Error().Err(err).Msg("Migration lock lost, stopping")
+		lost()
+		return
+	}
+}
+
+// isCASMismatch reports whether a write failed because the entry changed
+// since the version given in cas
+func isCASMismatch(err error) bool {
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	for _, message := range respErr.Errors {
+		if strings.Contains(message, "check-and-set") {
+			return true
+		}
+	}
+	return false
+}
+
+// holder identifies this runner as a lock holder
+func (m *MigrationRunner) holder() string {
+	if m.holderName != "" {
+		return m.holderName
+	}
+	return lockHolder()
+}
+
+// releaseLock stops renewing the lock and releases it if this process
+// holds it
+func (m *MigrationRunner) releaseLock(ctx context.Context) error {
+	if m.stopRenewal != nil {
+		m.stopRenewal()
+		m.stopRenewal = nil
+	}
+	info, err := m.LockInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.Holder != m.holder() {
+		return nil
+	}
+	return m.ForceUnlock(ctx)
+}
+
+// ForceUnlock removes the migration lock regardless of who holds it.
+func (m *MigrationRunner) ForceUnlock(ctx context.Context) error {
+	if m.client == nil {
+		return fmt.Errorf("cannot release lock without Vault client")
+	}
+	if _, err := m.client.Logical().DeleteWithContext(ctx, m.lockLocation(ctx).deletePath); err != nil {
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handleKVv2Lock serves migrations/ as a KV version 2 mount holding only the
+// lock, with check-and-set on writes. The first two reads are held until
+// both have arrived, so two acquirers see the lock free at the same time.
+func handleKVv2Lock(server *testVaultServer) {
+	server.put("", "sys/mounts/migrations", map[string]interface{}{
+		"type":    "kv",
+		"options": map[string]interface{}{"version": "2"},
+	})
+
+	var (
+		mu      sync.Mutex
+		reads   int
+		version int
+		lock    map[string]interface{}
+		readers sync.WaitGroup
+	)
+	readers.Add(2)
+
+	server.handle("migrations/data/lock", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			mu.Lock()
+			reads++
+			first := reads <= 2
+			mu.Unlock()
+			if first {
+				readers.Done()
+				readers.Wait()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if lock == nil {
+				writeTestVaultResponse(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+				return
+			}
+			writeTestVaultResponse(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+				"data":     lock,
+				"metadata": map[string]interface{}{"version": version},
+			}})
+		default:
+			var body struct {
+				Data    map[string]interface{} `json:"data"`
+				Options struct {
+					CAS *int `json:"cas"`
+				} `json:"options"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeTestVaultResponse(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if body.Options.CAS == nil || *body.Options.CAS != version {
+				writeTestVaultResponse(w, http.StatusBadRequest, map[string]interface{}{
+					"errors": []string{"check-and-set parameter did not match the current version"},
+				})
+				return
+			}
+			version++
+			lock = body.Data
+			writeTestVaultResponse(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"version": version}})
+		}
+	})
+	server.handle("migrations/metadata/lock", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		version, lock = 0, nil
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func TestMigrationRunner_LockRace(t *testing.T) {
+	server := newTestVaultServer(t)
+	handleKVv2Lock(server)
+
+	runners := make([]*MigrationRunner, 2)
+	for i, holder := range []string{"host-a:1", "host-b:2"} {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: t.TempDir(), LockHolder: holder},
+		})
+		require.NoError(t, err)
+		runners[i] = runner
+	}
+
+	ctx := context.Background()
+	errs := make([]error, len(runners))
+	var wg sync.WaitGroup
+	for i, runner := range runners {
+		wg.Add(1)
+		go func(i int, runner *MigrationRunner) {
+			defer wg.Done()
+			_, errs[i] = runner.acquireLock(ctx)
+		}(i, runner)
+	}
+	wg.Wait()
+
+	winner, loser := 0, 1
+	if errs[0] != nil {
+		winner, loser = 1, 0
+	}
+	require.NoError(t, errs[winner], "one run should take the lock")
+	require.Error(t, errs[loser], "the other run must not take the lock as well")
+	assert.Contains(t, errs[loser].Error(), "locked by "+runners[winner].holderName)
+
+	lock, err := runners[loser].LockInfo(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, lock)
+	assert.Equal(t, runners[winner].holderName, lock.Holder)
+
+	// Releasing deletes the metadata, so the lock can be created again
+	require.NoError(t, runners[winner].releaseLock(ctx))
+	_, err = runners[loser].acquireLock(ctx)
+	require.NoError(t, err)
+	require.NoError(t, runners[loser].releaseLock(ctx))
+}
+
+func TestMigrationRunner_RenewLock(t *testing.T) {
+	server := newTestVaultServer(t)
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: t.TempDir(), LockHolder: "host-a:1"},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	held, err := runner.acquireLock(ctx)
+	require.NoError(t, err)
+	entry := runner.lockLocation(ctx)
+
+	// A run that outlives the first expiry keeps the lock
+	acquired := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	server.put("", "migrations/lock", map[string]interface{}{
+		"holder":      "host-a:1",
+		"acquired_at": acquired,
+		"expires_at":  time.Now().UTC().Add(time.Minute).Format(time.RFC3339),
+	})
+	expiresAt, err := runner.renewLock(ctx, entry)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(lockTTL), expiresAt, time.Minute)
+	lock, err := runner.LockInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, acquired, lock.AcquiredAt.Format(time.RFC3339))
+	assert.Equal(t, expiresAt.Format(time.RFC3339), lock.ExpiresAt.Format(time.RFC3339))
+
+	// A lock taken over by another run is not renewed
+	server.put("", "migrations/lock", map[string]interface{}{
+		"holder":      "host-b:2",
+		"acquired_at": time.Now().UTC().Format(time.RFC3339),
+		"expires_at":  time.Now().UTC().Add(lockTTL).Format(time.RFC3339),
+	})
+	_, err = runner.renewLock(ctx, entry)
+	assert.ErrorIs(t, err, errLockLost)
+	assert.ErrorContains(t, err, "locked by host-b:2")
+
+	require.NoError(t, runner.releaseLock(ctx))
+	assert.ErrorIs(t, held.Err(), context.Canceled, "releasing stops the renewal")
+}
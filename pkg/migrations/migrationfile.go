@@ -0,0 +1,243 @@
+package migrations
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"gopkg.in/yaml.v2"
+)
+
+// migrationFormats maps the extensions of migration files to their format
+var migrationFormats = map[string]string{
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".json": "json",
+	".hcl":  "hcl",
+}
+
+// versionedFilename matches migration files named V<version>__<description>,
+// such as V0003__enable_pki.yaml
+var versionedFilename = regexp.MustCompile(`^V([0-9]+)__([^.]+)\.[a-z]+$`)
+
+// migrationFilename returns the V<version>__<description>.yaml name of a
+// migration file
+func migrationFilename(version int, description string) string {
+	name := strings.Trim(sanitizeFilename(strings.ReplaceAll(description, ".", " ")), "_")
+	if name == "" {
+		name = "migration"
+	}
+	return fmt.Sprintf("V%04d__%s.yaml", version, name)
+}
+
+// migrationFiles returns the migration files of a directory, in lexical
+// order. Hidden files, such as the generator's .state.yaml, are skipped.
+func migrationFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read migration files: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || migrationFormats[filepath.Ext(name)] == "" {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
+
+// readMigrationFile reads a migration file in any of the migration formats.
+// A file named V<version>__<description> takes its version and description
+// from its name; a version in the file must then be the same.
+func readMigrationFile(file string) (Migration, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Migration{}, fmt.Errorf("failed to read migration file %s: %w", file, err)
+	}
+
+	var migration Migration
+	if err := decodeMigration(migrationFormats[filepath.Ext(file)], data, &migration); err != nil {
+		return Migration{}, fmt.Errorf("failed to parse migration file %s: %w", file, err)
+	}
+
+	name := filepath.Base(file)
+	if match := versionedFilename.FindStringSubmatch(name); match != nil {
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return Migration{}, fmt.Errorf("invalid version in migration file name %s: %w", name, err)
+		}
+		if migration.Version != 0 && migration.Version != version {
+			return Migration{}, fmt.Errorf("migration file %s declares version %d, but its name says %d", name, migration.Version, version)
+		}
+		migration.Version = version
+		if migration.Description == "" {
+			migration.Description = strings.ReplaceAll(match[2], "_", " ")
+		}
+	}
+
+	if migration.Version <= 0 {
+		return Migration{}, fmt.Errorf("migration file %s has no positive version; set version or name it V<version>__<description>", name)
+	}
+
+	for i := range migration.Tasks {
+		migration.Tasks[i].Method = canonicalMethod(migration.Tasks[i].Method)
+	}
+	for i := range migration.Down {
+		migration.Down[i].Method = canonicalMethod(migration.Down[i].Method)
+	}
+	migration.File = name
+	migration.Checksum = checksum(data)
+	return migration, nil
+}
+
+// decodeMigration decodes a migration written in YAML, JSON or HCL. JSON and
+// HCL are converted to YAML first, so values decode to the same types in
+// every format.
+func decodeMigration(format string, data []byte, migration *Migration) error {
+	var document interface{}
+	switch format {
+	case "json":
+		if err := json.Unmarshal(data, &document); err != nil {
+			return err
+		}
+	case "hcl":
+		var err error
+		if document, err = decodeHCLMigration(data); err != nil {
+			return err
+		}
+	default:
+		return yaml.Unmarshal(data, migration)
+	}
+
+	converted, err := yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(converted, migration)
+}
+
+// decodeHCLMigration decodes a migration written in HCL. Tasks and down tasks
+// are written as repeated task and down blocks, and the checks of a task as
+// repeated expect blocks:
+//
+//	version     = 3
+//	description = "enable pki"
+//
+//	task {
+//	  path   = "sys/mounts/pki"
+//	  method = "POST"
+//	  data {
+//	    type = "pki"
+//	  }
+//	}
+func decodeHCLMigration(data []byte) (map[string]interface{}, error) {
+	root, err := hcl.ParseBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("does not contain a root object")
+	}
+
+	document, err := decodeHCLObject(list, map[string]string{"task": "tasks", "down": "down"})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"tasks", "down"} {
+		tasks, _ := document[key].([]interface{})
+		for i, task := range tasks {
+			block, _ := task.(*ast.ObjectType)
+			if block == nil {
+				return nil, fmt.Errorf("%s %d must be a block", strings.TrimSuffix(key, "s"), i)
+			}
+			decoded, err := decodeHCLObject(block.List, map[string]string{"expect": "expect"})
+			if err != nil {
+				return nil, fmt.Errorf("%s %d: %w", strings.TrimSuffix(key, "s"), i, err)
+			}
+			expects, _ := decoded["expect"].([]interface{})
+			for j, expect := range expects {
+				block, _ := expect.(*ast.ObjectType)
+				if block == nil {
+					return nil, fmt.Errorf("%s %d: expect %d must be a block", strings.TrimSuffix(key, "s"), i, j)
+				}
+				if expects[j], err = decodeHCLObject(block.List, nil); err != nil {
+					return nil, fmt.Errorf("%s %d: expect %d: %w", strings.TrimSuffix(key, "s"), i, j, err)
+				}
+			}
+			tasks[i] = decoded
+		}
+	}
+	return document, nil
+}
+
+// decodeHCLObject decodes the items of an HCL object. Repeated blocks named
+// in lists are collected, undecoded, under the key they map to, and the rest
+// are decoded with their nested blocks flattened into maps.
+func decodeHCLObject(items *ast.ObjectList, lists map[string]string) (map[string]interface{}, error) {
+	object := make(map[string]interface{})
+	rest := &ast.ObjectList{}
+	for _, item := range items.Items {
+		key := fmt.Sprint(item.Keys[0].Token.Value())
+		if to, ok := lists[key]; ok {
+			collected, _ := object[to].([]interface{})
+			object[to] = append(collected, item.Val)
+			continue
+		}
+		rest.Add(item)
+	}
+
+	var fields map[string]interface{}
+	if err := hcl.DecodeObject(&fields, rest); err != nil {
+		return nil, err
+	}
+	for key, value := range flattenHCL(fields).(map[string]interface{}) {
+		object[key] = value
+	}
+	return object, nil
+}
+
+// checkMigrationVersions reports migrations that claim the same version in
+// the same namespace. Versions are tracked per namespace, so namespaces may
+// reuse each other's versions.
+func checkMigrationVersions(migrations []Migration) error {
+	type key struct {
+		namespace string
+		version   int
+	}
+	files := make(map[key]string, len(migrations))
+	for _, migration := range migrations {
+		k := key{migration.Namespace, migration.Version}
+		if previous, ok := files[k]; ok {
+			if migration.Namespace != "" {
+				return fmt.Errorf("migration version %d of namespace %s is defined by both %s and %s", migration.Version, migration.Namespace, previous, migration.File)
+			}
+			return fmt.Errorf("migration version %d is defined by both %s and %s", migration.Version, previous, migration.File)
+		}
+		files[k] = migration.File
+	}
+	return nil
+}
+
+// sortMigrations orders migrations by version, and migrations of the same
+// version by namespace
+func sortMigrations(migrations []Migration) {
+	sort.Slice(migrations, func(i, j int) bool {
+		if migrations[i].Version != migrations[j].Version {
+			return migrations[i].Version < migrations[j].Version
+		}
+		return migrations[i].Namespace < migrations[j].Namespace
+	})
+}
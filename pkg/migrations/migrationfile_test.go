@@ -0,0 +1,172 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations_Formats(t *testing.T) {
+	dir := writeSchemaFiles(t, map[string]string{
+		"V0001__enable_kv.yaml": `tasks:
+  - type: mount
+    path: sys/mounts/kv
+    method: PUT
+    data:
+      type: kv
+`,
+		"V0002__pki_roles.json": `{
+	"version": 2,
+	"description": "PKI roles for the web tier",
+	"tasks": [
+		{"path": "pki/roles/web", "method": "write", "data": {"allowed_domains": ["example.com"], "max_ttl": "72h", "key_bits": 2048}}
+	]
+}`,
+		"V0003__app_policy.hcl": `task {
+  path   = "sys/policies/acl/app"
+  method = "PUT"
+  data {
+    policy = "path \"kv/data/app/*\" { capabilities = [\"read\"] }"
+  }
+}
+
+task {
+  path   = "sys/policies/acl/app"
+  method = "ASSERT"
+  expect {
+    field  = "name"
+    equals = "app"
+  }
+}
+
+down {
+  path   = "sys/policies/acl/app"
+  method = "DELETE"
+}
+`,
+		"004_legacy.yml": `version: 4
+tasks:
+  - path: secret/data/app
+    method: POST
+    data:
+      data:
+        key: value
+`,
+		".state.yaml":     "last_known_state: {}\n",
+		"README.md":       "not a migration",
+		"notes/V9__x.yml": "version: 9\n",
+	})
+
+	runner, err := NewMigrationRunner(nil, &Config{DryRun: true, Migrations: MigrationsConfig{Directory: dir}})
+	require.NoError(t, err)
+	migrations, err := runner.ValidateMigrations(context.Background())
+	require.NoError(t, err)
+	require.Len(t, migrations, 4)
+
+	assert.Equal(t, 1, migrations[0].Version)
+	assert.Equal(t, "enable kv", migrations[0].Description)
+	assert.Equal(t, "V0001__enable_kv.yaml", migrations[0].File)
+
+	assert.Equal(t, 2, migrations[1].Version)
+	assert.Equal(t, "PKI roles for the web tier", migrations[1].Description)
+	assert.Equal(t, []Task{{Method: "POST", Path: "pki/roles/web", Data: map[string]interface{}{
+		"allowed_domains": []interface{}{"example.com"}, "max_ttl": "72h", "key_bits": 2048,
+	}}}, migrations[1].Tasks)
+
+	assert.Equal(t, 3, migrations[2].Version)
+	assert.Equal(t, "app policy", migrations[2].Description)
+	assert.Equal(t, []Task{
+		{Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{
+			"policy": `path "kv/data/app/*" { capabilities = ["read"] }`,
+		}},
+		{Method: "ASSERT", Path: "sys/policies/acl/app", Expect: []Expectation{{Field: "name", Equals: "app"}}},
+	}, migrations[2].Tasks)
+	assert.Equal(t, []Task{{Method: "DELETE", Path: "sys/policies/acl/app"}}, migrations[2].Down)
+
+	assert.Equal(t, 4, migrations[3].Version)
+	assert.Equal(t, "", migrations[3].Description)
+
+	latest, err := getLatestVersion(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 4, latest)
+}
+
+func TestLoadMigrations_Versions(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name:  "file without a version",
+			files: map[string]string{"enable_pki.yaml": "tasks: []\n"},
+			err:   "migration file enable_pki.yaml has no positive version",
+		},
+		{
+			name:  "negative version",
+			files: map[string]string{"enable_pki.json": `{"version": -1, "tasks": []}`},
+			err:   "migration file enable_pki.json has no positive version",
+		},
+		{
+			name:  "version in the file differs from its name",
+			files: map[string]string{"V0003__enable_pki.yaml": "version: 4\ntasks: []\n"},
+			err:   "migration file V0003__enable_pki.yaml declares version 4, but its name says 3",
+		},
+		{
+			name: "two files claim the same version",
+			files: map[string]string{
+				"V0002__first.yaml": "tasks: []\n",
+				"second.json":       `{"version": 2, "tasks": []}`,
+			},
+			err: "migration version 2 is defined by both",
+		},
+		{
+			name: "two files claim the same version in a namespace",
+			files: map[string]string{
+				"V0002__first.yaml":  "namespace: tenant-a\ntasks: []\n",
+				"V0002__second.yaml": "namespace: tenant-a\ntasks: []\n",
+			},
+			err: "migration version 2 of namespace tenant-a is defined by both",
+		},
+		{
+			name:  "invalid HCL",
+			files: map[string]string{"V0001__broken.hcl": "task {\n"},
+			err:   "failed to parse migration file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, err := NewMigrationRunner(nil, &Config{DryRun: true, Migrations: MigrationsConfig{Directory: writeSchemaFiles(t, tt.files)}})
+			require.NoError(t, err)
+			_, err = runner.ValidateMigrations(context.Background())
+			assert.ErrorContains(t, err, tt.err)
+
+			_, err = getLatestVersion(runner.migrationsDir)
+			assert.ErrorContains(t, err, tt.err, "generate must not number a migration past a broken one")
+		})
+	}
+}
+
+func TestLoadMigrations_VersionsPerNamespace(t *testing.T) {
+	dir := writeSchemaFiles(t, map[string]string{
+		"V0001__root.yaml":     "tasks: []\n",
+		"V0001__tenant_a.yaml": "namespace: tenant-a\ntasks: []\n",
+		"V0001__tenant_b.yaml": "namespace: tenant-b\ntasks: []\n",
+	})
+
+	runner, err := NewMigrationRunner(nil, &Config{DryRun: true, Migrations: MigrationsConfig{Directory: dir}})
+	require.NoError(t, err)
+	migrations, err := runner.ValidateMigrations(context.Background())
+	require.NoError(t, err, "namespaces track their versions separately")
+	require.Len(t, migrations, 3)
+
+	namespaces := make([]string, len(migrations))
+	for i, migration := range migrations {
+		assert.Equal(t, 1, migration.Version)
+		namespaces[i] = migration.Namespace
+	}
+	assert.Equal(t, []string{"", "tenant-a", "tenant-b"}, namespaces)
+}
@@ -4,29 +4,73 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
-	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v2"
 )
 
-// Task defines a single Vault operation.
+// Task defines a single Vault operation. Tasks with a Type describe a
+// resource, such as a KV secret, and are translated into the requests it needs.
 type Task struct {
-	Path   string                 `yaml:"path"`
-	Method string                 `yaml:"method"`
-	Data   map[string]interface{} `yaml:"data"`
+	Path      string                 `yaml:"path"`
+	Method    string                 `yaml:"method"`
+	Data      map[string]interface{} `yaml:"data"`
+	Namespace string                 `yaml:"namespace,omitempty"`
+	Type      string                 `yaml:"type,omitempty"`
+
+	// Expect lists the field checks of ASSERT, WAIT_FOR and EXISTS tasks
+	Expect []Expectation `yaml:"expect,omitempty"`
+	// Timeout and Interval control how long and how often WAIT_FOR polls
+	Timeout  string `yaml:"timeout,omitempty"`
+	Interval string `yaml:"interval,omitempty"`
+	// OnFail decides what an unmet EXISTS or ABSENT precondition does: fail
+	// the migration (default) or skip it
+	OnFail string `yaml:"on_fail,omitempty"`
+	// ForEach lists a path and repeats the task for every child key, with
+	// {{key}} replaced in the task's path and data
+	ForEach string `yaml:"for_each,omitempty"`
+
+	// CAS, Versions and Metadata are used by kv tasks: the check-and-set
+	// version of a write, the versions to delete, undelete or destroy, and the
+	// secret's metadata
+	CAS      *int                   `yaml:"cas,omitempty"`
+	Versions []int                  `yaml:"versions,omitempty"`
+	Metadata map[string]interface{} `yaml:"metadata,omitempty"`
+
+	// Replace lets a typed task destroy and recreate a resource when a
+	// setting that cannot be changed in place differs, such as the type of
+	// an auth method
+	Replace bool `yaml:"replace,omitempty"`
+
+	// run, when set by a typed task, performs the request instead of
+	// executing Method on Path. It is used for steps that need the response
+	// of an earlier step, such as signing an intermediate CSR; Method, Path
+	// and Data still describe the request for dry runs and pre-flight checks.
+	run func(ctx context.Context, client *api.Client) error
 }
 
 // Migration groups a set of tasks into a migration file.
 type Migration struct {
-	Version int    `yaml:"version"`
-	Tasks   []Task `yaml:"tasks"`
+	Version int `yaml:"version"`
+	// Description says what the migration does; files named
+	// V<version>__<description> take it from their name
+	Description string `yaml:"description,omitempty"`
+	Namespace   string `yaml:"namespace,omitempty"`
+	Tasks       []Task `yaml:"tasks"`
+	Down        []Task `yaml:"down,omitempty"`
+	// Concurrent set to false runs the tasks in order even with
+	// concurrent_tasks. Generated migrations set it, as their tasks are
+	// ordered so that each can depend on the ones before it.
+	Concurrent *bool `yaml:"concurrent,omitempty"`
+
+	// File and Checksum are filled in when the migration is loaded from disk
+	File     string `yaml:"-"`
+	Checksum string `yaml:"-"`
 }
 
 // MigrationRunner handles running and tracking migrations.
@@ -36,6 +80,31 @@ type MigrationRunner struct {
 	trackingPath  string
 	logger        zerolog.Logger
 	dryRun        bool
+	skipPreflight bool
+
+	// lockEntryPath is the configured lock path; empty keeps the lock next
+	// to trackingPath
+	lockEntryPath string
+	// holderName identifies the runner in the lock and the history ledger;
+	// empty uses the host name and process ID
+	holderName string
+	// stopRenewal stops renewing the lock taken by acquireLock
+	stopRenewal func()
+
+	concurrentTasks bool
+	snapshots       bool
+	autoRestore     bool
+
+	// verifyConnections is the default verify_connection of database
+	// connection writes; nil leaves it to Vault
+	verifyConnections *bool
+
+	// namespaceClients caches clones of client bound to a namespace
+	namespaceClients map[string]*api.Client
+	namespaceMu      sync.Mutex
+
+	// applied records the versions applied by the last RunMigrations call
+	applied []int
 }
 
 // NewMigrationRunner initializes a new MigrationRunner.
@@ -60,16 +129,61 @@ func NewMigrationRunner(client *api.Client, config *Config) (*MigrationRunner, e
 		trackingPath:  "migrations/version",
 		logger:        logger,
 		dryRun:        config.DryRun,
+		skipPreflight: config.Migrations.SkipPreflight,
+		lockEntryPath: config.Migrations.LockPath,
+		holderName:    config.Migrations.LockHolder,
+
+		concurrentTasks: config.Migrations.ConcurrentTasks,
+		snapshots:       config.Migrations.Snapshots || config.Migrations.AutoRestore,
+		autoRestore:     config.Migrations.AutoRestore,
+
+		verifyConnections: config.Migrations.VerifyConnections,
 	}, nil
 }
 
-// getLastAppliedVersion retrieves the last applied migration version.
-func (m *MigrationRunner) getLastAppliedVersion(ctx context.Context) (int, error) {
+// clientForNamespace returns a client that sends requests to the given
+// namespace. An empty namespace returns the runner's client unchanged.
+func (m *MigrationRunner) clientForNamespace(namespace string) (*api.Client, error) {
+	if namespace == "" {
+		return m.client, nil
+	}
+	if m.client == nil {
+		return nil, fmt.Errorf("cannot use namespace %s without Vault client", namespace)
+	}
+
+	m.namespaceMu.Lock()
+	defer m.namespaceMu.Unlock()
+
+	if client, ok := m.namespaceClients[namespace]; ok {
+		return client, nil
+	}
+
+	client, err := m.client.CloneWithHeaders()
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone client for namespace %s: %w", namespace, err)
+	}
+	client.SetToken(m.client.Token())
+	client.SetNamespace(namespace)
+
+	if m.namespaceClients == nil {
+		m.namespaceClients = make(map[string]*api.Client)
+	}
+	m.namespaceClients[namespace] = client
+	return client, nil
+}
+
+// getLastAppliedVersion retrieves the last applied migration version in a namespace.
+func (m *MigrationRunner) getLastAppliedVersion(ctx context.Context, namespace string) (int, error) {
 	if m.client == nil {
 		return 0, nil
 	}
 
-	secret, err := m.client.Logical().ReadWithContext(ctx, m.trackingPath)
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return 0, err
+	}
+
+	secret, err := client.Logical().ReadWithContext(ctx, m.trackingPath)
 	if err != nil {
 		return 0, fmt.Errorf("failed to read tracking path: %w", err)
 	}
@@ -84,16 +198,21 @@ func (m *MigrationRunner) getLastAppliedVersion(ctx context.Context) (int, error
 	return version, nil
 }
 
-// setLastAppliedVersion updates the last applied migration version in Vault.
-func (m *MigrationRunner) setLastAppliedVersion(ctx context.Context, version int) error {
+// setLastAppliedVersion updates the last applied migration version in a namespace.
+func (m *MigrationRunner) setLastAppliedVersion(ctx context.Context, namespace string, version int) error {
 	if m.client == nil {
 		return nil
 	}
 
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return err
+	}
+
 	data := map[string]interface{}{
 		"version": strconv.Itoa(version),
 	}
-	_, err := m.client.Logical().WriteWithContext(ctx, m.trackingPath, data)
+	_, err = client.Logical().WriteWithContext(ctx, m.trackingPath, data)
 	if err != nil {
 		return fmt.Errorf("failed to update tracking path: %w", err)
 	}
@@ -102,30 +221,99 @@ func (m *MigrationRunner) setLastAppliedVersion(ctx context.Context, version int
 
 // loadMigrations loads migration files from the directory and sorts them by version.
 func (m *MigrationRunner) loadMigrations(ctx context.Context) ([]Migration, error) {
-	files, err := filepath.Glob(filepath.Join(m.migrationsDir, "*.yaml"))
+	return readMigrations(m.migrationsDir)
+}
+
+// readMigrations reads the migration files of a directory, sorted by version,
+// and checks that no two claim the same version
+func readMigrations(dir string) ([]Migration, error) {
+	files, err := migrationFiles(dir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read migration files: %w", err)
+		return nil, err
 	}
 
 	var migrations []Migration
 	for _, file := range files {
-		data, err := os.ReadFile(file)
+		migration, err := readMigrationFile(file)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read migration file %s: %w", file, err)
+			return nil, err
 		}
+		migrations = append(migrations, migration)
+	}
 
-		var migration Migration
-		if err := yaml.Unmarshal(data, &migration); err != nil {
-			return nil, fmt.Errorf("failed to parse migration file %s: %w", file, err)
-		}
+	sortMigrations(migrations)
+	if err := checkMigrationVersions(migrations); err != nil {
+		return nil, err
+	}
+	return migrations, nil
+}
 
-		migrations = append(migrations, migration)
+// canonicalMethod maps a task method, in any case, to the name used
+// internally. The vault CLI verbs write, read, delete and list are accepted as
+// aliases; write is a POST.
+func canonicalMethod(method string) string {
+	method = strings.ToUpper(method)
+	if method == "WRITE" {
+		return "POST"
 	}
+	return method
+}
 
-	sort.Slice(migrations, func(i, j int) bool {
-		return migrations[i].Version < migrations[j].Version
-	})
+// validateMigration checks that a migration is well formed before it is applied.
+func validateMigration(migration Migration) error {
+	if migration.Version <= 0 {
+		return fmt.Errorf("migration version must be positive, got %d", migration.Version)
+	}
+	for i, task := range append(append([]Task{}, migration.Tasks...), migration.Down...) {
+		if task.Path == "" {
+			return fmt.Errorf("task %d: path is required", i)
+		}
+		task.Method = canonicalMethod(task.Method)
+		if task.Type != "" {
+			handler, ok := taskTypes[task.Type]
+			if !ok {
+				return fmt.Errorf("task %d: unknown type %q, expected one of %s", i, task.Type, strings.Join(taskTypeNames(), ", "))
+			}
+			if err := handler.validate(task); err != nil {
+				return fmt.Errorf("task %d: %w", i, err)
+			}
+		} else {
+			switch task.Method {
+			case "POST", "PUT", "PATCH", "DELETE", "READ", "LIST", "ASSERT", "WAIT_FOR", "EXISTS", "ABSENT":
+			default:
+				return fmt.Errorf("task %d: unsupported method: %s", i, task.Method)
+			}
+			if task.CAS != nil || len(task.Versions) > 0 || len(task.Metadata) > 0 {
+				return fmt.Errorf("task %d: cas, versions and metadata are only supported by kv tasks", i)
+			}
+			if task.Replace {
+				return fmt.Errorf("task %d: replace is only supported by typed tasks", i)
+			}
+			switch task.Method {
+			case "POST", "PUT", "PATCH", "DELETE":
+				if auditDevicePath(task.Path) != "" {
+					return fmt.Errorf("task %d: audit devices are only changed by audit tasks, which guard the last enabled device", i)
+				}
+			}
+		}
+		if err := validateCheck(task); err != nil {
+			return fmt.Errorf("task %d: %w", i, err)
+		}
+	}
+	return nil
+}
 
+// ValidateMigrations loads every migration file and checks that it is well formed.
+func (m *MigrationRunner) ValidateMigrations(ctx context.Context) ([]Migration, error) {
+	migrations, err := m.loadMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, migration := range migrations {
+		if err := validateMigration(migration); err != nil {
+			return nil, fmt.Errorf("invalid migration %s: %w", migration.File, err)
+		}
+	}
 	return migrations, nil
 }
 
@@ -135,17 +323,129 @@ func (m *MigrationRunner) applyMigration(ctx context.Context, migration Migratio
 		return fmt.Errorf("cannot apply migration without Vault client")
 	}
 
-	m.logger.Info().Int("version", migration.Version).Msg("Applying migration")
+	m.logger.Info().
+		Int("version", migration.Version).
+		Str("description", migration.Description).
+		Str("namespace", migration.Namespace).
+		Msg("Applying migration")
 
 	if m.dryRun {
 		m.logger.Info().Int("version", migration.Version).Msg("Dry run - skipping migration")
 		return nil
 	}
 
-	var wg sync.WaitGroup
-	errChan := make(chan error, len(migration.Tasks))
+	resolved, err := m.resolveTasks(ctx, migration.Namespace, migration.Tasks)
+	if err != nil {
+		return err
+	}
+
+	// Preconditions are checked before anything is written, wherever they
+	// appear in the migration
+	var tasks []Task
+	for _, task := range resolved {
+		if !isPrecondition(task.Method) {
+			tasks = append(tasks, task)
+			continue
+		}
+		if err := m.checkPrecondition(ctx, task); err != nil {
+			return err
+		}
+	}
+
+	var snapshot *Snapshot
+	if m.snapshots {
+		var err error
+		if snapshot, err = m.captureSnapshot(ctx, migration, tasks); err != nil {
+			return fmt.Errorf("failed to capture snapshot: %w", err)
+		}
+		if err := m.saveSnapshot(ctx, snapshot); err != nil {
+			return fmt.Errorf("failed to save snapshot: %w", err)
+		}
+	}
+
+	attempted, err := m.executeTasks(ctx, tasks, m.runsConcurrently(migration))
+	if err == nil {
+		return nil
+	}
+
+	if snapshot != nil && m.autoRestore {
+		m.logger.Warn().Int("version", migration.Version).Msg("Restoring snapshot after failed migration")
+		if restoreErr := m.restoreEntries(ctx, snapshot.entriesBefore(attempted)); restoreErr != nil {
+			return fmt.Errorf("%w (restoring snapshot also failed: %v)", err, restoreErr)
+		}
+	}
+	return err
+}
+
+// checkPrecondition runs an EXISTS or ABSENT task. An unmet precondition with
+// on_fail: skip returns an error wrapping errMigrationSkipped.
+func (m *MigrationRunner) checkPrecondition(ctx context.Context, task Task) error {
+	expanded, err := m.expandType(ctx, task)
+	if err != nil {
+		return err
+	}
+	for _, task := range expanded {
+		client, err := m.clientForNamespace(task.Namespace)
+		if err != nil {
+			return err
+		}
+		reason, err := readCondition(ctx, client, task)
+		if err != nil {
+			return fmt.Errorf("failed to check precondition: %w", err)
+		}
+		if reason == "" {
+			continue
+		}
+		if task.OnFail == "skip" {
+			return fmt.Errorf("%w: %s %s: %s", errMigrationSkipped, task.Method, task.Path, reason)
+		}
+		return fmt.Errorf("precondition failed: %s %s: %s", task.Method, task.Path, reason)
+	}
+	return nil
+}
 
+// runsConcurrently reports whether the tasks of a migration run concurrently.
+// Migrations that opt out and migrations with typed tasks run in order: typed
+// tasks look up the mounts that earlier tasks may create.
+func (m *MigrationRunner) runsConcurrently(migration Migration) bool {
+	if !m.concurrentTasks || (migration.Concurrent != nil && !*migration.Concurrent) {
+		return false
+	}
 	for _, task := range migration.Tasks {
+		if task.Type != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// executeTasks runs tasks concurrently or in order. It returns how many tasks
+// were started, which is all of them for concurrent runs. When running
+// concurrently, ASSERT and WAIT_FOR tasks run in order after every write has
+// finished so they see its result.
+func (m *MigrationRunner) executeTasks(ctx context.Context, tasks []Task, concurrent bool) (int, error) {
+	if !concurrent {
+		for i, task := range tasks {
+			if err := m.executeTask(ctx, task); err != nil {
+				return i + 1, fmt.Errorf("failed to execute task %d: %w", i, err)
+			}
+		}
+		return len(tasks), nil
+	}
+
+	var writes, checks []Task
+	for _, task := range tasks {
+		if isReadOnly(task.Method) {
+			checks = append(checks, task)
+		} else {
+			writes = append(writes, task)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(writes))
+
+	for _, task := range writes {
 		wg.Add(1)
 		go func(t Task) {
 			defer wg.Done()
@@ -162,11 +462,17 @@ func (m *MigrationRunner) applyMigration(ctx context.Context, migration Migratio
 	// Check for errors
 	for err := range errChan {
 		if err != nil {
-			return err
+			return len(tasks), err
 		}
 	}
 
-	return nil
+	for _, task := range checks {
+		if err := m.executeTask(ctx, task); err != nil {
+			return len(tasks), fmt.Errorf("failed to execute task: %w", err)
+		}
+	}
+
+	return len(tasks), nil
 }
 
 // executeTask executes a single Vault task
@@ -175,29 +481,86 @@ func (m *MigrationRunner) executeTask(ctx context.Context, task Task) error {
 		return fmt.Errorf("cannot execute task without Vault client")
 	}
 
+	if task.Type != "" {
+		expanded, err := m.expandType(ctx, task)
+		if err != nil {
+			return err
+		}
+		for _, raw := range expanded {
+			if err := m.executeTask(ctx, raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	m.logger.Debug().
 		Str("path", task.Path).
 		Str("method", task.Method).
+		Str("namespace", task.Namespace).
 		Interface("data", task.Data).
 		Msg("Executing task")
 
-	switch task.Method {
+	client, err := m.clientForNamespace(task.Namespace)
+	if err != nil {
+		return err
+	}
+	if task.run != nil {
+		return task.run(ctx, client)
+	}
+
+	switch canonicalMethod(task.Method) {
 	case "POST":
-		_, err := m.client.Logical().WriteWithContext(ctx, task.Path, task.Data)
+		_, err := client.Logical().WriteWithContext(ctx, task.Path, task.Data)
 		return err
 	case "PUT":
-		_, err := m.client.Logical().WriteWithContext(ctx, task.Path, task.Data)
+		_, err := client.Logical().WriteWithContext(ctx, task.Path, task.Data)
+		return err
+	case "PATCH":
+		_, err := client.Logical().JSONMergePatch(ctx, task.Path, task.Data)
 		return err
 	case "DELETE":
-		_, err := m.client.Logical().DeleteWithContext(ctx, task.Path)
+		_, err := client.Logical().DeleteWithContext(ctx, task.Path)
+		return err
+	case "READ":
+		_, err := client.Logical().ReadWithContext(ctx, task.Path)
 		return err
+	case "LIST":
+		_, err := client.Logical().ListWithContext(ctx, task.Path)
+		return err
+	case "ASSERT", "EXISTS", "ABSENT":
+		return m.checkTask(ctx, client, task)
+	case "WAIT_FOR":
+		return m.waitFor(ctx, client, task)
 	default:
 		return fmt.Errorf("unsupported method: %s", task.Method)
 	}
 }
 
+// ApplyOptions limits which pending migrations RunMigrationsWithOptions applies.
+type ApplyOptions struct {
+	// TargetVersion stops after the migration with this version; 0 applies all
+	TargetVersion int
+	// Steps applies at most this many migrations; 0 applies all
+	Steps int
+	// Confirm is called before every migration after the first. Returning
+	// false stops the run without an error. Nil applies without pausing.
+	Confirm func(migration Migration) (bool, error)
+}
+
 // RunMigrations executes all pending migrations.
 func (m *MigrationRunner) RunMigrations(ctx context.Context) error {
+	return m.RunMigrationsWithOptions(ctx, ApplyOptions{})
+}
+
+// RunMigrationsWithOptions executes pending migrations up to the limits in opts.
+func (m *MigrationRunner) RunMigrationsWithOptions(ctx context.Context, opts ApplyOptions) error {
+	if opts.TargetVersion < 0 || opts.Steps < 0 {
+		return fmt.Errorf("target version and steps must not be negative")
+	}
+	if m.dryRun {
+		return m.logDryRun(ctx, opts)
+	}
 	if m.client == nil {
 		return fmt.Errorf("cannot run migrations without Vault client")
 	}
@@ -208,28 +571,228 @@ func (m *MigrationRunner) RunMigrations(ctx context.Context) error {
 		return fmt.Errorf("failed to load migrations: %w", err)
 	}
 
-	// Get last applied version
-	lastApplied, err := m.getLastAppliedVersion(ctx)
+	// Check every capability up front so a missing grant fails before the
+	// first write instead of halfway through
+	if !m.skipPreflight {
+		pending, err := m.selectPending(ctx, opts)
+		if err != nil {
+			return err
+		}
+		if err := m.Preflight(ctx, pending); err != nil {
+			return err
+		}
+	}
+
+	ctx, err = m.acquireLock(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get last applied version: %w", err)
+		return err
 	}
+	defer func() {
+		if err := m.releaseLock(context.Background()); err != nil {
+			m.logger.Warn().Err(err).Msg("Failed to release migration lock")
+		}
+	}()
+
+	m.applied = nil
+
+	// Versions are tracked separately in every namespace a migration targets,
+	// so each tenant namespace keeps its own history
+	lastApplied := make(map[string]int)
 
 	// Apply pending migrations
 	for _, migration := range migrations {
-		if migration.Version <= lastApplied {
+		applied, ok := lastApplied[migration.Namespace]
+		if !ok {
+			applied, err = m.getLastAppliedVersion(ctx, migration.Namespace)
+			if err != nil {
+				return fmt.Errorf("failed to get last applied version for namespace %q: %w", migration.Namespace, err)
+			}
+			lastApplied[migration.Namespace] = applied
+		}
+
+		if migration.Version <= applied {
 			continue
 		}
 
-		if err := m.applyMigration(ctx, migration); err != nil {
+		if opts.TargetVersion > 0 && migration.Version > opts.TargetVersion {
+			m.logger.Info().Int("target", opts.TargetVersion).Msg("Reached target version")
+			break
+		}
+		if opts.Steps > 0 && len(m.applied) >= opts.Steps {
+			m.logger.Info().Int("steps", opts.Steps).Msg("Reached step limit")
+			break
+		}
+
+		if err := validateMigration(migration); err != nil {
+			return fmt.Errorf("invalid migration %d: %w", migration.Version, err)
+		}
+
+		if opts.Confirm != nil && len(m.applied) > 0 {
+			proceed, err := opts.Confirm(migration)
+			if err != nil {
+				return fmt.Errorf("failed to confirm migration %d: %w", migration.Version, err)
+			}
+			if !proceed {
+				m.logger.Info().Int("version", migration.Version).Msg("Stopped by operator")
+				break
+			}
+		}
+
+		// A migration skipped by its preconditions is recorded like an applied
+		// one, so it is not attempted again
+		start := time.Now()
+		err := m.applyMigration(ctx, migration)
+		skipped := errors.Is(err, errMigrationSkipped)
+		if err != nil && !skipped {
 			return fmt.Errorf("failed to apply migration %d: %w", migration.Version, err)
 		}
+		if skipped {
+			m.logger.Info().
+				Int("version", migration.Version).
+				Str("reason", err.Error()).
+				Msg("Skipping migration, precondition not met")
+		}
+
+		if err := m.recordHistory(ctx, migration, start); err != nil {
+			return fmt.Errorf("failed to record history for migration %d: %w", migration.Version, err)
+		}
+		if err := m.setLastAppliedVersion(ctx, migration.Namespace, migration.Version); err != nil {
+			return fmt.Errorf("failed to update version after migration %d: %w", migration.Version, err)
+		}
+		lastApplied[migration.Namespace] = migration.Version
+		if !skipped {
+			m.applied = append(m.applied, migration.Version)
+		}
+	}
 
-		if !m.dryRun {
-			if err := m.setLastAppliedVersion(ctx, migration.Version); err != nil {
-				return fmt.Errorf("failed to update version after migration %d: %w", migration.Version, err)
+	return nil
+}
+
+// Rollback reverts applied migrations newer than target by running their down
+// tasks in reverse version order. Every migration being reverted must define
+// down tasks.
+func (m *MigrationRunner) Rollback(ctx context.Context, target int) error {
+	if m.client == nil {
+		return fmt.Errorf("cannot roll back migrations without Vault client")
+	}
+	if target < 0 {
+		return fmt.Errorf("rollback target must not be negative")
+	}
+
+	migrations, err := m.loadMigrations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	lastApplied := make(map[string]int)
+	var toRevert []Migration
+	for _, migration := range migrations {
+		applied, ok := lastApplied[migration.Namespace]
+		if !ok {
+			applied, err = m.getLastAppliedVersion(ctx, migration.Namespace)
+			if err != nil {
+				return fmt.Errorf("failed to get last applied version for namespace %q: %w", migration.Namespace, err)
+			}
+			lastApplied[migration.Namespace] = applied
+		}
+		if migration.Version > target && migration.Version <= applied {
+			if len(migration.Down) == 0 {
+				return fmt.Errorf("migration %d has no down tasks and cannot be rolled back", migration.Version)
+			}
+			toRevert = append(toRevert, migration)
+		}
+	}
+
+	if len(toRevert) == 0 {
+		m.logger.Info().Int("target", target).Msg("Nothing to roll back")
+		return nil
+	}
+
+	if !m.dryRun {
+		var err error
+		if ctx, err = m.acquireLock(ctx); err != nil {
+			return err
+		}
+		defer func() {
+			if err := m.releaseLock(context.Background()); err != nil {
+				m.logger.Warn().Err(err).Msg("Failed to release migration lock")
+			}
+		}()
+	}
+
+	for i := len(toRevert) - 1; i >= 0; i-- {
+		migration := toRevert[i]
+		m.logger.Info().
+			Int("version", migration.Version).
+			Str("namespace", migration.Namespace).
+			Msg("Rolling back migration")
+
+		if m.dryRun {
+			continue
+		}
+
+		// Down tasks run one at a time, in the order they are written
+		down, err := m.resolveTasks(ctx, migration.Namespace, migration.Down)
+		if err != nil {
+			return fmt.Errorf("failed to roll back migration %d: %w", migration.Version, err)
+		}
+		for _, task := range down {
+			if err := m.executeTask(ctx, task); err != nil {
+				return fmt.Errorf("failed to roll back migration %d: %w", migration.Version, err)
 			}
 		}
+
+		// The namespace's version moves to the newest migration still applied
+		previous := 0
+		for _, other := range migrations {
+			if other.Namespace == migration.Namespace && other.Version < migration.Version {
+				previous = other.Version
+			}
+		}
+		if err := m.deleteHistory(ctx, migration.Namespace, migration.Version); err != nil {
+			return fmt.Errorf("failed to remove history for migration %d: %w", migration.Version, err)
+		}
+		if err := m.setLastAppliedVersion(ctx, migration.Namespace, previous); err != nil {
+			return fmt.Errorf("failed to update version after rolling back migration %d: %w", migration.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// logDryRun simulates the pending migrations and logs what each task would do
+func (m *MigrationRunner) logDryRun(ctx context.Context, opts ApplyOptions) error {
+	report, err := m.DryRun(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, task := range report.Tasks {
+		event := m.logger.Info()
+		if task.Action == ActionPermissionDenied || task.Action == ActionFail {
+			event = m.logger.Warn()
+		}
+		event.
+			Int("version", task.Version).
+			Str("namespace", task.Namespace).
+			Str("method", task.Method).
+			Str("path", task.Path).
+			Str("action", string(task.Action)).
+			Strs("changed", task.Changed).
+			Str("error", task.Error).
+			Msg("Dry run")
 	}
 
+	if denied := report.Count(ActionPermissionDenied); denied > 0 {
+		return fmt.Errorf("dry run found %d tasks the token is not permitted to run", denied)
+	}
+	if failed := report.Count(ActionFail); failed > 0 {
+		return fmt.Errorf("dry run found %d preconditions that are not met", failed)
+	}
 	return nil
 }
+
+// AppliedVersions returns the versions applied by the last RunMigrations call.
+func (m *MigrationRunner) AppliedVersions() []int {
+	return m.applied
+}
@@ -7,7 +7,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/hashicorp/vault/api"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -70,7 +69,7 @@ tasks:
 func TestMigrationRunner_ApplyMigration(t *testing.T) {
 	// Create test runner
 	runner := &MigrationRunner{
-		client: &api.Client{},
+		client: newTestVaultClient(t),
 	}
 
 	// Create test migration
@@ -98,7 +97,7 @@ func TestMigrationRunner_ApplyMigration(t *testing.T) {
 func TestMigrationRunner_VersionTracking(t *testing.T) {
 	// Create test runner
 	runner := &MigrationRunner{
-		client:       &api.Client{},
+		client:       newTestVaultClient(t),
 		trackingPath: "migrations/version",
 	}
 
@@ -106,10 +105,10 @@ func TestMigrationRunner_VersionTracking(t *testing.T) {
 	ctx := context.Background()
 	version := 123
 
-	err := runner.setLastAppliedVersion(ctx, version)
+	err := runner.setLastAppliedVersion(ctx, "", version)
 	require.NoError(t, err)
 
-	lastVersion, err := runner.getLastAppliedVersion(ctx)
+	lastVersion, err := runner.getLastAppliedVersion(ctx, "")
 	require.NoError(t, err)
 	assert.Equal(t, version, lastVersion)
 }
@@ -117,7 +116,7 @@ func TestMigrationRunner_VersionTracking(t *testing.T) {
 func TestMigrationRunner_ConcurrentTasks(t *testing.T) {
 	// Create test runner
 	runner := &MigrationRunner{
-		client: &api.Client{},
+		client: newTestVaultClient(t),
 	}
 
 	// Create test migration with multiple tasks
@@ -158,7 +157,7 @@ func TestMigrationRunner_ConcurrentTasks(t *testing.T) {
 func TestMigrationRunner_DryRun(t *testing.T) {
 	// Create test runner with dry run enabled
 	runner := &MigrationRunner{
-		client: &api.Client{},
+		client: newTestVaultClient(t),
 		dryRun: true,
 	}
 
@@ -184,3 +183,205 @@ func TestMigrationRunner_DryRun(t *testing.T) {
 	require.NoError(t, err)
 	// In dry run mode, no actual changes should be made to Vault
 }
+
+func TestMigrationRunner_Namespaces(t *testing.T) {
+	server := newTestVaultServer(t)
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{Path: "sys/namespaces/tenant-a", Method: "POST"},
+			},
+		},
+		{
+			Version:   2,
+			Namespace: "tenant-a",
+			Tasks: []Task{
+				{Path: "secret/data/app", Method: "POST", Data: map[string]interface{}{"key": "a"}},
+				{Path: "secret/data/shared", Method: "POST", Namespace: "tenant-b", Data: map[string]interface{}{"key": "b"}},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+		require.NoError(t, runner.RunMigrations(context.Background()))
+	})
+
+	_, ok := server.get("", "sys/namespaces/tenant-a")
+	assert.True(t, ok)
+	_, ok = server.get("tenant-a", "secret/data/app")
+	assert.True(t, ok, "migration namespace should apply to its tasks")
+	_, ok = server.get("tenant-b", "secret/data/shared")
+	assert.True(t, ok, "task namespace should override the migration namespace")
+
+	// Each namespace tracks its own version
+	root, ok := server.get("", "migrations/version")
+	require.True(t, ok)
+	assert.Equal(t, "1", root["version"])
+	tenant, ok := server.get("tenant-a", "migrations/version")
+	require.True(t, ok)
+	assert.Equal(t, "2", tenant["version"])
+}
+
+func TestMigrationRunner_NamespaceVersionTracking(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("tenant-a", "migrations/version", map[string]interface{}{"version": "5"})
+
+	migration := Migration{
+		Version:   3,
+		Namespace: "tenant-a",
+		Tasks:     []Task{{Path: "secret/data/app", Method: "POST"}},
+	}
+
+	withTestMigrations(t, []Migration{migration}, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+		require.NoError(t, runner.RunMigrations(context.Background()))
+	})
+
+	// Version 3 is already covered by tenant-a's history
+	_, ok := server.get("tenant-a", "secret/data/app")
+	assert.False(t, ok)
+}
+
+func TestMigrationRunner_HistoryAndRollback(t *testing.T) {
+	server := newTestVaultServer(t)
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks:   []Task{{Path: "secret/one", Method: "POST", Data: map[string]interface{}{"key": "1"}}},
+			Down:    []Task{{Path: "secret/one", Method: "DELETE"}},
+		},
+		{
+			Version: 2,
+			Tasks:   []Task{{Path: "secret/two", Method: "POST", Data: map[string]interface{}{"key": "2"}}},
+			Down:    []Task{{Path: "secret/two", Method: "DELETE"}},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+
+		ctx := context.Background()
+		require.NoError(t, runner.RunMigrations(ctx))
+
+		history, err := runner.History(ctx)
+		require.NoError(t, err)
+		require.Len(t, history, 2)
+		assert.Equal(t, 1, history[0].Version)
+		assert.Equal(t, "001_test.yaml", history[0].File)
+		assert.NotEmpty(t, history[0].Checksum)
+
+		// The lock is released once the run completes
+		lock, err := runner.LockInfo(ctx)
+		require.NoError(t, err)
+		assert.Nil(t, lock)
+
+		require.NoError(t, runner.Rollback(ctx, 1))
+
+		_, ok := server.get("", "secret/two")
+		assert.False(t, ok)
+		_, ok = server.get("", "secret/one")
+		assert.True(t, ok)
+
+		versions, err := runner.CurrentVersions(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, versions[""])
+
+		history, err = runner.History(ctx)
+		require.NoError(t, err)
+		assert.Len(t, history, 1)
+	})
+}
+
+func TestMigrationRunner_Lock(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "migrations/lock", map[string]interface{}{
+		"holder":      "other-host:1",
+		"acquired_at": time.Now().UTC().Format(time.RFC3339),
+		"expires_at":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	})
+
+	migrations := []Migration{{Version: 1, Tasks: []Task{{Path: "secret/one", Method: "POST"}}}}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+
+		ctx := context.Background()
+		err = runner.RunMigrations(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "locked by other-host:1")
+
+		require.NoError(t, runner.ForceUnlock(ctx))
+		require.NoError(t, runner.RunMigrations(ctx))
+	})
+}
+
+func TestMigrationRunner_ApplyOptions(t *testing.T) {
+	migrations := []Migration{
+		{Version: 1, Tasks: []Task{{Path: "secret/one", Method: "POST"}}},
+		{Version: 2, Tasks: []Task{{Path: "secret/two", Method: "POST"}}},
+		{Version: 3, Tasks: []Task{{Path: "secret/three", Method: "POST"}}},
+	}
+
+	tests := []struct {
+		name     string
+		opts     func(confirmed *[]int) ApplyOptions
+		expected []int
+	}{
+		{
+			name:     "target version",
+			opts:     func(*[]int) ApplyOptions { return ApplyOptions{TargetVersion: 2} },
+			expected: []int{1, 2},
+		},
+		{
+			name:     "steps",
+			opts:     func(*[]int) ApplyOptions { return ApplyOptions{Steps: 1} },
+			expected: []int{1},
+		},
+		{
+			name: "operator stops after the second migration",
+			opts: func(confirmed *[]int) ApplyOptions {
+				return ApplyOptions{Confirm: func(migration Migration) (bool, error) {
+					*confirmed = append(*confirmed, migration.Version)
+					return migration.Version < 3, nil
+				}}
+			},
+			expected: []int{1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestVaultServer(t)
+			withTestMigrations(t, migrations, func(migrationsDir string) {
+				runner, err := NewMigrationRunner(server.client(t), &Config{
+					Migrations: MigrationsConfig{Directory: migrationsDir},
+				})
+				require.NoError(t, err)
+
+				var confirmed []int
+				opts := tt.opts(&confirmed)
+				require.NoError(t, runner.RunMigrationsWithOptions(context.Background(), opts))
+				assert.Equal(t, tt.expected, runner.AppliedVersions())
+				if opts.Confirm != nil {
+					assert.Equal(t, []int{2, 3}, confirmed, "the first migration is applied without confirmation")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// mountFields are the fields a mount task accepts in its data
+var mountFields = map[string]bool{
+	"type":                    true,
+	"description":             true,
+	"config":                  true,
+	"options":                 true,
+	"local":                   true,
+	"seal_wrap":               true,
+	"external_entropy_access": true,
+	"plugin_version":          true,
+	"moved_from":              true,
+}
+
+// systemMountTypes are the mounts every Vault has, which cannot be managed
+var systemMountTypes = map[string]bool{"system": true, "identity": true, "cubbyhole": true, "ns_system": true, "ns_identity": true, "ns_cubbyhole": true}
+
+// remountPollInterval is how often the status of a remount is read
+var remountPollInterval = time.Second
+
+// remountTimeout is how long a remount may take
+var remountTimeout = 10 * time.Minute
+
+// mountType handles tasks that enable, tune, move and disable secrets
+// engines. The task path is sys/mounts/<path>; data holds the engine type,
+// description, config (the tune parameters, such as default_lease_ttl) and
+// options. An existing mount is only tuned, never enabled again, and a mount
+// of another type is only replaced when the task sets replace: true.
+//
+// moved_from names the path the mount had before. When nothing is mounted at
+// the task path but the old path is, the mount is moved with sys/remount,
+// keeping its data, and then tuned.
+type mountType struct{}
+
+func (mountType) validate(task Task) error {
+	mountPath := secretMountPath(task.Path)
+	if mountPath == "" {
+		return fmt.Errorf("mount path must be sys/mounts/<path>")
+	}
+	switch task.Method {
+	case "POST", "PUT":
+	case "DELETE":
+		if len(task.Data) > 0 {
+			return fmt.Errorf("data is not supported by mount DELETE")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported mount method: %s", task.Method)
+	}
+
+	for field := range task.Data {
+		if !mountFields[field] {
+			return fmt.Errorf("unknown mount field %q", field)
+		}
+	}
+	if stringField(task.Data, "type") == "" {
+		return fmt.Errorf("mount %s needs data.type", task.Method)
+	}
+	for _, field := range []string{"config", "options"} {
+		if task.Data[field] != nil && stringKeyMap(task.Data[field]) == nil {
+			return fmt.Errorf("mount %s must be a map", field)
+		}
+	}
+	if _, ok := task.Data["moved_from"]; ok {
+		from := movedFromPath(task.Data)
+		if from == "" || strings.HasPrefix(from, "auth/") {
+			return fmt.Errorf("mount moved_from must be the previous path of the secrets engine")
+		}
+		if from == mountPath {
+			return fmt.Errorf("mount moved_from must differ from the mount path")
+		}
+	}
+	return nil
+}
+
+func (mountType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	mountPath := secretMountPath(task.Path)
+	current, err := m.secretMount(ctx, task.Namespace, mountPath)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := func(method, p string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Path, t.Data, t.Replace = method, p, data, false
+		return t
+	}
+	sysPath := path.Join("sys/mounts", mountPath)
+
+	if task.Method == "DELETE" {
+		if current == nil {
+			return nil, nil
+		}
+		return []Task{raw("DELETE", sysPath, nil)}, nil
+	}
+
+	var tasks []Task
+	if from := movedFromPath(task.Data); current == nil && from != "" {
+		current, err = m.secretMount(ctx, task.Namespace, from)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil {
+			tasks = append(tasks, remountTask(task, from, mountPath))
+		}
+	}
+
+	methodType := stringField(task.Data, "type")
+	switch {
+	case current == nil:
+		tasks = append(tasks, raw("POST", sysPath, mountEnableData(task.Data)))
+	case stringField(current, "type") != methodType:
+		if !task.Replace {
+			return nil, fmt.Errorf("%s is a %s engine, the task wants %s; set replace: true to disable and re-enable it, which deletes its data",
+				mountPath, stringField(current, "type"), methodType)
+		}
+		tasks = append(tasks,
+			raw("DELETE", sysPath, nil),
+			raw("POST", sysPath, mountEnableData(task.Data)))
+	default:
+		if tune := mountTuneData(task.Data); len(tune) > 0 {
+			tasks = append(tasks, raw("POST", path.Join(sysPath, "tune"), tune))
+		}
+	}
+	return tasks, nil
+}
+
+// secretMountPath returns the mount path of a sys/mounts/<path> task path
+func secretMountPath(p string) string {
+	p = strings.Trim(p, "/")
+	if !strings.HasPrefix(p, "sys/mounts/") {
+		return ""
+	}
+	return strings.TrimPrefix(p, "sys/mounts/")
+}
+
+// movedFromPath returns the previous path in data.moved_from, accepting it
+// with or without its sys/mounts or sys/ prefix
+func movedFromPath(data map[string]interface{}) string {
+	from := strings.Trim(stringField(data, "moved_from"), "/")
+	if p := secretMountPath(from); p != "" {
+		return p
+	}
+	return strings.TrimPrefix(from, "sys/")
+}
+
+// secretMount returns the current settings of a secrets engine, or nil if
+// nothing is mounted at the path
+func (m *MigrationRunner) secretMount(ctx context.Context, namespace, mountPath string) (map[string]interface{}, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, fmt.Errorf("cannot list mounts without Vault client")
+	}
+
+	secret, err := client.Logical().ReadWithContext(ctx, "sys/mounts")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mounts: %w", err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	return stringKeyMap(secret.Data[mountPath+"/"]), nil
+}
+
+// mountEnableData returns the body of a sys/mounts/<path> request
+func mountEnableData(data map[string]interface{}) map[string]interface{} {
+	enable := authEnableData(data)
+	for _, field := range []string{"external_entropy_access", "plugin_version"} {
+		if value, ok := data[field]; ok {
+			enable[field] = value
+		}
+	}
+	return enable
+}
+
+// mountTuneData returns the body of a sys/mounts/<path>/tune request. Type,
+// local, seal_wrap and external_entropy_access cannot be changed after the
+// engine is enabled.
+func mountTuneData(data map[string]interface{}) map[string]interface{} {
+	tune := authTuneData(data)
+	if version, ok := data["plugin_version"]; ok {
+		tune["plugin_version"] = version
+	}
+	return tune
+}
+
+// remountTask returns a task that moves a mount, auth methods written as
+// auth/<path>, and waits until Vault has finished moving it
+func remountTask(task Task, from, to string) Task {
+	t := task
+	t.Method, t.Path, t.Replace = "POST", "sys/remount", false
+	t.Data = map[string]interface{}{"from": from, "to": to}
+	t.run = func(ctx context.Context, client *api.Client) error {
+		secret, err := client.Logical().WriteWithContext(ctx, "sys/remount", t.Data)
+		if err != nil {
+			return fmt.Errorf("failed to move %s to %s: %w", from, to, err)
+		}
+		// Vault before 1.10 moves mounts before responding
+		if secret == nil || stringField(secret.Data, "migration_id") == "" {
+			return nil
+		}
+		return waitForRemount(ctx, client, stringField(secret.Data, "migration_id"), from, to)
+	}
+	return t
+}
+
+// waitForRemount polls the status of a remount until it succeeds or fails
+func waitForRemount(ctx context.Context, client *api.Client, id, from, to string) error {
+	ctx, cancel := context.WithTimeout(ctx, remountTimeout)
+	defer cancel()
+	ticker := time.NewTicker(remountPollInterval)
+	defer ticker.Stop()
+
+	for {
+		status, err := client.Logical().ReadWithContext(ctx, "sys/remount/status/"+id)
+		if err != nil {
+			return fmt.Errorf("failed to read status of moving %s to %s: %w", from, to, err)
+		}
+		if status != nil {
+			switch stringField(stringKeyMap(status.Data["migration_info"]), "status") {
+			case "success":
+				return nil
+			case "failure":
+				return fmt.Errorf("moving %s to %s failed; see the Vault server log for migration %s", from, to, id)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("moving %s to %s: timed out after %s", from, to, remountTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// mountTaskFromDiff converts a difference in a secrets engine, written in the
+// desired state as sys/mounts/<path> with a type, into a mount task
+func mountTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	mountPath := secretMountPath(diff.Path)
+	if mountPath == "" || strings.Contains(mountPath, "/") {
+		return Task{}, false
+	}
+	value := diff.NewValue
+	if value == nil {
+		value = diff.OldValue
+	}
+	if stringField(stringKeyMap(value), "type") == "" {
+		return Task{}, false
+	}
+
+	task := Task{Type: "mount", Path: "sys/mounts/" + mountPath, Method: method}
+	if method != "DELETE" {
+		task.Data = stringKeyMap(diff.NewValue)
+	}
+	return task, true
+}
+
+// mountStateEqual compares the current state of a secrets engine with the
+// desired one: its type, description, config and options. moved_from only
+// matters while the mount is moved and is not compared.
+func mountStateEqual(current, desired interface{}) bool {
+	if !authStateEqual(current, desired) {
+		return false
+	}
+	have, want := stringKeyMap(current), stringKeyMap(desired)
+	if have == nil || want == nil {
+		return true
+	}
+	haveOptions := stringKeyMap(have["options"])
+	for option, value := range stringKeyMap(want["options"]) {
+		if !configValuesEqual(haveOptions[option], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// movedMounts returns the previous paths of the mounts and auth methods the
+// differences move, as <path> for secrets engines and auth/<path> for auth
+// methods
+func movedMounts(diffs []HCLDiff) []string {
+	var moved []string
+	for _, diff := range diffs {
+		data := stringKeyMap(diff.NewValue)
+		if diff.OldValue != nil || stringField(data, "moved_from") == "" {
+			continue
+		}
+		switch {
+		case secretMountPath(diff.Path) != "":
+			moved = append(moved, movedFromPath(data))
+		case authMountPath(diff.Path) != "":
+			moved = append(moved, "auth/"+authMovedFromPath(data))
+		}
+	}
+	return moved
+}
+
+// isBelowMovedMount reports whether a desired state path is one of the moved
+// mounts or below one of them, so removing it must not delete anything
+func isBelowMovedMount(p string, moved []string) bool {
+	p = strings.Trim(p, "/")
+	if mountPath := secretMountPath(p); mountPath != "" {
+		p = mountPath
+	} else if authPath := authMountPath(p); authPath != "" {
+		p = "auth/" + authPath
+	}
+	for _, from := range moved {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeMounts rewrites the secrets engines of a schema written as
+// <path>/ with a type to sys/mounts/<path>/, the way the state read from
+// Vault holds them, and merges their tune settings into config. It returns
+// the keys it renamed, mapped to their new key.
+func normalizeMounts(state map[string]interface{}) map[string]string {
+	renamed := make(map[string]string)
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		value := state[key]
+		data := stringKeyMap(value)
+		if data == nil || stringField(data, "type") == "" {
+			continue
+		}
+		mountPath := secretMountPath(key)
+		if mountPath == "" {
+			if !strings.HasSuffix(key, "/") || authMountPath(key) != "" || strings.HasPrefix(key, "sys/") {
+				continue
+			}
+			mountPath = strings.Trim(key, "/")
+		}
+
+		if tune := stringKeyMap(data["tune"]); tune != nil {
+			config := stringKeyMap(data["config"])
+			if config == nil {
+				config = make(map[string]interface{})
+			}
+			for field, setting := range tune {
+				config[field] = setting
+			}
+			data["config"] = config
+			delete(data, "tune")
+		}
+		delete(state, key)
+		state["sys/mounts/"+mountPath+"/"] = data
+		renamed[key] = "sys/mounts/" + mountPath + "/"
+	}
+	return renamed
+}
+
+// followMovedMounts points the quotas of a schema that name a mount by its
+// previous path at the mount's current path
+func followMovedMounts(state map[string]interface{}) {
+	renamed := make(map[string]string)
+	for key, value := range state {
+		data := stringKeyMap(value)
+		if stringField(data, "moved_from") == "" {
+			continue
+		}
+		if mountPath := secretMountPath(key); mountPath != "" {
+			renamed[movedFromPath(data)] = mountPath
+		} else if authPath := authMountPath(key); authPath != "" {
+			renamed["auth/"+authMovedFromPath(data)] = "auth/" + authPath
+		}
+	}
+	for key, value := range state {
+		if _, ok := parseQuotaPath(key); !ok {
+			continue
+		}
+		data := stringKeyMap(value)
+		if to, ok := renamed[strings.Trim(stringField(data, "mount"), "/")]; ok {
+			data["mount"] = to
+			state[key] = data
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMountType_Validate(t *testing.T) {
+	valid := []Task{
+		{Type: "mount", Method: "PUT", Path: "sys/mounts/secret", Data: map[string]interface{}{
+			"type": "kv", "options": map[interface{}]interface{}{"version": "2"}, "config": map[interface{}]interface{}{"max_lease_ttl": "24h"},
+		}},
+		{Type: "mount", Method: "PUT", Path: "sys/mounts/kv/", Data: map[string]interface{}{"type": "kv", "moved_from": "secret"}},
+		{Type: "mount", Method: "PUT", Path: "sys/mounts/kv", Data: map[string]interface{}{"type": "kv", "moved_from": "sys/mounts/secret/"}},
+		{Type: "mount", Method: "DELETE", Path: "sys/mounts/secret"},
+	}
+	for _, task := range valid {
+		assert.NoError(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+
+	invalid := []Task{
+		{Type: "mount", Method: "PUT", Path: "secret/", Data: map[string]interface{}{"type": "kv"}},
+		{Type: "mount", Method: "PUT", Path: "sys/mounts/secret", Data: map[string]interface{}{"description": "no type"}},
+		{Type: "mount", Method: "PUT", Path: "sys/mounts/secret", Data: map[string]interface{}{"type": "kv", "tune": map[string]interface{}{}}},
+		{Type: "mount", Method: "PUT", Path: "sys/mounts/secret", Data: map[string]interface{}{"type": "kv", "config": "24h"}},
+		{Type: "mount", Method: "PUT", Path: "sys/mounts/kv", Data: map[string]interface{}{"type": "kv", "moved_from": "kv"}},
+		{Type: "mount", Method: "PUT", Path: "sys/mounts/kv", Data: map[string]interface{}{"type": "kv", "moved_from": "auth/kv"}},
+		{Type: "mount", Method: "DELETE", Path: "sys/mounts/secret", Data: map[string]interface{}{"type": "kv"}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestMountType_Expand(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "sys/mounts/secret", map[string]interface{}{"type": "kv", "options": map[string]interface{}{"version": "2"}})
+	server.put("", "sys/mounts/old", map[string]interface{}{"type": "kv"})
+	server.put("", "sys/auth/users", map[string]interface{}{"type": "userpass"})
+
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: t.TempDir()},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+	config := map[string]interface{}{"max_lease_ttl": "24h"}
+
+	tests := []struct {
+		name string
+		task Task
+		want []Task
+	}{
+		{
+			name: "enable",
+			task: Task{Type: "mount", Method: "PUT", Path: "sys/mounts/transit", Data: map[string]interface{}{"type": "transit", "local": true}},
+			want: []Task{{Method: "POST", Path: "sys/mounts/transit", Data: map[string]interface{}{"type": "transit", "local": true}}},
+		},
+		{
+			name: "tune an existing mount",
+			task: Task{Type: "mount", Method: "PUT", Path: "sys/mounts/secret/", Data: map[string]interface{}{
+				"type": "kv", "description": "app secrets", "config": config,
+			}},
+			want: []Task{{Method: "POST", Path: "sys/mounts/secret/tune", Data: map[string]interface{}{
+				"description": "app secrets", "max_lease_ttl": "24h",
+			}}},
+		},
+		{
+			name: "replace a mount of another type",
+			task: Task{Type: "mount", Method: "PUT", Path: "sys/mounts/secret", Replace: true, Data: map[string]interface{}{"type": "transit"}},
+			want: []Task{
+				{Method: "DELETE", Path: "sys/mounts/secret"},
+				{Method: "POST", Path: "sys/mounts/secret", Data: map[string]interface{}{"type": "transit"}},
+			},
+		},
+		{
+			name: "move a mount",
+			task: Task{Type: "mount", Method: "PUT", Path: "sys/mounts/kv", Data: map[string]interface{}{
+				"type": "kv", "config": config, "moved_from": "old",
+			}},
+			want: []Task{
+				{Method: "POST", Path: "sys/remount", Data: map[string]interface{}{"from": "old", "to": "kv"}},
+				{Method: "POST", Path: "sys/mounts/kv/tune", Data: map[string]interface{}{"max_lease_ttl": "24h"}},
+			},
+		},
+		{
+			name: "already moved",
+			task: Task{Type: "mount", Method: "PUT", Path: "sys/mounts/secret", Data: map[string]interface{}{"type": "kv", "moved_from": "old"}},
+			want: []Task{},
+		},
+		{
+			name: "previous path does not exist",
+			task: Task{Type: "mount", Method: "PUT", Path: "sys/mounts/fresh", Data: map[string]interface{}{"type": "kv", "moved_from": "gone"}},
+			want: []Task{{Method: "POST", Path: "sys/mounts/fresh", Data: map[string]interface{}{"type": "kv"}}},
+		},
+		{
+			name: "move an auth method",
+			task: Task{Type: "auth", Method: "PUT", Path: "auth/userpass", Data: map[string]interface{}{"type": "userpass", "moved_from": "auth/users"}},
+			want: []Task{{Method: "POST", Path: "sys/remount", Data: map[string]interface{}{"from": "auth/users", "to": "auth/userpass"}}},
+		},
+		{
+			name: "delete",
+			task: Task{Type: "mount", Method: "DELETE", Path: "sys/mounts/old"},
+			want: []Task{{Method: "DELETE", Path: "sys/mounts/old"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runner.expandType(ctx, tt.task)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, requests(got))
+		})
+	}
+
+	_, err = runner.expandType(ctx, Task{Type: "mount", Method: "PUT", Path: "sys/mounts/secret", Data: map[string]interface{}{"type": "transit"}})
+	assert.ErrorContains(t, err, "set replace: true")
+}
+
+func TestMigrationRunner_Remount(t *testing.T) {
+	interval := remountPollInterval
+	remountPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { remountPollInterval = interval })
+
+	server := newTestVaultServer(t)
+	server.put("", "sys/mounts/secret", map[string]interface{}{"type": "kv"})
+
+	respond := func(w http.ResponseWriter, data map[string]interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"data": data}))
+	}
+	var moved map[string]interface{}
+	server.handle("sys/remount", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&moved))
+		respond(w, map[string]interface{}{"migration_id": "m-1"})
+	})
+	var polls atomic.Int32
+	server.handle("sys/remount/status/m-1", func(w http.ResponseWriter, r *http.Request) {
+		status := "in-progress"
+		if polls.Add(1) == 3 {
+			status = "success"
+			server.put("", "sys/mounts/kv", map[string]interface{}{"type": "kv"})
+		}
+		respond(w, map[string]interface{}{"migration_info": map[string]interface{}{"status": status}})
+	})
+
+	migrations := []Migration{{
+		Version: 1,
+		Tasks: []Task{
+			{Type: "mount", Method: "PUT", Path: "sys/mounts/kv", Data: map[string]interface{}{"type": "kv", "moved_from": "secret"}},
+		},
+	}}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+		require.NoError(t, runner.RunMigrations(context.Background()))
+	})
+
+	assert.Equal(t, map[string]interface{}{"from": "secret", "to": "kv"}, moved)
+	assert.Equal(t, int32(3), polls.Load(), "the remount status is polled until it succeeds")
+}
+
+func TestGenerateTasksFromDiffs_Mount(t *testing.T) {
+	current := map[string]interface{}{
+		"sys/mounts/secret/": map[string]interface{}{
+			"type": "kv", "description": "",
+			"config":  map[string]interface{}{"default_lease_ttl": 0, "max_lease_ttl": 0},
+			"options": map[string]interface{}{"version": "2"},
+		},
+		"sys/mounts/transit/": map[string]interface{}{
+			"type": "transit", "config": map[string]interface{}{"max_lease_ttl": 0},
+		},
+		"secret/config/db": map[string]interface{}{"plugin_name": "postgresql-database-plugin"},
+	}
+	desired := map[string]interface{}{
+		"sys/mounts/kv/": map[interface{}]interface{}{
+			"type": "kv", "moved_from": "secret", "options": map[interface{}]interface{}{"version": "2"},
+		},
+		"sys/mounts/transit/": map[interface{}]interface{}{
+			"type": "transit", "config": map[interface{}]interface{}{"max_lease_ttl": "24h"},
+		},
+	}
+
+	tasks := generateTasksFromDiffs(compareConfigs(current, desired))
+	orderTasks(tasks)
+
+	assert.Equal(t, []Task{
+		{Type: "mount", Method: "POST", Path: "sys/mounts/kv", Data: map[string]interface{}{
+			"type": "kv", "moved_from": "secret", "options": map[string]interface{}{"version": "2"},
+		}},
+		{Type: "mount", Method: "PUT", Path: "sys/mounts/transit", Data: map[string]interface{}{
+			"type": "transit", "config": map[string]interface{}{"max_lease_ttl": "24h"},
+		}},
+	}, tasks, "a moved mount deletes nothing and tuning is an update")
+}
+
+func TestLoadSchema_Mounts(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := filepath.Join(dir, "schema.yaml")
+	require.NoError(t, os.WriteFile(schemaPath, []byte(`desired_state:
+  pki/:
+    type: pki
+    config:
+      max_lease_ttl: 87600h
+    tune:
+      default_lease_ttl: 8760h
+  sys/mounts/kv/:
+    type: kv
+    moved_from: secret
+  auth/userpass:
+    type: userpass
+    moved_from: auth/users
+  pki/roles/example:
+    allowed_domains: example.com
+  sys/quotas/rate-limit/kv:
+    mount: secret
+    rate: 50
+  sys/quotas/rate-limit/userpass:
+    mount: auth/users
+    rate: 5
+`), 0o644))
+
+	schema, err := LoadSchema(schemaPath)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"type":   "pki",
+		"config": map[string]interface{}{"max_lease_ttl": "87600h", "default_lease_ttl": "8760h"},
+	}, schema.DesiredState["sys/mounts/pki/"])
+	assert.NotContains(t, schema.DesiredState, "pki/")
+	assert.Contains(t, schema.DesiredState, "pki/roles/example")
+	assert.Equal(t, "kv", stringField(stringKeyMap(schema.DesiredState["sys/quotas/rate-limit/kv"]), "mount"),
+		"quotas follow moved mounts")
+	assert.Equal(t, "auth/userpass", stringField(stringKeyMap(schema.DesiredState["sys/quotas/rate-limit/userpass"]), "mount"))
+}
+
+func TestMigrationRunner_GeneratedMigrationRunsInOrder(t *testing.T) {
+	server := newTestVaultServer(t)
+	dir := t.TempDir()
+
+	desired := map[string]interface{}{
+		"sys/mounts/secret/": map[interface{}]interface{}{
+			"type":    "kv",
+			"options": map[interface{}]interface{}{"version": "2"},
+		},
+		"secret/data/app/config": map[interface{}]interface{}{
+			"data": map[interface{}]interface{}{"key": "value"},
+		},
+	}
+	_, err := GenerateIntelligentMigration(nil, desired, dir)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "V0001__initial_configuration.yaml"))
+
+	// The default configuration runs tasks concurrently
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`vault:
+  address: "`+server.server.URL+`"
+  token: "test-token"
+migrations:
+  directory: "`+dir+`"
+`), 0644))
+	config, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	require.True(t, config.Migrations.ConcurrentTasks)
+
+	runner, err := NewMigrationRunner(server.client(t), config)
+	require.NoError(t, err)
+	require.NoError(t, runner.RunMigrations(context.Background()))
+
+	_, ok := server.get("", "sys/mounts/secret")
+	assert.True(t, ok)
+	secret, ok := server.get("", "secret/data/app/config")
+	require.True(t, ok, "the secret is written once its mount exists")
+	assert.Equal(t, map[string]interface{}{"key": "value"}, secret["data"])
+}
@@ -0,0 +1,394 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// openAPIPath is the path Vault serves its OpenAPI document at. The document
+// describes the paths of every engine mounted in the namespace.
+const openAPIPath = "sys/internal/specs/openapi"
+
+// openAPIOperations maps write methods to the OpenAPI operation serving them
+var openAPIOperations = map[string]string{"POST": "post", "PUT": "post", "PATCH": "patch", "DELETE": "delete"}
+
+// OpenAPISpec is the part of Vault's OpenAPI document that schema and
+// migration paths are checked against
+type OpenAPISpec struct {
+	paths []openAPIRoute
+	// mounts holds the first segment of every path, and the first two of
+	// auth/ paths, to tell paths of unknown engines from unknown paths of
+	// mounted ones
+	mounts map[string]bool
+}
+
+// openAPIRoute is a path template of the document and its operations
+type openAPIRoute struct {
+	template string
+	strict   *regexp.Regexp
+	loose    *regexp.Regexp
+	literal  int
+	// operations maps the operations of the path to their request fields;
+	// a nil map means the fields are not described
+	operations map[string]map[string]openAPIField
+}
+
+// openAPIField is a request field of an operation
+type openAPIField struct {
+	Type   string `json:"type"`
+	Format string `json:"format"`
+}
+
+// openAPISchema is a request body schema of the document
+type openAPISchema struct {
+	Ref        string                  `json:"$ref"`
+	Properties map[string]openAPIField `json:"properties"`
+}
+
+// openAPIOperation is an operation of the document
+type openAPIOperation struct {
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema openAPISchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// openAPIDocument is the part of an OpenAPI document that is read
+type openAPIDocument struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+var openAPIParameter = regexp.MustCompile(`\{[^}]+\}`)
+
+// OpenAPIFinding is a path or field of a schema or migration that does not
+// match Vault's OpenAPI document
+type OpenAPIFinding struct {
+	Severity LintSeverity `json:"severity"`
+	// Source is the schema file location or migration file of the path
+	Source  string `json:"source"`
+	Path    string `json:"path"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// String formats the finding for logs
+func (f OpenAPIFinding) String() string {
+	location := fmt.Sprintf("%s: %s", f.Source, f.Path)
+	if f.Field != "" {
+		location += fmt.Sprintf(" field %q", f.Field)
+	}
+	return fmt.Sprintf("%s: %s: %s", f.Severity, location, f.Message)
+}
+
+// FetchOpenAPISpec downloads Vault's OpenAPI document
+func (c *VaultClient) FetchOpenAPISpec(ctx context.Context) ([]byte, error) {
+	resp, err := c.client.Logical().ReadRawWithContext(ctx, openAPIPath)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI document: %w", err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to read OpenAPI document: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI document: %w", err)
+	}
+	return data, nil
+}
+
+// ParseOpenAPISpec parses Vault's OpenAPI document
+func ParseOpenAPISpec(data []byte) (*OpenAPISpec, error) {
+	var doc openAPIDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI document: %w", err)
+	}
+	if doc.Paths == nil {
+		// vault read wraps the document in data
+		var wrapped struct {
+			Data openAPIDocument `json:"data"`
+		}
+		if err := json.Unmarshal(data, &wrapped); err == nil && wrapped.Data.Paths != nil {
+			doc = wrapped.Data
+		}
+	}
+	if doc.Paths == nil {
+		return nil, fmt.Errorf("OpenAPI document has no paths")
+	}
+
+	spec := &OpenAPISpec{mounts: make(map[string]bool)}
+	for template, item := range doc.Paths {
+		route := openAPIRoute{
+			template:   strings.Trim(template, "/"),
+			operations: make(map[string]map[string]openAPIField),
+		}
+		route.strict, route.loose = openAPIPattern(route.template)
+		route.literal = len(openAPIParameter.ReplaceAllString(route.template, ""))
+		for name, raw := range item {
+			if name != "get" && name != "post" && name != "patch" && name != "delete" {
+				continue
+			}
+			var operation openAPIOperation
+			if err := json.Unmarshal(raw, &operation); err != nil {
+				return nil, fmt.Errorf("failed to parse OpenAPI operation %s %s: %w", name, template, err)
+			}
+			route.operations[name] = operation.fields(doc.Components.Schemas)
+		}
+		spec.paths = append(spec.paths, route)
+		spec.mounts[openAPIMount(route.template)] = true
+	}
+	sort.Slice(spec.paths, func(i, j int) bool { return spec.paths[i].template < spec.paths[j].template })
+	return spec, nil
+}
+
+// fields returns the request fields of an operation, or nil if its request
+// body is not described
+func (o openAPIOperation) fields(components map[string]openAPISchema) map[string]openAPIField {
+	if o.RequestBody == nil {
+		return nil
+	}
+	content, ok := o.RequestBody.Content["application/json"]
+	if !ok {
+		return nil
+	}
+	schema := content.Schema
+	if schema.Ref != "" {
+		schema = components[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	if schema.Properties == nil {
+		return nil
+	}
+	return schema.Properties
+}
+
+// openAPIPattern compiles a path template. Parameters match one segment in
+// the strict pattern and any number of segments in the loose one, as some,
+// such as the path of a KV secret, span several.
+func openAPIPattern(template string) (strict, loose *regexp.Regexp) {
+	compile := func(parameter string) *regexp.Regexp {
+		parts := openAPIParameter.Split(template, -1)
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		return regexp.MustCompile("^" + strings.Join(parts, parameter) + "$")
+	}
+	return compile(`[^/]+`), compile(`.+`)
+}
+
+// openAPIMount returns the segments of a path that name its engine
+func openAPIMount(p string) string {
+	segments := strings.SplitN(strings.Trim(p, "/"), "/", 3)
+	if segments[0] == "auth" && len(segments) > 1 {
+		return segments[0] + "/" + segments[1]
+	}
+	return segments[0]
+}
+
+// route returns the template that best matches a path: one whose parameters
+// each match a single segment if there is one, and then the one with the most
+// literal text
+func (s *OpenAPISpec) route(p string) *openAPIRoute {
+	p = strings.Trim(p, "/")
+	var best *openAPIRoute
+	bestStrict := false
+	for i := range s.paths {
+		route := &s.paths[i]
+		strict := route.strict.MatchString(p)
+		if !strict && !route.loose.MatchString(p) {
+			continue
+		}
+		if best == nil || (strict && !bestStrict) || (strict == bestStrict && route.literal > best.literal) {
+			best, bestStrict = route, strict
+		}
+	}
+	return best
+}
+
+// check checks a write to a path and its data
+func (s *OpenAPISpec) check(source, method, p string, data map[string]interface{}) []OpenAPIFinding {
+	finding := func(severity LintSeverity, field, format string, args ...interface{}) OpenAPIFinding {
+		return OpenAPIFinding{Severity: severity, Source: source, Path: p, Field: field, Message: fmt.Sprintf(format, args...)}
+	}
+
+	route := s.route(p)
+	if route == nil {
+		if !s.mounts[openAPIMount(p)] {
+			// The engine may be mounted by an earlier migration
+			return nil
+		}
+		return []OpenAPIFinding{finding(LintWarning, "", "path is not described by the OpenAPI document")}
+	}
+	operation := openAPIOperations[method]
+	fields, ok := route.operations[operation]
+	if !ok {
+		return []OpenAPIFinding{finding(LintError, "", "%s is not supported by %s", method, route.template)}
+	}
+	if fields == nil {
+		return nil
+	}
+
+	var findings []OpenAPIFinding
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, ok := fields[name]
+		if !ok {
+			findings = append(findings, finding(LintError, name, "unknown field of %s", route.template))
+			continue
+		}
+		if !openAPIValueMatches(field, data[name]) {
+			findings = append(findings, finding(LintError, name, "must be %s", field.describe()))
+		}
+	}
+	return findings
+}
+
+// describe returns the type of a field for messages
+func (f openAPIField) describe() string {
+	if f.Format == "duration" || f.Format == "seconds" {
+		return "a duration"
+	}
+	if f.Type == "" {
+		return "any value"
+	}
+	return "of type " + f.Type
+}
+
+// openAPIValueMatches reports whether a value can be written to a field.
+// Vault converts strings to the type of their field, so only values it
+// would reject are mismatches.
+func openAPIValueMatches(field openAPIField, value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	text, isString := value.(string)
+	if isString && strings.Contains(text, "{{") {
+		// A template, filled in when the task runs
+		return true
+	}
+	_, isList := value.([]interface{})
+	isMap := stringKeyMap(value) != nil
+
+	if field.Format == "duration" || field.Format == "seconds" {
+		if isString {
+			_, ok := durationSeconds(text)
+			return ok
+		}
+		return !isList && !isMap
+	}
+
+	switch field.Type {
+	case "boolean":
+		if isString {
+			_, err := strconv.ParseBool(text)
+			return err == nil
+		}
+		_, ok := value.(bool)
+		return ok
+	case "integer", "number":
+		if isString {
+			_, err := strconv.ParseFloat(text, 64)
+			return err == nil
+		}
+		switch n := value.(type) {
+		case int, int64, uint64:
+			return true
+		case float64:
+			return field.Type == "number" || n == float64(int64(n))
+		}
+		return false
+	case "string":
+		return !isList && !isMap
+	case "array":
+		// Comma separated strings are accepted for lists
+		return isList || isString
+	case "object":
+		// JSON strings are accepted for maps
+		return isMap || isString
+	default:
+		return true
+	}
+}
+
+// CheckSchema checks the entries of a schema's desired state against the
+// document. Typed resources, which are checked by their JSON Schema and
+// written through their own endpoints, are skipped.
+func (s *OpenAPISpec) CheckSchema(schema *Schema) []OpenAPIFinding {
+	keys := make([]string, 0, len(schema.DesiredState))
+	for key := range schema.DesiredState {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var findings []OpenAPIFinding
+	for _, key := range keys {
+		value := schema.DesiredState[key]
+		if isTypedSchemaResource(key, value) {
+			continue
+		}
+		source := schema.Locations[key]
+		if source == "" {
+			source = "schema"
+		}
+		findings = append(findings, s.check(source, "POST", key, stringKeyMap(value))...)
+	}
+	return findings
+}
+
+// CheckMigrations checks the writes of migration tasks, and of their down
+// tasks, against the document. Typed tasks, reads and checks, and tasks in
+// other namespaces than the one the document describes are skipped.
+func (s *OpenAPISpec) CheckMigrations(migrations []Migration) []OpenAPIFinding {
+	var findings []OpenAPIFinding
+	for _, migration := range migrations {
+		source := migration.File
+		if source == "" {
+			source = fmt.Sprintf("migration %d", migration.Version)
+		}
+		for _, task := range append(append([]Task(nil), migration.Tasks...), migration.Down...) {
+			if task.Type != "" || migration.Namespace != "" || task.Namespace != "" {
+				continue
+			}
+			if _, ok := openAPIOperations[task.Method]; !ok {
+				continue
+			}
+			p := task.Path
+			if task.ForEach != "" {
+				p = strings.ReplaceAll(p, "{{key}}", "key")
+			}
+			findings = append(findings, s.check(source, task.Method, p, task.Data)...)
+		}
+	}
+	return findings
+}
+
+// isTypedSchemaResource reports whether a desired state entry is one of the
+// typed resources of schema files
+func isTypedSchemaResource(key string, value interface{}) bool {
+	for _, resource := range schemaResources {
+		if resource.typed && stringField(stringKeyMap(value), "type") == "" {
+			continue
+		}
+		for _, pattern := range resource.keys {
+			if regexp.MustCompile(pattern).MatchString(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
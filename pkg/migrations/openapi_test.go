@@ -0,0 +1,130 @@
+package migrations
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOpenAPIDocument = `{
+  "openapi": "3.0.2",
+  "paths": {
+    "/pki/roles/{name}": {
+      "parameters": [{"name": "name", "in": "path", "required": true}],
+      "get": {},
+      "post": {"requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/PkiWriteRoleRequest"}}}}},
+      "delete": {}
+    },
+    "/pki/root/generate/{exported}": {
+      "post": {"requestBody": {"content": {"application/json": {"schema": {"properties": {
+        "common_name": {"type": "string"},
+        "ttl": {"type": "string", "format": "duration"},
+        "key_bits": {"type": "integer"}
+      }}}}}}
+    },
+    "/secret/data/{path}": {
+      "post": {"requestBody": {"content": {"application/json": {"schema": {"properties": {
+        "data": {"type": "object"},
+        "options": {"type": "object"}
+      }}}}}}
+    },
+    "/auth/approle/role/{role_name}": {
+      "post": {"requestBody": {"content": {"application/json": {"schema": {"properties": {
+        "token_policies": {"type": "array"},
+        "token_ttl": {"type": "integer", "format": "seconds"},
+        "bind_secret_id": {"type": "boolean"}
+      }}}}}}
+    },
+    "/sys/seal": {"post": {}}
+  },
+  "components": {"schemas": {"PkiWriteRoleRequest": {"properties": {
+    "allowed_domains": {"type": "array"},
+    "allow_subdomains": {"type": "boolean"},
+    "max_ttl": {"type": "string", "format": "duration"}
+  }}}}
+}`
+
+func TestOpenAPISpec_CheckSchema(t *testing.T) {
+	spec, err := ParseOpenAPISpec([]byte(testOpenAPIDocument))
+	require.NoError(t, err)
+
+	schema := &Schema{
+		DesiredState: map[string]interface{}{
+			"pki/roles/web": map[interface{}]interface{}{
+				"allowed_domains": []interface{}{"example.com"}, "allow_subdomains": "maybe", "max_tll": "72h",
+			},
+			"pki/root/generate/internal": map[interface{}]interface{}{"common_name": "Root", "ttl": "87600h", "key_bits": "4096"},
+			"secret/data/team/app":       map[interface{}]interface{}{"data": map[interface{}]interface{}{"key": "value"}},
+			"auth/approle/role/app": map[interface{}]interface{}{
+				"token_policies": "app,default", "token_ttl": "1h", "bind_secret_id": true,
+			},
+			"auth/approle/login/app": map[interface{}]interface{}{"role_id": "x"},
+			"sys/mounts/pki/":        map[interface{}]interface{}{"type": "pki", "description": "typed, skipped"},
+			"transit/keys/app":       map[interface{}]interface{}{"type": "aes256-gcm96"},
+		},
+		Locations: map[string]string{"pki/roles/web": "schema.yaml:12"},
+	}
+
+	assert.Equal(t, []OpenAPIFinding{
+		{Severity: LintWarning, Source: "schema", Path: "auth/approle/login/app", Message: "path is not described by the OpenAPI document"},
+		{Severity: LintError, Source: "schema.yaml:12", Path: "pki/roles/web", Field: "allow_subdomains", Message: "must be of type boolean"},
+		{Severity: LintError, Source: "schema.yaml:12", Path: "pki/roles/web", Field: "max_tll", Message: "unknown field of pki/roles/{name}"},
+	}, spec.CheckSchema(schema))
+}
+
+func TestOpenAPISpec_CheckMigrations(t *testing.T) {
+	spec, err := ParseOpenAPISpec([]byte(`{"data": ` + testOpenAPIDocument + `}`))
+	require.NoError(t, err, "the document is accepted as vault read returns it")
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			File:    "V1__roles.yaml",
+			Tasks: []Task{
+				{Method: "POST", Path: "pki/roles/{{key}}", ForEach: "pki/roles", Data: map[string]interface{}{"max_ttl": "soon"}},
+				{Method: "PATCH", Path: "pki/roles/web", Data: map[string]interface{}{"max_ttl": "72h"}},
+				{Method: "GET", Path: "pki/roles/web"},
+				{Method: "PUT", Path: "sys/seal"},
+				{Type: "kv", Method: "PUT", Path: "secret/team/app", Data: map[string]interface{}{"key": "value"}},
+				{Namespace: "team", Method: "POST", Path: "pki/roles/web", Data: map[string]interface{}{"unknown": true}},
+			},
+			Down: []Task{{Method: "DELETE", Path: "pki/roles/web"}},
+		},
+	}
+
+	assert.Equal(t, []OpenAPIFinding{
+		{Severity: LintError, Source: "V1__roles.yaml", Path: "pki/roles/key", Field: "max_ttl", Message: "must be a duration"},
+		{Severity: LintError, Source: "V1__roles.yaml", Path: "pki/roles/web", Message: "PATCH is not supported by pki/roles/{name}"},
+	}, spec.CheckMigrations(migrations))
+}
+
+func TestVaultClient_FetchOpenAPISpec(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.handle(openAPIPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(testOpenAPIDocument))
+	})
+
+	client := &VaultClient{client: server.client(t)}
+	data, err := client.FetchOpenAPISpec(context.Background())
+	require.NoError(t, err)
+	spec, err := ParseOpenAPISpec(data)
+	require.NoError(t, err)
+	assert.Len(t, spec.paths, 5)
+}
+
+func TestLoadSchema_Locations(t *testing.T) {
+	dir := writeSchemaFiles(t, map[string]string{
+		"schema.yaml": "desired_state:\n  pki/:\n    type: pki\n  pki/roles/web:\n    max_ttl: 72h\n",
+	})
+	schema, err := LoadSchema(filepath.Join(dir, "schema.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"sys/mounts/pki/": filepath.Join(dir, "schema.yaml") + ":2",
+		"pki/roles/web":   filepath.Join(dir, "schema.yaml") + ":4",
+	}, schema.Locations)
+}
@@ -0,0 +1,307 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// pkiModes are the key modes of the root, intermediate and key generation
+// endpoints
+var pkiModes = map[string]bool{"internal": true, "exported": true, "existing": true, "kms": true}
+
+// pkiConfigs are the configuration endpoints below <mount>/config
+var pkiConfigs = map[string]bool{"urls": true, "crl": true, "issuers": true, "keys": true, "cluster": true, "auto-tidy": true}
+
+// pkiSigningFields are the fields of an intermediate task's sign_with, other
+// than mount and issuer_ref, that are passed to sign-intermediate
+var pkiSigningFields = map[string]bool{
+	"ttl": true, "not_after": true, "max_path_length": true, "use_csr_values": true,
+	"format": true, "permitted_dns_domains": true, "signature_bits": true, "use_pss": true,
+}
+
+// pkiType handles tasks on PKI mounts. The task path names the resource the
+// way Vault does:
+//
+//   - <mount>/root/generate/<mode> generates a root CA
+//   - <mount>/intermediate/generate/<mode> generates an intermediate CA and
+//     has it signed by the mount in data.sign_with
+//   - <mount>/keys/generate/<mode> generates a key named data.key_name
+//   - <mount>/issuer/<ref> and <mount>/key/<ref> update or delete an issuer
+//     or key
+//   - <mount>/config/<urls|crl|issuers|keys|cluster|auto-tidy> writes a
+//     configuration endpoint
+//   - <mount>/roles/<name> writes or deletes a role
+//
+// CA and key generation happen once: when the mount already has an issuer, or
+// the key exists, nothing is generated. A CA is only rotated when the task
+// sets replace: true.
+type pkiType struct{}
+
+// pkiResource is what a pki task path names
+type pkiResource struct {
+	mount string
+	// kind is root, intermediate, keys, issuer, key, config or roles
+	kind string
+	// name is the key mode of a generation, or the issuer, key, config or
+	// role name
+	name string
+}
+
+func (pkiType) validate(task Task) error {
+	resource, ok := parsePKIPath(task.Path)
+	if !ok {
+		return fmt.Errorf("pki path must name a PKI resource, such as pki/root/generate/internal or pki/roles/<name>")
+	}
+	if task.Replace && resource.kind != "root" && resource.kind != "intermediate" {
+		return fmt.Errorf("replace is only supported by root and intermediate CA generation")
+	}
+
+	switch task.Method {
+	case "POST", "PUT":
+	case "DELETE":
+		switch resource.kind {
+		case "issuer", "key", "roles":
+		default:
+			return fmt.Errorf("pki %s/%s cannot be deleted; delete its issuer or key instead", resource.kind, resource.name)
+		}
+		if len(task.Data) > 0 {
+			return fmt.Errorf("data is not supported by pki DELETE")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported pki method: %s", task.Method)
+	}
+
+	switch resource.kind {
+	case "root":
+		if stringField(task.Data, "common_name") == "" {
+			return fmt.Errorf("pki root CA needs data.common_name")
+		}
+	case "intermediate":
+		if stringField(task.Data, "common_name") == "" {
+			return fmt.Errorf("pki intermediate CA needs data.common_name")
+		}
+		signing := stringKeyMap(task.Data["sign_with"])
+		if stringField(signing, "mount") == "" {
+			return fmt.Errorf("pki intermediate CA needs data.sign_with.mount, the mount that signs it")
+		}
+		for field := range signing {
+			if field != "mount" && field != "issuer_ref" && !pkiSigningFields[field] {
+				return fmt.Errorf("unknown sign_with field %q", field)
+			}
+		}
+	case "keys":
+		if stringField(task.Data, "key_name") == "" {
+			return fmt.Errorf("pki key generation needs data.key_name, so an existing key is recognised")
+		}
+	}
+	return nil
+}
+
+func (pkiType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	resource, _ := parsePKIPath(task.Path)
+	raw := func(method, p string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Path, t.Data, t.Replace = method, p, data, false
+		return t
+	}
+	method := task.Method
+	if method == "PUT" {
+		method = "POST"
+	}
+
+	switch resource.kind {
+	case "root":
+		exists, err := m.pkiHasIssuer(ctx, task.Namespace, resource.mount)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !exists:
+			return []Task{raw("POST", task.Path, task.Data)}, nil
+		case task.Replace:
+			// Rotation adds a new issuer next to the current one; making it
+			// the default is left to a config/issuers task
+			return []Task{raw("POST", path.Join(resource.mount, "root/rotate", resource.name), task.Data)}, nil
+		default:
+			m.logger.Info().Str("mount", resource.mount).Msg("PKI mount already has a CA, not generating a root; set replace: true to rotate it")
+			return nil, nil
+		}
+	case "intermediate":
+		exists, err := m.pkiHasIssuer(ctx, task.Namespace, resource.mount)
+		if err != nil {
+			return nil, err
+		}
+		if exists && !task.Replace {
+			m.logger.Info().Str("mount", resource.mount).Msg("PKI mount already has a CA, not generating an intermediate; set replace: true to rotate it")
+			return nil, nil
+		}
+		return pkiIntermediateTasks(task, resource), nil
+	case "keys":
+		keyPath := path.Join(resource.mount, "key", stringField(task.Data, "key_name"))
+		exists, err := m.pathExists(ctx, task.Namespace, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, nil
+		}
+		return []Task{raw("POST", task.Path, task.Data)}, nil
+	default:
+		return []Task{raw(method, task.Path, task.Data)}, nil
+	}
+}
+
+// pkiIntermediateTasks returns the three steps of creating an intermediate
+// CA: generate a CSR on the mount, sign it with the mount in sign_with, and
+// import the signed certificate. Each step passes its response to the next.
+func pkiIntermediateTasks(task Task, resource pkiResource) []Task {
+	signing := stringKeyMap(task.Data["sign_with"])
+	generate := make(map[string]interface{})
+	for field, value := range task.Data {
+		if field != "sign_with" {
+			generate[field] = value
+		}
+	}
+	sign := map[string]interface{}{"common_name": task.Data["common_name"]}
+	for field, value := range signing {
+		if pkiSigningFields[field] {
+			sign[field] = value
+		}
+	}
+	signPath := path.Join(stringField(signing, "mount"), "root/sign-intermediate")
+	if ref := stringField(signing, "issuer_ref"); ref != "" {
+		signPath = path.Join(stringField(signing, "mount"), "issuer", ref, "sign-intermediate")
+	}
+
+	var csr, certificate string
+	step := func(p string, data map[string]interface{}, run func(ctx context.Context, client *api.Client) error) Task {
+		t := task
+		t.Method, t.Path, t.Data, t.Replace, t.run = "POST", p, data, false, run
+		return t
+	}
+	return []Task{
+		step(task.Path, generate, func(ctx context.Context, client *api.Client) error {
+			secret, err := client.Logical().WriteWithContext(ctx, task.Path, generate)
+			if err != nil {
+				return fmt.Errorf("failed to generate intermediate CSR: %w", err)
+			}
+			if secret == nil || stringField(secret.Data, "csr") == "" {
+				return fmt.Errorf("failed to generate intermediate CSR: no csr returned")
+			}
+			csr = stringField(secret.Data, "csr")
+			return nil
+		}),
+		step(signPath, sign, func(ctx context.Context, client *api.Client) error {
+			request := map[string]interface{}{"csr": csr}
+			for field, value := range sign {
+				request[field] = value
+			}
+			secret, err := client.Logical().WriteWithContext(ctx, signPath, request)
+			if err != nil {
+				return fmt.Errorf("failed to sign intermediate CSR: %w", err)
+			}
+			if secret == nil || stringField(secret.Data, "certificate") == "" {
+				return fmt.Errorf("failed to sign intermediate CSR: no certificate returned")
+			}
+			certificate = stringField(secret.Data, "certificate")
+			if issuing := stringField(secret.Data, "issuing_ca"); issuing != "" && !strings.Contains(certificate, issuing) {
+				certificate += "\n" + issuing
+			}
+			return nil
+		}),
+		step(path.Join(resource.mount, "intermediate/set-signed"), nil, func(ctx context.Context, client *api.Client) error {
+			_, err := client.Logical().WriteWithContext(ctx, path.Join(resource.mount, "intermediate/set-signed"), map[string]interface{}{
+				"certificate": certificate,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to import signed intermediate: %w", err)
+			}
+			return nil
+		}),
+	}
+}
+
+// parsePKIPath splits a pki task path into its mount and the resource below it
+func parsePKIPath(p string) (pkiResource, bool) {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	n := len(segments)
+	var resource pkiResource
+	switch {
+	case n >= 4 && segments[n-2] == "generate" && pkiModes[segments[n-1]] &&
+		(segments[n-3] == "root" || segments[n-3] == "intermediate" || segments[n-3] == "keys"):
+		resource = pkiResource{mount: strings.Join(segments[:n-3], "/"), kind: segments[n-3], name: segments[n-1]}
+	case n >= 3 && (segments[n-2] == "issuer" || segments[n-2] == "key" || segments[n-2] == "roles"):
+		resource = pkiResource{mount: strings.Join(segments[:n-2], "/"), kind: segments[n-2], name: segments[n-1]}
+	case n >= 3 && segments[n-2] == "config" && pkiConfigs[segments[n-1]]:
+		resource = pkiResource{mount: strings.Join(segments[:n-2], "/"), kind: "config", name: segments[n-1]}
+	default:
+		return pkiResource{}, false
+	}
+	return resource, resource.name != ""
+}
+
+// pkiHasIssuer reports whether a PKI mount already has a CA. Issuers are
+// listed where Vault supports them; older versions are asked for cert/ca.
+func (m *MigrationRunner) pkiHasIssuer(ctx context.Context, namespace, mount string) (bool, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return false, err
+	}
+	if client == nil {
+		return false, fmt.Errorf("cannot look up issuers without Vault client")
+	}
+
+	list, err := client.Logical().ListWithContext(ctx, path.Join(mount, "issuers"))
+	if err != nil {
+		return false, fmt.Errorf("failed to list issuers of %s: %w", mount, err)
+	}
+	if list != nil {
+		if keys, ok := list.Data["keys"].([]interface{}); ok && len(keys) > 0 {
+			return true, nil
+		}
+	}
+
+	ca, err := client.Logical().ReadWithContext(ctx, path.Join(mount, "cert/ca"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read the CA of %s: %w", mount, err)
+	}
+	return ca != nil && stringField(ca.Data, "certificate") != "", nil
+}
+
+// pathExists reports whether a path can be read
+func (m *MigrationRunner) pathExists(ctx context.Context, namespace, p string) (bool, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return false, err
+	}
+	if client == nil {
+		return false, fmt.Errorf("cannot read %s without Vault client", p)
+	}
+	secret, err := client.Logical().ReadWithContext(ctx, p)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", p, err)
+	}
+	return secret != nil, nil
+}
+
+// isPKIGeneration reports whether a path generates a CA or key, which is a
+// one-shot action rather than a resource that can be written again
+func isPKIGeneration(p string) bool {
+	resource, ok := parsePKIPath(p)
+	return ok && (resource.kind == "root" || resource.kind == "intermediate" || resource.kind == "keys")
+}
+
+// pkiTaskFromDiff converts a difference in a desired state entry that
+// generates a CA or key into a pki task, so applying it again does not
+// generate a new one
+func pkiTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	if !isPKIGeneration(diff.Path) || diff.NewValue == nil {
+		return Task{}, false
+	}
+	return Task{Type: "pki", Path: diff.Path, Method: method, Data: stringKeyMap(diff.NewValue)}, true
+}
@@ -0,0 +1,206 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requests returns the method, path and data of tasks, leaving out how they run
+func requests(tasks []Task) []Task {
+	stripped := make([]Task, len(tasks))
+	for i, task := range tasks {
+		stripped[i] = Task{Method: task.Method, Path: task.Path, Data: task.Data}
+	}
+	return stripped
+}
+
+func TestPKIType_Validate(t *testing.T) {
+	valid := []Task{
+		{Type: "pki", Method: "PUT", Path: "pki/root/generate/internal", Data: map[string]interface{}{"common_name": "Example Root CA"}},
+		{Type: "pki", Method: "PUT", Path: "pki/root/generate/internal", Replace: true, Data: map[string]interface{}{"common_name": "Example Root CA"}},
+		{Type: "pki", Method: "PUT", Path: "pki_int/intermediate/generate/internal", Data: map[string]interface{}{
+			"common_name": "Example Intermediate", "sign_with": map[interface{}]interface{}{"mount": "pki", "ttl": "43800h"},
+		}},
+		{Type: "pki", Method: "PUT", Path: "pki/keys/generate/internal", Data: map[string]interface{}{"key_name": "root-2024"}},
+		{Type: "pki", Method: "PUT", Path: "pki/config/urls", Data: map[string]interface{}{"issuing_certificates": "https://vault/v1/pki/ca"}},
+		{Type: "pki", Method: "PUT", Path: "pki/roles/example", Data: map[string]interface{}{"allowed_domains": "example.com"}},
+		{Type: "pki", Method: "DELETE", Path: "pki/roles/example"},
+		{Type: "pki", Method: "DELETE", Path: "pki/issuer/old"},
+	}
+	for _, task := range valid {
+		assert.NoError(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+
+	invalid := []Task{
+		{Type: "pki", Method: "PUT", Path: "pki/cert/ca", Data: map[string]interface{}{"a": 1}},
+		{Type: "pki", Method: "PUT", Path: "pki/root/generate/internal", Data: map[string]interface{}{"ttl": "87600h"}},
+		{Type: "pki", Method: "DELETE", Path: "pki/root/generate/internal"},
+		{Type: "pki", Method: "PUT", Path: "pki_int/intermediate/generate/internal", Data: map[string]interface{}{"common_name": "Example Intermediate"}},
+		{Type: "pki", Method: "PUT", Path: "pki_int/intermediate/generate/internal", Data: map[string]interface{}{
+			"common_name": "Example Intermediate", "sign_with": map[string]interface{}{"mount": "pki", "csr": "x"},
+		}},
+		{Type: "pki", Method: "PUT", Path: "pki/keys/generate/internal", Data: map[string]interface{}{"key_type": "ec"}},
+		{Type: "pki", Method: "PUT", Path: "pki/roles/example", Replace: true, Data: map[string]interface{}{"allowed_domains": "example.com"}},
+		{Type: "pki", Method: "DELETE", Path: "pki/config/crl"},
+		{Type: "pki", Method: "PATCH", Path: "pki/roles/example", Data: map[string]interface{}{"max_ttl": "1h"}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestPKIType_Expand(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "pki/issuers/0b4a3c1e", map[string]interface{}{"issuer_name": "root"})
+	server.put("", "legacy/cert/ca", map[string]interface{}{"certificate": "-----BEGIN CERTIFICATE-----"})
+	server.put("", "pki/key/root-2024", map[string]interface{}{"key_name": "root-2024"})
+
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: t.TempDir()},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+	root := map[string]interface{}{"common_name": "Example Root CA", "ttl": "87600h"}
+
+	tests := []struct {
+		name string
+		task Task
+		want []Task
+	}{
+		{
+			name: "generate a root CA",
+			task: Task{Type: "pki", Method: "PUT", Path: "fresh/root/generate/internal", Data: root},
+			want: []Task{{Method: "POST", Path: "fresh/root/generate/internal", Data: root}},
+		},
+		{
+			name: "root CA exists",
+			task: Task{Type: "pki", Method: "PUT", Path: "pki/root/generate/internal", Data: root},
+			want: []Task{},
+		},
+		{
+			name: "root CA exists on Vault without issuers",
+			task: Task{Type: "pki", Method: "PUT", Path: "legacy/root/generate/internal", Data: root},
+			want: []Task{},
+		},
+		{
+			name: "rotate a root CA",
+			task: Task{Type: "pki", Method: "PUT", Path: "pki/root/generate/internal", Replace: true, Data: root},
+			want: []Task{{Method: "POST", Path: "pki/root/rotate/internal", Data: root}},
+		},
+		{
+			name: "generate and sign an intermediate CA",
+			task: Task{Type: "pki", Method: "PUT", Path: "pki_int/intermediate/generate/internal", Data: map[string]interface{}{
+				"common_name": "Example Intermediate",
+				"sign_with":   map[string]interface{}{"mount": "pki", "issuer_ref": "root", "ttl": "43800h"},
+			}},
+			want: []Task{
+				{Method: "POST", Path: "pki_int/intermediate/generate/internal", Data: map[string]interface{}{"common_name": "Example Intermediate"}},
+				{Method: "POST", Path: "pki/issuer/root/sign-intermediate", Data: map[string]interface{}{"common_name": "Example Intermediate", "ttl": "43800h"}},
+				{Method: "POST", Path: "pki_int/intermediate/set-signed"},
+			},
+		},
+		{
+			name: "key exists",
+			task: Task{Type: "pki", Method: "PUT", Path: "pki/keys/generate/internal", Data: map[string]interface{}{"key_name": "root-2024"}},
+			want: []Task{},
+		},
+		{
+			name: "generate a key",
+			task: Task{Type: "pki", Method: "PUT", Path: "pki/keys/generate/internal", Data: map[string]interface{}{"key_name": "root-2025"}},
+			want: []Task{{Method: "POST", Path: "pki/keys/generate/internal", Data: map[string]interface{}{"key_name": "root-2025"}}},
+		},
+		{
+			name: "role",
+			task: Task{Type: "pki", Method: "PUT", Path: "pki/roles/example", Data: map[string]interface{}{"allowed_domains": "example.com"}},
+			want: []Task{{Method: "POST", Path: "pki/roles/example", Data: map[string]interface{}{"allowed_domains": "example.com"}}},
+		},
+		{
+			name: "delete an issuer",
+			task: Task{Type: "pki", Method: "DELETE", Path: "pki/issuer/old"},
+			want: []Task{{Method: "DELETE", Path: "pki/issuer/old"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runner.expandType(ctx, tt.task)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, requests(got))
+		})
+	}
+}
+
+func TestMigrationRunner_PKIIntermediate(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "pki/issuers/0b4a3c1e", map[string]interface{}{"issuer_name": "root"})
+
+	respond := func(data map[string]interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"data": data}))
+		}
+	}
+	var signed map[string]interface{}
+	server.handle("pki_int/intermediate/generate/internal", respond(map[string]interface{}{"csr": "CSR"}))
+	server.handle("pki/root/sign-intermediate", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&signed))
+		respond(map[string]interface{}{"certificate": "INTERMEDIATE", "issuing_ca": "ROOT"})(w, r)
+	})
+
+	migrations := []Migration{{
+		Version: 1,
+		Tasks: []Task{
+			{Type: "pki", Method: "PUT", Path: "pki/root/generate/internal", Data: map[string]interface{}{"common_name": "Example Root CA"}},
+			{Type: "pki", Method: "PUT", Path: "pki_int/intermediate/generate/internal", Data: map[string]interface{}{
+				"common_name": "Example Intermediate",
+				"sign_with":   map[string]interface{}{"mount": "pki", "ttl": "43800h"},
+			}},
+		},
+	}}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir, Snapshots: true},
+		})
+		require.NoError(t, err)
+		require.NoError(t, runner.RunMigrations(context.Background()))
+	})
+
+	_, generated := server.get("", "pki/root/generate/internal")
+	assert.False(t, generated, "the root CA already exists and must not be generated again")
+	assert.Equal(t, map[string]interface{}{"csr": "CSR", "common_name": "Example Intermediate", "ttl": "43800h"}, signed)
+	imported, ok := server.get("", "pki_int/intermediate/set-signed")
+	require.True(t, ok)
+	assert.Equal(t, "INTERMEDIATE\nROOT", imported["certificate"])
+}
+
+func TestGenerateTasksFromDiffs_PKI(t *testing.T) {
+	current := map[string]interface{}{
+		"old/root/generate/internal": map[string]interface{}{"common_name": "Old Root"},
+	}
+	desired := map[string]interface{}{
+		"pki_int/intermediate/generate/internal": map[interface{}]interface{}{
+			"common_name": "Example Intermediate",
+			"sign_with":   map[interface{}]interface{}{"mount": "pki"},
+		},
+		"pki/root/generate/internal": map[interface{}]interface{}{"common_name": "Example Root CA"},
+		"pki/roles/example":          map[interface{}]interface{}{"allowed_domains": "example.com"},
+	}
+
+	tasks := generateTasksFromDiffs(compareConfigs(current, desired))
+	orderTasks(tasks)
+
+	assert.Equal(t, []Task{
+		{Type: "pki", Method: "POST", Path: "pki/root/generate/internal", Data: map[string]interface{}{"common_name": "Example Root CA"}},
+		{Type: "pki", Method: "POST", Path: "pki_int/intermediate/generate/internal", Data: map[string]interface{}{
+			"common_name": "Example Intermediate",
+			"sign_with":   map[string]interface{}{"mount": "pki"},
+		}},
+		{Method: "POST", Path: "pki/roles/example", Data: map[string]interface{}{"allowed_domains": "example.com"}},
+	}, tasks, "removing a CA generation from the desired state removes nothing")
+}
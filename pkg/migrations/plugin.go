@@ -0,0 +1,347 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// pluginFields are the fields a plugin task accepts in its data
+var pluginFields = map[string]bool{
+	"sha256":  true,
+	"binary":  true,
+	"command": true,
+	"args":    true,
+	"env":     true,
+	"version": true,
+	"reload":  true,
+}
+
+// pluginTypes are the plugin types of the catalog
+var pluginTypes = map[string]bool{"auth": true, "database": true, "secret": true}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// pluginType handles tasks that register plugins in the catalog. The task
+// path is sys/plugins/catalog/<auth|database|secret>/<name>; data holds the
+// command, args, env and version, and the checksum either as sha256 or as the
+// path of the plugin binary, which is hashed when the task runs. Binary paths
+// are relative to the migrations directory.
+//
+// Registering a plugin that is already registered with the same checksum does
+// nothing. When data.version is set, mounts of the plugin are tuned to that
+// version; mounts running a plugin whose binary changed are reloaded, unless
+// the task sets reload: false.
+type pluginType struct{}
+
+// pluginResource is what a plugin task path names
+type pluginResource struct {
+	// kind is auth, database or secret
+	kind string
+	name string
+}
+
+func (pluginType) validate(task Task) error {
+	resource, ok := parsePluginPath(task.Path)
+	if !ok {
+		return fmt.Errorf("plugin path must be sys/plugins/catalog/<auth|database|secret>/<name>")
+	}
+	switch task.Method {
+	case "POST", "PUT":
+	case "DELETE":
+		for field := range task.Data {
+			if field != "version" {
+				return fmt.Errorf("plugin DELETE only supports data.version")
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported plugin method: %s", task.Method)
+	}
+
+	for field := range task.Data {
+		if !pluginFields[field] {
+			return fmt.Errorf("unknown plugin field %q", field)
+		}
+	}
+	if stringField(task.Data, "command") == "" {
+		return fmt.Errorf("plugin %s needs data.command", resource.name)
+	}
+	sum, hasSum := task.Data["sha256"].(string)
+	binary, hasBinary := task.Data["binary"].(string)
+	switch {
+	case !hasSum && !hasBinary:
+		return fmt.Errorf("plugin %s needs data.sha256 or data.binary", resource.name)
+	case hasSum && !sha256Pattern.MatchString(strings.ToLower(sum)):
+		return fmt.Errorf("plugin sha256 must be 64 hexadecimal characters")
+	case hasBinary && binary == "":
+		return fmt.Errorf("plugin binary must be a path")
+	}
+	if _, ok := task.Data["args"].([]interface{}); task.Data["args"] != nil && !ok {
+		return fmt.Errorf("plugin args must be a list")
+	}
+	if _, ok := task.Data["env"].([]interface{}); task.Data["env"] != nil && !ok {
+		return fmt.Errorf("plugin env must be a list of NAME=value")
+	}
+	if _, ok := task.Data["reload"].(bool); task.Data["reload"] != nil && !ok {
+		return fmt.Errorf("plugin reload must be true or false")
+	}
+	return nil
+}
+
+func (pluginType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	resource, _ := parsePluginPath(task.Path)
+	raw := func(method, p string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Path, t.Data = method, p, data
+		return t
+	}
+	version := stringField(task.Data, "version")
+
+	client, err := m.clientForNamespace(task.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, fmt.Errorf("cannot read the plugin catalog without Vault client")
+	}
+
+	if task.Method == "DELETE" {
+		if version == "" {
+			return []Task{raw("DELETE", task.Path, nil)}, nil
+		}
+		deregister := raw("DELETE", task.Path, task.Data)
+		deregister.run = func(ctx context.Context, client *api.Client) error {
+			_, err := client.Logical().DeleteWithDataWithContext(ctx, task.Path, map[string][]string{"version": {version}})
+			if err != nil {
+				return fmt.Errorf("failed to deregister plugin %s %s: %w", resource.name, version, err)
+			}
+			return nil
+		}
+		return []Task{deregister}, nil
+	}
+
+	sum, err := pluginChecksum(task.Data, m.migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	request := map[string]interface{}{"sha256": sum, "command": task.Data["command"]}
+	for _, field := range []string{"args", "env", "version"} {
+		if value, ok := task.Data[field]; ok {
+			request[field] = value
+		}
+	}
+
+	var query map[string][]string
+	if version != "" {
+		query = map[string][]string{"version": {version}}
+	}
+	current, err := client.Logical().ReadWithDataWithContext(ctx, task.Path, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plugin %s: %w", resource.name, err)
+	}
+
+	var tasks []Task
+	registered := current != nil && pluginRegistrationEqual(current.Data, request)
+	if !registered {
+		tasks = append(tasks, raw("POST", task.Path, request))
+	}
+
+	mounts, err := m.pluginMounts(ctx, task.Namespace, resource)
+	if err != nil {
+		return nil, err
+	}
+	tuned := 0
+	if version != "" && resource.kind != "database" {
+		for _, mount := range mounts {
+			if stringField(mount.config, "plugin_version") == version {
+				continue
+			}
+			tasks = append(tasks, raw("POST", path.Join(mount.path, "tune"), map[string]interface{}{"plugin_version": version}))
+			tuned++
+		}
+	}
+
+	reload, ok := task.Data["reload"].(bool)
+	if !ok {
+		reload = true
+	}
+	changed := current != nil && !registered
+	if !reload || len(mounts) == 0 || (!changed && tuned == 0) {
+		return tasks, nil
+	}
+	if resource.kind == "database" {
+		// Database plugins run per connection and are reloaded by the
+		// database mounts using them
+		for _, mount := range mounts {
+			tasks = append(tasks, raw("POST", path.Join(strings.TrimPrefix(mount.path, "sys/mounts/"), "reload", resource.name), nil))
+		}
+		return tasks, nil
+	}
+	return append(tasks, raw("POST", "sys/plugins/reload/backend", map[string]interface{}{"plugin": resource.name})), nil
+}
+
+// parsePluginPath returns the plugin a catalog path names
+func parsePluginPath(p string) (pluginResource, bool) {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segments) != 5 || strings.Join(segments[:3], "/") != "sys/plugins/catalog" ||
+		!pluginTypes[segments[3]] || segments[4] == "" {
+		return pluginResource{}, false
+	}
+	return pluginResource{kind: segments[3], name: segments[4]}, true
+}
+
+// pluginChecksum returns the SHA256 of a plugin, hashing data.binary, read
+// relative to baseDir, when it is set. A binary that does not match data.sha256
+// is an error.
+func pluginChecksum(data map[string]interface{}, baseDir string) (string, error) {
+	sum := strings.ToLower(stringField(data, "sha256"))
+	binary := stringField(data, "binary")
+	if binary == "" {
+		return sum, nil
+	}
+	if !filepath.IsAbs(binary) {
+		binary = filepath.Join(baseDir, binary)
+	}
+	file, err := os.Open(binary)
+	if err != nil {
+		return "", fmt.Errorf("failed to read plugin binary: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash plugin binary: %w", err)
+	}
+	computed := hex.EncodeToString(hash.Sum(nil))
+	if sum != "" && sum != computed {
+		return "", fmt.Errorf("plugin binary %s has SHA256 %s, not %s", binary, computed, sum)
+	}
+	return computed, nil
+}
+
+// inlinePluginBinary replaces the binary of plugin data with its SHA256, so
+// the desired state compares with what Vault returns
+func inlinePluginBinary(data map[string]interface{}, baseDir string) error {
+	if _, ok := data["binary"].(string); !ok {
+		return nil
+	}
+	sum, err := pluginChecksum(data, baseDir)
+	if err != nil {
+		return err
+	}
+	delete(data, "binary")
+	data["sha256"] = sum
+	return nil
+}
+
+// pluginRegistrationEqual reports whether a catalog entry matches a
+// registration request. Vault does not return env, so it is not compared.
+func pluginRegistrationEqual(current, request map[string]interface{}) bool {
+	if !strings.EqualFold(stringField(current, "sha256"), stringField(request, "sha256")) ||
+		stringField(current, "command") != stringField(request, "command") {
+		return false
+	}
+	args, _ := current["args"].([]interface{})
+	want, _ := request["args"].([]interface{})
+	return configValuesEqual(args, want) || (len(args) == 0 && len(want) == 0)
+}
+
+// pluginMount is a mount that runs a plugin
+type pluginMount struct {
+	// path is the mount's sys path, such as sys/mounts/kv or sys/auth/oidc
+	path   string
+	config map[string]interface{}
+}
+
+// pluginMounts returns the mounts that run a plugin. Database plugins are
+// run by every database secrets engine.
+func (m *MigrationRunner) pluginMounts(ctx context.Context, namespace string, resource pluginResource) ([]pluginMount, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	table, mountType := "sys/mounts", resource.name
+	switch resource.kind {
+	case "auth":
+		table = "sys/auth"
+	case "database":
+		mountType = "database"
+	}
+
+	secret, err := client.Logical().ReadWithContext(ctx, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mounts: %w", err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	var mounts []pluginMount
+	for mountPath, value := range secret.Data {
+		mount := stringKeyMap(value)
+		if mount == nil || stringField(mount, "type") != mountType {
+			continue
+		}
+		mounts = append(mounts, pluginMount{path: path.Join(table, mountPath), config: mount})
+	}
+	// Sorted, so the tasks for them are stable
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].path < mounts[j].path })
+	return mounts, nil
+}
+
+// pluginTaskFromDiff converts a difference in a plugin catalog entry into a
+// plugin task
+func pluginTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	if _, ok := parsePluginPath(diff.Path); !ok {
+		return Task{}, false
+	}
+	task := Task{Type: "plugin", Path: diff.Path, Method: method}
+	if method != "DELETE" {
+		task.Data = stringKeyMap(diff.NewValue)
+	} else if version := stringField(stringKeyMap(diff.OldValue), "version"); version != "" {
+		task.Data = map[string]interface{}{"version": version}
+	}
+	return task, true
+}
+
+// pluginStateEqual compares the current catalog entry of a plugin with the
+// desired one
+func pluginStateEqual(current, desired interface{}) bool {
+	have, want := stringKeyMap(current), stringKeyMap(desired)
+	if have == nil || want == nil {
+		return configValuesEqual(current, desired)
+	}
+	return pluginRegistrationEqual(have, want) && stringField(have, "version") == stringField(want, "version")
+}
+
+// pluginVersionLess reports whether plugin version a is older than b,
+// comparing the numbers of semantic versions such as v1.10.0 one by one
+func pluginVersionLess(a, b string) bool {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, errX := strconv.Atoi(as[i])
+		y, errY := strconv.Atoi(bs[i])
+		if errX != nil || errY != nil {
+			if as[i] != bs[i] {
+				return as[i] < bs[i]
+			}
+			continue
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
@@ -0,0 +1,196 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginType_Validate(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	valid := []Task{
+		{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/my-secrets", Data: map[string]interface{}{
+			"command": "my-secrets", "sha256": sum, "version": "v1.2.0", "args": []interface{}{"-tls-skip-verify"},
+		}},
+		{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/auth/my-auth", Data: map[string]interface{}{
+			"command": "my-auth", "binary": "plugins/my-auth", "reload": false,
+		}},
+		{Type: "plugin", Method: "DELETE", Path: "sys/plugins/catalog/secret/my-secrets", Data: map[string]interface{}{"version": "v1.1.0"}},
+		{Type: "plugin", Method: "DELETE", Path: "sys/plugins/catalog/database/my-db"},
+	}
+	for _, task := range valid {
+		assert.NoError(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+
+	invalid := []Task{
+		{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/my-secrets", Data: map[string]interface{}{"command": "x", "sha256": sum}},
+		{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/kms/x", Data: map[string]interface{}{"command": "x", "sha256": sum}},
+		{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/x", Data: map[string]interface{}{"sha256": sum}},
+		{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/x", Data: map[string]interface{}{"command": "x"}},
+		{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/x", Data: map[string]interface{}{"command": "x", "sha256": "abc"}},
+		{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/x", Data: map[string]interface{}{"command": "x", "sha256": sum, "args": "-v"}},
+		{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/x", Data: map[string]interface{}{"command": "x", "sha256": sum, "reload": "no"}},
+		{Type: "plugin", Method: "DELETE", Path: "sys/plugins/catalog/secret/x", Data: map[string]interface{}{"command": "x"}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestPluginType_Expand(t *testing.T) {
+	dir := t.TempDir()
+	binary := []byte("#!/bin/sh\n")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "plugins"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plugins", "my-secrets"), binary, 0o755))
+	digest := sha256.Sum256(binary)
+	sum := hex.EncodeToString(digest[:])
+	old := strings.Repeat("0", 64)
+
+	server := newTestVaultServer(t)
+	server.put("", "sys/plugins/catalog/secret/my-secrets", map[string]interface{}{"command": "my-secrets", "sha256": old})
+	server.put("", "sys/plugins/catalog/secret/unused", map[string]interface{}{"command": "unused", "sha256": old})
+	server.put("", "sys/plugins/catalog/auth/my-auth", map[string]interface{}{"command": "my-auth", "sha256": sum})
+	server.put("", "sys/plugins/catalog/database/my-db", map[string]interface{}{"command": "my-db", "sha256": old})
+	server.put("", "sys/mounts/team-a", map[string]interface{}{"type": "my-secrets", "plugin_version": "v1.0.0"})
+	server.put("", "sys/mounts/team-b", map[string]interface{}{"type": "my-secrets", "plugin_version": "v1.1.0"})
+	server.put("", "sys/mounts/database", map[string]interface{}{"type": "database"})
+
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: dir},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		task Task
+		want []Task
+	}{
+		{
+			name: "register a new plugin from its binary",
+			task: Task{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/new", Data: map[string]interface{}{
+				"command": "new", "binary": "plugins/my-secrets",
+			}},
+			want: []Task{{Method: "POST", Path: "sys/plugins/catalog/secret/new", Data: map[string]interface{}{"command": "new", "sha256": sum}}},
+		},
+		{
+			name: "already registered",
+			task: Task{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/auth/my-auth", Data: map[string]interface{}{
+				"command": "my-auth", "sha256": strings.ToUpper(sum),
+			}},
+			want: []Task{},
+		},
+		{
+			name: "upgrade the mounts of a plugin to a new version",
+			task: Task{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/my-secrets", Data: map[string]interface{}{
+				"command": "my-secrets", "binary": "plugins/my-secrets", "sha256": sum, "version": "v1.1.0",
+			}},
+			want: []Task{
+				{Method: "POST", Path: "sys/plugins/catalog/secret/my-secrets", Data: map[string]interface{}{
+					"command": "my-secrets", "sha256": sum, "version": "v1.1.0",
+				}},
+				{Method: "POST", Path: "sys/mounts/team-a/tune", Data: map[string]interface{}{"plugin_version": "v1.1.0"}},
+				{Method: "POST", Path: "sys/plugins/reload/backend", Data: map[string]interface{}{"plugin": "my-secrets"}},
+			},
+		},
+		{
+			name: "replace the binary of an unused plugin",
+			task: Task{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/unused", Data: map[string]interface{}{
+				"command": "unused", "sha256": sum,
+			}},
+			want: []Task{{Method: "POST", Path: "sys/plugins/catalog/secret/unused", Data: map[string]interface{}{"command": "unused", "sha256": sum}}},
+		},
+		{
+			name: "replace the binary of a database plugin",
+			task: Task{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/database/my-db", Data: map[string]interface{}{
+				"command": "my-db", "sha256": sum,
+			}},
+			want: []Task{
+				{Method: "POST", Path: "sys/plugins/catalog/database/my-db", Data: map[string]interface{}{"command": "my-db", "sha256": sum}},
+				{Method: "POST", Path: "database/reload/my-db"},
+			},
+		},
+		{
+			name: "without reloading",
+			task: Task{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/database/my-db", Data: map[string]interface{}{
+				"command": "my-db", "sha256": sum, "reload": false,
+			}},
+			want: []Task{{Method: "POST", Path: "sys/plugins/catalog/database/my-db", Data: map[string]interface{}{"command": "my-db", "sha256": sum}}},
+		},
+		{
+			name: "deregister a version",
+			task: Task{Type: "plugin", Method: "DELETE", Path: "sys/plugins/catalog/secret/my-secrets", Data: map[string]interface{}{"version": "v1.0.0"}},
+			want: []Task{{Method: "DELETE", Path: "sys/plugins/catalog/secret/my-secrets", Data: map[string]interface{}{"version": "v1.0.0"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runner.expandType(ctx, tt.task)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, requests(got))
+		})
+	}
+
+	_, err = runner.expandType(ctx, Task{Type: "plugin", Method: "PUT", Path: "sys/plugins/catalog/secret/x", Data: map[string]interface{}{
+		"command": "x", "binary": "plugins/my-secrets", "sha256": old,
+	}})
+	assert.ErrorContains(t, err, "has SHA256 "+sum)
+}
+
+func TestLoadSchema_PluginBinary(t *testing.T) {
+	dir := t.TempDir()
+	binary := []byte("plugin")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "my-secrets"), binary, 0o755))
+	schemaPath := filepath.Join(dir, "schema.yaml")
+	require.NoError(t, os.WriteFile(schemaPath, []byte(`desired_state:
+  sys/plugins/catalog/secret/my-secrets:
+    command: my-secrets
+    binary: my-secrets
+`), 0o644))
+
+	schema, err := LoadSchema(schemaPath)
+	require.NoError(t, err)
+	digest := sha256.Sum256(binary)
+	assert.Equal(t, map[string]interface{}{"command": "my-secrets", "sha256": hex.EncodeToString(digest[:])},
+		schema.DesiredState["sys/plugins/catalog/secret/my-secrets"])
+}
+
+func TestOrderTasks_Plugin(t *testing.T) {
+	tasks := []Task{
+		{Method: "POST", Path: "sys/mounts/team-a", Data: map[string]interface{}{"type": "my-secrets"}},
+		{Type: "auth", Method: "POST", Path: "auth/my-auth", Data: map[string]interface{}{"type": "my-auth"}},
+		{Type: "plugin", Method: "DELETE", Path: "sys/plugins/catalog/secret/old"},
+		{Type: "plugin", Method: "POST", Path: "sys/plugins/catalog/secret/my-secrets"},
+		{Type: "plugin", Method: "POST", Path: "sys/plugins/catalog/auth/my-auth"},
+		{Type: "auth", Method: "DELETE", Path: "auth/old"},
+	}
+	orderTasks(tasks)
+
+	var paths []string
+	for _, task := range tasks {
+		paths = append(paths, task.Method+" "+task.Path)
+	}
+	assert.Equal(t, []string{
+		"POST sys/plugins/catalog/auth/my-auth",
+		"POST sys/plugins/catalog/secret/my-secrets",
+		"POST auth/my-auth",
+		"POST sys/mounts/team-a",
+		"DELETE auth/old",
+		"DELETE sys/plugins/catalog/secret/old",
+	}, paths)
+}
+
+func TestPluginVersionLess(t *testing.T) {
+	assert.True(t, pluginVersionLess("v1.9.0", "v1.10.0"))
+	assert.True(t, pluginVersionLess("", "v1.0.0"))
+	assert.False(t, pluginVersionLess("v2.0.0", "v1.10.0"))
+	assert.False(t, pluginVersionLess("v1.0.0", "v1.0.0"))
+}
@@ -0,0 +1,488 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+// policyKinds are the policy endpoints below sys/policies. RGP and EGP are
+// Sentinel policies and need Vault Enterprise.
+var policyKinds = map[string]bool{"acl": true, "rgp": true, "egp": true}
+
+// enforcementLevels are the enforcement levels of Sentinel policies
+var enforcementLevels = map[string]bool{"advisory": true, "soft-mandatory": true, "hard-mandatory": true}
+
+// policyFields are the fields a policy task accepts in its data
+var policyFields = map[string]bool{
+	"policy":            true,
+	"file":              true,
+	"rules":             true,
+	"enforcement_level": true,
+	"paths":             true,
+}
+
+// policyType handles tasks on ACL, RGP and EGP policies. The task path is the
+// policy endpoint, sys/policies/<acl|rgp|egp>/<name>, and the legacy
+// sys/policy/<name> for ACL policies. The policy comes from data.policy, a
+// file named by data.file relative to the migrations directory, or, for ACL
+// policies, data.rules, a list of path rules rendered to HCL. A policy whose
+// text only differs in formatting from the current one is not written.
+type policyType struct{}
+
+// policyRule is a path block of an ACL policy
+type policyRule struct {
+	path   string
+	fields map[string]interface{}
+}
+
+func (policyType) validate(task Task) error {
+	kind, _ := policyEndpoint(task.Path)
+	if kind == "" {
+		return fmt.Errorf("policy path must be sys/policies/<acl|rgp|egp>/<name>")
+	}
+	switch task.Method {
+	case "POST", "PUT":
+	case "DELETE":
+		if len(task.Data) > 0 {
+			return fmt.Errorf("data is not supported by policy DELETE")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported policy method: %s", task.Method)
+	}
+	return validatePolicyData(kind, task.Data)
+}
+
+func (policyType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	kind, name := policyEndpoint(task.Path)
+	endpoint := path.Join("sys/policies", kind, name)
+	current, err := m.readPolicy(ctx, task.Namespace, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := func(method string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Path, t.Data = method, endpoint, data
+		return t
+	}
+
+	if task.Method == "DELETE" {
+		if current == nil {
+			return nil, nil
+		}
+		return []Task{raw("DELETE", nil)}, nil
+	}
+
+	desired, err := policyRequest(kind, task.Data, m.migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && policyRequestEqual(kind, current, desired) {
+		return nil, nil
+	}
+	return []Task{raw("PUT", desired)}, nil
+}
+
+// policyEndpoint returns the kind and name of a policy path, or empty strings
+// if the path is not a policy
+func policyEndpoint(p string) (kind, name string) {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "sys" && parts[1] == "policy":
+		kind, name = "acl", parts[2]
+	case len(parts) == 4 && parts[0] == "sys" && parts[1] == "policies" && policyKinds[parts[2]]:
+		kind, name = parts[2], parts[3]
+	}
+	if name == "" {
+		return "", ""
+	}
+	return kind, name
+}
+
+// isDefaultPolicy reports whether p is the default ACL policy, which Vault
+// ships with and refuses to delete
+func isDefaultPolicy(p string) bool {
+	kind, name := policyEndpoint(p)
+	return kind == "acl" && name == "default"
+}
+
+// validatePolicyData checks the data of a policy write
+func validatePolicyData(kind string, data map[string]interface{}) error {
+	for field := range data {
+		if !policyFields[field] {
+			return fmt.Errorf("unknown policy field %q", field)
+		}
+	}
+
+	sources := 0
+	for _, field := range []string{"policy", "file", "rules"} {
+		if data[field] != nil {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("policy needs exactly one of policy, file and rules")
+	}
+	for _, field := range []string{"policy", "file"} {
+		if _, ok := data[field].(string); data[field] != nil && !ok {
+			return fmt.Errorf("policy %s must be a string", field)
+		}
+	}
+
+	if kind == "acl" {
+		if data["enforcement_level"] != nil || data["paths"] != nil {
+			return fmt.Errorf("enforcement_level and paths are only supported by Sentinel policies")
+		}
+		if text, ok := data["policy"].(string); ok {
+			if _, err := parsePolicy(text); err != nil {
+				return err
+			}
+		}
+		if data["rules"] != nil {
+			if _, err := policyRulesFromData(data["rules"]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if data["rules"] != nil {
+		return fmt.Errorf("rules are only supported by ACL policies")
+	}
+	if level := stringField(data, "enforcement_level"); !enforcementLevels[level] {
+		return fmt.Errorf("%s policy needs enforcement_level advisory, soft-mandatory or hard-mandatory", kind)
+	}
+	paths, ok := data["paths"].([]interface{})
+	switch {
+	case kind == "egp" && (!ok || len(paths) == 0):
+		return fmt.Errorf("egp policy needs paths")
+	case kind == "rgp" && data["paths"] != nil:
+		return fmt.Errorf("paths are only supported by egp policies")
+	}
+	return nil
+}
+
+// policyRequest returns the body of a policy write. baseDir is the directory
+// data.file is relative to.
+func policyRequest(kind string, data map[string]interface{}, baseDir string) (map[string]interface{}, error) {
+	text, err := policyText(data, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	request := map[string]interface{}{"policy": text}
+	if kind != "acl" {
+		request["enforcement_level"] = stringField(data, "enforcement_level")
+		if paths, ok := data["paths"]; ok {
+			request["paths"] = paths
+		}
+	}
+	return request, nil
+}
+
+// policyText returns the text of a policy from its inline text, file or rules
+func policyText(data map[string]interface{}, baseDir string) (string, error) {
+	if text, ok := data["policy"].(string); ok {
+		return text, nil
+	}
+	if file, ok := data["file"].(string); ok {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(baseDir, file)
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read policy file: %w", err)
+		}
+		return string(content), nil
+	}
+	rules, err := policyRulesFromData(data["rules"])
+	if err != nil {
+		return "", err
+	}
+	return renderPolicy(rules), nil
+}
+
+// inlinePolicyFile replaces the file reference of policy data with the text
+// of the file, read relative to baseDir
+func inlinePolicyFile(data map[string]interface{}, baseDir string) error {
+	if _, ok := data["file"].(string); !ok {
+		return nil
+	}
+	text, err := policyText(data, baseDir)
+	if err != nil {
+		return err
+	}
+	delete(data, "file")
+	data["policy"] = text
+	return nil
+}
+
+// readPolicy returns the current policy at an endpoint, or nil if there is none
+func (m *MigrationRunner) readPolicy(ctx context.Context, namespace, endpoint string) (map[string]interface{}, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, fmt.Errorf("cannot read policy without Vault client")
+	}
+
+	secret, err := client.Logical().ReadWithContext(ctx, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	return secret.Data, nil
+}
+
+// policyRequestEqual reports whether a current policy matches a desired
+// policy write, ignoring differences in formatting
+func policyRequestEqual(kind string, current, desired map[string]interface{}) bool {
+	if normalizePolicy(kind, stringField(current, "policy")) != normalizePolicy(kind, stringField(desired, "policy")) {
+		return false
+	}
+	if kind == "acl" {
+		return true
+	}
+	return stringField(current, "enforcement_level") == stringField(desired, "enforcement_level") &&
+		configValuesEqual(current["paths"], desired["paths"])
+}
+
+// normalizePolicy returns a canonical form of a policy for comparison. ACL
+// policies are parsed and rendered again, so the order of path blocks,
+// capabilities and fields, comments and whitespace do not matter. Sentinel
+// policies, and ACL policies that cannot be parsed, only have trailing
+// whitespace and blank lines removed.
+func normalizePolicy(kind, text string) string {
+	if kind == "acl" {
+		if rules, err := parsePolicy(text); err == nil {
+			return renderPolicy(rules)
+		}
+	}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimRight(line, " \t\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parsePolicy parses the path rules of an ACL policy written in HCL
+func parsePolicy(text string) ([]policyRule, error) {
+	root, err := hcl.Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse policy: does not contain a root object")
+	}
+	for _, item := range list.Items {
+		if key := item.Keys[0].Token.Value(); key != "path" && key != "name" {
+			return nil, fmt.Errorf("invalid policy: unknown key %v", key)
+		}
+	}
+
+	var rules []policyRule
+	for _, item := range list.Filter("path").Items {
+		if len(item.Keys) == 0 {
+			return nil, fmt.Errorf("invalid policy: path block without a path")
+		}
+		rulePath, _ := item.Keys[0].Token.Value().(string)
+		var fields map[string]interface{}
+		if err := hcl.DecodeObject(&fields, item.Val); err != nil {
+			return nil, fmt.Errorf("invalid policy: path %q: %w", rulePath, err)
+		}
+		rules = append(rules, policyRule{path: rulePath, fields: flattenHCL(fields).(map[string]interface{})})
+	}
+	return rules, nil
+}
+
+// flattenHCL turns the lists of objects HCL decodes nested blocks into back
+// into plain maps
+func flattenHCL(v interface{}) interface{} {
+	switch value := v.(type) {
+	case []map[string]interface{}:
+		merged := make(map[string]interface{})
+		for _, item := range value {
+			for k, field := range item {
+				merged[k] = flattenHCL(field)
+			}
+		}
+		return merged
+	case map[string]interface{}:
+		flattened := make(map[string]interface{}, len(value))
+		for k, field := range value {
+			flattened[k] = flattenHCL(field)
+		}
+		return flattened
+	case []interface{}:
+		flattened := make([]interface{}, len(value))
+		for i, item := range value {
+			flattened[i] = flattenHCL(item)
+		}
+		return flattened
+	default:
+		return v
+	}
+}
+
+// policyRulesFromData reads the structured form of an ACL policy: a list of
+// rules, each with a path and the fields of its path block
+func policyRulesFromData(v interface{}) ([]policyRule, error) {
+	items, ok := v.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("policy rules must be a list of path rules")
+	}
+	seen := make(map[string]bool)
+	rules := make([]policyRule, 0, len(items))
+	for i, item := range items {
+		fields := stringKeyMap(item)
+		rulePath, _ := fields["path"].(string)
+		if rulePath == "" {
+			return nil, fmt.Errorf("policy rule %d needs a path", i)
+		}
+		if seen[rulePath] {
+			return nil, fmt.Errorf("policy rule %d: duplicate path %q", i, rulePath)
+		}
+		seen[rulePath] = true
+		delete(fields, "path")
+		rules = append(rules, policyRule{path: rulePath, fields: fields})
+	}
+	return rules, nil
+}
+
+// renderPolicy renders path rules as HCL. Rules are sorted by path and
+// capabilities by name, so equal policies render the same text.
+func renderPolicy(rules []policyRule) string {
+	sorted := append([]policyRule(nil), rules...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].path < sorted[j].path })
+
+	var b strings.Builder
+	for i, rule := range sorted {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "path %s {\n", strconv.Quote(rule.path))
+		keys := make([]string, 0, len(rule.fields))
+		for key := range rule.fields {
+			if key != "capabilities" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		if _, ok := rule.fields["capabilities"]; ok {
+			keys = append([]string{"capabilities"}, keys...)
+		}
+		for _, key := range keys {
+			value := rule.fields[key]
+			if key == "capabilities" {
+				value = sortedStrings(value)
+			}
+			fmt.Fprintf(&b, "  %s = %s\n", key, renderHCLValue(value, "  "))
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// sortedStrings returns a list as sorted strings, or the value unchanged if
+// it is not a list
+func sortedStrings(v interface{}) interface{} {
+	var values []string
+	switch list := v.(type) {
+	case []interface{}:
+		for _, item := range list {
+			values = append(values, fmt.Sprint(item))
+		}
+	case []string:
+		values = append(values, list...)
+	default:
+		return v
+	}
+	sort.Strings(values)
+	sorted := make([]interface{}, len(values))
+	for i, value := range values {
+		sorted[i] = value
+	}
+	return sorted
+}
+
+// renderHCLValue renders a value as HCL, indenting nested objects
+func renderHCLValue(v interface{}, indent string) string {
+	if m := stringKeyMap(v); m != nil {
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		b.WriteString("{\n")
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s  %s = %s\n", indent, strconv.Quote(key), renderHCLValue(m[key], indent+"  "))
+		}
+		b.WriteString(indent + "}")
+		return b.String()
+	}
+	switch value := v.(type) {
+	case string:
+		return strconv.Quote(value)
+	case []string:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = item
+		}
+		return renderHCLValue(items, indent)
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = renderHCLValue(item, indent)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case nil:
+		return `""`
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// policyTaskFromDiff converts a difference in a policy, written in the desired
+// state as sys/policies/<kind>/<name> with a policy, file or rules, into a
+// policy task
+func policyTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	kind, name := policyEndpoint(diff.Path)
+	if kind == "" {
+		return Task{}, false
+	}
+	task := Task{Type: "policy", Path: path.Join("sys/policies", kind, name), Method: method}
+	if method != "DELETE" {
+		task.Data = stringKeyMap(diff.NewValue)
+	}
+	return task, true
+}
+
+// policyStateEqual compares the current state of a policy with the desired
+// one, ignoring differences in formatting
+func policyStateEqual(kind string, current, desired interface{}) bool {
+	have, want := stringKeyMap(current), stringKeyMap(desired)
+	if have == nil || want == nil {
+		return configValuesEqual(current, desired)
+	}
+	request, err := policyRequest(kind, want, "")
+	if err != nil {
+		return false
+	}
+	return policyRequestEqual(kind, have, request)
+}
@@ -0,0 +1,214 @@
+package migrations
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const appPolicy = `path "secret/data/app/*" {
+  capabilities = ["list", "read"]
+}
+
+path "sys/leases/renew" {
+  capabilities = ["update"]
+  allowed_parameters = {
+    "increment" = []
+  }
+}
+`
+
+func TestNormalizePolicy(t *testing.T) {
+	reformatted := `
+# Leases
+path "sys/leases/renew" {
+	capabilities = [ "update" ]
+	allowed_parameters = { "increment" = [] }
+}
+path "secret/data/app/*" { capabilities = ["read","list"] }
+`
+	assert.Equal(t, normalizePolicy("acl", appPolicy), normalizePolicy("acl", reformatted))
+	assert.NotEqual(t, normalizePolicy("acl", appPolicy), normalizePolicy("acl", `path "secret/data/app/*" { capabilities = ["read"] }`))
+
+	sentinel := "main = rule {\n  true\n}\n"
+	assert.Equal(t, normalizePolicy("rgp", sentinel), normalizePolicy("rgp", "\nmain = rule {  \n  true\n}"))
+}
+
+func TestRenderPolicy(t *testing.T) {
+	rules, err := policyRulesFromData([]interface{}{
+		map[interface{}]interface{}{
+			"path":               "sys/leases/renew",
+			"capabilities":       []interface{}{"update"},
+			"allowed_parameters": map[interface{}]interface{}{"increment": []interface{}{}},
+		},
+		map[interface{}]interface{}{
+			"path":         "secret/data/app/*",
+			"capabilities": []interface{}{"read", "list"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, appPolicy, renderPolicy(rules))
+
+	parsed, err := parsePolicy(renderPolicy(rules))
+	require.NoError(t, err)
+	assert.Len(t, parsed, 2)
+}
+
+func TestPolicyType_Validate(t *testing.T) {
+	valid := []Task{
+		{Type: "policy", Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{"policy": appPolicy}},
+		{Type: "policy", Method: "PUT", Path: "sys/policy/app", Data: map[string]interface{}{"file": "app.hcl"}},
+		{Type: "policy", Method: "PUT", Path: "sys/policies/egp/business-hours", Data: map[string]interface{}{
+			"policy": "main = rule { true }", "enforcement_level": "soft-mandatory", "paths": []interface{}{"secret/*"},
+		}},
+		{Type: "policy", Method: "DELETE", Path: "sys/policies/rgp/old"},
+	}
+	for _, task := range valid {
+		assert.NoError(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+
+	invalid := []Task{
+		{Type: "policy", Method: "PUT", Path: "sys/policies/app", Data: map[string]interface{}{"policy": appPolicy}},
+		{Type: "policy", Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{}},
+		{Type: "policy", Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{"policy": appPolicy, "file": "app.hcl"}},
+		{Type: "policy", Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{"policy": `path "a" {`}},
+		{Type: "policy", Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{"policy": `key "a" {}`}},
+		{Type: "policy", Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{"rules": []interface{}{map[interface{}]interface{}{"capabilities": []interface{}{"read"}}}}},
+		{Type: "policy", Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{"policy": appPolicy, "enforcement_level": "advisory"}},
+		{Type: "policy", Method: "PUT", Path: "sys/policies/rgp/app", Data: map[string]interface{}{"policy": "main = rule { true }"}},
+		{Type: "policy", Method: "PUT", Path: "sys/policies/egp/app", Data: map[string]interface{}{"policy": "main = rule { true }", "enforcement_level": "advisory"}},
+		{Type: "policy", Method: "DELETE", Path: "sys/policies/acl/app", Data: map[string]interface{}{"policy": appPolicy}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestPolicyType_Expand(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "sys/policies/acl/app", map[string]interface{}{"name": "app", "policy": appPolicy})
+
+	migrationsDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(migrationsDir, "ops.hcl"), []byte(`path "sys/health" { capabilities = ["read"] }`), 0644))
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: migrationsDir},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		task Task
+		want []Task
+	}{
+		{
+			name: "unchanged apart from formatting",
+			task: Task{Type: "policy", Method: "PUT", Path: "sys/policy/app", Data: map[string]interface{}{
+				"rules": []interface{}{
+					map[interface{}]interface{}{"path": "secret/data/app/*", "capabilities": []interface{}{"read", "list"}},
+					map[interface{}]interface{}{"path": "sys/leases/renew", "capabilities": []interface{}{"update"},
+						"allowed_parameters": map[interface{}]interface{}{"increment": []interface{}{}}},
+				},
+			}},
+			want: nil,
+		},
+		{
+			name: "changed",
+			task: Task{Type: "policy", Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{
+				"policy": `path "secret/data/app/*" { capabilities = ["read"] }`,
+			}},
+			want: []Task{{Method: "PUT", Path: "sys/policies/acl/app", Data: map[string]interface{}{
+				"policy": `path "secret/data/app/*" { capabilities = ["read"] }`,
+			}}},
+		},
+		{
+			name: "from a file",
+			task: Task{Type: "policy", Method: "PUT", Path: "sys/policies/acl/ops", Data: map[string]interface{}{"file": "ops.hcl"}},
+			want: []Task{{Method: "PUT", Path: "sys/policies/acl/ops", Data: map[string]interface{}{
+				"policy": `path "sys/health" { capabilities = ["read"] }`,
+			}}},
+		},
+		{
+			name: "sentinel",
+			task: Task{Type: "policy", Method: "PUT", Path: "sys/policies/egp/hours", Data: map[string]interface{}{
+				"policy": "main = rule { true }", "enforcement_level": "advisory", "paths": []interface{}{"secret/*"},
+			}},
+			want: []Task{{Method: "PUT", Path: "sys/policies/egp/hours", Data: map[string]interface{}{
+				"policy": "main = rule { true }", "enforcement_level": "advisory", "paths": []interface{}{"secret/*"},
+			}}},
+		},
+		{
+			name: "delete",
+			task: Task{Type: "policy", Method: "DELETE", Path: "sys/policies/acl/app"},
+			want: []Task{{Method: "DELETE", Path: "sys/policies/acl/app"}},
+		},
+		{
+			name: "delete a missing policy",
+			task: Task{Type: "policy", Method: "DELETE", Path: "sys/policies/acl/missing"},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runner.expandType(ctx, tt.task)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGenerateTasksFromDiffs_Policy(t *testing.T) {
+	current := map[string]interface{}{
+		"sys/policies/acl/app":     map[string]interface{}{"policy": appPolicy},
+		"sys/policies/acl/old":     map[string]interface{}{"policy": `path "a" { capabilities = ["read"] }`},
+		"sys/policies/acl/default": map[string]interface{}{"policy": `path "auth/token/lookup-self" { capabilities = ["read"] }`},
+	}
+	desired := map[string]interface{}{
+		"sys/policies/acl/app": map[interface{}]interface{}{
+			"policy": "path \"sys/leases/renew\" {\n capabilities = [\"update\"]\n allowed_parameters = {\"increment\" = []}\n}\npath \"secret/data/app/*\" { capabilities = [\"read\", \"list\"] }",
+		},
+		"sys/policies/acl/new": map[interface{}]interface{}{
+			"rules": []interface{}{map[interface{}]interface{}{"path": "b", "capabilities": []interface{}{"read"}}},
+		},
+	}
+
+	tasks := generateTasksFromDiffs(compareConfigs(current, desired))
+	orderTasks(tasks)
+
+	assert.Equal(t, []Task{
+		{Type: "policy", Method: "POST", Path: "sys/policies/acl/new", Data: map[string]interface{}{
+			"rules": []interface{}{map[string]interface{}{"path": "b", "capabilities": []interface{}{"read"}}},
+		}},
+		{Type: "policy", Method: "DELETE", Path: "sys/policies/acl/old"},
+	}, tasks, "sys/policies/acl/app only differs in formatting and the default policy is never deleted")
+}
+
+func TestLoadSchema_Policies(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.hcl"), []byte(appPolicy), 0644))
+	schemaPath := filepath.Join(dir, "schema.yaml")
+	require.NoError(t, os.WriteFile(schemaPath, []byte(`desired_state:
+  sys/policies/acl/app:
+    file: app.hcl
+`), 0644))
+
+	schema, err := LoadSchema(schemaPath)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"policy": appPolicy}, schema.DesiredState["sys/policies/acl/app"])
+
+	// The example schema's policy renders to valid HCL
+	example, err := LoadSchema(filepath.Join("..", "..", "schema.yaml"))
+	require.NoError(t, err)
+	data := stringKeyMap(example.DesiredState["sys/policies/acl/app-policy"])
+	require.NoError(t, validatePolicyData("acl", data))
+	text, err := policyText(data, "")
+	require.NoError(t, err)
+	rules, err := parsePolicy(text)
+	require.NoError(t, err)
+	assert.Len(t, rules, 4)
+}
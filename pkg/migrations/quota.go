@@ -0,0 +1,210 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// quotaFields are the fields each kind of quota accepts in its data
+var quotaFields = map[string]map[string]bool{
+	"rate-limit": {
+		"mount": true, "path": true, "role": true, "inheritable": true,
+		"rate": true, "interval": true, "block_interval": true,
+	},
+	"lease-count": {
+		"mount": true, "path": true, "role": true, "inheritable": true,
+		"max_leases": true,
+	},
+}
+
+// quotaLimitFields are the limit each kind of quota needs
+var quotaLimitFields = map[string]string{
+	"rate-limit":  "rate",
+	"lease-count": "max_leases",
+}
+
+// quotaType handles tasks on rate limit and lease count quotas. The task path
+// is sys/quotas/<rate-limit|lease-count>/<name>; data is written as Vault
+// takes it, except that a quota can name the mount it applies to in
+// data.mount, such as secret or auth/kubernetes. The quota path is then
+// data.path below that mount, and the mount must exist when the task runs.
+type quotaType struct{}
+
+// quotaResource is what a quota task path names
+type quotaResource struct {
+	// kind is rate-limit or lease-count
+	kind string
+	name string
+}
+
+func (quotaType) validate(task Task) error {
+	resource, ok := parseQuotaPath(task.Path)
+	if !ok {
+		return fmt.Errorf("quota path must be sys/quotas/<rate-limit|lease-count>/<name>")
+	}
+	switch task.Method {
+	case "POST", "PUT":
+	case "DELETE":
+		if len(task.Data) > 0 {
+			return fmt.Errorf("data is not supported by quota DELETE")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported quota method: %s", task.Method)
+	}
+	return validateQuotaData(resource.kind, task.Data)
+}
+
+// validateQuotaData checks the data of a quota write
+func validateQuotaData(kind string, data map[string]interface{}) error {
+	for field := range data {
+		if !quotaFields[kind][field] {
+			return fmt.Errorf("unknown %s quota field %q", kind, field)
+		}
+	}
+	limit := quotaLimitFields[kind]
+	if data[limit] == nil {
+		return fmt.Errorf("%s quota needs data.%s", kind, limit)
+	}
+	if _, ok := data["mount"]; ok {
+		if stringField(data, "mount") == "" {
+			return fmt.Errorf("quota mount must be a mount path")
+		}
+		if strings.HasPrefix(stringField(data, "path"), "/") {
+			return fmt.Errorf("quota path must be relative to data.mount")
+		}
+	}
+	return nil
+}
+
+func (quotaType) expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error) {
+	raw := func(method string, data map[string]interface{}) Task {
+		t := task
+		t.Method, t.Data = method, data
+		return t
+	}
+	if task.Method == "DELETE" {
+		return []Task{raw("DELETE", nil)}, nil
+	}
+
+	request := quotaRequest(task.Data)
+	if mount := strings.Trim(stringField(task.Data, "mount"), "/"); mount != "" {
+		exists, err := m.mountExists(ctx, task.Namespace, mount)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("quota mount %s is not enabled", mount)
+		}
+	}
+	return []Task{raw("POST", request)}, nil
+}
+
+// parseQuotaPath returns the quota a task path names
+func parseQuotaPath(p string) (quotaResource, bool) {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segments) != 4 || segments[0] != "sys" || segments[1] != "quotas" ||
+		quotaFields[segments[2]] == nil || segments[3] == "" {
+		return quotaResource{}, false
+	}
+	return quotaResource{kind: segments[2], name: segments[3]}, true
+}
+
+// quotaRequest returns the body of a quota write, with data.mount and
+// data.path joined into the quota path
+func quotaRequest(data map[string]interface{}) map[string]interface{} {
+	request := make(map[string]interface{}, len(data))
+	for field, value := range data {
+		if field != "mount" {
+			request[field] = value
+		}
+	}
+	if _, ok := data["mount"]; ok {
+		request["path"] = quotaPath(data)
+	}
+	return request
+}
+
+// quotaPath returns the path a quota applies to, joining data.mount and
+// data.path. Mount paths end with a slash, like Vault returns them.
+func quotaPath(data map[string]interface{}) string {
+	mount := strings.Trim(stringField(data, "mount"), "/")
+	if mount == "" {
+		return stringField(data, "path")
+	}
+	if p := strings.Trim(stringField(data, "path"), "/"); p != "" {
+		return path.Join(mount, p)
+	}
+	return mount + "/"
+}
+
+// mountExists reports whether a secrets engine, or an auth method written as
+// auth/<path>, is mounted at a path
+func (m *MigrationRunner) mountExists(ctx context.Context, namespace, mountPath string) (bool, error) {
+	if authPath := authMountPath(mountPath); authPath != "" {
+		mount, err := m.authMount(ctx, namespace, authPath)
+		return mount != nil, err
+	}
+
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return false, err
+	}
+	if client == nil {
+		return false, fmt.Errorf("cannot list mounts without Vault client")
+	}
+	secret, err := client.Logical().ReadWithContext(ctx, "sys/mounts")
+	if err != nil {
+		return false, fmt.Errorf("failed to list mounts: %w", err)
+	}
+	return secret != nil && secret.Data[mountPath+"/"] != nil, nil
+}
+
+// quotaTaskFromDiff converts a difference in a quota into a quota task
+func quotaTaskFromDiff(diff HCLDiff, method string) (Task, bool) {
+	if _, ok := parseQuotaPath(diff.Path); !ok {
+		return Task{}, false
+	}
+	task := Task{Type: "quota", Path: diff.Path, Method: method}
+	if method != "DELETE" {
+		task.Data = stringKeyMap(diff.NewValue)
+	}
+	return task, true
+}
+
+// quotaStateEqual compares the current state of a quota with the desired
+// one. The desired path is resolved from its mount, and only the fields the
+// desired state sets are compared.
+func quotaStateEqual(current, desired interface{}) bool {
+	have, want := stringKeyMap(current), stringKeyMap(desired)
+	if have == nil || want == nil {
+		return configValuesEqual(current, desired)
+	}
+	if strings.Trim(stringField(have, "path"), "/") != strings.Trim(quotaPath(want), "/") {
+		return false
+	}
+	for field, value := range want {
+		if field == "mount" || field == "path" {
+			continue
+		}
+		if !configFieldEqual(have[field], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// quotaMountDefined reports whether the mount a quota names is part of a
+// desired state, as sys/mounts/<path> or auth/<path>
+func quotaMountDefined(state map[string]interface{}, mount string) bool {
+	mount = strings.Trim(mount, "/")
+	for key := range state {
+		key = strings.Trim(key, "/")
+		if key == "sys/mounts/"+mount || (strings.HasPrefix(mount, "auth/") && (key == mount || key == "sys/"+mount)) {
+			return true
+		}
+	}
+	return false
+}
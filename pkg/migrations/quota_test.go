@@ -0,0 +1,153 @@
+package migrations
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaType_Validate(t *testing.T) {
+	valid := []Task{
+		{Type: "quota", Method: "PUT", Path: "sys/quotas/rate-limit/global", Data: map[string]interface{}{"rate": 500}},
+		{Type: "quota", Method: "PUT", Path: "sys/quotas/rate-limit/secret", Data: map[string]interface{}{
+			"mount": "secret", "path": "data/app", "rate": 50, "interval": "1s", "block_interval": "30s",
+		}},
+		{Type: "quota", Method: "PUT", Path: "sys/quotas/lease-count/kubernetes", Data: map[string]interface{}{
+			"mount": "auth/kubernetes", "max_leases": 1000, "role": "app",
+		}},
+		{Type: "quota", Method: "DELETE", Path: "sys/quotas/rate-limit/global"},
+	}
+	for _, task := range valid {
+		assert.NoError(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+
+	invalid := []Task{
+		{Type: "quota", Method: "PUT", Path: "sys/quotas/config", Data: map[string]interface{}{"enable_rate_limit_audit_logging": true}},
+		{Type: "quota", Method: "PUT", Path: "sys/quotas/rate-limit/global", Data: map[string]interface{}{"interval": "1s"}},
+		{Type: "quota", Method: "PUT", Path: "sys/quotas/lease-count/global", Data: map[string]interface{}{"rate": 10}},
+		{Type: "quota", Method: "PUT", Path: "sys/quotas/rate-limit/secret", Data: map[string]interface{}{"mount": "", "rate": 10}},
+		{Type: "quota", Method: "PUT", Path: "sys/quotas/rate-limit/secret", Data: map[string]interface{}{"mount": "secret", "path": "/data", "rate": 10}},
+		{Type: "quota", Method: "DELETE", Path: "sys/quotas/rate-limit/global", Data: map[string]interface{}{"rate": 10}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestQuotaType_Expand(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "sys/mounts/secret", map[string]interface{}{"type": "kv"})
+	server.put("", "sys/auth/kubernetes", map[string]interface{}{"type": "kubernetes"})
+
+	runner, err := NewMigrationRunner(server.client(t), &Config{
+		Migrations: MigrationsConfig{Directory: t.TempDir()},
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		task Task
+		want []Task
+	}{
+		{
+			name: "global quota",
+			task: Task{Type: "quota", Method: "PUT", Path: "sys/quotas/rate-limit/global", Data: map[string]interface{}{"rate": 500}},
+			want: []Task{{Method: "POST", Path: "sys/quotas/rate-limit/global", Data: map[string]interface{}{"rate": 500}}},
+		},
+		{
+			name: "path below a mount",
+			task: Task{Type: "quota", Method: "PUT", Path: "sys/quotas/rate-limit/app", Data: map[string]interface{}{
+				"mount": "secret", "path": "data/app", "rate": 50,
+			}},
+			want: []Task{{Method: "POST", Path: "sys/quotas/rate-limit/app", Data: map[string]interface{}{"path": "secret/data/app", "rate": 50}}},
+		},
+		{
+			name: "auth mount",
+			task: Task{Type: "quota", Method: "PUT", Path: "sys/quotas/lease-count/kubernetes", Data: map[string]interface{}{
+				"mount": "auth/kubernetes", "max_leases": 1000,
+			}},
+			want: []Task{{Method: "POST", Path: "sys/quotas/lease-count/kubernetes", Data: map[string]interface{}{
+				"path": "auth/kubernetes/", "max_leases": 1000,
+			}}},
+		},
+		{
+			name: "delete",
+			task: Task{Type: "quota", Method: "DELETE", Path: "sys/quotas/rate-limit/global"},
+			want: []Task{{Method: "DELETE", Path: "sys/quotas/rate-limit/global"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runner.expandType(ctx, tt.task)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = runner.expandType(ctx, Task{Type: "quota", Method: "PUT", Path: "sys/quotas/rate-limit/x", Data: map[string]interface{}{
+		"mount": "missing", "rate": 1,
+	}})
+	assert.ErrorContains(t, err, "quota mount missing is not enabled")
+}
+
+func TestQuotaStateEqual(t *testing.T) {
+	current := map[string]interface{}{"path": "secret/", "rate": 50, "interval": 1, "block_interval": 0}
+
+	assert.True(t, quotaStateEqual(current, map[interface{}]interface{}{"mount": "secret", "rate": 50, "interval": "1s"}))
+	assert.True(t, quotaStateEqual(current, map[interface{}]interface{}{"path": "secret/", "rate": 50}))
+	assert.False(t, quotaStateEqual(current, map[interface{}]interface{}{"mount": "kv", "rate": 50}), "the mount was renamed")
+	assert.False(t, quotaStateEqual(current, map[interface{}]interface{}{"mount": "secret", "rate": 100}))
+}
+
+func TestGenerateTasksFromDiffs_Quota(t *testing.T) {
+	current := map[string]interface{}{
+		"sys/quotas/rate-limit/old": map[string]interface{}{"path": "", "rate": 10},
+	}
+	desired := map[string]interface{}{
+		"sys/quotas/rate-limit/kv": map[interface{}]interface{}{"mount": "kv", "rate": 50},
+		"sys/mounts/kv/":           map[interface{}]interface{}{"type": "kv"},
+	}
+
+	tasks := generateTasksFromDiffs(compareConfigs(current, desired))
+	orderTasks(tasks)
+
+	assert.Equal(t, []Task{
+		{Type: "mount", Method: "POST", Path: "sys/mounts/kv", Data: map[string]interface{}{"type": "kv"}},
+		{Type: "quota", Method: "DELETE", Path: "sys/quotas/rate-limit/old"},
+		{Type: "quota", Method: "POST", Path: "sys/quotas/rate-limit/kv", Data: map[string]interface{}{"mount": "kv", "rate": 50}},
+	}, tasks, "quotas are written after the mounts they apply to")
+}
+
+func TestLoadSchema_QuotaMount(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := filepath.Join(dir, "schema.yaml")
+
+	require.NoError(t, os.WriteFile(schemaPath, []byte(`desired_state:
+  sys/mounts/kv/:
+    type: kv
+  auth/kubernetes:
+    type: kubernetes
+  sys/quotas/rate-limit/kv:
+    mount: kv
+    rate: 50
+  sys/quotas/lease-count/kubernetes:
+    mount: auth/kubernetes
+    max_leases: 100
+`), 0o644))
+	_, err := LoadSchema(schemaPath)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(schemaPath, []byte(`desired_state:
+  sys/quotas/rate-limit/kv:
+    mount: kv
+    rate: 50
+`), 0o644))
+	_, err = LoadSchema(schemaPath)
+	assert.ErrorContains(t, err, "mount kv is not defined in the schema")
+}
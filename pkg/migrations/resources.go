@@ -0,0 +1,271 @@
+package migrations
+
+import "sort"
+
+// jsonSchemaDialect is the JSON Schema version of the exported schemas
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaResource is a typed resource of a schema file: the desired_state keys
+// it applies to and the JSON Schema of their values
+type schemaResource struct {
+	name string
+	// keys matches the desired_state keys of the resource
+	keys []string
+	// typed limits the resource to entries that set a type, for auth
+	// methods and mounts written as <path>/, whose keys are shared with
+	// other entries
+	typed  bool
+	schema *JSONSchema
+}
+
+func jsonType(types ...string) *JSONSchema { return &JSONSchema{Type: types} }
+
+func closedObject(description string, properties map[string]*JSONSchema, required ...string) *JSONSchema {
+	return &JSONSchema{
+		Description:          description,
+		Type:                 []string{"object"},
+		Properties:           properties,
+		AdditionalProperties: false,
+		Required:             required,
+	}
+}
+
+// stringList is a list of strings
+func stringList() *JSONSchema { return &JSONSchema{Type: []string{"array"}, Items: jsonType("string")} }
+
+// stringMap is an object of string values, such as metadata
+func stringMap() *JSONSchema {
+	return &JSONSchema{Type: []string{"object"}, AdditionalProperties: jsonType("string")}
+}
+
+// scalarMap is an object of scalar values, such as mount options
+func scalarMap() *JSONSchema {
+	return &JSONSchema{Type: []string{"object"}, AdditionalProperties: jsonType("string", "integer", "number", "boolean")}
+}
+
+// ttl is a duration, as seconds or a Go duration such as 1h30m
+func ttl() *JSONSchema {
+	return &JSONSchema{
+		Type:    []string{"string", "integer"},
+		Pattern: `^(([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h|d)?)+|system)$`,
+	}
+}
+
+// tuneSchema are the tune parameters of mounts and auth methods
+func tuneSchema() *JSONSchema {
+	return closedObject("Tune parameters, as written to sys/mounts/<path>/tune", map[string]*JSONSchema{
+		"default_lease_ttl":            ttl(),
+		"max_lease_ttl":                ttl(),
+		"force_no_cache":               jsonType("boolean"),
+		"listing_visibility":           {Type: []string{"string"}, Enum: []interface{}{"", "unauth", "hidden"}},
+		"audit_non_hmac_request_keys":  stringList(),
+		"audit_non_hmac_response_keys": stringList(),
+		"passthrough_request_headers":  stringList(),
+		"allowed_response_headers":     stringList(),
+		"allowed_managed_keys":         stringList(),
+		"delegated_auth_accessors":     stringList(),
+		"plugin_version":               jsonType("string"),
+		"token_type":                   {Type: []string{"string"}, Enum: []interface{}{"default-service", "default-batch", "service", "batch"}},
+		"user_lockout_config":          jsonType("object"),
+		"identity_token_key":           jsonType("string"),
+	})
+}
+
+func mountSchema() *JSONSchema {
+	return closedObject("Secrets engine mounted at sys/mounts/<path>", map[string]*JSONSchema{
+		"type":                    jsonType("string"),
+		"description":             jsonType("string"),
+		"config":                  tuneSchema(),
+		"tune":                    tuneSchema(),
+		"options":                 scalarMap(),
+		"local":                   jsonType("boolean"),
+		"seal_wrap":               jsonType("boolean"),
+		"external_entropy_access": jsonType("boolean"),
+		"plugin_version":          jsonType("string"),
+		"moved_from":              jsonType("string"),
+	}, "type")
+}
+
+func authSchema() *JSONSchema {
+	return closedObject("Auth method mounted at auth/<path>", map[string]*JSONSchema{
+		"type":          jsonType("string"),
+		"description":   jsonType("string"),
+		"config":        tuneSchema(),
+		"options":       scalarMap(),
+		"local":         jsonType("boolean"),
+		"seal_wrap":     jsonType("boolean"),
+		"method_config": jsonType("object"),
+		"moved_from":    jsonType("string"),
+	}, "type")
+}
+
+func auditSchema() *JSONSchema {
+	return closedObject("Audit device enabled at sys/audit/<path>", map[string]*JSONSchema{
+		"type":        jsonType("string"),
+		"description": jsonType("string"),
+		"options":     scalarMap(),
+		"local":       jsonType("boolean"),
+	}, "type")
+}
+
+func pluginSchema() *JSONSchema {
+	return closedObject("Plugin registered at sys/plugins/catalog/<type>/<name>", map[string]*JSONSchema{
+		"sha256":  {Type: []string{"string"}, Pattern: `^[0-9a-fA-F]{64}$`},
+		"binary":  jsonType("string"),
+		"command": jsonType("string"),
+		"args":    stringList(),
+		"env":     stringList(),
+		"version": jsonType("string"),
+		"reload":  jsonType("boolean"),
+	}, "command")
+}
+
+func policySchema() *JSONSchema {
+	return closedObject("Policy at sys/policies/<acl|rgp|egp>/<name>", map[string]*JSONSchema{
+		"policy": jsonType("string"),
+		"file":   jsonType("string"),
+		"rules": {
+			Type: []string{"array"},
+			Items: &JSONSchema{
+				Type: []string{"object"},
+				Properties: map[string]*JSONSchema{
+					"path":         jsonType("string"),
+					"capabilities": {Type: []string{"array"}, Items: &JSONSchema{Type: []string{"string"}, Enum: policyCapabilityEnum()}},
+				},
+				Required: []string{"path"},
+			},
+		},
+		"enforcement_level": {Type: []string{"string"}, Enum: []interface{}{"advisory", "soft-mandatory", "hard-mandatory"}},
+		"paths":             stringList(),
+	})
+}
+
+// policyCapabilityEnum lists the capabilities of ACL policy rules
+func policyCapabilityEnum() []interface{} {
+	capabilities := make([]string, 0, len(aclCapabilities))
+	for capability := range aclCapabilities {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+	enum := make([]interface{}, len(capabilities))
+	for i, capability := range capabilities {
+		enum[i] = capability
+	}
+	return enum
+}
+
+func quotaSchema(kind string) *JSONSchema {
+	properties := map[string]*JSONSchema{
+		"mount":       jsonType("string"),
+		"path":        jsonType("string"),
+		"role":        jsonType("string"),
+		"inheritable": jsonType("boolean"),
+	}
+	if kind == "rate-limit" {
+		properties["rate"] = jsonType("number")
+		properties["interval"] = ttl()
+		properties["block_interval"] = ttl()
+	} else {
+		properties["max_leases"] = jsonType("integer")
+	}
+	return closedObject("Quota at sys/quotas/"+kind+"/<name>", properties, quotaLimitFields[kind])
+}
+
+func identitySchema(kind string) *JSONSchema {
+	switch kind {
+	case "entity":
+		return closedObject("Identity entity at identity/entity/name/<name>", map[string]*JSONSchema{
+			"policies": stringList(),
+			"metadata": stringMap(),
+			"disabled": jsonType("boolean"),
+		})
+	case "group":
+		return closedObject("Identity group at identity/group/name/<name>", map[string]*JSONSchema{
+			"type":              {Type: []string{"string"}, Enum: []interface{}{"internal", "external"}},
+			"policies":          stringList(),
+			"metadata":          stringMap(),
+			"member_entities":   stringList(),
+			"member_groups":     stringList(),
+			"member_entity_ids": stringList(),
+			"member_group_ids":  stringList(),
+		})
+	case "entity-alias":
+		return closedObject("Entity alias at identity/entity-alias/name/<name>", map[string]*JSONSchema{
+			"mount":           jsonType("string"),
+			"entity":          jsonType("string"),
+			"custom_metadata": stringMap(),
+		}, "mount", "entity")
+	default:
+		return closedObject("Group alias at identity/group-alias/name/<name>", map[string]*JSONSchema{
+			"mount": jsonType("string"),
+			"group": jsonType("string"),
+		}, "mount", "group")
+	}
+}
+
+// schemaResources are the typed resources of a schema file. Entries whose
+// key matches none of them, such as KV data and roles, are not checked.
+var schemaResources = []schemaResource{
+	{name: "mount", keys: []string{`^sys/mounts/.+$`}, schema: mountSchema()},
+	{name: "mount", keys: []string{`^[^/]+/$`}, typed: true, schema: mountSchema()},
+	{name: "auth", keys: []string{`^(sys/)?auth/.+$`}, typed: true, schema: authSchema()},
+	{name: "audit", keys: []string{`^sys/audit/.+$`}, schema: auditSchema()},
+	{name: "plugin", keys: []string{`^sys/plugins/catalog/(auth|database|secret)/[^/]+$`}, schema: pluginSchema()},
+	{name: "policy", keys: []string{`^sys/policies/(acl|rgp|egp)/[^/]+$`, `^sys/policy/[^/]+$`}, schema: policySchema()},
+	{name: "rate-limit-quota", keys: []string{`^sys/quotas/rate-limit/[^/]+$`}, schema: quotaSchema("rate-limit")},
+	{name: "lease-count-quota", keys: []string{`^sys/quotas/lease-count/[^/]+$`}, schema: quotaSchema("lease-count")},
+	{name: "identity-entity", keys: []string{`^identity/entity/name/.+$`}, schema: identitySchema("entity")},
+	{name: "identity-group", keys: []string{`^identity/group/name/.+$`}, schema: identitySchema("group")},
+	{name: "identity-entity-alias", keys: []string{`^identity/entity-alias/name/.+$`}, schema: identitySchema("entity-alias")},
+	{name: "identity-group-alias", keys: []string{`^identity/group-alias/name/.+$`}, schema: identitySchema("group-alias")},
+}
+
+// ResourceSchemas returns the JSON Schema of each typed resource of a schema
+// file, by resource name
+func ResourceSchemas() map[string]*JSONSchema {
+	schemas := make(map[string]*JSONSchema)
+	for _, resource := range schemaResources {
+		schema := *resource.schema
+		schema.Schema = jsonSchemaDialect
+		schema.Title = resource.name
+		schemas[resource.name] = &schema
+	}
+	return schemas
+}
+
+// SchemaFileSchema returns the JSON Schema of a schema file, which applies
+// the resource schemas to the desired_state keys they describe
+func SchemaFileSchema() *JSONSchema {
+	defs := make(map[string]*JSONSchema)
+	entries := make(map[string]*JSONSchema)
+	for _, resource := range schemaResources {
+		defs[resource.name] = resource.schema
+		ref := &JSONSchema{Ref: "#/$defs/" + resource.name}
+		if resource.typed {
+			ref = &JSONSchema{If: &JSONSchema{Type: []string{"object"}, Required: []string{"type"}}, Then: ref}
+		}
+		for _, key := range resource.keys {
+			entries[key] = ref
+		}
+	}
+
+	return &JSONSchema{
+		Schema:      jsonSchemaDialect,
+		Title:       "vault-migrations schema",
+		Description: "Desired state of a Vault cluster, read by vault-migrations generate",
+		Type:        []string{"object"},
+		Properties: map[string]*JSONSchema{
+			"include": {
+				Description: "Schema files, directories or globs, relative to this file",
+				Type:        []string{"array"},
+				Items:       jsonType("string"),
+			},
+			"desired_state": {
+				Description:       "Vault paths and the values they should hold",
+				Type:              []string{"object"},
+				PatternProperties: entries,
+			},
+		},
+		Defs: defs,
+	}
+}
@@ -1,39 +1,268 @@
 package migrations
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/vault/api"
 	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
 )
 
 // Schema represents the desired state of Vault configuration
 type Schema struct {
 	DesiredState map[string]interface{} `yaml:"desired_state"`
+	// Locations holds the file and line each desired_state key is defined at
+	Locations map[string]string `yaml:"-"`
 }
 
-// LoadSchema loads and parses a schema file
+// schemaFile is one file of a schema. A schema can be split across files:
+// include names further files, directories or globs, relative to the file
+// that includes them.
+type schemaFile struct {
+	Include      []string               `yaml:"include"`
+	DesiredState map[string]interface{} `yaml:"desired_state"`
+}
+
+// schemaLoader merges the desired state of schema files
+type schemaLoader struct {
+	state map[string]interface{}
+	// locations holds the file and line each key is defined at
+	locations map[string]string
+	// loaded holds the absolute path of the files already read, so a file
+	// that is included twice, or includes itself, is read once
+	loaded map[string]bool
+	found  bool
+	// resources validates each file, and errors collects the values that
+	// do not match
+	resources *JSONSchema
+	errors    []error
+}
+
+// LoadSchema loads and parses a schema. The path is a schema file, a
+// directory of .yaml and .yml files, or a glob; the desired state of all
+// files, and of the files they include, is merged, and a key defined twice
+// is an error. Each file is validated against the JSON Schema of its
+// resources, and every mismatch is reported with its file, line and column.
 func LoadSchema(schemaPath string) (*Schema, error) {
-	data, err := os.ReadFile(schemaPath)
+	files, err := schemaFiles(schemaPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read schema file: %w", err)
+		return nil, err
 	}
 
-	var schema Schema
-	if err := yaml.Unmarshal(data, &schema); err != nil {
-		return nil, fmt.Errorf("failed to parse schema file: %w", err)
+	loader := &schemaLoader{
+		state:     make(map[string]interface{}),
+		locations: make(map[string]string),
+		loaded:    make(map[string]bool),
+		resources: SchemaFileSchema(),
 	}
-
-	if schema.DesiredState == nil {
+	for _, file := range files {
+		if err := loader.load(file); err != nil {
+			return nil, err
+		}
+	}
+	if len(loader.errors) > 0 {
+		return nil, errors.Join(loader.errors...)
+	}
+	if !loader.found {
 		return nil, fmt.Errorf("schema file must contain desired_state")
 	}
 
+	schema := Schema{DesiredState: loader.state, Locations: loader.locations}
+	followMovedMounts(schema.DesiredState)
+
+	// Quotas scoped to a mount must name a mount of the same schema
+	for key, value := range schema.DesiredState {
+		resource, ok := parseQuotaPath(key)
+		if !ok {
+			continue
+		}
+		data := stringKeyMap(value)
+		if err := validateQuotaData(resource.kind, data); err != nil {
+			return nil, fmt.Errorf("quota %s: %w", key, err)
+		}
+		if mount, ok := data["mount"]; ok && !quotaMountDefined(schema.DesiredState, fmt.Sprint(mount)) {
+			return nil, fmt.Errorf("quota %s: mount %v is not defined in the schema", key, mount)
+		}
+	}
+
 	return &schema, nil
 }
 
+// load reads a schema file into the merged desired state, then the files it
+// includes
+func (l *schemaLoader) load(file string) error {
+	absPath, err := filepath.Abs(file)
+	if err != nil {
+		return fmt.Errorf("failed to resolve schema file %s: %w", file, err)
+	}
+	if l.loaded[absPath] {
+		return nil
+	}
+	l.loaded[absPath] = true
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read schema file: %w", err)
+	}
+	var doc schemaFile
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse schema file %s: %w", file, err)
+	}
+	mismatches, err := validateYAML(l.resources, file, data)
+	if err != nil {
+		return err
+	}
+	for _, mismatch := range mismatches {
+		l.errors = append(l.errors, mismatch)
+	}
+
+	if doc.DesiredState != nil {
+		l.found = true
+		if err := resolveSchemaFiles(doc.DesiredState, filepath.Dir(file)); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		lines := desiredStateLines(data)
+		origins := make(map[string]string)
+		for from, to := range normalizeMounts(doc.DesiredState) {
+			origins[to] = from
+		}
+		keys := make([]string, 0, len(doc.DesiredState))
+		for key := range doc.DesiredState {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			location := file
+			origin, ok := origins[key]
+			if !ok {
+				origin = key
+			}
+			if line := lines[origin]; line > 0 {
+				location = fmt.Sprintf("%s:%d", file, line)
+			}
+			if previous, ok := l.locations[key]; ok {
+				return fmt.Errorf("desired_state key %s is defined in %s and in %s", key, previous, location)
+			}
+			l.state[key] = doc.DesiredState[key]
+			l.locations[key] = location
+		}
+	}
+
+	for _, include := range doc.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(file), include)
+		}
+		files, err := schemaFiles(include)
+		if err != nil {
+			return fmt.Errorf("%s: include: %w", file, err)
+		}
+		for _, included := range files {
+			if err := l.load(included); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// schemaFiles returns the schema files a path names: the path itself, the
+// .yaml and .yml files of a directory, or the files matching a glob, in
+// lexical order
+func schemaFiles(schemaPath string) ([]string, error) {
+	matches := []string{schemaPath}
+	if strings.ContainsAny(schemaPath, "*?[") {
+		var err error
+		matches, err = filepath.Glob(schemaPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema pattern %s: %w", schemaPath, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no schema files match %s", schemaPath)
+		}
+	}
+
+	var files []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || !info.IsDir() {
+			// A missing file is reported when it is read
+			files = append(files, match)
+			continue
+		}
+		entries, err := os.ReadDir(match)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema directory: %w", err)
+		}
+		found := false
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+				continue
+			}
+			files = append(files, filepath.Join(match, entry.Name()))
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("no schema files in %s", match)
+		}
+	}
+	return files, nil
+}
+
+// resolveSchemaFiles reads the policy files and plugin binaries a schema
+// file refers to, relative to the directory of the schema file
+func resolveSchemaFiles(state map[string]interface{}, baseDir string) error {
+	for key, value := range state {
+		data := stringKeyMap(value)
+		if data == nil {
+			continue
+		}
+		if kind, _ := policyEndpoint(key); kind != "" {
+			if err := inlinePolicyFile(data, baseDir); err != nil {
+				return fmt.Errorf("policy %s: %w", key, err)
+			}
+			state[key] = data
+		}
+		// Plugin binaries are replaced by their checksum
+		if _, ok := parsePluginPath(key); ok {
+			if err := inlinePluginBinary(data, baseDir); err != nil {
+				return fmt.Errorf("plugin %s: %w", key, err)
+			}
+			state[key] = data
+		}
+	}
+	return nil
+}
+
+// desiredStateLines returns the line each desired_state key of a schema
+// file is defined at
+func desiredStateLines(data []byte) map[string]int {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "desired_state" {
+			continue
+		}
+		state := root.Content[i+1]
+		lines := make(map[string]int, len(state.Content)/2)
+		for j := 0; j+1 < len(state.Content); j += 2 {
+			lines[state.Content[j].Value] = state.Content[j].Line
+		}
+		return lines
+	}
+	return nil
+}
+
 // sanitizeFilename ensures filenames are safe and standardized.
 func sanitizeFilename(name string) string {
 	re := regexp.MustCompile(`[^\w\-.]+`)
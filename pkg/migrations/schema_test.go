@@ -0,0 +1,107 @@
+package migrations
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSchemaFiles writes schema files below a temporary directory and
+// returns the directory
+func writeSchemaFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0o755))
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+	}
+	return dir
+}
+
+func TestLoadSchema_Directory(t *testing.T) {
+	dir := writeSchemaFiles(t, map[string]string{
+		"schema.d/platform.yaml": `desired_state:
+  sys/mounts/kv/:
+    type: kv
+`,
+		"schema.d/team-a.yml": `desired_state:
+  kv/data/team-a:
+    owner: team-a
+  sys/quotas/rate-limit/kv:
+    mount: kv
+    rate: 50
+`,
+		"schema.d/README.md": "not a schema",
+	})
+
+	for _, schemaPath := range []string{filepath.Join(dir, "schema.d"), filepath.Join(dir, "schema.d", "*.y*ml")} {
+		schema, err := LoadSchema(schemaPath)
+		require.NoError(t, err, schemaPath)
+		assert.Len(t, schema.DesiredState, 3)
+		assert.Contains(t, schema.DesiredState, "sys/mounts/kv/")
+		assert.Contains(t, schema.DesiredState, "kv/data/team-a")
+	}
+
+	_, err := LoadSchema(filepath.Join(dir, "*.json"))
+	assert.ErrorContains(t, err, "no schema files match")
+}
+
+func TestLoadSchema_Include(t *testing.T) {
+	dir := writeSchemaFiles(t, map[string]string{
+		"schema.yaml": `include:
+  - schema.d/
+  - schema.yaml
+desired_state:
+  sys/mounts/kv/:
+    type: kv
+`,
+		"schema.d/team-a.yaml": `include: [policies/*.yaml]
+desired_state:
+  kv/data/team-a:
+    owner: team-a
+`,
+		"schema.d/policies/team-a.yaml": `desired_state:
+  sys/policies/acl/team-a:
+    file: team-a.hcl
+`,
+		"schema.d/policies/team-a.hcl": `path "kv/data/team-a/*" { capabilities = ["read"] }`,
+	})
+
+	schema, err := LoadSchema(filepath.Join(dir, "schema.yaml"))
+	require.NoError(t, err)
+	assert.Len(t, schema.DesiredState, 3)
+	assert.Equal(t, map[string]interface{}{"policy": `path "kv/data/team-a/*" { capabilities = ["read"] }`},
+		schema.DesiredState["sys/policies/acl/team-a"], "policy files are relative to the file that names them")
+
+	_, err = LoadSchema(writeSchemaFiles(t, map[string]string{
+		"schema.yaml": "include: [missing/*.yaml]\ndesired_state: {}\n",
+	}))
+	assert.ErrorContains(t, err, "include: no schema files match")
+}
+
+func TestLoadSchema_DuplicateKey(t *testing.T) {
+	dir := writeSchemaFiles(t, map[string]string{
+		"a.yaml": `desired_state:
+  kv/data/app:
+    owner: a
+  pki/:
+    type: pki
+`,
+		"b.yaml": `desired_state:
+  kv/data/other:
+    owner: b
+
+  sys/mounts/pki:
+    type: pki
+`,
+	})
+
+	_, err := LoadSchema(dir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "desired_state key sys/mounts/pki/ is defined in "+
+		filepath.Join(dir, "a.yaml")+":4 and in "+filepath.Join(dir, "b.yaml")+":5")
+}
@@ -0,0 +1,256 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotEntry is the value a path held before a migration modified it.
+type SnapshotEntry struct {
+	Namespace string                 `json:"namespace,omitempty"`
+	Path      string                 `json:"path"`
+	Task      int                    `json:"task"`
+	Existed   bool                   `json:"existed"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	// Unreadable holds the read error for paths that cannot be read back,
+	// such as write-only endpoints. These paths are not restored.
+	Unreadable string `json:"unreadable,omitempty"`
+}
+
+// Snapshot records the prior values of every path a migration touches.
+type Snapshot struct {
+	Version   int             `json:"version"`
+	Namespace string          `json:"namespace,omitempty"`
+	TakenAt   time.Time       `json:"taken_at"`
+	Entries   []SnapshotEntry `json:"entries"`
+}
+
+// entriesBefore returns the entries of the first n tasks
+func (s *Snapshot) entriesBefore(n int) []SnapshotEntry {
+	var entries []SnapshotEntry
+	for _, entry := range s.Entries {
+		if entry.Task < n {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// snapshotPath returns where a migration's snapshot is stored, next to the history ledger
+func (m *MigrationRunner) snapshotPath(version int) string {
+	return path.Join(path.Dir(m.trackingPath), "snapshots", strconv.Itoa(version))
+}
+
+// captureSnapshot reads the current value of every path the tasks modify.
+// Only the first task touching a path is recorded, since that holds the value
+// from before the migration.
+func (m *MigrationRunner) captureSnapshot(ctx context.Context, migration Migration, tasks []Task) (*Snapshot, error) {
+	snapshot := &Snapshot{
+		Version:   migration.Version,
+		Namespace: migration.Namespace,
+		TakenAt:   time.Now().UTC(),
+	}
+
+	seen := make(map[string]bool)
+	for i, typed := range tasks {
+		if isReadOnly(typed.Method) {
+			continue
+		}
+		// Typed tasks whose mount does not exist yet, because an earlier task
+		// creates it, have nothing to snapshot
+		expanded, err := m.expandType(ctx, typed)
+		if err != nil {
+			m.logger.Warn().Err(err).Str("path", typed.Path).Msg("Task cannot be resolved and will not be restored")
+			continue
+		}
+		for _, task := range expanded {
+			// Steps that pass a response on, such as signing a CSR, are
+			// one-shot actions that writing an old value cannot undo
+			if task.run != nil {
+				continue
+			}
+			key := statePathKey(task.Namespace, task.Path)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			client, err := m.clientForNamespace(task.Namespace)
+			if err != nil {
+				return nil, err
+			}
+
+			entry := SnapshotEntry{Namespace: task.Namespace, Path: task.Path, Task: i}
+			secret, err := client.Logical().ReadWithContext(ctx, task.Path)
+			switch {
+			case err != nil:
+				entry.Unreadable = err.Error()
+				m.logger.Warn().Err(err).Str("path", task.Path).Msg("Path cannot be read and will not be restored")
+			case secret != nil:
+				entry.Existed = true
+				entry.Data = secret.Data
+			}
+			snapshot.Entries = append(snapshot.Entries, entry)
+		}
+	}
+	return snapshot, nil
+}
+
+// saveSnapshot persists a snapshot in the migration's namespace
+func (m *MigrationRunner) saveSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	client, err := m.clientForNamespace(snapshot.Namespace)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = client.Logical().WriteWithContext(ctx, m.snapshotPath(snapshot.Version), map[string]interface{}{
+		"snapshot": string(encoded),
+	})
+	return err
+}
+
+// loadSnapshot reads a migration's snapshot from a namespace
+func (m *MigrationRunner) loadSnapshot(ctx context.Context, namespace string, version int) (*Snapshot, error) {
+	client, err := m.clientForNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := client.Logical().ReadWithContext(ctx, m.snapshotPath(version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if secret == nil || secret.Data["snapshot"] == nil {
+		return nil, fmt.Errorf("no snapshot recorded for migration %d", version)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal([]byte(stringField(secret.Data, "snapshot")), &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// restoreEntries puts snapshot entries back in reverse order: paths that
+// existed get their old value written back and paths that did not are deleted.
+// A path that fails to restore does not stop the others.
+func (m *MigrationRunner) restoreEntries(ctx context.Context, entries []SnapshotEntry) error {
+	var errs []error
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Unreadable != "" {
+			m.logger.Warn().Str("path", entry.Path).Msg("Skipping path that could not be read before the migration")
+			continue
+		}
+
+		client, err := m.clientForNamespace(entry.Namespace)
+		if err == nil {
+			if entry.Existed {
+				_, err = client.Logical().WriteWithContext(ctx, entry.Path, entry.Data)
+			} else {
+				_, err = client.Logical().DeleteWithContext(ctx, entry.Path)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s: %w", entry.Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RestoreSnapshot replays the snapshot taken before the migration with the
+// given version, in whichever namespace it belongs to. A version used by
+// migrations of several namespaces is refused with the candidates; restore
+// one of them with RestoreSnapshotInNamespace.
+func (m *MigrationRunner) RestoreSnapshot(ctx context.Context, version int) error {
+	migrations, err := m.loadMigrations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+	var namespaces []string
+	for _, migration := range migrations {
+		if migration.Version == version {
+			namespaces = append(namespaces, migration.Namespace)
+		}
+	}
+	if len(namespaces) > 1 {
+		candidates := make([]string, len(namespaces))
+		for i, namespace := range namespaces {
+			candidates[i] = strconv.Quote(namespace)
+		}
+		return fmt.Errorf("migration version %d exists in namespaces %s, choose one", version, strings.Join(candidates, ", "))
+	}
+	namespace := ""
+	if len(namespaces) == 1 {
+		namespace = namespaces[0]
+	}
+	return m.RestoreSnapshotInNamespace(ctx, namespace, version)
+}
+
+// RestoreSnapshotInNamespace replays the snapshot taken before a migration of
+// a namespace. When the migration is the newest applied one in its namespace,
+// the tracked version moves back and its ledger entry is removed; a snapshot
+// of a newer, failed migration is replayed without touching the version.
+// Restoring a migration with newer migrations applied on top is refused.
+func (m *MigrationRunner) RestoreSnapshotInNamespace(ctx context.Context, namespace string, version int) error {
+	if m.client == nil {
+		return fmt.Errorf("cannot restore snapshot without Vault client")
+	}
+
+	migrations, err := m.loadMigrations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+	previous := 0
+	for _, migration := range migrations {
+		if migration.Namespace == namespace && migration.Version < version {
+			previous = migration.Version
+		}
+	}
+
+	snapshot, err := m.loadSnapshot(ctx, namespace, version)
+	if err != nil {
+		return err
+	}
+	applied, err := m.getLastAppliedVersion(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	if applied > version {
+		return fmt.Errorf("migration %d is not the newest applied migration (version %d is applied), roll back newer migrations first", version, applied)
+	}
+
+	if ctx, err = m.acquireLock(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.releaseLock(context.Background()); err != nil {
+			m.logger.Warn().Err(err).Msg("Failed to release migration lock")
+		}
+	}()
+
+	m.logger.Info().Int("version", version).Str("namespace", namespace).Msg("Restoring snapshot")
+	if err := m.restoreEntries(ctx, snapshot.Entries); err != nil {
+		return err
+	}
+
+	if applied == version {
+		if err := m.deleteHistory(ctx, namespace, version); err != nil {
+			return fmt.Errorf("failed to remove history for migration %d: %w", version, err)
+		}
+		if err := m.setLastAppliedVersion(ctx, namespace, previous); err != nil {
+			return fmt.Errorf("failed to update version after restoring migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package migrations
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationRunner_AutoRestoreOnFailure(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "secret/existing", map[string]interface{}{"key": "old"})
+	server.handle("secret/broken", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeTestVaultResponse(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		writeTestVaultResponse(w, http.StatusInternalServerError, map[string]interface{}{"errors": []string{"boom"}})
+	})
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{Path: "secret/existing", Method: "PUT", Data: map[string]interface{}{"key": "new"}},
+				{Path: "secret/created", Method: "POST", Data: map[string]interface{}{"key": "new"}},
+				{Path: "secret/broken", Method: "POST", Data: map[string]interface{}{"key": "new"}},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir, Snapshots: true, AutoRestore: true},
+		})
+		require.NoError(t, err)
+
+		err = runner.RunMigrations(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to execute task 2")
+	})
+
+	existing, ok := server.get("", "secret/existing")
+	require.True(t, ok)
+	assert.Equal(t, "old", existing["key"], "modified path should be restored")
+	_, ok = server.get("", "secret/created")
+	assert.False(t, ok, "created path should be removed")
+	_, ok = server.get("", "migrations/snapshots/1")
+	assert.True(t, ok, "snapshot should be kept for a later restore")
+	_, ok = server.get("", "migrations/version")
+	assert.False(t, ok)
+}
+
+func TestMigrationRunner_RestoreSnapshot(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "secret/existing", map[string]interface{}{"key": "old"})
+
+	migrations := []Migration{
+		{Version: 1, Tasks: []Task{{Path: "secret/first", Method: "POST"}}},
+		{
+			Version: 2,
+			Tasks: []Task{
+				{Path: "secret/existing", Method: "PUT", Data: map[string]interface{}{"key": "new"}},
+				{Path: "secret/existing", Method: "PUT", Data: map[string]interface{}{"key": "newer"}},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir, Snapshots: true},
+		})
+		require.NoError(t, err)
+		ctx := context.Background()
+		require.NoError(t, runner.RunMigrations(ctx))
+
+		assert.Error(t, runner.RestoreSnapshot(ctx, 1), "migration 2 is applied on top of 1")
+		require.NoError(t, runner.RestoreSnapshot(ctx, 2))
+
+		versions, err := runner.CurrentVersions(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, versions[""])
+	})
+
+	existing, ok := server.get("", "secret/existing")
+	require.True(t, ok)
+	assert.Equal(t, "old", existing["key"], "the value from before the migration should be restored")
+}
+
+func TestMigrationRunner_RestoreSnapshotNamespaces(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "secret/app", map[string]interface{}{"key": "old"})
+	server.put("tenant-a", "secret/app", map[string]interface{}{"key": "old"})
+
+	update := []Task{{Path: "secret/app", Method: "PUT", Data: map[string]interface{}{"key": "new"}}}
+	migrations := []Migration{
+		{Version: 1, Tasks: update},
+		{Version: 1, Namespace: "tenant-a", Tasks: update},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir, Snapshots: true},
+		})
+		require.NoError(t, err)
+		ctx := context.Background()
+		require.NoError(t, runner.RunMigrations(ctx))
+
+		assert.EqualError(t, runner.RestoreSnapshot(ctx, 1), `migration version 1 exists in namespaces "", "tenant-a", choose one`)
+		require.NoError(t, runner.RestoreSnapshotInNamespace(ctx, "tenant-a", 1))
+
+		versions, err := runner.CurrentVersions(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"": 1, "tenant-a": 0}, versions)
+	})
+
+	restored, _ := server.get("tenant-a", "secret/app")
+	assert.Equal(t, "old", restored["key"])
+	untouched, _ := server.get("", "secret/app")
+	assert.Equal(t, "new", untouched["key"], "the other namespace keeps its migration")
+}
+
+func TestMigrationRunner_PreflightSnapshotReads(t *testing.T) {
+	migrations := []Migration{{Version: 1, Tasks: []Task{{Path: "secret/app", Method: "POST"}}}}
+
+	for _, snapshots := range []bool{false, true} {
+		server := newTestVaultServer(t)
+		server.setCapabilities("secret/app", "create", "update")
+
+		withTestMigrations(t, migrations, func(migrationsDir string) {
+			runner, err := NewMigrationRunner(server.client(t), &Config{
+				Migrations: MigrationsConfig{Directory: migrationsDir, Snapshots: snapshots},
+			})
+			require.NoError(t, err)
+
+			err = runner.RunMigrations(context.Background())
+			if !snapshots {
+				require.NoError(t, err, "write-only tokens are enough without snapshots")
+				return
+			}
+			var preflightErr *PreflightError
+			require.ErrorAs(t, err, &preflightErr)
+			require.Len(t, preflightErr.Missing, 1)
+			assert.Equal(t, []string{"read"}, preflightErr.Missing[0].Needed)
+		})
+	}
+}
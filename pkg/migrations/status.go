@@ -0,0 +1,134 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MigrationState describes where a migration stands in a Vault.
+type MigrationState string
+
+// Migration states reported by Status
+const (
+	StateApplied          MigrationState = "applied"
+	StatePending          MigrationState = "pending"
+	StateMissingFile      MigrationState = "missing-file"
+	StateChecksumMismatch MigrationState = "checksum-mismatch"
+)
+
+// MigrationStatus is the state of a single migration.
+type MigrationStatus struct {
+	Version   int            `json:"version"`
+	Namespace string         `json:"namespace,omitempty"`
+	File      string         `json:"file,omitempty"`
+	State     MigrationState `json:"state"`
+	AppliedAt *time.Time     `json:"applied_at,omitempty"`
+}
+
+// StatusReport combines the migration files with what Vault has recorded.
+type StatusReport struct {
+	Versions   map[string]int    `json:"versions"`
+	Lock       *LockInfo         `json:"lock"`
+	Migrations []MigrationStatus `json:"migrations"`
+}
+
+// HasPending reports whether any migration is waiting to be applied.
+func (r *StatusReport) HasPending() bool {
+	return r.count(StatePending) > 0
+}
+
+// HasDrift reports whether the files on disk no longer match the ledger.
+func (r *StatusReport) HasDrift() bool {
+	return r.count(StateMissingFile) > 0 || r.count(StateChecksumMismatch) > 0
+}
+
+func (r *StatusReport) count(state MigrationState) int {
+	n := 0
+	for _, migration := range r.Migrations {
+		if migration.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// Status compares the migration files with the tracked versions and the
+// history ledger. Migrations at or below the tracked version without a ledger
+// entry (applied before the ledger existed) are reported as applied.
+func (m *MigrationRunner) Status(ctx context.Context) (*StatusReport, error) {
+	if m.client == nil {
+		return nil, fmt.Errorf("cannot read status without Vault client")
+	}
+
+	migrations, err := m.loadMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	versions, err := m.CurrentVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	history, err := m.History(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := m.LockInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		namespace string
+		version   int
+	}
+	ledger := make(map[key]HistoryEntry, len(history))
+	for _, entry := range history {
+		ledger[key{entry.Namespace, entry.Version}] = entry
+	}
+
+	report := &StatusReport{Versions: versions, Lock: lock}
+	for _, migration := range migrations {
+		status := MigrationStatus{
+			Version:   migration.Version,
+			Namespace: migration.Namespace,
+			File:      migration.File,
+		}
+
+		k := key{migration.Namespace, migration.Version}
+		entry, recorded := ledger[k]
+		delete(ledger, k)
+
+		switch {
+		case recorded && entry.Checksum != "" && entry.Checksum != migration.Checksum:
+			status.State = StateChecksumMismatch
+		case recorded || migration.Version <= versions[migration.Namespace]:
+			status.State = StateApplied
+		default:
+			status.State = StatePending
+		}
+		if recorded && !entry.AppliedAt.IsZero() {
+			appliedAt := entry.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		report.Migrations = append(report.Migrations, status)
+	}
+
+	// Whatever remains in the ledger has no file on disk anymore
+	for _, entry := range ledger {
+		appliedAt := entry.AppliedAt
+		report.Migrations = append(report.Migrations, MigrationStatus{
+			Version:   entry.Version,
+			Namespace: entry.Namespace,
+			File:      entry.File,
+			State:     StateMissingFile,
+			AppliedAt: &appliedAt,
+		})
+	}
+
+	sort.SliceStable(report.Migrations, func(i, j int) bool {
+		return report.Migrations[i].Version < report.Migrations[j].Version
+	})
+	return report, nil
+}
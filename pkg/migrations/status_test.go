@@ -0,0 +1,104 @@
+package migrations
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationRunner_Status(t *testing.T) {
+	server := newTestVaultServer(t)
+
+	migrations := []Migration{
+		{Version: 1, Tasks: []Task{{Path: "secret/one", Method: "POST"}}},
+		{Version: 2, Tasks: []Task{{Path: "secret/two", Method: "POST"}}},
+		{Version: 3, Tasks: []Task{{Path: "secret/three", Method: "POST"}}},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		// Apply 1 and 2, then edit 1 and remove 2 from disk and add 3
+		require.NoError(t, os.Rename(filepath.Join(migrationsDir, "003_test.yaml"), filepath.Join(migrationsDir, "003_test.later")))
+		require.NoError(t, runner.RunMigrations(ctx))
+		require.NoError(t, os.Rename(filepath.Join(migrationsDir, "003_test.later"), filepath.Join(migrationsDir, "003_test.yaml")))
+		writeTestMigrationFile(t, migrationsDir, Migration{Version: 1, Tasks: []Task{{Path: "secret/changed", Method: "POST"}}})
+		require.NoError(t, os.Remove(filepath.Join(migrationsDir, "002_test.yaml")))
+
+		report, err := runner.Status(ctx)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, report.Versions[""])
+		assert.Nil(t, report.Lock)
+		require.Len(t, report.Migrations, 3)
+		assert.Equal(t, StateChecksumMismatch, report.Migrations[0].State)
+		assert.Equal(t, StateMissingFile, report.Migrations[1].State)
+		assert.Equal(t, "002_test.yaml", report.Migrations[1].File)
+		assert.Equal(t, StatePending, report.Migrations[2].State)
+		assert.True(t, report.HasPending())
+		assert.True(t, report.HasDrift())
+	})
+}
+
+func TestMigrationRunner_StatusWithoutLedger(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "migrations/version", map[string]interface{}{"version": "1"})
+
+	migrations := []Migration{
+		{Version: 1, Tasks: []Task{{Path: "secret/one", Method: "POST"}}},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+
+		report, err := runner.Status(context.Background())
+		require.NoError(t, err)
+		require.Len(t, report.Migrations, 1)
+		assert.Equal(t, StateApplied, report.Migrations[0].State)
+		assert.False(t, report.HasPending())
+		assert.False(t, report.HasDrift())
+	})
+}
+
+func TestMigrationRunner_StatusOrphanedNamespace(t *testing.T) {
+	server := newTestVaultServer(t)
+
+	migrations := []Migration{
+		{Version: 1, Tasks: []Task{{Path: "secret/one", Method: "POST"}}},
+		{Version: 2, Namespace: "tenant-a", Tasks: []Task{{Path: "secret/two", Method: "POST"}}},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		// Apply both, then remove the only file of tenant-a
+		require.NoError(t, runner.RunMigrations(ctx))
+		require.NoError(t, os.Remove(filepath.Join(migrationsDir, "002_tenant-a_test.yaml")))
+
+		report, err := runner.Status(ctx)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, report.Versions["tenant-a"])
+		require.Len(t, report.Migrations, 2)
+		assert.Equal(t, StateApplied, report.Migrations[0].State)
+		assert.Equal(t, StateMissingFile, report.Migrations[1].State)
+		assert.Equal(t, "tenant-a", report.Migrations[1].Namespace)
+		assert.Equal(t, "002_tenant-a_test.yaml", report.Migrations[1].File)
+		assert.True(t, report.HasDrift())
+	})
+}
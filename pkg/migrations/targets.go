@@ -0,0 +1,198 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// TargetResult is the outcome of applying migrations to one target.
+type TargetResult struct {
+	Target   string
+	Canary   bool
+	Applied  []int
+	Skipped  bool
+	Duration time.Duration
+	Err      error
+}
+
+// Status returns a short human-readable status for the result.
+func (r TargetResult) Status() string {
+	switch {
+	case r.Skipped:
+		return "skipped"
+	case r.Err != nil:
+		return "failed"
+	default:
+		return "ok"
+	}
+}
+
+// RunMigrationsOnTargets applies pending migrations to every configured
+// target. Canary targets always run first and one at a time; if a canary
+// fails, the remaining targets are skipped. The other targets then run in
+// parallel (bounded by FanOut.Parallelism) or serially, depending on
+// FanOut.Mode; in both modes StopOnError skips the targets not started when
+// one fails. Versions are tracked independently in each cluster, and opts
+// applies to every target.
+func RunMigrationsOnTargets(ctx context.Context, config *Config, opts ApplyOptions) []TargetResult {
+	targets := make([]TargetConfig, len(config.Targets))
+	copy(targets, config.Targets)
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].Canary && !targets[j].Canary
+	})
+
+	results := make([]TargetResult, len(targets))
+	for i, target := range targets {
+		results[i] = TargetResult{Target: target.Name, Canary: target.Canary}
+	}
+
+	// Canaries run serially before anything else
+	next := 0
+	for ; next < len(targets) && targets[next].Canary; next++ {
+		results[next] = runTarget(ctx, config, opts, targets[next])
+		if results[next].Err != nil {
+			skipTargets(results[next+1:])
+			return results
+		}
+	}
+
+	rest := targets[next:]
+	if config.FanOut.Mode == FanOutSerial {
+		for i, target := range rest {
+			results[next+i] = runTarget(ctx, config, opts, target)
+			if results[next+i].Err != nil && config.Migrations.StopOnError {
+				skipTargets(results[next+i+1:])
+				break
+			}
+		}
+		return results
+	}
+
+	parallelism := config.FanOut.Parallelism
+	if parallelism <= 0 {
+		parallelism = len(rest)
+	}
+	// Targets are dispatched as slots free up; with StopOnError, none are
+	// dispatched after one failed, and those already running finish
+	sem := make(chan struct{}, parallelism)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+	)
+	for i, target := range rest {
+		sem <- struct{}{}
+		mu.Lock()
+		stop := failed && config.Migrations.StopOnError
+		mu.Unlock()
+		if stop {
+			<-sem
+			skipTargets(results[next+i:])
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, target TargetConfig) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := runTarget(ctx, config, opts, target)
+			results[next+i] = result
+			if result.Err != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(i, target)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// runTarget applies migrations to a single target cluster
+func runTarget(ctx context.Context, config *Config, opts ApplyOptions, target TargetConfig) (result TargetResult) {
+	result = TargetResult{Target: target.Name, Canary: target.Canary}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	if err := ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	targetConfig := *config
+	targetConfig.Vault = config.TargetVaultConfig(target)
+	targetConfig.Targets = nil
+
+	client, err := NewVaultClient(targetConfig.Vault)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	runner, err := NewMigrationRunner(client.GetClient(), &targetConfig)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	runner.logger = runner.logger.With().Str("target", target.Name).Logger()
+
+	result.Err = runner.RunMigrationsWithOptions(ctx, opts)
+	result.Applied = runner.AppliedVersions()
+	return result
+}
+
+// skipTargets marks results as skipped
+func skipTargets(results []TargetResult) {
+	for i := range results {
+		results[i].Skipped = true
+	}
+}
+
+// TargetsFailed reports whether any target failed or was skipped.
+func TargetsFailed(results []TargetResult) bool {
+	for _, result := range results {
+		if result.Err != nil || result.Skipped {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatTargetSummary renders a consolidated per-target summary table.
+func FormatTargetSummary(results []TargetResult) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tSTATUS\tAPPLIED\tDURATION\tERROR")
+	for _, result := range results {
+		name := result.Target
+		if result.Canary {
+			name += " (canary)"
+		}
+
+		applied := "-"
+		if len(result.Applied) > 0 {
+			versions := make([]string, len(result.Applied))
+			for i, v := range result.Applied {
+				versions[i] = fmt.Sprint(v)
+			}
+			applied = strings.Join(versions, ",")
+		}
+
+		errMsg := ""
+		if result.Err != nil {
+			errMsg = result.Err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, result.Status(), applied, result.Duration.Round(time.Millisecond), errMsg)
+	}
+	w.Flush()
+	return b.String()
+}
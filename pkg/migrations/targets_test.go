@@ -0,0 +1,121 @@
+package migrations
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTargetsConfig(t *testing.T, migrationsDir string, servers map[string]*testVaultServer, canary string) *Config {
+	config := &Config{
+		Vault:      VaultConfig{Token: "test-token"},
+		Migrations: MigrationsConfig{Directory: migrationsDir, StopOnError: true},
+		FanOut:     FanOutConfig{Mode: FanOutParallel, Parallelism: 2},
+	}
+	for name, server := range servers {
+		config.Targets = append(config.Targets, TargetConfig{
+			Name:   name,
+			Canary: name == canary,
+			Vault:  VaultConfig{Address: server.server.URL},
+		})
+	}
+	require.NoError(t, config.validateTargets())
+	return config
+}
+
+func TestRunMigrationsOnTargets(t *testing.T) {
+	servers := map[string]*testVaultServer{
+		"eu": newTestVaultServer(t),
+		"us": newTestVaultServer(t),
+	}
+	// us is already at version 1 and only needs version 2
+	servers["us"].put("", "migrations/version", map[string]interface{}{"version": "1"})
+
+	migrations := []Migration{
+		{Version: 1, Tasks: []Task{{Path: "secret/data/one", Method: "POST"}}},
+		{Version: 2, Tasks: []Task{{Path: "secret/data/two", Method: "POST"}}},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		config := newTargetsConfig(t, migrationsDir, servers, "eu")
+		results := RunMigrationsOnTargets(context.Background(), config, ApplyOptions{})
+
+		require.Len(t, results, 2)
+		assert.False(t, TargetsFailed(results))
+		assert.Equal(t, "eu", results[0].Target, "canary should run first")
+		assert.Equal(t, []int{1, 2}, results[0].Applied)
+		assert.Equal(t, []int{2}, results[1].Applied)
+		assert.Contains(t, FormatTargetSummary(results), "eu (canary)")
+	})
+
+	for name, server := range servers {
+		version, ok := server.get("", "migrations/version")
+		require.True(t, ok, name)
+		assert.Equal(t, "2", version["version"], name)
+	}
+}
+
+func TestRunMigrationsOnTargets_CanaryFailure(t *testing.T) {
+	servers := map[string]*testVaultServer{
+		"canary": newTestVaultServer(t),
+		"prod":   newTestVaultServer(t),
+	}
+	servers["canary"].handle("secret/data/one", func(w http.ResponseWriter, _ *http.Request) {
+		writeTestVaultResponse(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+	})
+
+	migrations := []Migration{
+		{Version: 1, Tasks: []Task{{Path: "secret/data/one", Method: "POST"}}},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		config := newTargetsConfig(t, migrationsDir, servers, "canary")
+		results := RunMigrationsOnTargets(context.Background(), config, ApplyOptions{})
+
+		require.Len(t, results, 2)
+		assert.True(t, TargetsFailed(results))
+		assert.Equal(t, "failed", results[0].Status())
+		assert.NotZero(t, results[0].Duration, "failed targets should report their duration")
+		assert.Equal(t, "skipped", results[1].Status())
+	})
+
+	_, ok := servers["prod"].get("", "secret/data/one")
+	assert.False(t, ok, "targets after a failed canary must not be touched")
+}
+
+func TestRunMigrationsOnTargets_ParallelStopOnError(t *testing.T) {
+	servers := map[string]*testVaultServer{
+		"eu":   newTestVaultServer(t),
+		"us":   newTestVaultServer(t),
+		"apac": newTestVaultServer(t),
+	}
+	for _, server := range servers {
+		server.handle("secret/data/one", func(w http.ResponseWriter, _ *http.Request) {
+			writeTestVaultResponse(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		})
+	}
+
+	migrations := []Migration{
+		{Version: 1, Tasks: []Task{{Path: "secret/data/one", Method: "POST"}}},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		config := newTargetsConfig(t, migrationsDir, servers, "")
+		config.FanOut.Parallelism = 1
+		results := RunMigrationsOnTargets(context.Background(), config, ApplyOptions{})
+
+		require.Len(t, results, 3)
+		assert.Equal(t, "failed", results[0].Status())
+		assert.Equal(t, "skipped", results[1].Status(), "no target is started after a failure")
+		assert.Equal(t, "skipped", results[2].Status())
+
+		config.Migrations.StopOnError = false
+		results = RunMigrationsOnTargets(context.Background(), config, ApplyOptions{})
+		for _, result := range results {
+			assert.Equal(t, "failed", result.Status(), result.Target)
+		}
+	})
+}
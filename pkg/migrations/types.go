@@ -0,0 +1,65 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// taskType translates the tasks of a resource type, such as kv, into the raw
+// requests they stand for. Typed tasks are expanded when they run, so they can
+// depend on mounts created earlier in the same migration.
+type taskType interface {
+	// validate checks a task of this type before anything runs
+	validate(task Task) error
+	// expand returns the raw tasks to execute, reading Vault where needed
+	expand(ctx context.Context, m *MigrationRunner, task Task) ([]Task, error)
+}
+
+// taskTypes holds every supported task type by name
+var taskTypes = map[string]taskType{
+	"kv":       kvType{},
+	"mount":    mountType{},
+	"auth":     authType{},
+	"audit":    auditType{},
+	"plugin":   pluginType{},
+	"policy":   policyType{},
+	"quota":    quotaType{},
+	"pki":      pkiType{},
+	"database": databaseType{},
+	"identity": identityType{},
+}
+
+// taskTypeNames returns the names of the supported task types
+func taskTypeNames() []string {
+	names := make([]string, 0, len(taskTypes))
+	for name := range taskTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expandType returns the raw tasks a typed task stands for. Untyped tasks are
+// returned unchanged.
+func (m *MigrationRunner) expandType(ctx context.Context, task Task) ([]Task, error) {
+	if task.Type == "" {
+		return []Task{task}, nil
+	}
+	handler, ok := taskTypes[task.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown task type: %s", task.Type)
+	}
+
+	expanded, err := handler.expand(ctx, m, task)
+	if err != nil {
+		return nil, fmt.Errorf("%s task %s: %w", task.Type, task.Path, err)
+	}
+	for i := range expanded {
+		expanded[i].Type = ""
+		if expanded[i].Namespace == "" {
+			expanded[i].Namespace = task.Namespace
+		}
+	}
+	return expanded, nil
+}
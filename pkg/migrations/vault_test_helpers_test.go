@@ -0,0 +1,336 @@
+package migrations
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+// createTestMigrationFile creates a test migration file with the given version and tasks
+func createTestMigrationFile(t *testing.T, dir string, version int, tasks []Task) string {
+	return writeTestMigrationFile(t, dir, Migration{
+		Version: version,
+		Tasks:   tasks,
+	})
+}
+
+// writeTestMigrationFile writes a complete migration to a test migration file
+func writeTestMigrationFile(t *testing.T, dir string, migration Migration) string {
+	filename := fmt.Sprintf("%03d_test.yaml", migration.Version)
+	if migration.Namespace != "" {
+		// Namespaces may reuse each other's versions
+		filename = fmt.Sprintf("%03d_%s_test.yaml", migration.Version, sanitizeFilename(migration.Namespace))
+	}
+	path := filepath.Join(dir, filename)
+
+	data, err := yaml.Marshal(migration)
+	require.NoError(t, err)
+
+	err = os.WriteFile(path, data, 0644)
+	require.NoError(t, err)
+
+	return path
+}
+
+// createTestConfig creates a test configuration file
+func createTestConfig(t *testing.T, dir string, config *Config) string {
+	path := filepath.Join(dir, "config.yaml")
+
+	data, err := yaml.Marshal(config)
+	require.NoError(t, err)
+
+	err = os.WriteFile(path, data, 0644)
+	require.NoError(t, err)
+
+	return path
+}
+
+// createTempDir creates a temporary directory and returns its path
+// The directory will be automatically cleaned up when the test completes
+func createTempDir(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "vault-migrations-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// withTestConfig runs a test with a temporary configuration
+func withTestConfig(t *testing.T, config *Config, fn func(configPath string)) {
+	dir := createTempDir(t)
+	configPath := createTestConfig(t, dir, config)
+	fn(configPath)
+}
+
+// withTestMigrations runs a test with temporary migration files
+func withTestMigrations(t *testing.T, migrations []Migration, fn func(migrationsDir string)) {
+	dir := createTempDir(t)
+	for _, migration := range migrations {
+		writeTestMigrationFile(t, dir, migration)
+	}
+	fn(dir)
+}
+
+// testVaultServer is a minimal in-memory stand-in for the Vault HTTP API. It
+// stores logical data per namespace and supports read, list, write, patch and
+// delete, which is enough to exercise the runner without a real Vault.
+type testVaultServer struct {
+	mu           sync.Mutex
+	data         map[string]map[string]interface{}
+	handlers     map[string]http.HandlerFunc
+	capabilities map[string][]string
+	server       *httptest.Server
+}
+
+// newTestVaultServer starts a fake Vault server that is shut down when the test completes
+func newTestVaultServer(t *testing.T) *testVaultServer {
+	s := &testVaultServer{
+		data:         make(map[string]map[string]interface{}),
+		handlers:     make(map[string]http.HandlerFunc),
+		capabilities: make(map[string][]string),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// newTestVaultClient creates a Vault API client backed by a fresh fake server
+func newTestVaultClient(t *testing.T) *api.Client {
+	return newTestVaultServer(t).client(t)
+}
+
+// client returns a Vault API client pointed at the fake server
+func (s *testVaultServer) client(t *testing.T) *api.Client {
+	config := api.DefaultConfig()
+	config.Address = s.server.URL
+	config.MaxRetries = 0
+
+	client, err := api.NewClient(config)
+	require.NoError(t, err)
+	client.SetToken("test-token")
+	return client
+}
+
+// handle overrides the response for an exact path, e.g. sys/capabilities-self
+func (s *testVaultServer) handle(path string, fn http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[path] = fn
+}
+
+// setCapabilities sets what sys/capabilities-self reports for a path. Paths
+// without capabilities report "root".
+func (s *testVaultServer) setCapabilities(path string, capabilities ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capabilities[path] = capabilities
+}
+
+// serveCapabilities answers sys/capabilities-self for the requested paths
+func (s *testVaultServer) serveCapabilities(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Path  string   `json:"path"`
+		Paths []string `json:"paths"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeTestVaultResponse(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+		return
+	}
+	if body.Path != "" {
+		body.Paths = append(body.Paths, body.Path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := make(map[string]interface{})
+	for _, path := range body.Paths {
+		capabilities, ok := s.capabilities[path]
+		if !ok {
+			capabilities = []string{"root"}
+		}
+		data[path] = capabilities
+	}
+	writeTestVaultResponse(w, http.StatusOK, map[string]interface{}{"data": data})
+}
+
+// get returns the data stored at path in the given namespace
+func (s *testVaultServer) get(namespace, path string) (map[string]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.data[testVaultKey(namespace, path)]
+	return data, ok
+}
+
+// put stores data at path in the given namespace
+func (s *testVaultServer) put(namespace, path string, data map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[testVaultKey(namespace, path)] = data
+}
+
+func testVaultKey(namespace, path string) string {
+	return strings.Trim(namespace, "/") + "|" + strings.Trim(path, "/")
+}
+
+func (s *testVaultServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	namespace := r.Header.Get(api.NamespaceHeaderName)
+
+	s.mu.Lock()
+	handler := s.handlers[path]
+	s.mu.Unlock()
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+	if path == "sys/capabilities-self" {
+		s.serveCapabilities(w, r)
+		return
+	}
+	if (path == "sys/auth" || path == "sys/audit" || path == "sys/mounts") && r.Method == http.MethodGet {
+		s.serveMountTable(w, namespace, path)
+		return
+	}
+	if strings.HasPrefix(path, "sys/internal/ui/mounts/") {
+		s.serveMountLookup(w, namespace, strings.TrimPrefix(path, "sys/internal/ui/mounts/"))
+		return
+	}
+
+	key := testVaultKey(namespace, path)
+	switch {
+	case r.Method == "LIST" || (r.Method == http.MethodGet && r.URL.Query().Get("list") == "true"):
+		keys := s.list(namespace, path)
+		if len(keys) == 0 {
+			writeTestVaultResponse(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		writeTestVaultResponse(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{"keys": keys},
+		})
+	case r.Method == http.MethodGet:
+		data, ok := s.get(namespace, path)
+		if !ok {
+			writeTestVaultResponse(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		writeTestVaultResponse(w, http.StatusOK, map[string]interface{}{"data": data})
+	case r.Method == http.MethodPut || r.Method == http.MethodPost || r.Method == http.MethodPatch:
+		body := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			writeTestVaultResponse(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+			return
+		}
+		s.mu.Lock()
+		existing, ok := s.data[key]
+		if r.Method == http.MethodPatch {
+			if !ok {
+				s.mu.Unlock()
+				writeTestVaultResponse(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+				return
+			}
+			for k, v := range body {
+				existing[k] = v
+			}
+			body = existing
+		}
+		s.data[key] = body
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.data, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeTestVaultResponse(w, http.StatusMethodNotAllowed, map[string]interface{}{"errors": []string{"unsupported operation"}})
+	}
+}
+
+// serveMountTable answers a read of sys/auth, sys/audit or sys/mounts with
+// every mount stored directly below it, keyed by path with a trailing slash
+// like Vault does
+func (s *testVaultServer) serveMountTable(w http.ResponseWriter, namespace, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := testVaultKey(namespace, path) + "/"
+	table := make(map[string]interface{})
+	for key, value := range s.data {
+		mount := strings.TrimPrefix(key, prefix)
+		if mount != key && !strings.Contains(mount, "/") {
+			table[mount+"/"] = value
+		}
+	}
+	writeTestVaultResponse(w, http.StatusOK, map[string]interface{}{"data": table})
+}
+
+// serveMountLookup answers sys/internal/ui/mounts/<path> with the longest
+// mount stored under sys/mounts that contains path
+func (s *testVaultServer) serveMountLookup(w http.ResponseWriter, namespace, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := testVaultKey(namespace, "sys/mounts") + "/"
+	mount, data := "", map[string]interface{}(nil)
+	for key, value := range s.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		candidate := strings.TrimSuffix(strings.TrimPrefix(key, prefix), "/") + "/"
+		if strings.HasPrefix(path+"/", candidate) && len(candidate) > len(mount) {
+			mount, data = candidate, value
+		}
+	}
+	if data == nil {
+		writeTestVaultResponse(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"no mount found"}})
+		return
+	}
+	writeTestVaultResponse(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{"path": mount, "type": data["type"], "options": data["options"]},
+	})
+}
+
+// list returns the immediate children of path, with a trailing slash for
+// children that have descendants of their own
+func (s *testVaultServer) list(namespace, path string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := testVaultKey(namespace, path) + "/"
+	seen := make(map[string]bool)
+	var keys []string
+	for key := range s.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		child := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(child, "/"); i >= 0 {
+			child = child[:i+1]
+		}
+		if !seen[child] {
+			seen[child] = true
+			keys = append(keys, child)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeTestVaultResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,296 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Defaults for wait_for tasks that do not set their own
+const (
+	defaultWaitTimeout  = time.Minute
+	defaultWaitInterval = 2 * time.Second
+)
+
+// errMigrationSkipped is returned by applyMigration when a precondition with
+// on_fail: skip is not met
+var errMigrationSkipped = errors.New("migration skipped")
+
+// Expectation checks one field of the value read by an ASSERT, WAIT_FOR or
+// EXISTS task. Field is a JSONPath-style reference into the response data,
+// such as $.options.version or $.policies[0]. Without Equals or Matches the
+// field only has to be present.
+type Expectation struct {
+	Field   string      `yaml:"field"`
+	Equals  interface{} `yaml:"equals,omitempty"`
+	Matches string      `yaml:"matches,omitempty"`
+	Present *bool       `yaml:"present,omitempty"`
+}
+
+// isReadOnly reports whether a task method only reads from Vault
+func isReadOnly(method string) bool {
+	switch method {
+	case "READ", "LIST", "ASSERT", "WAIT_FOR", "EXISTS", "ABSENT":
+		return true
+	}
+	return false
+}
+
+// isPrecondition reports whether a task method is checked before a migration
+// writes anything
+func isPrecondition(method string) bool {
+	return method == "EXISTS" || method == "ABSENT"
+}
+
+// validateCheck checks the fields specific to read-only tasks
+func validateCheck(task Task) error {
+	if task.OnFail != "" {
+		if !isPrecondition(task.Method) {
+			return fmt.Errorf("on_fail is only supported by EXISTS and ABSENT")
+		}
+		if task.OnFail != "fail" && task.OnFail != "skip" {
+			return fmt.Errorf("on_fail must be fail or skip, got %q", task.OnFail)
+		}
+	}
+	if len(task.Expect) > 0 && task.Method != "ASSERT" && task.Method != "WAIT_FOR" && task.Method != "EXISTS" {
+		return fmt.Errorf("expect is not supported by %s", task.Method)
+	}
+	if (task.Timeout != "" || task.Interval != "") && task.Method != "WAIT_FOR" {
+		return fmt.Errorf("timeout and interval are only supported by WAIT_FOR")
+	}
+	if _, _, err := waitDurations(task); err != nil {
+		return err
+	}
+	for i, expect := range task.Expect {
+		if expect.Field == "" {
+			return fmt.Errorf("expectation %d: field is required", i)
+		}
+		if _, err := parseFieldPath(expect.Field); err != nil {
+			return fmt.Errorf("expectation %d: %w", i, err)
+		}
+		if expect.Matches != "" {
+			if _, err := regexp.Compile(expect.Matches); err != nil {
+				return fmt.Errorf("expectation %d: invalid matches pattern: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// waitDurations returns the timeout and poll interval of a WAIT_FOR task
+func waitDurations(task Task) (time.Duration, time.Duration, error) {
+	timeout, interval := defaultWaitTimeout, defaultWaitInterval
+	if task.Timeout != "" {
+		d, err := time.ParseDuration(task.Timeout)
+		if err != nil || d <= 0 {
+			return 0, 0, fmt.Errorf("invalid timeout %q", task.Timeout)
+		}
+		timeout = d
+	}
+	if task.Interval != "" {
+		d, err := time.ParseDuration(task.Interval)
+		if err != nil || d <= 0 {
+			return 0, 0, fmt.Errorf("invalid interval %q", task.Interval)
+		}
+		interval = d
+	}
+	return timeout, interval, nil
+}
+
+// checkTask runs an ASSERT, EXISTS or ABSENT task once and fails if its
+// condition does not hold
+func (m *MigrationRunner) checkTask(ctx context.Context, client *api.Client, task Task) error {
+	reason, err := readCondition(ctx, client, task)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return fmt.Errorf("%s %s: %s", task.Method, task.Path, reason)
+	}
+	return nil
+}
+
+// waitFor polls a WAIT_FOR task's path until its condition holds or the
+// timeout passes. Read errors are retried, since the path may not be served
+// yet right after a plugin or mount is enabled.
+func (m *MigrationRunner) waitFor(ctx context.Context, client *api.Client, task Task) error {
+	timeout, interval, err := waitDurations(task)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		reason, err := readCondition(ctx, client, task)
+		if err != nil {
+			reason = err.Error()
+		}
+		if reason == "" {
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("WAIT_FOR %s: timed out after %s: %s", task.Path, timeout, reason)
+		}
+
+		m.logger.Debug().Str("path", task.Path).Str("reason", reason).Msg("Waiting for condition")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// readCondition reads a task's path and returns why its condition does not
+// hold, or an empty string if it does
+func readCondition(ctx context.Context, client *api.Client, task Task) (string, error) {
+	secret, err := client.Logical().ReadWithContext(ctx, task.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", task.Path, err)
+	}
+	if secret == nil {
+		return evaluateCondition(task, false, nil), nil
+	}
+	return evaluateCondition(task, true, secret.Data), nil
+}
+
+// evaluateCondition checks a read-only task against a path's value. Failure
+// reasons name the field but never its value, so secrets stay out of logs.
+func evaluateCondition(task Task, exists bool, data map[string]interface{}) string {
+	if task.Method == "ABSENT" {
+		if exists {
+			return "path exists"
+		}
+		return ""
+	}
+	if !exists {
+		return "path does not exist"
+	}
+
+	var failures []string
+	for _, expect := range task.Expect {
+		if reason := expect.check(data); reason != "" {
+			failures = append(failures, fmt.Sprintf("%s %s", expect.Field, reason))
+		}
+	}
+	return strings.Join(failures, "; ")
+}
+
+// check returns why the expectation does not hold for data, or an empty string
+func (e Expectation) check(data map[string]interface{}) string {
+	value, found := lookupField(data, e.Field)
+
+	present := true
+	if e.Present != nil {
+		present = *e.Present
+	}
+	if !present {
+		if found {
+			return "is present"
+		}
+		return ""
+	}
+	if !found {
+		return "is missing"
+	}
+
+	if e.Equals != nil && !configValuesEqual(value, e.Equals) {
+		return "does not equal the expected value"
+	}
+	if e.Matches != "" {
+		re, err := regexp.Compile(e.Matches)
+		if err != nil {
+			return fmt.Sprintf("has an invalid pattern: %v", err)
+		}
+		if !re.MatchString(fmt.Sprint(value)) {
+			return fmt.Sprintf("does not match %q", e.Matches)
+		}
+	}
+	return ""
+}
+
+// parseFieldPath splits a JSONPath-style field reference into map keys and
+// list indexes. It accepts $.a.b, a.b, $.a[0] and $['a.b'].
+func parseFieldPath(field string) ([]interface{}, error) {
+	rest := strings.TrimPrefix(field, "$")
+	var segments []interface{}
+
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated bracket in field %q", field)
+			}
+			segments = append(segments, rest[2:end])
+			rest = rest[end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated bracket in field %q", field)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index %q in field %q", rest[1:end], field)
+			}
+			segments = append(segments, index)
+			rest = rest[end+1:]
+		default:
+			rest = strings.TrimPrefix(rest, ".")
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in field %q", field)
+			}
+			segments = append(segments, rest[:end])
+			rest = rest[end:]
+		}
+	}
+	return segments, nil
+}
+
+// lookupField resolves a field reference in data
+func lookupField(data map[string]interface{}, field string) (interface{}, bool) {
+	segments, err := parseFieldPath(field)
+	if err != nil {
+		return nil, false
+	}
+
+	var current interface{} = data
+	for _, segment := range segments {
+		switch key := segment.(type) {
+		case string:
+			switch node := current.(type) {
+			case map[string]interface{}:
+				value, ok := node[key]
+				if !ok {
+					return nil, false
+				}
+				current = value
+			case map[interface{}]interface{}:
+				value, ok := node[key]
+				if !ok {
+					return nil, false
+				}
+				current = value
+			default:
+				return nil, false
+			}
+		case int:
+			list, ok := current.([]interface{})
+			if !ok || key >= len(list) {
+				return nil, false
+			}
+			current = list[key]
+		}
+	}
+	return current, true
+}
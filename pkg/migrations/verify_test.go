@@ -0,0 +1,206 @@
+package migrations
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupField(t *testing.T) {
+	data := map[string]interface{}{
+		"type":     "kv",
+		"options":  map[string]interface{}{"version": "2"},
+		"policies": []interface{}{"default", "reader"},
+		"a.b":      true,
+	}
+
+	tests := []struct {
+		field string
+		want  interface{}
+		found bool
+	}{
+		{field: "$.type", want: "kv", found: true},
+		{field: "type", want: "kv", found: true},
+		{field: "$.options.version", want: "2", found: true},
+		{field: "$.policies[1]", want: "reader", found: true},
+		{field: "$['a.b']", want: true, found: true},
+		{field: "$.policies[2]", found: false},
+		{field: "$.options.missing", found: false},
+		{field: "$.type.nested", found: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			value, found := lookupField(data, tt.field)
+			assert.Equal(t, tt.found, found)
+			assert.Equal(t, tt.want, value)
+		})
+	}
+}
+
+func TestValidateMigration_Checks(t *testing.T) {
+	valid := Migration{Version: 1, Tasks: []Task{
+		{Path: "sys/mounts/secret", Method: "EXISTS", OnFail: "skip"},
+		{Path: "sys/mounts/secret", Method: "WAIT_FOR", Timeout: "30s", Interval: "1s"},
+		{Path: "sys/mounts/secret", Method: "ASSERT", Expect: []Expectation{{Field: "$.type", Matches: "^kv"}}},
+	}}
+	assert.NoError(t, validateMigration(valid))
+
+	invalid := []Task{
+		{Path: "secret/a", Method: "ASSERT", OnFail: "skip"},
+		{Path: "secret/a", Method: "EXISTS", OnFail: "ignore"},
+		{Path: "secret/a", Method: "ABSENT", Expect: []Expectation{{Field: "$.a"}}},
+		{Path: "secret/a", Method: "POST", Expect: []Expectation{{Field: "$.a"}}},
+		{Path: "secret/a", Method: "WAIT_FOR", Timeout: "soon"},
+		{Path: "secret/a", Method: "ASSERT", Timeout: "1s"},
+		{Path: "secret/a", Method: "ASSERT", Expect: []Expectation{{Matches: "x"}}},
+		{Path: "secret/a", Method: "ASSERT", Expect: []Expectation{{Field: "$.a", Matches: "("}}},
+		{Path: "secret/a", Method: "ASSERT", Expect: []Expectation{{Field: "$.a[x]"}}},
+	}
+	for _, task := range invalid {
+		assert.Error(t, validateMigration(Migration{Version: 1, Tasks: []Task{task}}), "%+v", task)
+	}
+}
+
+func TestMigrationRunner_Assert(t *testing.T) {
+	server := newTestVaultServer(t)
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{Path: "secret/app", Method: "POST", Data: map[string]interface{}{"type": "kv", "version": 2}},
+				{Path: "secret/app", Method: "ASSERT", Expect: []Expectation{
+					{Field: "$.type", Equals: "kv"},
+					{Field: "$.version", Matches: "^[0-9]+$"},
+					{Field: "$.missing", Present: new(bool)},
+				}},
+			},
+		},
+		{
+			Version: 2,
+			Tasks: []Task{
+				{Path: "secret/app", Method: "ASSERT", Expect: []Expectation{{Field: "$.type", Equals: "pki"}}},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir, ConcurrentTasks: true},
+		})
+		require.NoError(t, err)
+
+		err = runner.RunMigrations(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to apply migration 2")
+		assert.Contains(t, err.Error(), "$.type does not equal the expected value")
+		assert.NotContains(t, err.Error(), "kv", "values should not be reported")
+		assert.Equal(t, []int{1}, runner.AppliedVersions())
+	})
+}
+
+func TestMigrationRunner_Preconditions(t *testing.T) {
+	server := newTestVaultServer(t)
+	server.put("", "sys/mounts/pki", map[string]interface{}{"type": "pki"})
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{Path: "secret/skipped", Method: "POST", Data: map[string]interface{}{"key": "value"}},
+				{Path: "sys/mounts/pki", Method: "ABSENT", OnFail: "skip"},
+			},
+		},
+		{
+			Version: 2,
+			Tasks: []Task{
+				{Path: "secret/applied", Method: "POST", Data: map[string]interface{}{"key": "value"}},
+				{Path: "sys/mounts/pki", Method: "EXISTS", Expect: []Expectation{{Field: "type", Equals: "pki"}}},
+			},
+		},
+		{
+			Version: 3,
+			Tasks: []Task{
+				{Path: "secret/failed", Method: "POST", Data: map[string]interface{}{"key": "value"}},
+				{Path: "sys/mounts/transit", Method: "EXISTS"},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		report, err := runner.DryRun(ctx, ApplyOptions{})
+		require.NoError(t, err)
+		actions := make([]TaskAction, len(report.Tasks))
+		for i, task := range report.Tasks {
+			actions[i] = task.Action
+		}
+		assert.Equal(t, []TaskAction{ActionSkip, ActionSkip, ActionCheck, ActionCreate, ActionFail, ActionCreate}, actions)
+
+		err = runner.RunMigrations(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "precondition failed: EXISTS sys/mounts/transit: path does not exist")
+		assert.Equal(t, []int{2}, runner.AppliedVersions())
+
+		versions, err := runner.CurrentVersions(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 2, versions[""])
+	})
+
+	_, ok := server.get("", "secret/skipped")
+	assert.False(t, ok, "a skipped migration should not write")
+	_, ok = server.get("", "secret/applied")
+	assert.True(t, ok)
+	_, ok = server.get("", "secret/failed")
+	assert.False(t, ok, "a failed precondition should stop the migration before it writes")
+}
+
+func TestMigrationRunner_WaitFor(t *testing.T) {
+	server := newTestVaultServer(t)
+	var reads int32
+	server.handle("sys/plugins/catalog/secret/custom", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&reads, 1) < 3 {
+			writeTestVaultResponse(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		writeTestVaultResponse(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"name": "custom"}})
+	})
+
+	migrations := []Migration{
+		{
+			Version: 1,
+			Tasks: []Task{
+				{Path: "sys/plugins/catalog/secret/custom", Method: "WAIT_FOR", Timeout: "5s", Interval: "10ms"},
+			},
+		},
+		{
+			Version: 2,
+			Tasks: []Task{
+				{Path: "sys/mounts/never", Method: "WAIT_FOR", Timeout: "50ms", Interval: "10ms"},
+			},
+		},
+	}
+
+	withTestMigrations(t, migrations, func(migrationsDir string) {
+		runner, err := NewMigrationRunner(server.client(t), &Config{
+			Migrations: MigrationsConfig{Directory: migrationsDir},
+		})
+		require.NoError(t, err)
+
+		err = runner.RunMigrations(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "WAIT_FOR sys/mounts/never: timed out after 50ms")
+		assert.Equal(t, []int{1}, runner.AppliedVersions())
+		assert.Equal(t, int32(3), atomic.LoadInt32(&reads))
+	})
+}